@@ -2,13 +2,36 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding"
 	"encoding/binary"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
+	"hash/crc32"
+	"hash/fnv"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 type Product struct {
@@ -19,6 +42,15 @@ type Product struct {
 	Active     bool
 }
 
+// Produto com a marca de tamanho variável, gravado com AppendVarRecord
+type VarProduct struct {
+	ID         uint32
+	CategoryID uint32
+	Brand      string
+	Price      float32
+	Active     bool
+}
+
 type ProductMetrics struct {
 	ProductID           uint32
 	ProductDataLocation int64
@@ -50,25 +82,41 @@ const (
 	USER_SESSION         // 8
 )
 const (
-	PRODUCT_DATA_FILE           = "products_data.bin"
-	PRODUCT_INDEX_FILE          = "products_index.bin"
-	MOST_EXPENSIVE_PRODUCT_FILE = "most_expensive_product.bin"
+	PRODUCT_DATA_FILE                = "products_data.bin"
+	PRODUCT_INDEX_FILE               = "products_index.bin"
+	MOST_EXPENSIVE_PRODUCT_FILE      = "most_expensive_product.bin"
+	MOST_EXPENSIVE_PER_CATEGORY_FILE = "most_expensive_per_category.bin"
+	PRODUCT_METRICS_FILE             = "product_metrics.bin"
 
 	CATEGORY_DATA_FILE  = "categorys_data.bin"
 	CATEGORY_INDEX_FILE = "categorys_index.bin"
 
-	EVENT_DATA_FILE     = "events_data.bin"
-	EVENT_INDEX_FILE    = "events_index.bin"
-	ACTION_METRICS_FILE = "action_metrics.bin"
+	EVENT_DATA_FILE       = "events_data.bin"
+	EVENT_INDEX_FILE      = "events_index.bin"
+	EVENT_USER_INDEX_FILE = "events_user_index.bin"
+	EVENT_TIME_INDEX_FILE = "events_time_index.bin"
+	ACTION_METRICS_FILE   = "action_metrics.bin"
+
+	EXTERNAL_ID_MAP_FILE   = "external_id_map.bin"
+	IMPORT_CHECKPOINT_FILE = "import_checkpoint.bin"
+
+	WAL_FILE        = "wal.bin"
+	STORE_LOCK_FILE = "store.lock"
 )
 
+// A cada quantas linhas ImportarCSV sincroniza os arquivos de métricas,
+// limitando o que se perde numa queda
+const IMPORT_FLUSH_EVERY = 1000
+
 type Event struct {
 	ID          uint32
 	UserSession [50]byte
 	UserID      uint32
 	ProductID   uint32
 	EventAction Action
-	EventTime   [100]byte
+	// Horário do evento em segundos Unix (UTC), ou 0 se o horário do CSV
+	// não pôde ser interpretado
+	EventTime int64
 }
 
 type ActionMetrics struct {
@@ -81,19 +129,398 @@ const (
 	ACTION_VALUE_SIZE = 32
 )
 
+// ProductID usado em eventos cujo produto não foi importado
+const UNKNOWN_PRODUCT_ID uint32 = math.MaxUint32
+
+// Configuração compartilhada por todas as leituras e escritas de registros
+type StoreConfig struct {
+	// Ordem dos bytes dos registros e dos índices. O padrão é little-endian
+	ByteOrder binary.ByteOrder
+	// Quando AppendDataToFile chama Sync. O padrão é SyncAlways
+	Sync SyncPolicy
+	// O que fazer com um preço negativo. O padrão é RejectNegativePrices
+	Prices PricePolicy
+}
+
+// Como AddProduct, AddProducts, UpsertProduct e a importação tratam um
+// produto com preço negativo ou NaN, que de outro modo entraria na disputa
+// pelo mais caro. Preço 0 é sempre aceito
+type PricePolicy uint8
+
+const (
+	// O produto é recusado com ErrNegativePrice; na importação, a linha é
+	// ignorada e passada para CSVOptions.OnRowError
+	RejectNegativePrices PricePolicy = iota
+	// O preço vira 0 e o produto é gravado
+	ClampNegativePrices
+	// O preço é gravado como veio
+	AllowNegativePrices
+)
+
+// Quando os registros gravados por AppendDataToFile vão para o disco. Sem o
+// Sync, o registro fica no cache do sistema: sobrevive à queda do processo,
+// mas não à do sistema ou a uma falta de energia. SyncAlways perde no máximo
+// o registro sendo gravado; SyncInterval(n) pode perder os últimos n-1
+// registros de cada arquivo, e SyncNever tudo o que o sistema ainda não
+// tiver gravado. O WAL continua sincronizado a cada entrada, então as
+// gravações feitas por LoggedAppend são refeitas na recuperação
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = 0
+	SyncNever  SyncPolicy = -1
+)
+
+// Sync a cada n gravações no mesmo arquivo. n <= 1 é o mesmo que SyncAlways
+func SyncInterval(n int) SyncPolicy {
+	if n <= 1 {
+		return SyncAlways
+	}
+	return SyncPolicy(n)
+}
+
+// Gravações sem Sync por arquivo, para SyncInterval
+var (
+	unsyncedMu     sync.Mutex
+	unsyncedWrites = map[string]int{}
+)
+
+// Chama Sync depois de uma gravação conforme Config.Sync
+func syncAfterWrite(file *os.File) error {
+	switch policy := Config.Sync; {
+	case policy == SyncNever:
+		return nil
+	case policy <= SyncAlways:
+		return file.Sync()
+	default:
+		unsyncedMu.Lock()
+		unsyncedWrites[file.Name()]++
+		due := unsyncedWrites[file.Name()] >= int(policy)
+		if due {
+			delete(unsyncedWrites, file.Name())
+		}
+		unsyncedMu.Unlock()
+		if !due {
+			return nil
+		}
+		return file.Sync()
+	}
+}
+
+var Config = StoreConfig{
+	ByteOrder: binary.LittleEndian,
+}
+
+// Destino das mensagens de diagnóstico. *slog.Logger já implementa a
+// interface; por padrão nada é registrado
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+var logger Logger = nopLogger{}
+
+// Troca o logger usado pelo pacote; nil volta a não registrar nada
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	logger = l
+}
+
+// Contadores das operações dos stores em disco, desde o início do processo.
+// Não há cache de registros: GetHits e GetMisses contam os Get que acharam
+// ou não o ID, e BloomSkips as buscas no índice descartadas pelo filtro de
+// Bloom sem ler o arquivo
+type OperationCounters struct {
+	Adds       atomic.Int64
+	Gets       atomic.Int64
+	GetHits    atomic.Int64
+	GetMisses  atomic.Int64
+	Removes    atomic.Int64
+	BloomSkips atomic.Int64
+	ImportRows atomic.Int64
+}
+
+// Publicados pelo expvar como "store" e por GET /metrics de NewHandler
+var Counters OperationCounters
+
+func init() {
+	expvar.Publish("store", expvar.Func(func() any { return Counters.Snapshot() }))
+}
+
+// Valores atuais, pelo nome usado no expvar
+func (c *OperationCounters) Snapshot() map[string]int64 {
+	return map[string]int64{
+		"adds":        c.Adds.Load(),
+		"gets":        c.Gets.Load(),
+		"get_hits":    c.GetHits.Load(),
+		"get_misses":  c.GetMisses.Load(),
+		"removes":     c.Removes.Load(),
+		"bloom_skips": c.BloomSkips.Load(),
+		"import_rows": c.ImportRows.Load(),
+	}
+}
+
+// Os contadores no formato de texto do Prometheus, como store_<nome>_total
+func (c *OperationCounters) WritePrometheus(w io.Writer) error {
+	snapshot := c.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, err := fmt.Fprintf(w, "# TYPE store_%s_total counter\nstore_%s_total %d\n", name, name, snapshot[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cabeçalho gravado no início de cada arquivo de dados (produtos, categorias
+// e eventos). Os registros começam logo depois dele, então todo offset de
+// registro já inclui o tamanho do cabeçalho. O cabeçalho em si é sempre
+// little-endian; ByteOrder diz em qual ordem os registros foram gravados.
+//
+// A partir da versão 3, cada registro é seguido do CRC32 (IEEE) dos seus
+// bytes, conferido em toda leitura. RecordSize continua sendo o tamanho do
+// registro sem o checksum
+type FileHeader struct {
+	Magic      [4]byte
+	Version    uint16
+	RecordSize uint32
+	ByteOrder  uint8
+}
+
+const DATA_FILE_VERSION = 3
+
+const (
+	LITTLE_ENDIAN_FILE uint8 = 1
+	BIG_ENDIAN_FILE    uint8 = 2
+)
+
+var DATA_FILE_MAGIC = [4]byte{'U', 'C', 'S', 'D'}
+
+var dataHeaderSize = int64(binary.Size(FileHeader{}))
+
+var ErrSchemaMismatch = errors.New("arquivo de dados incompatível com o esquema atual")
+var ErrByteOrderMismatch = errors.New("ordem de bytes do arquivo diferente da configurada")
+var ErrCorruptRecord = errors.New("registro corrompido: checksum não confere")
+var ErrTruncatedFile = errors.New("arquivo termina no meio de um registro")
+var ErrOffsetOutOfRange = errors.New("offset fora do arquivo de dados")
+
+const checksumSize = 4
+
+// Tamanhos dos registros em disco, calculados uma vez em init: binary.Size
+// usa reflexão e era chamado a cada leitura
+var (
+	productRecordSize        int64
+	categoryRecordSize       int64
+	eventRecordSize          int64
+	indexEntrySize           int64
+	actionMetricsRecordSize  int64
+	productMetricsRecordSize int64
+	externalIDRecordSize     int64
+)
+
+// Um campo de tamanho variável num desses tipos derruba o programa já na
+// inicialização, antes de qualquer arquivo ser gravado com o layout errado
+func init() {
+	productRecordSize = mustFixedSize[Product]()
+	categoryRecordSize = mustFixedSize[Category]()
+	eventRecordSize = mustFixedSize[Event]()
+	indexEntrySize = mustFixedSize[IndexEntry]()
+	actionMetricsRecordSize = mustFixedSize[ActionMetrics]()
+	productMetricsRecordSize = mustFixedSize[ProductMetrics]()
+	externalIDRecordSize = mustFixedSize[ExternalIDEntry]()
+}
+
+// binary.Size de T, ou pânico se T tiver um campo de tamanho variável
+// (string, slice, map), com o qual os offsets calculados deixam de valer
+func mustFixedSize[T any]() int64 {
+	size := binary.Size(*new(T))
+	if size <= 0 {
+		panic(fmt.Sprintf("registro %T não tem tamanho fixo", *new(T)))
+	}
+	return int64(size)
+}
+
+// Tamanho de T em disco, sem checksum. Os tipos conhecidos usam os tamanhos
+// calculados em init; os demais caem em binary.Size
+func fixedSize[T any]() int64 {
+	switch any(*new(T)).(type) {
+	case Product:
+		return productRecordSize
+	case Category:
+		return categoryRecordSize
+	case Event:
+		return eventRecordSize
+	case IndexEntry:
+		return indexEntrySize
+	case ActionMetrics:
+		return actionMetricsRecordSize
+	case ProductMetrics:
+		return productMetricsRecordSize
+	case ExternalIDEntry:
+		return externalIDRecordSize
+	}
+	return int64(binary.Size(*new(T)))
+}
+
+// Tamanho ocupado por um registro no arquivo de dados, incluindo o checksum
+func dataRecordSize[T any]() int64 {
+	return fixedSize[T]() + checksumSize
+}
+
+func encodeDataRecord[T any](record T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, Config.ByteOrder, record)
+	if err != nil {
+		return nil, err
+	}
+
+	checksum := crc32.ChecksumIEEE(buf.Bytes())
+	err = binary.Write(&buf, Config.ByteOrder, checksum)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeDataRecord[T any](buf []byte) (T, error) {
+	var record T
+	payload := buf[:len(buf)-checksumSize]
+	stored := Config.ByteOrder.Uint32(buf[len(buf)-checksumSize:])
+	if crc32.ChecksumIEEE(payload) != stored {
+		return record, ErrCorruptRecord
+	}
+
+	err := binary.Read(bytes.NewReader(payload), Config.ByteOrder, &record)
+	return record, err
+}
+
+// Grava um registro com checksum no arquivo de dados, com uma única escrita
+func WriteDataRecordAt[T any](file *os.File, offset int64, record T) error {
+	buf, err := encodeDataRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(buf, offset)
+	return err
+}
+
+// Lê um registro do arquivo de dados conferindo o checksum
+func ReadDataRecordAt[T any](file *os.File, offset int64) (T, error) {
+	buf := make([]byte, dataRecordSize[T]())
+	_, err := file.ReadAt(buf, offset)
+	if err != nil {
+		var record T
+		return record, err
+	}
+
+	record, err := decodeDataRecord[T](buf)
+	if err == ErrCorruptRecord {
+		return record, fmt.Errorf("%w: %s, offset %d", ErrCorruptRecord, file.Name(), offset)
+	}
+	return record, err
+}
+
+func writeDataRecord[T any](w io.Writer, record T) error {
+	buf, err := encodeDataRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// Lê o próximo registro de um leitor sequencial. Retorna io.EOF no fim
+// exato do arquivo e io.ErrUnexpectedEOF se o último registro estiver cortado
+func readDataRecord[T any](r io.Reader) (T, error) {
+	var record T
+	buf := make([]byte, dataRecordSize[T]())
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return record, err
+	}
+	return decodeDataRecord[T](buf)
+}
+
+func byteOrderCode(order binary.ByteOrder) uint8 {
+	if order == binary.BigEndian {
+		return BIG_ENDIAN_FILE
+	}
+	return LITTLE_ENDIAN_FILE
+}
+
 type IndexEntry struct {
 	ID     uint32
 	Offset int64
 }
 
-func CreateOrOpenFile(filename string) *os.File {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		log.Fatal(err)
+// Offset de uma entrada marcada por Tombstone. Nenhum registro fica antes do
+// cabeçalho, então o valor não se confunde com um offset de verdade e o
+// formato da entrada não muda: índices antigos continuam válidos e a versão
+// do cabeçalho dos arquivos de dados fica a mesma
+const TOMBSTONE_OFFSET int64 = -1
+
+var ErrNoActiveProducts = errors.New("nenhum produto ativo")
+var ErrDuplicateCategory = errors.New("já existe uma categoria com esse nome")
+var ErrDuplicateID = errors.New("já existe um registro com esse ID")
+var ErrIDOutOfOrder = errors.New("ID menor que o último do índice")
+var ErrCategoryInUse = errors.New("categoria ainda usada por produtos ativos")
+var ErrAlreadyActive = errors.New("produto já está ativo")
+var ErrDanglingCategory = errors.New("produto aponta para uma categoria que não existe")
+
+// Retornado por um callback de ForEach para encerrar a varredura sem erro
+var errStopScan = errors.New("varredura interrompida")
+
+// Todo o cálculo de offsets depende de binary.Size dos registros. Se algum
+// campo de tamanho variável (slice, string) for adicionado, binary.Size
+// retorna -1 e os Seek passam a cair em lugares errados
+func ValidateSchema() error {
+	records := []struct {
+		name  string
+		value any
+	}{
+		{"Product", Product{}},
+		{"Category", Category{}},
+		{"Event", Event{}},
+		{"IndexEntry", IndexEntry{}},
+		{"ActionMetrics", ActionMetrics{}},
+		{"ProductMetrics", ProductMetrics{}},
+		{"ExternalIDEntry", ExternalIDEntry{}},
 	}
 
-	return file
+	for _, record := range records {
+		if binary.Size(record.value) <= 0 {
+			return fmt.Errorf("registro %s não tem tamanho fixo", record.name)
+		}
+	}
+	return nil
+}
+
+func CreateOrOpenFile(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// Abre só para leitura, sem criar: um arquivo que não existe é um erro
+// (os.IsNotExist), e não um arquivo vazio novo
+func OpenReadOnly(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_RDONLY, 0)
 }
+
 func getActionFromName(actionName string) Action {
 	switch actionName {
 	case "cart":
@@ -119,6 +546,11 @@ func getActionName(action Action) string {
 	}
 }
 
+// Converte um array de bytes de tamanho fixo em string, sem os NULs do final
+func ByteArrayToString(arr []byte) string {
+	return string(bytes.TrimRight(arr, "\x00"))
+}
+
 func StringTo50ByteArray(str string) [50]byte {
 	var arr [50]byte
 	copy(arr[:], str)
@@ -130,764 +562,6917 @@ func StringToByteArray(str string) [100]byte {
 	return arr
 }
 
-func AppendDataToFile[T any](filename string, data T) (int64, error) {
-
-	dataFile := CreateOrOpenFile(filename)
-	defer dataFile.Close()
+var ErrTruncated = errors.New("texto maior que o campo")
+var ErrInvalidField = errors.New("campo numérico inválido")
+var ErrNegativePrice = fmt.Errorf("%w: preço negativo", ErrInvalidField)
+var ErrIDOverflow = errors.New("não há mais IDs livres")
 
-	// Busca o offset atual
-	offset, err := dataFile.Seek(0, io.SeekEnd)
-	if err != nil {
-		return 0, err
+// ID seguinte a lastID. Em vez de dar a volta para 0 e colidir com os
+// registros existentes, retorna ErrIDOverflow quando lastID já é maxID
+func nextIDAfter(lastID uint32, maxID uint32) (uint32, error) {
+	if lastID >= maxID {
+		return 0, fmt.Errorf("%w: último ID é %d", ErrIDOverflow, lastID)
 	}
+	return lastID + 1, nil
+}
 
-	// Escreve o registro no arquivo de dados
-	err = binary.Write(dataFile, binary.LittleEndian, data)
-	if err != nil {
-		fmt.Printf("Erro ao escrever no arquivo de dados: %v\n", err)
-		return 0, err
-	}
+// Store de onde uma IDStrategy tira os IDs
+type IDSource interface {
+	// ID seguinte ao do último registro gravado
+	NextID() (uint32, error)
+	// Maior ID permitido
+	MaxID() uint32
+	Exists(id uint32) (bool, error)
+}
 
-	// Garante que o buffer de escrita é enviado para o disco
-	err = dataFile.Sync()
+// Como os registros novos recebem o ID. Uma estratégia não deve ser
+// misturada com outra no mesmo store: Sequential parte do último registro
+// gravado, e FromExternal grava fora de ordem
+type IDStrategy interface {
+	Next(store IDSource) (uint32, error)
+}
+
+// O último ID mais um, como NextID, mas lembrando os IDs já entregues para
+// cada store: duas goroutines que pedem um ID antes de gravar o registro
+// recebem IDs diferentes. O valor zero está pronto para uso
+type Sequential struct {
+	mu     sync.Mutex
+	issued map[IDSource]sequentialState
+}
+
+type sequentialState struct {
+	// NextID do store na última chamada
+	seen uint32
+	// Último ID entregue
+	last uint32
+}
+
+// Estratégia usada pelas funções Build* e por AddCategory
+var SequentialIDs = &Sequential{}
+
+func (s *Sequential) Next(store IDSource) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen, err := store.NextID()
 	if err != nil {
 		return 0, err
 	}
-
-	// Retorna o offsert do registro gravada
-	return offset, nil
+	id := seen
+	// Se NextID voltou, o store foi esvaziado ou truncado e os IDs entregues
+	// antes não valem mais
+	state, ok := s.issued[store]
+	if ok && seen >= state.seen && id <= state.last {
+		id, err = nextIDAfter(state.last, store.MaxID())
+		if err != nil {
+			return 0, err
+		}
+	}
+	if s.issued == nil {
+		s.issued = make(map[IDSource]sequentialState)
+	}
+	s.issued[store] = sequentialState{seen: seen, last: id}
+	return id, nil
 }
-func AppendIndexToFile(filename string, id uint32, offset int64) error {
-	file := CreateOrOpenFile(filename)
-	defer file.Close()
 
-	_, err := file.Seek(0, io.SeekEnd)
-	if err != nil {
-		log.Fatal(err)
-		return err
+// ID derivado do ID de origem (o do CSV): o hash FNV-1a do ID externo. O
+// mesmo CSV importado em diretórios diferentes gera os mesmos IDs. Se o
+// hash já estiver em uso, os IDs seguintes são tentados em ordem, então a
+// estabilidade vale enquanto os registros forem gravados na mesma ordem.
+// Os IDs saem fora de ordem, e o índice primário só fica ordenado quando
+// é gravado de uma vez, como em ImportSorted
+type FromExternal uint64
+
+func (external FromExternal) Next(store IDSource) (uint32, error) {
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], uint64(external))
+	hash := fnv.New32a()
+	hash.Write(key[:])
+
+	maxID := store.MaxID()
+	id := hash.Sum32()
+	if maxID != math.MaxUint32 {
+		id %= maxID + 1
+	}
+	for tries := uint64(0); tries <= uint64(maxID); tries++ {
+		used, err := store.Exists(id)
+		if err != nil {
+			return 0, err
+		}
+		if !used {
+			return id, nil
+		}
+		if id == maxID {
+			id = 0
+		} else {
+			id++
+		}
 	}
+	return 0, fmt.Errorf("%w: todos os IDs até %d em uso", ErrIDOverflow, maxID)
+}
 
-	// Cria a entrada do índice
-	entry := IndexEntry{
-		ID:     id,
-		Offset: offset,
+// Como StringTo50ByteArray, mas retorna ErrTruncated quando o texto não cabe.
+// O array retornado tem o prefixo que coube
+func StringTo50ByteArrayChecked(str string) ([50]byte, error) {
+	arr := StringTo50ByteArray(str)
+	if len(str) > len(arr) {
+		return arr, fmt.Errorf("%w: %d bytes, máximo %d", ErrTruncated, len(str), len(arr))
 	}
+	return arr, nil
+}
 
-	// Escreve a entrada no arquivo
-	return binary.Write(file, binary.LittleEndian, entry)
+// Como StringToByteArray, mas retorna ErrTruncated quando o texto não cabe.
+// O array retornado tem o prefixo que coube
+func StringToByteArrayChecked(str string) ([100]byte, error) {
+	arr := StringToByteArray(str)
+	if len(str) > len(arr) {
+		return arr, fmt.Errorf("%w: %d bytes, máximo %d", ErrTruncated, len(str), len(arr))
+	}
+	return arr, nil
 }
 
-func Append[T any](dataFilename string, indexFilename string, data T, id uint32) error {
-	offset, err := AppendDataToFile(dataFilename, data)
+var ErrUnsupportedField = errors.New("campo sem tamanho fixo")
+
+// Grava o registro com o layout de binary.Write, na ordem de Config, mas
+// com campos string: um campo com a tag fixed:"N" ocupa sempre N bytes,
+// completados com NULs. Assim um tipo novo pode usar string em vez de um
+// [N]byte e StringToByteArray, e o registro continua com o tamanho fixo
+// de RecordSize. Um texto maior que N é cortado e o erro é ErrTruncated,
+// junto com o registro codificado
+func EncodeRecord(record any) ([]byte, error) {
+	var buf bytes.Buffer
+	var truncated error
+	err := encodeValue(&buf, reflect.ValueOf(record), &truncated)
 	if err != nil {
-		log.Fatalf("Nao foi possivel salvar registro no arquivo %s: %v", dataFilename, err)
+		return nil, err
 	}
-	return AppendIndexToFile(indexFilename, id, offset)
+	return buf.Bytes(), truncated
 }
 
-func StoreActionMetrics(filename string, action Action) error {
-	file := CreateOrOpenFile(filename)
-	defer file.Close()
-
-	var storedMetrics ActionMetrics
-	for {
-		err := binary.Read(file, binary.LittleEndian, &storedMetrics)
-		if err != nil {
-			break
+func encodeValue(buf *bytes.Buffer, value reflect.Value, truncated *error) error {
+	if value.Kind() != reflect.Struct {
+		return binary.Write(buf, Config.ByteOrder, value.Interface())
+	}
+	valueType := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			return fmt.Errorf("%w: %s.%s não é exportado", ErrUnsupportedField, valueType.Name(), field.Name)
 		}
-
-		if storedMetrics.Action == action {
-			storedMetrics.NumberOfOcurrences++
-			file.Seek(-int64(binary.Size(storedMetrics)), os.SEEK_CUR)
-			err = binary.Write(file, binary.LittleEndian, storedMetrics)
+		if field.Type.Kind() == reflect.String {
+			width, err := fixedWidth(field)
 			if err != nil {
 				return err
 			}
-			return nil
+			text := value.Field(i).String()
+			if len(text) > width && *truncated == nil {
+				*truncated = fmt.Errorf("%w: %s tem %d bytes, máximo %d", ErrTruncated, field.Name, len(text), width)
+			}
+			raw := make([]byte, width)
+			copy(raw, text)
+			buf.Write(raw)
+			continue
+		}
+		err := encodeValue(buf, value.Field(i), truncated)
+		if err != nil {
+			return err
 		}
-	}
-
-	newMetric := ActionMetrics{
-		Action:             action,
-		NumberOfOcurrences: 1,
-	}
-	err := binary.Write(file, binary.LittleEndian, &newMetric)
-	if err != nil {
-		log.Fatalf("Erro ao gravar métrica no map: %v", err)
 	}
 	return nil
 }
-func SearchActionMetrics(filename string, action Action) (ActionMetrics, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return ActionMetrics{}, err
+
+// Lê em record, um ponteiro para struct, o que EncodeRecord gravou. Os
+// campos string perdem os NULs do fim, como em ByteArrayToString
+func DecodeRecord(data []byte, record any) error {
+	value := reflect.ValueOf(record)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%w: DecodeRecord precisa de um ponteiro para struct, recebeu %T", ErrUnsupportedField, record)
 	}
-	defer file.Close()
+	reader := bytes.NewReader(data)
+	return decodeValue(reader, value.Elem())
+}
 
-	var storedMetrics ActionMetrics
-	for {
-		err := binary.Read(file, binary.LittleEndian, &storedMetrics)
+func decodeValue(reader *bytes.Reader, value reflect.Value) error {
+	if value.Kind() != reflect.Struct {
+		return binary.Read(reader, Config.ByteOrder, value.Addr().Interface())
+	}
+	valueType := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := valueType.Field(i)
+		if !field.IsExported() {
+			return fmt.Errorf("%w: %s.%s não é exportado", ErrUnsupportedField, valueType.Name(), field.Name)
+		}
+		if field.Type.Kind() == reflect.String {
+			width, err := fixedWidth(field)
+			if err != nil {
+				return err
+			}
+			raw := make([]byte, width)
+			_, err = io.ReadFull(reader, raw)
+			if err != nil {
+				return err
+			}
+			value.Field(i).SetString(ByteArrayToString(raw))
+			continue
+		}
+		err := decodeValue(reader, value.Field(i))
 		if err != nil {
-			break
+			return err
 		}
+	}
+	return nil
+}
 
-		if storedMetrics.Action == action {
-			return storedMetrics, nil
+// Tamanho em bytes do que EncodeRecord grava para registros do tipo de
+// record, o mesmo para qualquer valor do tipo
+func RecordSize(record any) (int, error) {
+	return recordTypeSize(reflect.TypeOf(record))
+}
+
+func recordTypeSize(recordType reflect.Type) (int, error) {
+	if recordType.Kind() != reflect.Struct {
+		size := binary.Size(reflect.New(recordType).Elem().Interface())
+		if size < 0 {
+			return 0, fmt.Errorf("%w: %s", ErrUnsupportedField, recordType)
 		}
+		return size, nil
 	}
-
-	return ActionMetrics{
-		Action:             action,
-		NumberOfOcurrences: 0,
-	}, nil
+	total := 0
+	for i := 0; i < recordType.NumField(); i++ {
+		field := recordType.Field(i)
+		var size int
+		var err error
+		if field.Type.Kind() == reflect.String {
+			size, err = fixedWidth(field)
+		} else {
+			size, err = recordTypeSize(field.Type)
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
 }
 
-func ReadFromDataFile[T any](filename string, offset int64) T {
-	file := CreateOrOpenFile(filename)
-	defer file.Close()
+// Largura de um campo string, da tag fixed
+func fixedWidth(field reflect.StructField) (int, error) {
+	width, err := strconv.Atoi(field.Tag.Get("fixed"))
+	if err != nil || width <= 0 {
+		return 0, fmt.Errorf("%w: o campo string %s precisa da tag fixed:\"N\"", ErrUnsupportedField, field.Name)
+	}
+	return width, nil
+}
 
-	var data T
+func AppendDataToFile[T any](filename string, data T) (int64, error) {
 
-	_, err := file.Seek(offset, io.SeekStart)
+	dataFile, err := OpenDataFile[T](filename)
 	if err != nil {
-		log.Fatalf("Erro ao posicionar ponteiro para o offset arquivo de dados: %v", err)
+		return 0, err
 	}
+	defer dataFile.Close()
 
-	err = binary.Read(file, binary.LittleEndian, &data)
-	if err != nil {
-		log.Fatalf("Erro ao ler do arquivo de dados: %v", err)
-	}
-	return data
+	return appendDataRecord(dataFile, data)
 }
-func BinarySearchOnDisk(primaryIndexFilename string, targetID uint32) (int64, bool) {
-
-	primaryIndexFile := CreateOrOpenFile(primaryIndexFilename)
-	defer primaryIndexFile.Close()
 
-	fileInfo, err := primaryIndexFile.Stat()
+// Como AppendDataToFile, num arquivo já aberto por OpenDataFile, que
+// continua aberto: quem grava vários registros abre o arquivo uma vez só
+func appendDataRecord[T any](dataFile *os.File, data T) (int64, error) {
+	// Busca o offset atual
+	offset, err := dataFile.Seek(0, io.SeekEnd)
 	if err != nil {
-		fmt.Printf("Erro ao consultar informacoes do arquivo: %v\n", err)
-		return 0, false
+		return 0, err
 	}
 
-	recordSize := int64(binary.Size(IndexEntry{}))
-	left := int64(0)
-	right := fileInfo.Size()/recordSize - 1
+	// Escreve o registro no arquivo de dados, seguido do checksum
+	err = writeDataRecord(dataFile, data)
+	if err != nil {
+		return 0, err
+	}
 
-	fmt.Printf("Record size: %v | File size: %v\n", recordSize, fileInfo.Size())
-	fmt.Printf("Left: %d | Right: %d\n", left, right)
+	// Envia o registro para o disco, conforme Config.Sync
+	err = syncAfterWrite(dataFile)
+	if err != nil {
+		return 0, err
+	}
 
-	for left <= right {
-		mid := (left + right) / 2
+	// Retorna o offsert do registro gravada
+	return offset, nil
+}
 
-		_, err = primaryIndexFile.Seek(mid*recordSize, io.SeekStart)
-		if err != nil {
-			log.Fatalf("Erro ao posicionar ponteiro para binary search: %v", err)
-		}
+// Grava o cabeçalho em um arquivo de dados vazio, ou confere o cabeçalho de
+// um arquivo já existente contra o tamanho de registro esperado
+func InitDataFile(file *os.File, recordSize int) error {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
 
-		var record IndexEntry
-		err = binary.Read(primaryIndexFile, binary.LittleEndian, &record)
-		if err != nil {
-			log.Fatalf("Erro ao ler arquivo para binary search: %v", err)
+	if fileInfo.Size() == 0 {
+		header := FileHeader{
+			Magic:      DATA_FILE_MAGIC,
+			Version:    DATA_FILE_VERSION,
+			RecordSize: uint32(recordSize),
+			ByteOrder:  byteOrderCode(Config.ByteOrder),
 		}
+		return writeAt(file, 0, binary.LittleEndian, header)
+	}
 
-		fmt.Printf("Mid value: %d | ID atual: %d | ID procurado: %d\n", mid, record.ID, targetID)
-		if record.ID == targetID {
-			fmt.Printf("ID encontrado\n")
-			return record.Offset, true
-		} else if record.ID < targetID {
-			left = mid + 1
-		} else {
-			right = mid - 1
-		}
+	header, err := readAt[FileHeader](file, 0, binary.LittleEndian)
+	if err != nil {
+		return fmt.Errorf("não foi possível ler o cabeçalho de %s: %w", file.Name(), err)
 	}
-	return 0, false
+	return checkDataFileHeader(file.Name(), header, recordSize)
 }
-func SearchMostExpensiveProduct(secondaryIndexFilename string) (Product, error) {
-	secondaryIndexFile := CreateOrOpenFile(secondaryIndexFilename)
-	defer secondaryIndexFile.Close()
 
-	var mostExpensiveProduct Product
-	err := binary.Read(secondaryIndexFile, binary.LittleEndian, &mostExpensiveProduct)
+func checkDataFileHeader(filename string, header FileHeader, recordSize int) error {
+	if header.Magic != DATA_FILE_MAGIC {
+		return fmt.Errorf("%w: %s não é um arquivo de dados", ErrSchemaMismatch, filename)
+	}
+	if header.Version != DATA_FILE_VERSION {
+		return fmt.Errorf("%w: %s está na versão %d, esperada %d; é necessário migrar o arquivo",
+			ErrSchemaMismatch, filename, header.Version, DATA_FILE_VERSION)
+	}
+	if header.RecordSize != uint32(recordSize) {
+		return fmt.Errorf("%w: %s tem registros de %d bytes, esperados %d; é necessário migrar o arquivo",
+			ErrSchemaMismatch, filename, header.RecordSize, recordSize)
+	}
+	if header.ByteOrder != byteOrderCode(Config.ByteOrder) {
+		return fmt.Errorf("%w: %s", ErrByteOrderMismatch, filename)
+	}
+	return nil
+}
+
+// Abre (criando se preciso) um arquivo de dados de registros do tipo T,
+// garantindo que o cabeçalho existe e bate com o registro atual
+func OpenDataFile[T any](filename string) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		log.Fatalf("Erro ao buscar produto mais caro")
-		return Product{}, err
+		return nil, err
 	}
-	return mostExpensiveProduct, err
+
+	err = InitDataFile(file, int(fixedSize[T]()))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
 }
-func RemoveProduct(dataFilename string, primaryIndexFilename string, secondaryIndexFilename string, id uint32) error {
 
-	offset, found := BinarySearchOnDisk(primaryIndexFilename, id)
-	if !found {
-		return fmt.Errorf("Produto com ID %d não encontrado", id)
+// Como OpenDataFile, só para leitura e sem criar o arquivo. Um arquivo
+// vazio é aceito como um arquivo sem registros
+func OpenDataFileReadOnly[T any](filename string) (*os.File, error) {
+	file, err := OpenReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fileInfo.Size() == 0 {
+		return file, nil
+	}
+	header, err := readAt[FileHeader](file, 0, binary.LittleEndian)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("não foi possível ler o cabeçalho de %s: %w", filename, err)
+	}
+	err = checkDataFileHeader(filename, header, int(fixedSize[T]()))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func AppendIndexToFile(filename string, id uint32, offset int64) error {
+	file, err := CreateOrOpenFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return appendIndexEntry(file, id, offset)
+}
+
+// Como AppendIndexToFile, num arquivo já aberto
+func appendIndexEntry(file *os.File, id uint32, offset int64) error {
+	_, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// Cria a entrada do índice
+	entry := IndexEntry{
+		ID:     id,
+		Offset: offset,
 	}
 
-	dataFile := CreateOrOpenFile(dataFilename)
+	// Escreve a entrada no arquivo
+	err = binary.Write(file, Config.ByteOrder, entry)
+	if err != nil {
+		return err
+	}
+	bloomAdd(file.Name(), id)
+	return nil
+}
+
+func Append[T any](dataFilename string, indexFilename string, data T, id uint32) error {
+	dataFile, err := OpenDataFile[T](dataFilename)
+	if err != nil {
+		return fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", dataFilename, err)
+	}
 	defer dataFile.Close()
-	product := ReadFromDataFile[Product](dataFilename, offset)
-	if product.Active {
-		product.Active = false
-		dataFile.Seek(offset, os.SEEK_SET)
-		binary.Write(dataFile, binary.LittleEndian, &product)
+	indexFile, err := CreateOrOpenFile(indexFilename)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
 
-		secondaryIndexFile := CreateOrOpenFile(secondaryIndexFilename)
-		defer secondaryIndexFile.Close()
-		mostExpensiveProduct, err := SearchMostExpensiveProduct(secondaryIndexFilename)
+	offset, err := appendDataRecord(dataFile, data)
+	if err != nil {
+		return fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", dataFilename, err)
+	}
+	return appendIndexEntry(indexFile, id, offset)
+}
+
+// Operações registradas no write-ahead log
+type WALOp uint8
+
+const (
+	WAL_APPEND_PRODUCT WALOp = iota + 1
+	WAL_APPEND_CATEGORY
+	WAL_APPEND_EVENT
+	WAL_COMMIT
+)
+
+// Cabeçalho de cada entrada do WAL, seguido de PayloadSize bytes com o
+// registro. Uma intenção guarda o tamanho dos arquivos antes da operação,
+// para que a repetição comece sempre do mesmo ponto; um commit aponta, em
+// Intent, para o offset da intenção que foi concluída
+type walEntryHeader struct {
+	Op          WALOp
+	ID          uint32
+	Intent      int64
+	DataSize    int64
+	IndexSize   int64
+	PayloadSize uint32
+	Checksum    uint32
+}
+
+var ErrUnknownWALOp = errors.New("operação desconhecida no WAL")
+
+// Arquivo de dados e arquivos de índice alterados por cada operação
+func walFiles(op WALOp) (string, []string, error) {
+	switch op {
+	case WAL_APPEND_PRODUCT:
+		return PRODUCT_DATA_FILE, []string{PRODUCT_INDEX_FILE}, nil
+	case WAL_APPEND_CATEGORY:
+		return CATEGORY_DATA_FILE, []string{CATEGORY_INDEX_FILE}, nil
+	case WAL_APPEND_EVENT:
+		// O índice por usuário tem uma entrada por evento, como o primário,
+		// então os dois têm sempre o mesmo tamanho
+		return EVENT_DATA_FILE, []string{EVENT_INDEX_FILE, EVENT_USER_INDEX_FILE}, nil
+	}
+	return "", nil, fmt.Errorf("%w: %d", ErrUnknownWALOp, op)
+}
+
+func walChecksum(header walEntryHeader, payload []byte) uint32 {
+	header.Checksum = 0
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(payload)
+	return crc32.ChecksumIEEE(buf.Bytes())
+}
+
+// Grava uma entrada no fim do WAL e só retorna depois do fsync. Retorna o
+// offset da entrada
+func walAppend(header walEntryHeader, payload []byte) (int64, error) {
+	file, err := os.OpenFile(WAL_FILE, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	header.PayloadSize = uint32(len(payload))
+	header.Checksum = walChecksum(header, payload)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(payload)
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return offset, file.Sync()
+}
+
+// Executa uma inclusão protegida pelo WAL: grava a intenção, altera os
+// arquivos de dados e de índice e então grava o commit. Se o processo cair
+// no meio, RecoverWAL refaz a operação na próxima execução
+func LoggedAppend[T any](op WALOp, id uint32, data T) error {
+	var payload bytes.Buffer
+	err := binary.Write(&payload, Config.ByteOrder, data)
+	if err != nil {
+		return err
+	}
+
+	dataFilename, indexFilenames, err := walFiles(op)
+	if err != nil {
+		return err
+	}
+	header := walEntryHeader{Op: op, ID: id}
+	header.DataSize, err = fileSize(dataFilename)
+	if err != nil {
+		return err
+	}
+	header.IndexSize, err = fileSize(indexFilenames[0])
+	if err != nil {
+		return err
+	}
+
+	intent, err := walAppend(header, payload.Bytes())
+	if err != nil {
+		return err
+	}
+	err = applyWALEntry(header, payload.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = walAppend(walEntryHeader{Op: WAL_COMMIT, Intent: intent}, nil)
+	return err
+}
+
+// Volta os arquivos ao tamanho registrado na intenção e refaz a inclusão.
+// Como sempre parte do mesmo estado, pode ser repetida sem duplicar registros
+func applyWALEntry(header walEntryHeader, payload []byte) error {
+	dataFilename, indexFilenames, err := walFiles(header.Op)
+	if err != nil {
+		return err
+	}
+
+	err = os.Truncate(dataFilename, header.DataSize)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, indexFilename := range indexFilenames {
+		err = os.Truncate(indexFilename, header.IndexSize)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	reader := bytes.NewReader(payload)
+	switch header.Op {
+	case WAL_APPEND_PRODUCT:
+		var product Product
+		err = binary.Read(reader, Config.ByteOrder, &product)
 		if err != nil {
 			return err
 		}
-		if product.ID == mostExpensiveProduct.ID {
-			RecalculateMostExpensiveProduct(dataFilename, secondaryIndexFile)
+		return Append(dataFilename, indexFilenames[0], product, header.ID)
+	case WAL_APPEND_CATEGORY:
+		var category Category
+		err = binary.Read(reader, Config.ByteOrder, &category)
+		if err != nil {
+			return err
+		}
+		return Append(dataFilename, indexFilenames[0], category, header.ID)
+	default:
+		var event Event
+		err = binary.Read(reader, Config.ByteOrder, &event)
+		if err != nil {
+			return err
+		}
+		offset, err := AppendDataToFile(dataFilename, event)
+		if err != nil {
+			return err
+		}
+		err = AppendIndexToFile(indexFilenames[0], header.ID, offset)
+		if err != nil {
+			return err
 		}
+		return AppendIndexToFile(indexFilenames[1], event.UserID, offset)
 	}
-	return nil
 }
-func RecalculateMostExpensiveProduct(productFilename string, secondaryIndexFile *os.File) {
-	productFile := CreateOrOpenFile(productFilename)
-	defer productFile.Close()
 
-	var product Product
-	var mostExpensiveProduct Product
+// Refaz as operações do WAL que não chegaram ao commit e depois esvazia o
+// log. Uma entrada cortada ou com checksum errado no fim do arquivo é uma
+// intenção que não chegou ao disco, e portanto nunca foi aplicada; ela é
+// descartada. Retorna quantas operações foram refeitas
+func RecoverWAL() (int, error) {
+	file, err := os.Open(WAL_FILE)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
 
-	for {
-		err := binary.Read(productFile, binary.LittleEndian, &product)
+	type walEntry struct {
+		header  walEntryHeader
+		payload []byte
+	}
+	pending := map[int64]walEntry{}
+	order := []int64{}
+
+	reader := bufio.NewReader(file)
+	headerSize := int64(binary.Size(walEntryHeader{}))
+	for offset := int64(0); ; {
+		var header walEntryHeader
+		err = binary.Read(reader, binary.LittleEndian, &header)
 		if err != nil {
-			break //EOF
+			break
 		}
-		if product.Active && product.Price > mostExpensiveProduct.Price {
-			mostExpensiveProduct = product
+		payload := make([]byte, header.PayloadSize)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil || walChecksum(header, payload) != header.Checksum {
+			break
+		}
+
+		if header.Op == WAL_COMMIT {
+			delete(pending, header.Intent)
+		} else {
+			pending[offset] = walEntry{header, payload}
+			order = append(order, offset)
+		}
+		offset += headerSize + int64(header.PayloadSize)
+	}
+	file.Close()
+
+	replayed := 0
+	for _, offset := range order {
+		entry, ok := pending[offset]
+		if !ok {
+			continue
+		}
+		err = applyWALEntry(entry.header, entry.payload)
+		if err != nil {
+			return replayed, fmt.Errorf("não foi possível refazer a operação do WAL no offset %d: %w", offset, err)
 		}
+		replayed++
+	}
+	return replayed, os.Remove(WAL_FILE)
+}
+
+func StoreActionMetrics(filename string, action Action) error {
+	file, err := CreateOrOpenFile(filename)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	err := binary.Write(secondaryIndexFile, binary.LittleEndian, mostExpensiveProduct)
+	fileInfo, err := file.Stat()
 	if err != nil {
-		log.Fatalf("Nao foi possivel atualizar o produto mais caro")
+		return err
+	}
+
+	// Um arquivo cortado no meio de um registro faria a métrica ser gravada
+	// de novo depois do pedaço, duplicando a contagem
+	recordSize := actionMetricsRecordSize
+	if fileInfo.Size()%recordSize != 0 {
+		return fmt.Errorf("%w: %s tem %d bytes", ErrTruncatedFile, filename, fileInfo.Size())
+	}
+
+	offset := int64(0)
+	for ; offset < fileInfo.Size(); offset += recordSize {
+		storedMetrics, err := ReadRecordAt[ActionMetrics](file, offset)
+		if err != nil {
+			return err
+		}
+
+		if storedMetrics.Action == action {
+			storedMetrics.NumberOfOcurrences++
+			return WriteRecordAt(file, offset, storedMetrics)
+		}
+	}
+
+	newMetric := ActionMetrics{
+		Action:             action,
+		NumberOfOcurrences: 1,
 	}
-	fmt.Println("Produto mais caro atualizado com sucesso")
+	return WriteRecordAt(file, offset, newMetric)
 }
-func UpdateMostExpensiveProductIndex(secondaryIndexFilename string, product Product) error {
-	secondaryIndexFile := CreateOrOpenFile(secondaryIndexFilename)
-	defer secondaryIndexFile.Close()
 
-	if !product.Active {
+// Desfaz um StoreActionMetrics: diminui em um a contagem da ação, sem passar
+// de zero. Uma ação que não está no arquivo não muda nada
+func DecrementActionMetrics(filename string, action Action) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
 		return nil
+	} else if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	var mostExpensiveProduct Product
-	err := binary.Read(secondaryIndexFile, binary.LittleEndian, &mostExpensiveProduct)
-	if err == nil {
-		fmt.Printf("Produto atual: %.2f\n", product.Price)
-		fmt.Printf("Produto mais caro: %.2f\n", mostExpensiveProduct.Price)
-		if product.Price > mostExpensiveProduct.Price {
-			secondaryIndexFile.Seek(io.SeekStart, io.SeekStart)
-			err = binary.Write(secondaryIndexFile, binary.LittleEndian, product)
-			if err != nil {
-				return err
+	for offset := int64(0); ; offset += actionMetricsRecordSize {
+		storedMetrics, err := ReadRecordAt[ActionMetrics](file, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if storedMetrics.Action == action {
+			if storedMetrics.NumberOfOcurrences == 0 {
+				return nil
 			}
+			storedMetrics.NumberOfOcurrences--
+			return WriteRecordAt(file, offset, storedMetrics)
 		}
-	} else {
-		secondaryIndexFile.Seek(io.SeekStart, io.SeekStart)
-		err = binary.Write(secondaryIndexFile, binary.LittleEndian, product)
-		fmt.Print(secondaryIndexFile.Stat())
+	}
+}
+
+// Regrava ACTION_METRICS_FILE do zero contando as ações dos eventos. Só
+// RemoveEvent desconta das métricas, então elas se desencontram dos eventos
+// removidos por outro caminho (Events.Remove, remoções em lote); isso
+// também serve para consertar um arquivo corrompido
+func RecomputeActionMetrics(eventDataFilename string) error {
+	return recomputeActionMetrics(eventDataFilename, ACTION_METRICS_FILE)
+}
+
+func recomputeActionMetrics(eventDataFilename string, metricsFilename string) error {
+	counts, err := Reduce(eventDataFilename, map[Action]uint32{}, func(counts map[Action]uint32, event Event) map[Action]uint32 {
+		counts[event.EventAction]++
+		return counts
+	})
+	if err != nil {
+		return err
+	}
+	actions := make([]Action, 0, len(counts))
+	for action := range counts {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i] < actions[j] })
+
+	tempFile, err := createTempNear(metricsFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	writer := bufio.NewWriter(tempFile)
+	for _, action := range actions {
+		err = binary.Write(writer, Config.ByteOrder, ActionMetrics{Action: action, NumberOfOcurrences: counts[action]})
 		if err != nil {
-			fmt.Print(err)
+			tempFile.Close()
 			return err
 		}
 	}
-	return nil
+	err = firstError(writer.Flush(), tempFile.Close())
+	if err != nil {
+		return err
+	}
+	return atomicReplace(tempFile.Name(), metricsFilename)
 }
 
-// Função genérica para retornar o tamanho de uma struct
-// o go não permite consultar binary.Sizeof() de um tipo
-// não concreto
-func SizeOf[T any](value T) (int, error) {
-	return binary.Size(value), nil
+// Lê a próxima métrica de ação. Retorna io.EOF só no fim exato do arquivo;
+// um registro pela metade vira ErrTruncatedFile
+func readActionMetrics(r io.Reader) (ActionMetrics, error) {
+	var storedMetrics ActionMetrics
+	err := binary.Read(r, Config.ByteOrder, &storedMetrics)
+	if err == io.ErrUnexpectedEOF {
+		return storedMetrics, ErrTruncatedFile
+	}
+	return storedMetrics, err
+}
+func SearchActionMetrics(filename string, action Action) (ActionMetrics, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return ActionMetrics{}, err
+	}
+	defer file.Close()
+
+	for {
+		storedMetrics, err := readActionMetrics(file)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ActionMetrics{}, err
+		}
+
+		if storedMetrics.Action == action {
+			return storedMetrics, nil
+		}
+	}
+
+	return ActionMetrics{
+		Action:             action,
+		NumberOfOcurrences: 0,
+	}, nil
+}
+
+// Incrementa o total de compras de um produto. Na primeira compra o offset
+// do produto no arquivo de dados é buscado no índice e guardado junto
+func StoreProductMetrics(filename string, productIndexFilename string, productID uint32) error {
+	file, err := CreateOrOpenFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	recordSize := productMetricsRecordSize
+	offset := int64(0)
+	for {
+		storedMetrics, err := ReadRecordAt[ProductMetrics](file, offset)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// Gravar a métrica depois do pedaço duplicaria a contagem
+			return fmt.Errorf("%w: %s, offset %d", ErrTruncatedFile, filename, offset)
+		} else if err != nil {
+			return err
+		}
+
+		if storedMetrics.ProductID == productID {
+			storedMetrics.TotalPurchase++
+			return WriteRecordAt(file, offset, storedMetrics)
+		}
+		offset += recordSize
+	}
+
+	dataOffset, found := BinarySearchOnDisk(productIndexFilename, productID)
+	if !found {
+		dataOffset = -1
+	}
+	newMetric := ProductMetrics{
+		ProductID:           productID,
+		ProductDataLocation: dataOffset,
+		TotalPurchase:       1,
+	}
+	return WriteRecordAt(file, offset, newMetric)
+}
+
+// Desfaz um StoreProductMetrics: diminui em um o total de compras do
+// produto, sem passar de zero
+func DecrementProductMetrics(filename string, productID uint32) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for offset := int64(0); ; offset += productMetricsRecordSize {
+		storedMetrics, err := ReadRecordAt[ProductMetrics](file, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if storedMetrics.ProductID == productID {
+			if storedMetrics.TotalPurchase == 0 {
+				return nil
+			}
+			storedMetrics.TotalPurchase--
+			return WriteRecordAt(file, offset, storedMetrics)
+		}
+	}
+}
+
+// Retorna os n produtos mais comprados, em ordem decrescente de compras
+func TopProductsByPurchase(n int) ([]ProductMetrics, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("quantidade inválida: %d", n)
+	}
+
+	file, err := os.Open(PRODUCT_METRICS_FILE)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ProductMetrics{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	metrics := []ProductMetrics{}
+	for {
+		var storedMetrics ProductMetrics
+		err := binary.Read(file, Config.ByteOrder, &storedMetrics)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, storedMetrics)
+	}
+
+	// Empates são resolvidos pelo menor ID
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].TotalPurchase != metrics[j].TotalPurchase {
+			return metrics[i].TotalPurchase > metrics[j].TotalPurchase
+		}
+		return metrics[i].ProductID < metrics[j].ProductID
+	})
+
+	if n < len(metrics) {
+		metrics = metrics[:n]
+	}
+	return metrics, nil
+}
+
+// Grava o registro inteiro com uma única escrita posicionada (WriteAt),
+// sem Seek antes, então não depende da posição atual do arquivo
+func WriteRecordAt[T any](file *os.File, offset int64, data T) error {
+	return writeAt(file, offset, Config.ByteOrder, data)
+}
+func ReadRecordAt[T any](file *os.File, offset int64) (T, error) {
+	return readAt[T](file, offset, Config.ByteOrder)
+}
+
+func writeAt[T any](file *os.File, offset int64, order binary.ByteOrder, data T) error {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, order, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteAt(buf.Bytes(), offset)
+	return err
+}
+func readAt[T any](file *os.File, offset int64, order binary.ByteOrder) (T, error) {
+	var data T
+	buf := make([]byte, fixedSize[T]())
+
+	// ReadAt retorna io.EOF também quando só parte do registro existe; como
+	// em io.ReadFull, só o fim exatamente entre registros é io.EOF
+	n, err := file.ReadAt(buf, offset)
+	if err == io.EOF && n > 0 {
+		return data, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return data, err
+	}
+
+	err = binary.Read(bytes.NewReader(buf), order, &data)
+	return data, err
+}
+
+// Lê o registro no offset, que normalmente vem de um índice. Um offset que
+// não cabe no arquivo (índice desatualizado ou corrompido) retorna
+// ErrOffsetOutOfRange em vez de ler lixo
+func ReadFromDataFile[T any](filename string, offset int64) (T, error) {
+	var data T
+	lock := dataLock(filename)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	file, err := OpenDataFileReadOnly[T](filename)
+	if err != nil {
+		return data, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return data, err
+	}
+	if offset < dataHeaderSize || offset+dataRecordSize[T]() > fileInfo.Size() {
+		return data, fmt.Errorf("%w: offset %d, %s tem %d bytes", ErrOffsetOutOfRange, offset, filename, fileInfo.Size())
+	}
+	return ReadDataRecordAt[T](file, offset)
+}
+func BinarySearchOnDisk(primaryIndexFilename string, targetID uint32) (int64, bool) {
+	if !bloomMayContain(primaryIndexFilename, targetID) {
+		Counters.BloomSkips.Add(1)
+		logger.Debug("ID descartado pelo filtro de Bloom", "indice", primaryIndexFilename, "id", targetID)
+		return 0, false
+	}
+
+	record, found, err := searchLiveEntry(primaryIndexFilename, targetID)
+	if err != nil {
+		logger.Error("erro na busca binária", "indice", primaryIndexFilename, "id", targetID, "erro", err)
+		return 0, false
+	}
+	if !found {
+		logger.Debug("ID não encontrado no índice", "indice", primaryIndexFilename, "id", targetID)
+		return 0, false
+	}
+	logger.Debug("ID encontrado no índice", "indice", primaryIndexFilename, "id", targetID, "offset", record.Offset)
+	return record.Offset, true
+}
+
+// Diz se o ID está no índice sem ler o arquivo de dados. Ao contrário de
+// BinarySearchOnDisk, erros de leitura do índice são retornados em vez de
+// virarem "não encontrado"
+func Exists(indexFilename string, id uint32) (bool, error) {
+	if !bloomMayContain(indexFilename, id) {
+		return false, nil
+	}
+
+	_, found, err := searchLiveEntry(indexFilename, id)
+	return found, err
+}
+
+// Busca a entrada do ID que não é uma lápide. A busca binária cai na
+// primeira entrada com o ID e as lápides seguintes com o mesmo ID são
+// puladas, para o caso de o ID ter sido gravado de novo depois da lápide
+func searchLiveEntry(indexFilename string, id uint32) (IndexEntry, bool, error) {
+	file, err := OpenReadOnly(indexFilename)
+	if os.IsNotExist(err) {
+		return IndexEntry{}, false, nil
+	} else if err != nil {
+		return IndexEntry{}, false, err
+	}
+	defer file.Close()
+
+	_, entry, found, err := liveEntryPosition(file, id)
+	return entry, found, err
+}
+
+// Posição (em bytes) da entrada viva do ID no arquivo de índice
+func liveEntryPosition(file *os.File, id uint32) (int64, IndexEntry, bool, error) {
+	position, count, err := lowerBound(file, func(entry IndexEntry) bool { return entry.ID < id })
+	if err != nil {
+		return 0, IndexEntry{}, false, err
+	}
+	for ; position < count; position++ {
+		entry, err := ReadRecordAt[IndexEntry](file, position*indexEntrySize)
+		if err != nil {
+			return 0, IndexEntry{}, false, err
+		}
+		if entry.ID != id {
+			break
+		}
+		if entry.Offset != TOMBSTONE_OFFSET {
+			return position * indexEntrySize, entry, true, nil
+		}
+	}
+	return 0, IndexEntry{}, false, nil
+}
+
+// Filtro de Bloom sobre os IDs de um arquivo de índice. Diz com certeza
+// quando um ID não está no índice; quando diz que pode estar, ainda é
+// preciso fazer a busca binária
+type BloomIndex struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+// Capacidade mínima do filtro, para que um índice pequeno ainda tenha
+// espaço para crescer com as inclusões
+const bloomMinCapacity = 1024
+
+// Filtros em uso, por nome do arquivo de índice. BinarySearchOnDisk só
+// consulta o disco quando o filtro do arquivo (se houver) não descarta o ID
+var (
+	bloomMu      sync.RWMutex
+	bloomIndexes = map[string]*BloomIndex{}
+)
+
+// Monta um filtro com todos os IDs do índice, dimensionado para a taxa de
+// falsos positivos pedida
+func NewBloomIndex(indexFilename string, falsePositiveRate float64) (*BloomIndex, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("taxa de falsos positivos inválida: %v", falsePositiveRate)
+	}
+
+	size, err := fileSize(indexFilename)
+	if err != nil {
+		return nil, err
+	}
+	capacity := size / indexEntrySize
+	if capacity < bloomMinCapacity {
+		capacity = bloomMinCapacity
+	}
+
+	// m = -n ln(p) / ln(2)^2 bits e k = m/n ln(2) funções de hash
+	bits := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Max(1, math.Round(bits/float64(capacity)*math.Ln2))
+	bloom := &BloomIndex{
+		bits:   make([]uint64, (uint64(bits)+63)/64),
+		size:   uint64(bits),
+		hashes: uint64(hashes),
+	}
+
+	err = ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		bloom.Add(entry.ID)
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return bloom, nil
+}
+
+// Passa a usar um filtro de Bloom nas buscas em indexFilename
+func UseBloomIndex(indexFilename string, falsePositiveRate float64) error {
+	bloom, err := NewBloomIndex(indexFilename, falsePositiveRate)
+	if err != nil {
+		return err
+	}
+
+	bloomMu.Lock()
+	defer bloomMu.Unlock()
+	bloomIndexes[indexFilename] = bloom
+	return nil
+}
+
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// Hash duplo: a i-ésima função de hash é h1 + i*h2
+func (b *BloomIndex) positions(id uint32, visit func(uint64) bool) bool {
+	h1 := splitmix64(uint64(id))
+	h2 := splitmix64(h1) | 1
+	for i := uint64(0); i < b.hashes; i++ {
+		if !visit((h1 + i*h2) % b.size) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BloomIndex) Add(id uint32) {
+	b.positions(id, func(bit uint64) bool {
+		b.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (b *BloomIndex) MayContain(id uint32) bool {
+	return b.positions(id, func(bit uint64) bool {
+		return b.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+func bloomAdd(indexFilename string, id uint32) {
+	bloomMu.Lock()
+	defer bloomMu.Unlock()
+	bloom, ok := bloomIndexes[indexFilename]
+	if ok {
+		bloom.Add(id)
+	}
+}
+
+// Sem filtro para o arquivo, qualquer ID pode estar no índice
+func bloomMayContain(indexFilename string, id uint32) bool {
+	bloomMu.RLock()
+	defer bloomMu.RUnlock()
+	bloom, ok := bloomIndexes[indexFilename]
+	return !ok || bloom.MayContain(id)
+}
+
+// Refaz o filtro de um índice que foi reescrito a partir do arquivo de dados
+func bloomReload(indexFilename string) error {
+	bloomMu.RLock()
+	_, ok := bloomIndexes[indexFilename]
+	bloomMu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	return ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		bloomAdd(indexFilename, entry.ID)
+		return nil
+	})
+}
+
+// Percorre as entradas de um arquivo de índice na ordem em que estão gravadas
+func ForEachIndexEntry(indexFilename string, fn func(IndexEntry) error) error {
+	indexFile, err := os.Open(indexFilename)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	reader := bufio.NewReader(indexFile)
+	for {
+		var entry IndexEntry
+		err = binary.Read(reader, Config.ByteOrder, &entry)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Busca binária genérica sobre um arquivo de registros de tamanho fixo,
+// ordenado de forma que less é verdadeiro para um prefixo dos registros e
+// falso para o resto. Retorna o primeiro registro para o qual less é falso;
+// found é false quando less é verdadeiro para todos. Cabe a quem chama
+// conferir se o registro retornado é de fato o procurado (igualdade)
+func SearchSorted[T any](filename string, less func(T) bool) (T, bool, error) {
+	var record T
+	file, err := OpenReadOnly(filename)
+	if os.IsNotExist(err) {
+		return record, false, nil
+	} else if err != nil {
+		return record, false, err
+	}
+	defer file.Close()
+
+	position, count, err := lowerBound(file, less)
+	if err != nil {
+		return record, false, err
+	}
+	if position == count {
+		return record, false, nil
+	}
+
+	record, err = ReadRecordAt[T](file, position*fixedSize[T]())
+	if err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+// Posição (em registros) do primeiro registro para o qual less é falso, e o
+// total de registros do arquivo
+func lowerBound[T any](file *os.File, less func(T) bool) (int64, int64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	recordSize := fixedSize[T]()
+	count := fileInfo.Size() / recordSize
+	left := int64(0)
+	right := count
+
+	for left < right {
+		mid := (left + right) / 2
+
+		record, err := ReadRecordAt[T](file, mid*recordSize)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if less(record) {
+			left = mid + 1
+		} else {
+			right = mid
+		}
+	}
+	return left, count, nil
+}
+
+// Busca o produto pelo índice primário; produtos inativos também são
+// retornados
+func GetProductByID(dataFilename string, indexFilename string, id uint32) (Product, bool, error) {
+	return NewFileStore(dataFilename, indexFilename, productID).Get(id)
+}
+
+// Busca vários produtos de uma vez: ordena os IDs, percorre o índice uma
+// única vez junto com eles e lê o arquivo de dados em ordem de offset. IDs
+// que não existem ficam de fora do map. Assim como GetProductByID, produtos
+// inativos também são retornados
+func GetProductsByIDs(ids []uint32) (map[uint32]Product, error) {
+	sorted := append([]uint32(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	products := make(map[uint32]Product)
+	entries := []IndexEntry{}
+	next := 0
+	err := ForEachIndexEntry(PRODUCT_INDEX_FILE, func(entry IndexEntry) error {
+		if entry.Offset == TOMBSTONE_OFFSET {
+			return nil
+		}
+		for next < len(sorted) && sorted[next] < entry.ID {
+			next++
+		}
+		if next == len(sorted) {
+			return errStopScan
+		}
+		if sorted[next] == entry.ID {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return products, nil
+	} else if err != nil && err != errStopScan {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	dataFile, err := OpenDataFileReadOnly[Product](PRODUCT_DATA_FILE)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+	for _, entry := range entries {
+		product, err := ReadDataRecordAt[Product](dataFile, entry.Offset)
+		if err != nil {
+			return nil, err
+		}
+		products[entry.ID] = product
+	}
+	return products, nil
+}
+
+// Busca o produto e a categoria dele. Se a categoria foi removida, o produto
+// é retornado com uma categoria zerada e ErrDanglingCategory. Assim como
+// GetProductByID, produtos inativos também são retornados
+func GetProductWithCategory(id uint32) (Product, Category, error) {
+	product, found, err := Products.Get(id)
+	if err != nil {
+		return Product{}, Category{}, err
+	}
+	if !found {
+		return Product{}, Category{}, fmt.Errorf("Produto com ID %d não encontrado", id)
+	}
+
+	category, found, err := Categories.Get(product.CategoryID)
+	if err != nil {
+		return product, Category{}, err
+	}
+	if !found {
+		return product, Category{}, fmt.Errorf("%w: produto %d, categoria %d", ErrDanglingCategory, id, product.CategoryID)
+	}
+	return product, category, nil
+}
+
+// Inclusão, busca e remoção de registros do tipo T por ID
+type Appender[T any] interface {
+	Add(record T) error
+	Get(id uint32) (T, bool, error)
+	Remove(id uint32) error
+}
+
+// Appender sobre um arquivo de dados e seu índice primário ordenado por ID
+type FileStore[T any] struct {
+	dataFilename  string
+	indexFilename string
+	idOf          func(T) uint32
+
+	// Operação do WAL usada por Add. Zero grava direto, sem passar pelo WAL
+	walOp WALOp
+	// Índices secundários sem ordenação (arquivo -> chave do registro),
+	// reconstruídos depois de cada remoção
+	secondary map[string]func(T) uint32
+	// Pula a busca no índice que Add faz para recusar IDs repetidos
+	allowDuplicates bool
+	// Entradas de índice que Add ainda não gravou (arquivo -> entradas),
+	// só nos stores criados por Deferred
+	pending map[string][]IndexEntry
+	// Maior ID que NextID pode devolver; zero é math.MaxUint32
+	maxID uint32
+}
+
+var _ Appender[Product] = (*FileStore[Product])(nil)
+
+func NewFileStore[T any](dataFilename string, indexFilename string, idOf func(T) uint32) *FileStore[T] {
+	return &FileStore[T]{
+		dataFilename:  dataFilename,
+		indexFilename: indexFilename,
+		idOf:          idOf,
+	}
+}
+
+func productID(product Product) uint32    { return product.ID }
+func categoryID(category Category) uint32 { return category.ID }
+func eventID(event Event) uint32          { return event.ID }
+
+var Products = &FileStore[Product]{
+	dataFilename:  PRODUCT_DATA_FILE,
+	indexFilename: PRODUCT_INDEX_FILE,
+	idOf:          productID,
+	walOp:         WAL_APPEND_PRODUCT,
+	maxID:         UNKNOWN_PRODUCT_ID - 1,
+}
+
+var Categories = &FileStore[Category]{
+	dataFilename:  CATEGORY_DATA_FILE,
+	indexFilename: CATEGORY_INDEX_FILE,
+	idOf:          categoryID,
+	walOp:         WAL_APPEND_CATEGORY,
+}
+
+// O WAL de eventos já grava o índice por usuário; ele só aparece em
+// secondary para ser reconstruído nas remoções
+var Events = &FileStore[Event]{
+	dataFilename:  EVENT_DATA_FILE,
+	indexFilename: EVENT_INDEX_FILE,
+	idOf:          eventID,
+	walOp:         WAL_APPEND_EVENT,
+	secondary: map[string]func(Event) uint32{
+		EVENT_USER_INDEX_FILE: func(event Event) uint32 { return event.UserID },
+	},
+}
+
+// Cópia do store que não confere IDs repetidos em Add, para cargas em lote
+// em que os IDs são gerados e já se sabe que são únicos
+func (s *FileStore[T]) Unchecked() *FileStore[T] {
+	unchecked := *s
+	unchecked.allowDuplicates = true
+	return &unchecked
+}
+
+// Cópia do store em que Add grava só o registro e guarda as entradas de
+// índice em memória até FlushDeferred. Não passa pelo WAL nem confere IDs
+// repetidos, já que o índice em disco fica desatualizado até o fim da carga
+func (s *FileStore[T]) Deferred() *FileStore[T] {
+	deferred := *s
+	deferred.allowDuplicates = true
+	deferred.pending = make(map[string][]IndexEntry)
+	return &deferred
+}
+
+// Grava as entradas acumuladas desde Deferred. O índice primário é ordenado
+// uma vez e intercalado com o que já estava no arquivo; os secundários, que
+// não têm ordem, recebem as entradas no fim
+func (s *FileStore[T]) FlushDeferred() error {
+	for filename, entries := range s.pending {
+		var err error
+		if filename == s.indexFilename {
+			err = mergeIndexFile(filename, entries)
+			pendingClear(filename)
+		} else {
+			err = appendIndexEntries(filename, entries)
+		}
+		if err != nil {
+			return err
+		}
+		delete(s.pending, filename)
+	}
+	return nil
+}
+
+// Intercala entries com o índice ordenado já gravado em indexFilename numa
+// única passada, gravando num temporário que depois substitui o índice
+func mergeIndexFile(indexFilename string, entries []IndexEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	tempFile, err := createTempNear(indexFilename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tempFile)
+	next := 0
+	err = ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		for ; next < len(entries) && entries[next].ID < entry.ID; next++ {
+			err := binary.Write(writer, Config.ByteOrder, entries[next])
+			if err != nil {
+				return err
+			}
+		}
+		return binary.Write(writer, Config.ByteOrder, entry)
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	for ; err == nil && next < len(entries); next++ {
+		err = binary.Write(writer, Config.ByteOrder, entries[next])
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	tempFile.Close()
+	if err == nil {
+		err = atomicReplace(tempFile.Name(), indexFilename)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return bloomReload(indexFilename)
+}
+
+func appendIndexEntries(indexFilename string, entries []IndexEntry) error {
+	file, err := os.OpenFile(indexFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		err = binary.Write(writer, Config.ByteOrder, entry)
+		if err != nil {
+			return err
+		}
+		bloomAdd(indexFilename, entry.ID)
+	}
+	return writer.Flush()
+}
+
+// Grava o registro e as entradas de índice. Retorna ErrDuplicateID se o ID
+// já estiver no índice, a menos que o store venha de Unchecked
+func (s *FileStore[T]) Add(record T) error {
+	Counters.Adds.Add(1)
+	lock := dataLock(s.dataFilename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !s.allowDuplicates {
+		_, found := BinarySearchOnDisk(s.indexFilename, s.idOf(record))
+		if found {
+			return fmt.Errorf("%w: %d em %s", ErrDuplicateID, s.idOf(record), s.indexFilename)
+		}
+	}
+
+	if s.pending != nil {
+		offset, err := AppendDataToFile(s.dataFilename, record)
+		if err != nil {
+			return err
+		}
+		s.pending[s.indexFilename] = append(s.pending[s.indexFilename], IndexEntry{ID: s.idOf(record), Offset: offset})
+		pendingAdd(s.indexFilename, s.idOf(record))
+		for filename, keyOf := range s.secondary {
+			s.pending[filename] = append(s.pending[filename], IndexEntry{ID: keyOf(record), Offset: offset})
+		}
+		return nil
+	}
+
+	if s.walOp != 0 {
+		return LoggedAppend(s.walOp, s.idOf(record), record)
+	}
+
+	offset, err := AppendDataToFile(s.dataFilename, record)
+	if err != nil {
+		return err
+	}
+	err = AppendIndexToFile(s.indexFilename, s.idOf(record), offset)
+	if err != nil {
+		return err
+	}
+	for filename, keyOf := range s.secondary {
+		err = AppendIndexToFile(filename, keyOf(record), offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore[T]) Get(id uint32) (T, bool, error) {
+	var record T
+	Counters.Gets.Add(1)
+	lock := dataLock(s.dataFilename)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	offset, found := BinarySearchOnDisk(s.indexFilename, id)
+	if !found {
+		Counters.GetMisses.Add(1)
+		return record, false, nil
+	}
+	Counters.GetHits.Add(1)
+
+	dataFile, err := OpenDataFileReadOnly[T](s.dataFilename)
+	if err != nil {
+		return record, false, err
+	}
+	defer dataFile.Close()
+
+	record, err = ReadDataRecordAt[T](dataFile, offset)
+	if err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+func (s *FileStore[T]) Remove(id uint32) error {
+	Counters.Removes.Add(1)
+	lock := dataLock(s.dataFilename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := RemoveByID(s.indexFilename, s.dataFilename, id, *new(T))
+	if err != nil {
+		return err
+	}
+	for filename, keyOf := range s.secondary {
+		err = RebuildIndex(context.Background(), s.dataFilename, filename, keyOf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove o registro só no índice: a entrada do ID e as dos índices
+// secundários que apontam para o mesmo registro viram lápides. Ao contrário
+// de Remove, nenhum arquivo é reescrito, então os offsets dos outros
+// registros continuam valendo. O registro fica no arquivo de dados (e
+// aparece em ForEach) até CompactTombstones
+func (s *FileStore[T]) Tombstone(id uint32) error {
+	Counters.Removes.Add(1)
+	lock := dataLock(s.dataFilename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	offset, err := TombstoneByID(s.indexFilename, id)
+	if err != nil {
+		return err
+	}
+	for filename := range s.secondary {
+		err = tombstoneOffset(filename, offset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Descarta do arquivo de dados os registros com lápide e reconstrói os
+// índices, que ficam sem lápides
+func (s *FileStore[T]) CompactTombstones(ctx context.Context) error {
+	lock := dataLock(s.dataFilename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	err := compactTombstones(ctx, s.dataFilename, s.indexFilename, s.idOf)
+	if err != nil {
+		return err
+	}
+	for filename, keyOf := range s.secondary {
+		err = RebuildIndex(context.Background(), s.dataFilename, filename, keyOf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Próximo ID livre, seguindo a regra da importação: o ID do último registro
+// gravado mais um
+func (s *FileStore[T]) NextID() (uint32, error) {
+	last, err := ReadLastRecord[T](s.dataFilename)
+	if err != nil {
+		return 0, err
+	}
+	if last == nil {
+		return 0, nil
+	}
+	return nextIDAfter(s.idOf(*last), s.MaxID())
+}
+
+func (s *FileStore[T]) MaxID() uint32 {
+	if s.maxID == 0 {
+		return math.MaxUint32
+	}
+	return s.maxID
+}
+
+// Diz se o ID está no índice primário ou entre as entradas ainda não
+// gravadas de um store criado por Deferred para o mesmo índice
+func (s *FileStore[T]) Exists(id uint32) (bool, error) {
+	if pendingContains(s.indexFilename, id) {
+		return true, nil
+	}
+	found, err := Exists(s.indexFilename, id)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return found, err
+}
+
+// IDs adicionados pelos stores de Deferred e ainda fora do índice em disco
+// (arquivo de índice -> IDs), para que Exists os enxergue de qualquer cópia
+// do store
+var (
+	pendingMu  sync.RWMutex
+	pendingIDs = map[string]map[uint32]bool{}
+)
+
+func pendingAdd(indexFilename string, id uint32) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	if pendingIDs[indexFilename] == nil {
+		pendingIDs[indexFilename] = make(map[uint32]bool)
+	}
+	pendingIDs[indexFilename][id] = true
+}
+
+func pendingContains(indexFilename string, id uint32) bool {
+	pendingMu.RLock()
+	defer pendingMu.RUnlock()
+	return pendingIDs[indexFilename][id]
+}
+
+func pendingClear(indexFilename string) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	delete(pendingIDs, indexFilename)
+}
+
+// Trava de leitura e escrita de cada arquivo de dados (nome limpo ->
+// trava), compartilhada por todas as cópias de um store. Get e
+// ReadFromDataFile pegam RLock, e várias leituras andam juntas; Add, Remove e
+// as atualizações no lugar (UpsertProduct, RemoveProduct, ReactivateProduct)
+// pegam Lock, então nenhuma leitura vê um registro pela metade. Varreduras
+// com ForEach não passam pela trava. O mesmo arquivo aberto por caminhos
+// diferentes (relativo e absoluto) tem travas diferentes
+var (
+	dataLocksMu sync.Mutex
+	dataLocks   = map[string]*sync.RWMutex{}
+)
+
+func dataLock(dataFilename string) *sync.RWMutex {
+	dataLocksMu.Lock()
+	defer dataLocksMu.Unlock()
+	name := filepath.Clean(dataFilename)
+	lock, ok := dataLocks[name]
+	if !ok {
+		lock = &sync.RWMutex{}
+		dataLocks[name] = lock
+	}
+	return lock
+}
+
+// Appender em memória, com a mesma semântica de FileStore, para testar a
+// lógica de consultas sem tocar no disco
+type MemStore[T any] struct {
+	records []T
+	idOf    func(T) uint32
+
+	// Se definido, Remove troca o registro pela versão devolvida (remoção
+	// lógica, como RemoveProduct faz) em vez de apagá-lo
+	deactivate func(T) T
+}
+
+var _ Appender[Product] = (*MemStore[Product])(nil)
+
+func NewMemStore[T any](idOf func(T) uint32) *MemStore[T] {
+	return &MemStore[T]{idOf: idOf}
+}
+
+// MemStore de produtos em que Remove só marca o produto como inativo
+func NewProductMemStore() *MemStore[Product] {
+	store := NewMemStore(productID)
+	store.deactivate = func(product Product) Product {
+		product.Active = false
+		return product
+	}
+	return store
+}
+
+func (s *MemStore[T]) Add(record T) error {
+	s.records = append(s.records, record)
+	return nil
+}
+
+// Assim como no índice em disco, vale o primeiro registro com o ID
+func (s *MemStore[T]) Get(id uint32) (T, bool, error) {
+	for _, record := range s.records {
+		if s.idOf(record) == id {
+			return record, true, nil
+		}
+	}
+	var record T
+	return record, false, nil
+}
+
+func (s *MemStore[T]) Remove(id uint32) error {
+	for i, record := range s.records {
+		if s.idOf(record) != id {
+			continue
+		}
+		if s.deactivate != nil {
+			s.records[i] = s.deactivate(record)
+		} else {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+		}
+		return nil
+	}
+	return fmt.Errorf("registro com ID %d não encontrado", id)
+}
+
+func (s *MemStore[T]) NextID() (uint32, error) {
+	if len(s.records) == 0 {
+		return 0, nil
+	}
+	return nextIDAfter(s.idOf(s.records[len(s.records)-1]), s.MaxID())
+}
+
+func (s *MemStore[T]) MaxID() uint32 {
+	return math.MaxUint32
+}
+
+func (s *MemStore[T]) Exists(id uint32) (bool, error) {
+	_, found, err := s.Get(id)
+	return found, err
+}
+
+// Appender que divide os registros em vários arquivos de dados (shards) de
+// no máximo recordsPerShard registros cada: base.000.bin, base.001.bin etc.
+// O manifesto guarda os IDs e a quantidade de registros de cada shard, e o
+// índice primário guarda o shard junto com o offset (ver shardOffset). Como
+// em FileStore, os IDs precisam chegar em ordem crescente. As gravações não
+// passam pelo WAL
+type ShardedStore[T any] struct {
+	base             string
+	manifestFilename string
+	indexFilename    string
+	recordsPerShard  int64
+	idOf             func(T) uint32
+}
+
+var _ Appender[Event] = (*ShardedStore[Event])(nil)
+
+// Entrada do manifesto, uma por shard, na ordem dos shards
+type ShardInfo struct {
+	FirstID uint32
+	LastID  uint32
+	Records int64
+}
+
+// Bits do offset no índice de um ShardedStore; os de cima são o shard
+const SHARD_OFFSET_BITS = 40
+
+var ErrShardOutOfRange = errors.New("shard fora do manifesto")
+
+func shardOffset(shard int, offset int64) int64 {
+	return int64(shard)<<SHARD_OFFSET_BITS | offset
+}
+
+func splitShardOffset(encoded int64) (int, int64) {
+	return int(encoded >> SHARD_OFFSET_BITS), encoded & (1<<SHARD_OFFSET_BITS - 1)
+}
+
+func NewShardedStore[T any](base string, indexFilename string, recordsPerShard int64, idOf func(T) uint32) *ShardedStore[T] {
+	return &ShardedStore[T]{
+		base:             base,
+		manifestFilename: base + ".manifest.bin",
+		indexFilename:    indexFilename,
+		recordsPerShard:  recordsPerShard,
+		idOf:             idOf,
+	}
+}
+
+func (s *ShardedStore[T]) ShardFilename(shard int) string {
+	return fmt.Sprintf("%s.%03d.bin", s.base, shard)
+}
+
+// Os shards na ordem em que foram criados. Sem manifesto, não há shards
+func (s *ShardedStore[T]) Manifest() ([]ShardInfo, error) {
+	shards := []ShardInfo{}
+	file, err := OpenReadOnly(s.manifestFilename)
+	if os.IsNotExist(err) {
+		return shards, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		var shard ShardInfo
+		err = binary.Read(reader, Config.ByteOrder, &shard)
+		if err == io.EOF {
+			return shards, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("erro ao ler o manifesto %s: %w", s.manifestFilename, err)
+		}
+		shards = append(shards, shard)
+	}
+}
+
+func (s *ShardedStore[T]) writeShardInfo(shard int, info ShardInfo) error {
+	file, err := CreateOrOpenFile(s.manifestFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = WriteRecordAt(file, int64(shard)*fixedSize[ShardInfo](), info)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Grava o registro no último shard, ou num shard novo se o último estiver
+// cheio
+func (s *ShardedStore[T]) Add(record T) error {
+	Counters.Adds.Add(1)
+	id := s.idOf(record)
+	_, found := BinarySearchOnDisk(s.indexFilename, id)
+	if found {
+		return fmt.Errorf("%w: %d em %s", ErrDuplicateID, id, s.indexFilename)
+	}
+
+	shards, err := s.Manifest()
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 || shards[len(shards)-1].Records >= s.recordsPerShard {
+		shards = append(shards, ShardInfo{})
+	}
+	shard := len(shards) - 1
+
+	offset, err := AppendDataToFile(s.ShardFilename(shard), record)
+	if err != nil {
+		return err
+	}
+	info := shards[shard]
+	if info.Records == 0 {
+		info.FirstID = id
+	}
+	info.LastID = id
+	info.Records++
+	err = s.writeShardInfo(shard, info)
+	if err != nil {
+		return err
+	}
+	return AppendIndexToFile(s.indexFilename, id, shardOffset(shard, offset))
+}
+
+func (s *ShardedStore[T]) Get(id uint32) (T, bool, error) {
+	var record T
+	Counters.Gets.Add(1)
+	encoded, found := BinarySearchOnDisk(s.indexFilename, id)
+	if !found {
+		Counters.GetMisses.Add(1)
+		return record, false, nil
+	}
+	Counters.GetHits.Add(1)
+
+	shards, err := s.Manifest()
+	if err != nil {
+		return record, false, err
+	}
+	shard, offset := splitShardOffset(encoded)
+	if shard >= len(shards) {
+		return record, false, fmt.Errorf("%w: shard %d do ID %d, o manifesto tem %d", ErrShardOutOfRange, shard, id, len(shards))
+	}
+
+	record, err = ReadFromDataFile[T](s.ShardFilename(shard), offset)
+	if err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+// Remove o registro do shard dele. Só as entradas do índice que apontam
+// para depois dele no mesmo shard mudam de offset
+func (s *ShardedStore[T]) Remove(id uint32) error {
+	Counters.Removes.Add(1)
+	encoded, found := BinarySearchOnDisk(s.indexFilename, id)
+	if !found {
+		return fmt.Errorf("ID %d não encontrado em %s", id, s.indexFilename)
+	}
+	shards, err := s.Manifest()
+	if err != nil {
+		return err
+	}
+	shard, offset := splitShardOffset(encoded)
+	if shard >= len(shards) {
+		return fmt.Errorf("%w: shard %d do ID %d, o manifesto tem %d", ErrShardOutOfRange, shard, id, len(shards))
+	}
+
+	err = RemoveProductFromDataFile(s.ShardFilename(shard), offset, *new(T))
+	if err != nil {
+		return fmt.Errorf("não foi possível remover registro do arquivo de dados: %w", err)
+	}
+	err = RemoveFromIndexFile(s.indexFilename, id)
+	if err != nil {
+		return fmt.Errorf("não foi possível remover registro do arquivo de índices: %w", err)
+	}
+	err = s.shiftShardOffsets(shard, offset, -dataRecordSize[T]())
+	if err != nil {
+		return err
+	}
+
+	info := shards[shard]
+	info.Records--
+	return s.writeShardInfo(shard, info)
+}
+
+// Como ShiftIndexOffsets, só para as entradas do shard
+func (s *ShardedStore[T]) shiftShardOffsets(shard int, afterOffset int64, delta int64) error {
+	indexFile, err := os.OpenFile(s.indexFilename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	for position := int64(0); ; position += indexEntrySize {
+		entry, err := ReadRecordAt[IndexEntry](indexFile, position)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		entryShard, offset := splitShardOffset(entry.Offset)
+		if entryShard == shard && offset > afterOffset {
+			entry.Offset = shardOffset(shard, offset+delta)
+			err = WriteRecordAt(indexFile, position, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Percorre os registros de todos os shards, em ordem
+func (s *ShardedStore[T]) ForEach(fn func(T) error) error {
+	shards, err := s.Manifest()
+	if err != nil {
+		return err
+	}
+	for shard := range shards {
+		err = ForEach(s.ShardFilename(shard), fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Busca vários IDs em qualquer Appender, ignorando os que não existem
+func GetMany[T any](store Appender[T], ids []uint32) ([]T, error) {
+	records := []T{}
+	for _, id := range ids {
+		record, found, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Reconstrói o índice primário a partir do arquivo de dados, ordenado por ID.
+// Se ctx for cancelado durante a leitura, o índice antigo fica intacto.
+// As lápides se perdem e os registros marcados voltam a ser encontrados,
+// então um índice com lápides deve passar por compactTombstones
+func RebuildIndex[T any](ctx context.Context, dataFilename string, indexFilename string, idOf func(T) uint32) error {
+	entries := []IndexEntry{}
+	err := ForEachWithOffsetContext(ctx, dataFilename, func(offset int64, record T) error {
+		entries = append(entries, IndexEntry{ID: idOf(record), Offset: offset})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Estável para que entradas com a mesma chave (índices secundários)
+	// continuem na ordem dos registros
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	// O índice novo é montado ao lado e só substitui o atual no fim, então
+	// uma falha no meio deixa o índice anterior intacto
+	tempFile, err := createTempNear(indexFilename)
+	if err != nil {
+		return err
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+
+	writer := bufio.NewWriter(tempFile)
+	for _, entry := range entries {
+		err = binary.Write(writer, Config.ByteOrder, entry)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+
+	err = atomicReplace(tempFilename, indexFilename)
+	if err != nil {
+		return err
+	}
+	return bloomReload(indexFilename)
+}
+
+type InconsistencyKind uint8
+
+const (
+	// A entrada do índice aponta para fora do arquivo de dados ou para o
+	// meio de um registro
+	OFFSET_PAST_EOF InconsistencyKind = iota + 1
+	// A entrada do índice aponta para um produto desativado
+	POINTS_TO_INACTIVE
+	// O mesmo ID aparece mais de uma vez no índice
+	DUPLICATE_ID
+	// O registro no offset tem outro ID
+	ID_MISMATCH
+	// O ID está no arquivo de dados mas não no índice
+	MISSING_FROM_INDEX
+	// O checksum do registro não confere
+	CORRUPT_RECORD
+)
+
+func (kind InconsistencyKind) String() string {
+	switch kind {
+	case OFFSET_PAST_EOF:
+		return "offset fora do arquivo"
+	case POINTS_TO_INACTIVE:
+		return "aponta para produto inativo"
+	case DUPLICATE_ID:
+		return "ID repetido no índice"
+	case ID_MISMATCH:
+		return "ID do registro diferente do índice"
+	case MISSING_FROM_INDEX:
+		return "ID ausente do índice"
+	case CORRUPT_RECORD:
+		return "registro corrompido"
+	}
+	return "desconhecida"
+}
+
+type Inconsistency struct {
+	Kind   InconsistencyKind
+	ID     uint32
+	Offset int64
+}
+
+// Os size bytes a partir de offset no formato de hex.Dump, para investigar
+// registros corrompidos ou gravados com outra ordem de bytes. Para ver um
+// registro inteiro, com o CRC, use dataRecordSize[T]() como size
+func DumpRecordHex(filename string, offset int64, size int) (string, error) {
+	file, err := OpenReadOnly(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	if offset < 0 || size < 0 || offset+int64(size) > fileInfo.Size() {
+		return "", fmt.Errorf("%w: %d bytes no offset %d, %s tem %d bytes", ErrOffsetOutOfRange, size, offset, filename, fileInfo.Size())
+	}
+
+	buf := make([]byte, size)
+	_, err = file.ReadAt(buf, offset)
+	if err != nil {
+		return "", err
+	}
+	return hex.Dump(buf), nil
+}
+
+// O arquivo inteiro no formato de hex.Dump. Lê tudo para a memória, então é
+// só para arquivos pequenos
+func DumpAllHex(filename string) (string, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return hex.Dump(raw), nil
+}
+
+// Confere o índice primário contra o arquivo de produtos sem modificar
+// nenhum dos dois. Cada problema encontrado vira um Inconsistency; o erro só
+// é retornado quando não dá para ler os arquivos
+func VerifyStore(dataFilename string, indexFilename string) ([]Inconsistency, error) {
+	dataFile, err := os.Open(dataFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	dataSize, err := fileSize(dataFilename)
+	if err != nil {
+		return nil, err
+	}
+	recordSize := dataRecordSize[Product]()
+	if dataSize > 0 {
+		header, err := readAt[FileHeader](dataFile, 0, binary.LittleEndian)
+		if err != nil {
+			return nil, err
+		}
+		err = checkDataFileHeader(dataFilename, header, int(productRecordSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	problems := []Inconsistency{}
+	indexed := make(map[uint32]bool)
+	tombstoned := make(map[uint32]bool)
+	corrupt := make(map[int64]bool)
+	err = ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		if entry.Offset == TOMBSTONE_OFFSET {
+			tombstoned[entry.ID] = true
+			return nil
+		}
+		if indexed[entry.ID] {
+			problems = append(problems, Inconsistency{Kind: DUPLICATE_ID, ID: entry.ID, Offset: entry.Offset})
+		}
+		indexed[entry.ID] = true
+
+		if entry.Offset < dataHeaderSize || entry.Offset+recordSize > dataSize ||
+			(entry.Offset-dataHeaderSize)%recordSize != 0 {
+			problems = append(problems, Inconsistency{Kind: OFFSET_PAST_EOF, ID: entry.ID, Offset: entry.Offset})
+			return nil
+		}
+
+		product, err := ReadDataRecordAt[Product](dataFile, entry.Offset)
+		if errors.Is(err, ErrCorruptRecord) {
+			if !corrupt[entry.Offset] {
+				problems = append(problems, Inconsistency{Kind: CORRUPT_RECORD, ID: entry.ID, Offset: entry.Offset})
+			}
+			corrupt[entry.Offset] = true
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if product.ID != entry.ID {
+			problems = append(problems, Inconsistency{Kind: ID_MISMATCH, ID: entry.ID, Offset: entry.Offset})
+		} else if !product.Active {
+			problems = append(problems, Inconsistency{Kind: POINTS_TO_INACTIVE, ID: entry.ID, Offset: entry.Offset})
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Lê registro a registro em vez de usar RecordScanner, que para no
+	// primeiro registro corrompido. O ID de um registro corrompido não é
+	// confiável, então ele é reportado com ID 0 se o índice não apontou
+	// para ele
+	for offset := dataHeaderSize; offset+recordSize <= dataSize; offset += recordSize {
+		product, err := ReadDataRecordAt[Product](dataFile, offset)
+		if errors.Is(err, ErrCorruptRecord) {
+			if !corrupt[offset] {
+				problems = append(problems, Inconsistency{Kind: CORRUPT_RECORD, Offset: offset})
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !indexed[product.ID] && !tombstoned[product.ID] {
+			problems = append(problems, Inconsistency{Kind: MISSING_FROM_INDEX, ID: product.ID, Offset: offset})
+		}
+	}
+	return problems, nil
+}
+
+// Remove fisicamente os produtos inativos do arquivo de dados e reconstrói
+// o índice, já que os offsets dos produtos seguintes mudam. As métricas por
+// produto guardam o offset, então elas também são atualizadas.
+//
+// Se ctx for cancelado antes da troca dos arquivos, o arquivo de dados
+// original fica intacto e o temporário é apagado
+func Compact(ctx context.Context, dataFilename string, indexFilename string) error {
+	return compactProducts(ctx, dataFilename, indexFilename, PRODUCT_METRICS_FILE)
+}
+
+func compactProducts(ctx context.Context, dataFilename string, indexFilename string, metricsFilename string) error {
+	tombstones, err := readTombstones(indexFilename)
+	if err != nil {
+		return err
+	}
+	err = compactDataFile(ctx, dataFilename, func(offset int64, product Product) bool {
+		return product.Active && !tombstones.covers(product.ID, offset)
+	})
+	if err != nil {
+		return err
+	}
+
+	// O arquivo de dados já foi trocado: a partir daqui o índice precisa ser
+	// reconstruído de qualquer jeito, então o cancelamento é ignorado
+	err = RebuildIndex(context.Background(), dataFilename, indexFilename, productID)
+	if err != nil {
+		return err
+	}
+	return RefreshProductMetricsLocations(metricsFilename, indexFilename)
+}
+
+// Reescreve o arquivo de dados só com os registros para os quais keep é
+// verdadeiro. Se ctx for cancelado, o arquivo original fica intacto
+func compactDataFile[T any](ctx context.Context, dataFilename string, keep func(offset int64, record T) bool) error {
+	tempFile, err := createTempNear(dataFilename)
+	if err != nil {
+		return err
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+
+	err = InitDataFile(tempFile, int(fixedSize[T]()))
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tempFile)
+	err = ForEachWithOffsetContext(ctx, dataFilename, func(offset int64, record T) error {
+		if !keep(offset, record) {
+			return nil
+		}
+		return writeDataRecord(writer, record)
+	})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+
+	return atomicReplace(tempFilename, dataFilename)
+}
+
+// Registros removidos por Tombstone: os IDs com lápide no índice e os
+// offsets para os quais o índice ainda aponta. Um registro é descartado se o
+// ID tem lápide e nenhuma entrada viva aponta para ele, o que mantém um ID
+// gravado de novo depois da lápide
+type tombstoneSet struct {
+	ids  map[uint32]bool
+	live map[int64]bool
+}
+
+func (t tombstoneSet) covers(id uint32, offset int64) bool {
+	return t.ids[id] && !t.live[offset]
+}
+
+func (t tombstoneSet) empty() bool {
+	return len(t.ids) == 0
+}
+
+func readTombstones(indexFilename string) (tombstoneSet, error) {
+	tombstones := tombstoneSet{ids: make(map[uint32]bool), live: make(map[int64]bool)}
+	err := ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		if entry.Offset == TOMBSTONE_OFFSET {
+			tombstones.ids[entry.ID] = true
+		} else {
+			tombstones.live[entry.Offset] = true
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return tombstones, err
+}
+
+// Descarta os registros com lápide e reconstrói o índice primário. Sem
+// lápides, só o índice é reconstruído
+func compactTombstones[T any](ctx context.Context, dataFilename string, indexFilename string, idOf func(T) uint32) error {
+	tombstones, err := readTombstones(indexFilename)
+	if err != nil {
+		return err
+	}
+	if tombstones.empty() {
+		return RebuildIndex(ctx, dataFilename, indexFilename, idOf)
+	}
+	err = compactDataFile(ctx, dataFilename, func(offset int64, record T) bool {
+		return !tombstones.covers(idOf(record), offset)
+	})
+	if err != nil {
+		return err
+	}
+	return RebuildIndex(context.Background(), dataFilename, indexFilename, idOf)
+}
+
+// Compacta todos os arquivos do diretório segurando a trava. Os IDs não
+// mudam, então as referências de produto para categoria e de evento para
+// produto continuam valendo; só os eventos de produtos inativos, que são
+// descartados, passam a apontar para um ID que não existe mais, como os
+// eventos de UNKNOWN_PRODUCT_ID. Categorias e eventos são removidos
+// fisicamente, então para eles só são descartados os registros com lápide e
+// os índices são reconstruídos. No fim, os
+// índices secundários e os de mais caro são refeitos a partir dos dados
+func CompactAll(ctx context.Context, dir string) error {
+	lock, err := lockStore(dir)
+	if err != nil {
+		return err
+	}
+	return firstError(compactAll(ctx, dir), unlockStore(lock))
+}
+
+func compactAll(ctx context.Context, dir string) error {
+	path := func(filename string) string { return filepath.Join(dir, filename) }
+	exists := func(filename string) bool {
+		_, err := os.Stat(path(filename))
+		return err == nil
+	}
+
+	if exists(PRODUCT_DATA_FILE) {
+		err := compactProducts(ctx, path(PRODUCT_DATA_FILE), path(PRODUCT_INDEX_FILE), path(PRODUCT_METRICS_FILE))
+		if err != nil {
+			return err
+		}
+		err = RebuildMostExpensiveIndexes(path(PRODUCT_DATA_FILE), path(MOST_EXPENSIVE_PRODUCT_FILE), path(MOST_EXPENSIVE_PER_CATEGORY_FILE))
+		if err != nil {
+			return err
+		}
+	}
+	if exists(CATEGORY_DATA_FILE) {
+		err := compactTombstones(ctx, path(CATEGORY_DATA_FILE), path(CATEGORY_INDEX_FILE), categoryID)
+		if err != nil {
+			return err
+		}
+	}
+	if exists(EVENT_DATA_FILE) {
+		err := compactTombstones(ctx, path(EVENT_DATA_FILE), path(EVENT_INDEX_FILE), eventID)
+		if err != nil {
+			return err
+		}
+		err = RebuildIndex(ctx, path(EVENT_DATA_FILE), path(EVENT_USER_INDEX_FILE), func(event Event) uint32 { return event.UserID })
+		if err != nil {
+			return err
+		}
+		return refreshTimeIndex(ctx, path(EVENT_DATA_FILE), path(EVENT_TIME_INDEX_FILE))
+	}
+	return nil
+}
+
+// Refaz do zero o índice do produto mais caro e o de mais caro por
+// categoria, com uma única varredura dos produtos ativos
+func RebuildMostExpensiveIndexes(dataFilename string, mostExpensiveFilename string, perCategoryFilename string) error {
+	var mostExpensiveProduct Product
+	found := false
+	leaders := make(map[uint32]Product)
+	err := ForEach(dataFilename, func(product Product) error {
+		if !product.Active {
+			return nil
+		}
+		if !found || moreExpensive(product, mostExpensiveProduct) {
+			mostExpensiveProduct = product
+			found = true
+		}
+		leader, exists := leaders[product.CategoryID]
+		if !exists || moreExpensive(product, leader) {
+			leaders[product.CategoryID] = product
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = truncateFiles(mostExpensiveFilename, perCategoryFilename)
+	if err != nil {
+		return err
+	}
+	mostExpensiveFile, err := CreateOrOpenFile(mostExpensiveFilename)
+	if err != nil {
+		return err
+	}
+	defer mostExpensiveFile.Close()
+	err = WriteRecordAt(mostExpensiveFile, 0, mostExpensiveProduct)
+	if err != nil {
+		return err
+	}
+
+	categoryIDs := make([]uint32, 0, len(leaders))
+	for id := range leaders {
+		categoryIDs = append(categoryIDs, id)
+	}
+	sort.Slice(categoryIDs, func(i, j int) bool { return categoryIDs[i] < categoryIDs[j] })
+	perCategoryFile, err := CreateOrOpenFile(perCategoryFilename)
+	if err != nil {
+		return err
+	}
+	defer perCategoryFile.Close()
+	offset := int64(0)
+	for _, id := range categoryIDs {
+		err = WriteRecordAt(perCategoryFile, offset, leaders[id])
+		if err != nil {
+			return err
+		}
+		offset += productRecordSize
+	}
+	return nil
+}
+
+// Junta dois arquivos de dados (por exemplo, importações feitas em partes)
+// em dstData, com os registros de srcA seguidos dos de srcB, e reconstrói
+// dstIndex. dstData pode ser um dos arquivos de origem.
+//
+// Um ID que aparece de novo é recusado com ErrDuplicateID se renumber for
+// nil; senão o registro repetido recebe, via renumber, um ID novo a partir
+// do maior ID das duas origens mais um
+func MergeStores[T any](dstData string, dstIndex string, srcA string, srcB string, idOf func(T) uint32, renumber func(*T, uint32)) error {
+	var nextID uint32
+	for _, src := range []string{srcA, srcB} {
+		err := ForEach(src, func(record T) error {
+			if idOf(record) >= nextID {
+				nextID = idOf(record) + 1
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	tempFile, err := createTempNear(dstData)
+	if err != nil {
+		return err
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+
+	err = InitDataFile(tempFile, int(fixedSize[T]()))
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tempFile)
+	seen := make(map[uint32]bool)
+	for _, src := range []string{srcA, srcB} {
+		err = ForEach(src, func(record T) error {
+			if seen[idOf(record)] {
+				if renumber == nil {
+					return fmt.Errorf("%w: %d em %s", ErrDuplicateID, idOf(record), src)
+				}
+				renumber(&record, nextID)
+				nextID++
+			}
+			seen[idOf(record)] = true
+			return writeDataRecord(writer, record)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+
+	err = atomicReplace(tempFilename, dstData)
+	if err != nil {
+		return err
+	}
+	return RebuildIndex(context.Background(), dstData, dstIndex, idOf)
+}
+
+// Atualiza o ProductDataLocation das métricas por produto com o offset atual
+// do índice. Produtos que não estão mais no índice ficam com -1
+func RefreshProductMetricsLocations(filename string, productIndexFilename string) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	recordSize := productMetricsRecordSize
+	for offset := int64(0); ; offset += recordSize {
+		metrics, err := ReadRecordAt[ProductMetrics](file, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		dataOffset, found := BinarySearchOnDisk(productIndexFilename, metrics.ProductID)
+		if !found {
+			dataOffset = -1
+		}
+		metrics.ProductDataLocation = dataOffset
+		err = WriteRecordAt(file, offset, metrics)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Retorna as entradas do índice com ID em [lo, hi], em ordem crescente.
+// A busca binária encontra o primeiro ID >= lo e a leitura segue
+// sequencialmente até passar de hi
+func IndexRange(indexFilename string, lo, hi uint32) ([]IndexEntry, error) {
+	entries := []IndexEntry{}
+	if lo > hi {
+		return entries, nil
+	}
+
+	indexFile, err := os.Open(indexFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer indexFile.Close()
+
+	// Lower bound: primeira posição cujo ID é >= lo
+	left, _, err := lowerBound(indexFile, func(entry IndexEntry) bool { return entry.ID < lo })
+	if err != nil {
+		return nil, err
+	}
+
+	recordSize := indexEntrySize
+	_, err = indexFile.Seek(left*recordSize, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(indexFile)
+	for {
+		var record IndexEntry
+		err = binary.Read(reader, Config.ByteOrder, &record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if record.ID > hi {
+			break
+		}
+		if record.Offset == TOMBSTONE_OFFSET {
+			continue
+		}
+		entries = append(entries, record)
+	}
+	return entries, nil
+}
+func SearchMostExpensiveProduct(secondaryIndexFilename string) (Product, error) {
+	secondaryIndexFile, err := OpenReadOnly(secondaryIndexFilename)
+	if err != nil {
+		return Product{}, err
+	}
+	defer secondaryIndexFile.Close()
+
+	// O arquivo guarda um único registro, sempre no início
+	_, err = secondaryIndexFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return Product{}, err
+	}
+
+	var mostExpensiveProduct Product
+	err = binary.Read(secondaryIndexFile, Config.ByteOrder, &mostExpensiveProduct)
+	if err != nil {
+		return Product{}, fmt.Errorf("erro ao buscar produto mais caro em %s: %w", secondaryIndexFilename, err)
+	}
+	return mostExpensiveProduct, nil
+}
+func RemoveProduct(dataFilename string, primaryIndexFilename string, secondaryIndexFilename string, perCategoryFilename string, id uint32) error {
+
+	offset, found := BinarySearchOnDisk(primaryIndexFilename, id)
+	if !found {
+		return fmt.Errorf("Produto com ID %d não encontrado", id)
+	}
+
+	dataFile, err := OpenDataFile[Product](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	lock := dataLock(dataFilename)
+	lock.Lock()
+	product, err := ReadDataRecordAt[Product](dataFile, offset)
+	wasActive := err == nil && product.Active
+	if wasActive {
+		product.Active = false
+		err = WriteDataRecordAt(dataFile, offset, product)
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if wasActive {
+		secondaryIndexFile, err := CreateOrOpenFile(secondaryIndexFilename)
+		if err != nil {
+			return err
+		}
+		defer secondaryIndexFile.Close()
+		mostExpensiveProduct, err := SearchMostExpensiveProduct(secondaryIndexFilename)
+		if err != nil {
+			return err
+		}
+		if product.ID == mostExpensiveProduct.ID {
+			err = RecalculateMostExpensiveProduct(dataFilename, secondaryIndexFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		leaders, err := MostExpensiveByCategoryFromFile(perCategoryFilename)
+		if err != nil {
+			return err
+		}
+		if leader, exists := leaders[product.CategoryID]; exists && leader.ID == product.ID {
+			return RecalculateMostExpensiveOfCategory(dataFilename, perCategoryFilename, product.CategoryID)
+		}
+	}
+	return nil
+}
+
+// Grava o produto: atualiza no lugar se o ID já estiver no índice, ou
+// acrescenta no fim. Os índices de mais caro são atualizados nos dois casos;
+// se o produto atualizado era o mais caro (geral ou da categoria antiga),
+// eles são recalculados, já que o preço pode ter caído
+func UpsertProduct(dataFilename string, primaryIndexFilename string, secondaryIndexFilename string, perCategoryFilename string, product Product) error {
+	err := checkPrice(&product)
+	if err != nil {
+		return err
+	}
+
+	offset, found := BinarySearchOnDisk(primaryIndexFilename, product.ID)
+	if !found {
+		err := NewFileStore(dataFilename, primaryIndexFilename, productID).Add(product)
+		if err != nil {
+			return err
+		}
+		err = UpdateMostExpensiveProductIndex(secondaryIndexFilename, product)
+		if err != nil {
+			return err
+		}
+		return UpdateMostExpensivePerCategoryIndex(perCategoryFilename, product)
+	}
+
+	dataFile, err := OpenDataFile[Product](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	lock := dataLock(dataFilename)
+	lock.Lock()
+	old, err := ReadDataRecordAt[Product](dataFile, offset)
+	if err == nil {
+		err = WriteDataRecordAt(dataFile, offset, product)
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	secondaryIndexFile, err := CreateOrOpenFile(secondaryIndexFilename)
+	if err != nil {
+		return err
+	}
+	defer secondaryIndexFile.Close()
+	mostExpensiveProduct, err := ReadRecordAt[Product](secondaryIndexFile, 0)
+	if err == nil && mostExpensiveProduct.ID == product.ID {
+		err = RecalculateMostExpensiveProduct(dataFilename, secondaryIndexFile)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = UpdateMostExpensiveProductIndex(secondaryIndexFilename, product)
+		if err != nil {
+			return err
+		}
+	}
+
+	leaders, err := MostExpensiveByCategoryFromFile(perCategoryFilename)
+	if err != nil {
+		return err
+	}
+	if leader, exists := leaders[old.CategoryID]; exists && leader.ID == old.ID {
+		err = RecalculateMostExpensiveOfCategory(dataFilename, perCategoryFilename, old.CategoryID)
+		if err != nil {
+			return err
+		}
+	}
+	return UpdateMostExpensivePerCategoryIndex(perCategoryFilename, product)
+}
+
+// Desfaz RemoveProduct: marca o produto como ativo de novo, no mesmo lugar,
+// e o recoloca nos índices de mais caro se ele passar o atual
+func ReactivateProduct(dataFilename string, primaryIndexFilename string, secondaryIndexFilename string, perCategoryFilename string, id uint32) error {
+	offset, found := BinarySearchOnDisk(primaryIndexFilename, id)
+	if !found {
+		return fmt.Errorf("Produto com ID %d não encontrado", id)
+	}
+
+	dataFile, err := OpenDataFile[Product](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	lock := dataLock(dataFilename)
+	lock.Lock()
+	product, err := ReadDataRecordAt[Product](dataFile, offset)
+	if err == nil && product.Active {
+		err = fmt.Errorf("%w: %d", ErrAlreadyActive, id)
+	} else if err == nil {
+		product.Active = true
+		err = WriteDataRecordAt(dataFile, offset, product)
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	err = UpdateMostExpensiveProductIndex(secondaryIndexFilename, product)
+	if err != nil {
+		return err
+	}
+	return UpdateMostExpensivePerCategoryIndex(perCategoryFilename, product)
+}
+
+// Ordem usada por todos os índices de mais caro: o maior preço e, no
+// empate, o menor ID. Assim o resultado não depende da ordem dos registros
+// no arquivo, e uma atualização incremental escolhe o mesmo produto que um
+// recálculo do zero
+func moreExpensive(product Product, than Product) bool {
+	if product.Price != than.Price {
+		return product.Price > than.Price
+	}
+	return product.ID < than.ID
+}
+
+// O primeiro produto ativo é o ponto de partida, e não um produto zerado,
+// para que um produto de preço 0 também possa ser o mais caro. Sem produtos
+// ativos, o registro gravado é o valor zero, com Active falso
+func RecalculateMostExpensiveProduct(productFilename string, secondaryIndexFile *os.File) error {
+	var mostExpensiveProduct Product
+	found := false
+
+	err := ForEach(productFilename, func(product Product) error {
+		if product.Active && (!found || moreExpensive(product, mostExpensiveProduct)) {
+			mostExpensiveProduct = product
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("erro ao ler arquivo de produtos: %w", err)
+	}
+
+	// Trunca antes de gravar para o arquivo conter sempre um único produto
+	err = secondaryIndexFile.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("não foi possível truncar o arquivo do produto mais caro: %w", err)
+	}
+	err = WriteRecordAt(secondaryIndexFile, 0, mostExpensiveProduct)
+	if err != nil {
+		return fmt.Errorf("não foi possível atualizar o produto mais caro: %w", err)
+	}
+	logger.Debug("produto mais caro recalculado", "id", mostExpensiveProduct.ID, "preco", mostExpensiveProduct.Price)
+	return nil
+}
+func UpdateMostExpensiveProductIndex(secondaryIndexFilename string, product Product) error {
+	secondaryIndexFile, err := CreateOrOpenFile(secondaryIndexFilename)
+	if err != nil {
+		return err
+	}
+	defer secondaryIndexFile.Close()
+
+	if !product.Active {
+		return nil
+	}
+
+	mostExpensiveProduct, err := ReadRecordAt[Product](secondaryIndexFile, 0)
+	if err == nil {
+		logger.Debug("comparando com o produto mais caro", "id", product.ID, "preco", product.Price, "mais_caro", mostExpensiveProduct.Price)
+		if !mostExpensiveProduct.Active || moreExpensive(product, mostExpensiveProduct) {
+			err = WriteRecordAt(secondaryIndexFile, 0, product)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		err = WriteRecordAt(secondaryIndexFile, 0, product)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Guarda um produto por categoria: o mais caro entre os ativos dela
+func UpdateMostExpensivePerCategoryIndex(filename string, product Product) error {
+	if !product.Active {
+		return nil
+	}
+
+	file, err := CreateOrOpenFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	recordSize := productRecordSize
+	offset := int64(0)
+	for {
+		categoryLeader, err := ReadRecordAt[Product](file, offset)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if categoryLeader.CategoryID == product.CategoryID {
+			if moreExpensive(product, categoryLeader) {
+				return WriteRecordAt(file, offset, product)
+			}
+			return nil
+		}
+		offset += recordSize
+	}
+
+	// Primeiro produto ativo da categoria
+	return WriteRecordAt(file, offset, product)
+}
+
+// Recalcula apenas a categoria informada, varrendo o arquivo de dados.
+// Se a categoria não tiver mais produtos ativos, ela sai do índice
+func RecalculateMostExpensiveOfCategory(dataFilename string, filename string, categoryID uint32) error {
+	var categoryLeader Product
+	found := false
+	err := ForEach(dataFilename, func(product Product) error {
+		if product.Active && product.CategoryID == categoryID {
+			if !found || moreExpensive(product, categoryLeader) {
+				categoryLeader = product
+				found = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	leaders, err := MostExpensiveByCategoryFromFile(filename)
+	if err != nil {
+		return err
+	}
+	if found {
+		leaders[categoryID] = categoryLeader
+	} else {
+		delete(leaders, categoryID)
+	}
+
+	file, err := CreateOrOpenFile(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	// Em ordem de categoria, para o arquivo não depender da ordem do map
+	categoryIDs := make([]uint32, 0, len(leaders))
+	for id := range leaders {
+		categoryIDs = append(categoryIDs, id)
+	}
+	sort.Slice(categoryIDs, func(i, j int) bool { return categoryIDs[i] < categoryIDs[j] })
+	recordSize := productRecordSize
+	offset := int64(0)
+	for _, id := range categoryIDs {
+		err = WriteRecordAt(file, offset, leaders[id])
+		if err != nil {
+			return err
+		}
+		offset += recordSize
+	}
+	return nil
+}
+
+func MostExpensiveByCategoryFromFile(filename string) (map[uint32]Product, error) {
+	leaders := make(map[uint32]Product)
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return leaders, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		var product Product
+		err = binary.Read(reader, Config.ByteOrder, &product)
+		if err == io.EOF {
+			return leaders, nil
+		} else if err != nil {
+			return nil, err
+		}
+		leaders[product.CategoryID] = product
+	}
+}
+
+// Produto ativo mais caro de cada categoria, indexado por CategoryID
+func MostExpensiveByCategory() (map[uint32]Product, error) {
+	return MostExpensiveByCategoryFromFile(MOST_EXPENSIVE_PER_CATEGORY_FILE)
+}
+
+// Percorre todos os registros do arquivo de dados em ordem, chamando fn para
+// cada um. O cabeçalho é conferido antes e pulado. Um erro retornado por fn
+// interrompe a varredura e é repassado, exceto errStopScan, que apenas
+// encerra a varredura
+func ForEach[T any](filename string, fn func(T) error) error {
+	return ForEachContext(context.Background(), filename, fn)
+}
+
+// A cada quantos registros as varreduras longas conferem se o contexto foi
+// cancelado
+const CANCEL_CHECK_EVERY = 1000
+
+// Como ForEach, mas para com ctx.Err() se o contexto for cancelado. Os
+// registros já entregues a fn continuam entregues
+func ForEachContext[T any](ctx context.Context, filename string, fn func(T) error) error {
+	return ForEachWithOffsetContext(ctx, filename, func(offset int64, record T) error {
+		return fn(record)
+	})
+}
+
+// Como ForEach, passando também o offset do registro no arquivo, o mesmo
+// que fica no índice primário
+func ForEachWithOffset[T any](filename string, fn func(offset int64, record T) error) error {
+	return ForEachWithOffsetContext(context.Background(), filename, fn)
+}
+
+func ForEachWithOffsetContext[T any](ctx context.Context, filename string, fn func(offset int64, record T) error) error {
+	scanner, err := NewRecordScanner[T](filename)
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	for count := 0; scanner.Scan(); count++ {
+		if count%CANCEL_CHECK_EVERY == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		err = fn(scanner.Offset(), scanner.Record())
+		if err == errStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Registros do arquivo de dados para os quais pred retorna true, na ordem do
+// arquivo. Registros inativos também passam por pred, que decide se entram
+func Filter[T any](filename string, pred func(T) bool) ([]T, error) {
+	records := []T{}
+	err := ForEach(filename, func(record T) error {
+		if pred(record) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Acumula todos os registros do arquivo de dados numa única passada, sem
+// guardar os registros: acc começa em init e vira fn(acc, registro) a cada
+// registro, na ordem do arquivo. Registros inativos também passam por fn
+func Reduce[T, A any](filename string, init A, fn func(A, T) A) (A, error) {
+	acc := init
+	err := ForEach(filename, func(record T) error {
+		acc = fn(acc, record)
+		return nil
+	})
+	if err != nil {
+		return init, err
+	}
+	return acc, nil
+}
+
+// Soma dos preços dos produtos ativos
+func InventoryValue(dataFilename string) (float64, error) {
+	return Reduce(dataFilename, 0.0, func(total float64, product Product) float64 {
+		if product.Active {
+			return total + float64(product.Price)
+		}
+		return total
+	})
+}
+
+// Leitura sequencial de um arquivo de dados no estilo de bufio.Scanner:
+//
+//	scanner, err := NewRecordScanner[Product](PRODUCT_DATA_FILE)
+//	...
+//	defer scanner.Close()
+//	for scanner.Scan() {
+//		product := scanner.Record()
+//	}
+//	err = scanner.Err()
+type RecordScanner[T any] struct {
+	file   *os.File
+	reader *bufio.Reader
+	record T
+	offset int64
+	err    error
+}
+
+// Abre o arquivo e confere o cabeçalho. Um arquivo vazio, ainda sem
+// cabeçalho, não tem registros
+func NewRecordScanner[T any](filename string) (*RecordScanner[T], error) {
+	file, err := OpenReadOnly(filename)
+	if err != nil {
+		return nil, err
+	}
+	scanner := &RecordScanner[T]{
+		file:   file,
+		reader: bufio.NewReader(file),
+		offset: dataHeaderSize,
+	}
+
+	var header FileHeader
+	err = binary.Read(scanner.reader, binary.LittleEndian, &header)
+	if err == io.EOF {
+		scanner.err = io.EOF
+		return scanner, nil
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+	err = checkDataFileHeader(filename, header, int(fixedSize[T]()))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return scanner, nil
+}
+
+// Avança para o próximo registro. Retorna false no fim do arquivo ou no
+// primeiro erro, que fica disponível em Err
+func (s *RecordScanner[T]) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+
+	record, err := readDataRecord[T](s.reader)
+	if err == ErrCorruptRecord {
+		err = fmt.Errorf("%w: %s, offset %d", ErrCorruptRecord, s.file.Name(), s.offset)
+	}
+	if err != nil {
+		s.err = err
+		return false
+	}
+	s.record = record
+	s.offset += dataRecordSize[T]()
+	return true
+}
+
+// Registro lido pelo último Scan bem-sucedido
+func (s *RecordScanner[T]) Record() T {
+	return s.record
+}
+
+// Offset no arquivo do registro lido pelo último Scan bem-sucedido
+func (s *RecordScanner[T]) Offset() int64 {
+	return s.offset - dataRecordSize[T]()
+}
+
+// Primeiro erro encontrado; o fim do arquivo não é erro
+func (s *RecordScanner[T]) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+func (s *RecordScanner[T]) Close() error {
+	return s.file.Close()
+}
+
+// Menor, maior, média e mediana dos preços dos produtos ativos. A mediana
+// precisa dos preços ordenados, então eles ficam em memória
+func PriceStats(dataFilename string) (min, max, mean float32, median float32, err error) {
+	prices := []float32{}
+	sum := 0.0
+	err = ForEach(dataFilename, func(product Product) error {
+		if product.Active {
+			prices = append(prices, product.Price)
+			sum += float64(product.Price)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if len(prices) == 0 {
+		return 0, 0, 0, 0, ErrNoActiveProducts
+	}
+
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+	middle := len(prices) / 2
+	if len(prices)%2 == 0 {
+		median = (prices[middle-1] + prices[middle]) / 2
+	} else {
+		median = prices[middle]
+	}
+
+	return prices[0], prices[len(prices)-1], float32(sum / float64(len(prices))), median, nil
+}
+
+// Preço médio dos produtos ativos de cada categoria, numa única passada.
+// Categorias sem produtos ativos ficam fora do map
+func AveragePriceByCategory(dataFilename string) (map[uint32]float32, error) {
+	sums := make(map[uint32]float64)
+	counts := make(map[uint32]int)
+	err := ForEach(dataFilename, func(product Product) error {
+		if product.Active {
+			sums[product.CategoryID] += float64(product.Price)
+			counts[product.CategoryID]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	averages := make(map[uint32]float32)
+	for categoryID, sum := range sums {
+		averages[categoryID] = float32(sum / float64(counts[categoryID]))
+	}
+	return averages, nil
+}
+
+// Produto encontrado numa consulta junto com o offset dele no arquivo de
+// dados, para atualizar no lugar com WriteDataRecordAt sem buscar no índice
+type ProductHit struct {
+	Product Product
+	Offset  int64
+}
+
+// Produtos ativos com preço entre min e max (inclusive), na ordem do arquivo
+func QueryProductHitsByPriceRange(dataFilename string, min, max float32) ([]ProductHit, error) {
+	hits := []ProductHit{}
+	err := ForEachWithOffset(dataFilename, func(offset int64, product Product) error {
+		if product.Active && product.Price >= min && product.Price <= max {
+			hits = append(hits, ProductHit{Product: product, Offset: offset})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hits, nil
+}
+
+func QueryProductsByPriceRange(dataFilename string, min, max float32) ([]Product, error) {
+	return Filter(dataFilename, func(product Product) bool {
+		return product.Active && product.Price >= min && product.Price <= max
+	})
+}
+
+type BrandCount struct {
+	Brand string
+	Count int
+}
+
+// As n marcas com mais produtos ativos, em ordem decrescente de quantidade,
+// com empates resolvidos pelo nome. Produtos sem marca não entram na conta
+func TopBrands(dataFilename string, n int) ([]BrandCount, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("quantidade inválida: %d", n)
+	}
+
+	counts := make(map[string]int)
+	err := ForEach(dataFilename, func(product Product) error {
+		brand := strings.TrimSpace(ByteArrayToString(product.Brand[:]))
+		if product.Active && brand != "" {
+			counts[brand]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	brands := make([]BrandCount, 0, len(counts))
+	for brand, count := range counts {
+		brands = append(brands, BrandCount{Brand: brand, Count: count})
+	}
+	sort.Slice(brands, func(i, j int) bool {
+		if brands[i].Count != brands[j].Count {
+			return brands[i].Count > brands[j].Count
+		}
+		return brands[i].Brand < brands[j].Brand
+	})
+
+	if n < len(brands) {
+		brands = brands[:n]
+	}
+	return brands, nil
+}
+
+// Como ForEach, mas do último registro para o primeiro, voltando um registro
+// por vez. Útil para listar eventos do mais recente para o mais antigo
+func ForEachReverse[T any](filename string, fn func(T) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() == 0 {
+		return nil
+	}
+
+	recordSize := dataRecordSize[T]()
+	header, err := readAt[FileHeader](file, 0, binary.LittleEndian)
+	if err != nil {
+		return err
+	}
+	err = checkDataFileHeader(filename, header, int(fixedSize[T]()))
+	if err != nil {
+		return err
+	}
+
+	dataSize := fileInfo.Size() - dataHeaderSize
+	if dataSize%recordSize != 0 {
+		return fmt.Errorf("%s tem %d bytes de registros, que não é múltiplo do tamanho do registro (%d)",
+			filename, dataSize, recordSize)
+	}
+
+	for offset := fileInfo.Size() - recordSize; offset >= dataHeaderSize; offset -= recordSize {
+		record, err := ReadDataRecordAt[T](file, offset)
+		if err != nil {
+			return err
+		}
+
+		err = fn(record)
+		if err == errStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Função genérica para retornar o tamanho de uma struct
+// o go não permite consultar binary.Sizeof() de um tipo
+// não concreto
+func SizeOf[T any](value T) (int, error) {
+	return binary.Size(value), nil
+}
+
+// Cria um arquivo temporário com nome único no mesmo diretório de target,
+// para que o Rename final fique no mesmo sistema de arquivos e seja atômico
+func createTempNear(target string) (*os.File, error) {
+	file, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+
+	// CreateTemp usa 0600; o arquivo final deve ter a mesma permissão dos demais
+	err = file.Chmod(0644)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// Substitui target por temp. O Rename sobre o arquivo existente é atômico
+// em POSIX, então target nunca deixa de existir; depois o diretório é
+// sincronizado para que a troca sobreviva a uma queda de energia
+func atomicReplace(temp string, target string) error {
+	file, err := os.OpenFile(temp, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temp, target)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(target))
+}
+
+func RemoveProductFromDataFile[T any](dataFilename string, offsetToRemove int64, dataType T) error {
+	dataFile, err := OpenDataFile[T](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	// Arquivo temporário para reorganizar os dados, com o mesmo cabeçalho
+	tempDataFile, err := createTempNear(dataFilename)
+	if err != nil {
+		return err
+	}
+	tempFilename := tempDataFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempDataFile.Close()
+
+	err = InitDataFile(tempDataFile, int(fixedSize[T]()))
+	if err != nil {
+		return err
+	}
+	_, err = tempDataFile.Seek(dataHeaderSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = dataFile.Seek(dataHeaderSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	// Tamanho do registro no arquivo, com o checksum
+	recordSize := dataRecordSize[T]()
+
+	// Percorre o arquivo atual
+	currentOffset := dataHeaderSize
+	for {
+		product, err := readDataRecord[T](dataFile)
+		if err == io.EOF {
+			break // Fim do arquivo
+		} else if err != nil {
+			return err
+		}
+
+		// Será removido apenas o registro com offset igual ao procurado, o restante será copiado para o arquivo temporário
+		if currentOffset != offsetToRemove {
+			err = writeDataRecord(tempDataFile, product)
+			if err != nil {
+				return err
+			}
+		}
+		currentOffset += recordSize
+	}
+
+	tempDataFile.Close()
+	dataFile.Close()
+
+	return atomicReplace(tempFilename, dataFilename)
+}
+
+func RemoveFromIndexFile(indexFilename string, idToRemove uint32) error {
+	indexFile, err := CreateOrOpenFile(indexFilename)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	tempIndexFile, err := createTempNear(indexFilename)
+	if err != nil {
+		return err
+	}
+	tempFilename := tempIndexFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempIndexFile.Close()
+
+	for {
+		var indexEntry IndexEntry
+
+		err := binary.Read(indexFile, Config.ByteOrder, &indexEntry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if indexEntry.ID != idToRemove {
+			err = binary.Write(tempIndexFile, Config.ByteOrder, indexEntry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tempIndexFile.Close()
+	indexFile.Close()
+
+	return atomicReplace(tempFilename, indexFilename)
+}
+
+// O que RemoveByID faria com os arquivos, sem alterá-los
+type RemovalPlan struct {
+	Found        bool
+	Offset       int64
+	DataSize     int64
+	NewDataSize  int64
+	IndexSize    int64
+	NewIndexSize int64
+}
+
+// Simula RemoveByID: procura o ID e calcula os tamanhos esperados dos
+// arquivos depois da remoção. Nenhum arquivo é criado ou modificado
+func PlanRemoval[T any](indexFilename string, dataFilename string, itemID uint32) (RemovalPlan, error) {
+	var plan RemovalPlan
+	var err error
+
+	plan.DataSize, err = fileSize(dataFilename)
+	if err != nil {
+		return plan, err
+	}
+	plan.IndexSize, err = fileSize(indexFilename)
+	if err != nil {
+		return plan, err
+	}
+	plan.NewDataSize = plan.DataSize
+	plan.NewIndexSize = plan.IndexSize
+
+	plan.Offset, plan.Found = BinarySearchOnDisk(indexFilename, itemID)
+	if !plan.Found {
+		return plan, nil
+	}
+	plan.NewDataSize -= dataRecordSize[T]()
+	plan.NewIndexSize -= indexEntrySize
+	return plan, nil
+}
+
+func RemoveByID[T any](indexFilename string, dataFilename string, itemID uint32, dataType T) error {
+	indexFile, err := CreateOrOpenFile(indexFilename)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	offset, found := BinarySearchOnDisk(indexFilename, itemID)
+	if !found {
+		return fmt.Errorf("ID %d em %s: %w", itemID, indexFilename, os.ErrNotExist)
+	}
+	err = RemoveProductFromDataFile(dataFilename, offset, dataType)
+	if err != nil {
+		return fmt.Errorf("não foi possível remover registro do arquivo de dados: %w", err)
+	}
+
+	err = RemoveFromIndexFile(indexFilename, itemID)
+	if err != nil {
+		return fmt.Errorf("não foi possível remover registro do arquivo de índices: %w", err)
+	}
+
+	// Os registros depois do removido foram puxados um registro para trás
+	return ShiftIndexOffsets(indexFilename, offset, -dataRecordSize[T]())
+}
+
+// Marca a entrada do ID como lápide, sem mexer no arquivo de dados, e
+// retorna o offset para o qual ela apontava
+func TombstoneByID(indexFilename string, id uint32) (int64, error) {
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer indexFile.Close()
+
+	position, entry, found, err := liveEntryPosition(indexFile, id)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("ID %d não encontrado em %s", id, indexFilename)
+	}
+	err = WriteRecordAt(indexFile, position, IndexEntry{ID: id, Offset: TOMBSTONE_OFFSET})
+	if err != nil {
+		return 0, err
+	}
+	return entry.Offset, nil
+}
+
+// Marca como lápide as entradas de um índice secundário que apontam para
+// offset
+func tombstoneOffset(indexFilename string, offset int64) error {
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	for position := int64(0); ; position += indexEntrySize {
+		entry, err := ReadRecordAt[IndexEntry](indexFile, position)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if entry.Offset == offset {
+			entry.Offset = TOMBSTONE_OFFSET
+			err = WriteRecordAt(indexFile, position, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Soma delta ao offset de todas as entradas do índice que apontam para depois
+// de afterOffset
+func ShiftIndexOffsets(indexFilename string, afterOffset int64, delta int64) error {
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	recordSize := indexEntrySize
+	for position := int64(0); ; position += recordSize {
+		entry, err := ReadRecordAt[IndexEntry](indexFile, position)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if entry.Offset > afterOffset {
+			entry.Offset += delta
+			err = WriteRecordAt(indexFile, position, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// O que fazer com os produtos de uma categoria que está sendo removida
+type OrphanPolicy struct {
+	reassign bool
+	newID    uint32
+}
+
+// Recusa a remoção se algum produto ativo ainda usa a categoria
+var RejectIfReferenced = OrphanPolicy{}
+
+// Move todos os produtos da categoria removida para a categoria newID
+func ReassignTo(newID uint32) OrphanPolicy {
+	return OrphanPolicy{reassign: true, newID: newID}
+}
+
+func RemoveCategory(id uint32, onOrphans OrphanPolicy) error {
+	_, found := BinarySearchOnDisk(CATEGORY_INDEX_FILE, id)
+	if !found {
+		return fmt.Errorf("Categoria com ID %d não encontrada", id)
+	}
+
+	if onOrphans.reassign {
+		if onOrphans.newID == id {
+			return fmt.Errorf("não é possível reatribuir produtos à própria categoria %d", id)
+		}
+		_, found = BinarySearchOnDisk(CATEGORY_INDEX_FILE, onOrphans.newID)
+		if !found {
+			return fmt.Errorf("Categoria com ID %d não encontrada", onOrphans.newID)
+		}
+
+		err := reassignProductsCategory(PRODUCT_DATA_FILE, id, onOrphans.newID)
+		if err != nil {
+			return err
+		}
+		err = RecalculateMostExpensiveOfCategory(PRODUCT_DATA_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, onOrphans.newID)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := ForEach(PRODUCT_DATA_FILE, func(product Product) error {
+			if product.Active && product.CategoryID == id {
+				return fmt.Errorf("%w: categoria %d, produto %d", ErrCategoryInUse, id, product.ID)
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err := RecalculateMostExpensiveOfCategory(PRODUCT_DATA_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return Categories.Remove(id)
+}
+
+// Troca, no próprio arquivo, o CategoryID de todos os produtos da categoria
+// from para to, incluindo os inativos
+func reassignProductsCategory(dataFilename string, from uint32, to uint32) error {
+	dataFile, err := OpenDataFile[Product](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	recordSize := dataRecordSize[Product]()
+	for offset := dataHeaderSize; ; offset += recordSize {
+		product, err := ReadDataRecordAt[Product](dataFile, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if product.CategoryID == from {
+			product.CategoryID = to
+			err = WriteDataRecordAt(dataFile, offset, product)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// O que fazer com os eventos de um produto renumerado
+type EventPolicy struct {
+	cascade bool
+}
+
+// Os eventos continuam com o ID antigo, que deixa de existir
+var KeepEvents = EventPolicy{}
+
+// Os eventos passam a apontar para o novo ID
+var CascadeToEvents = EventPolicy{cascade: true}
+
+// Troca o ID de um produto: o registro é alterado no lugar e a entrada do
+// índice muda de ID e de posição, para que o índice continue ordenado. As
+// métricas, o mapa de IDs do CSV e os índices de mais caro acompanham a
+// troca; os eventos, só com CascadeToEvents. Retorna ErrDuplicateID se
+// newID já existir
+func RenumberProduct(oldID, newID uint32, onEvents EventPolicy) error {
+	if oldID == newID {
+		return nil
+	}
+	if newID > Products.MaxID() {
+		return fmt.Errorf("ID %d reservado: o maior ID de produto é %d", newID, Products.MaxID())
+	}
+	_, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, newID)
+	if found {
+		return fmt.Errorf("%w: %d em %s", ErrDuplicateID, newID, PRODUCT_INDEX_FILE)
+	}
+
+	err := renumberProductRecord(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, oldID, newID)
+	if err != nil {
+		return err
+	}
+	err = renumberProductMetrics(PRODUCT_METRICS_FILE, oldID, newID)
+	if err != nil {
+		return err
+	}
+	err = renumberExternalID(EXTERNAL_ID_MAP_FILE, EXTERNAL_PRODUCT, oldID, newID)
+	if err != nil {
+		return err
+	}
+	err = RebuildMostExpensiveIndexes(PRODUCT_DATA_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE)
+	if err != nil {
+		return err
+	}
+	if onEvents.cascade {
+		return reassignEventsProduct(EVENT_DATA_FILE, oldID, newID)
+	}
+	return nil
+}
+
+// Troca o ID no registro e no índice com a trava do arquivo de dados, para
+// que um Get não veja um sem o outro
+func renumberProductRecord(dataFilename string, indexFilename string, oldID, newID uint32) error {
+	lock := dataLock(dataFilename)
+	lock.Lock()
+	defer lock.Unlock()
+
+	offset, found := BinarySearchOnDisk(indexFilename, oldID)
+	if !found {
+		return fmt.Errorf("Produto com ID %d não encontrado", oldID)
+	}
+
+	dataFile, err := OpenDataFile[Product](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+	product, err := ReadDataRecordAt[Product](dataFile, offset)
+	if err != nil {
+		return err
+	}
+	product.ID = newID
+	err = WriteDataRecordAt(dataFile, offset, product)
+	if err != nil {
+		return err
+	}
+	return renumberIndexEntry(indexFilename, offset, newID)
+}
+
+// Troca o ID da entrada que aponta para offset e reordena o índice num
+// temporário que depois substitui o original. As lápides ficam como estão
+func renumberIndexEntry(indexFilename string, offset int64, newID uint32) error {
+	entries := []IndexEntry{}
+	err := ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		if entry.Offset == offset {
+			entry.ID = newID
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	tempFile, err := createTempNear(indexFilename)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tempFile)
+	for _, entry := range entries {
+		err = binary.Write(writer, Config.ByteOrder, entry)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	tempFile.Close()
+	if err == nil {
+		err = atomicReplace(tempFile.Name(), indexFilename)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	bloomAdd(indexFilename, newID)
+	return nil
+}
+
+func renumberProductMetrics(filename string, oldID, newID uint32) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for offset := int64(0); ; offset += productMetricsRecordSize {
+		metrics, err := ReadRecordAt[ProductMetrics](file, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if metrics.ProductID == oldID {
+			metrics.ProductID = newID
+			return WriteRecordAt(file, offset, metrics)
+		}
+	}
+}
+
+// Faz o ID do CSV que levava a oldID levar a newID, para que importar o
+// mesmo CSV de novo não crie outro registro
+func renumberExternalID(filename string, kind ExternalKind, oldID, newID uint32) error {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for offset := int64(0); ; offset += externalIDRecordSize {
+		entry, err := ReadRecordAt[ExternalIDEntry](file, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if entry.Kind == kind && entry.ID == oldID {
+			entry.ID = newID
+			err = WriteRecordAt(file, offset, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Como reassignProductsCategory, para o ProductID dos eventos
+func reassignEventsProduct(dataFilename string, from uint32, to uint32) error {
+	dataFile, err := OpenDataFile[Event](dataFilename)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	recordSize := dataRecordSize[Event]()
+	for offset := dataHeaderSize; ; offset += recordSize {
+		event, err := ReadDataRecordAt[Event](dataFile, offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if event.ProductID == from {
+			event.ProductID = to
+			err = WriteDataRecordAt(dataFile, offset, event)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Pula os offset primeiros produtos ativos e retorna até limit produtos,
+// parando de ler o arquivo assim que a página estiver completa
+func ListProducts(dataFilename string, offset, limit int) ([]Product, error) {
+	products := []Product{}
+	if limit <= 0 {
+		return products, nil
+	}
+
+	skipped := 0
+	err := ForEach(dataFilename, func(product Product) error {
+		if !product.Active {
+			return nil
+		}
+		if skipped < offset {
+			skipped++
+			return nil
+		}
+
+		products = append(products, product)
+		if len(products) == limit {
+			return errStopScan
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return products, nil
+}
+
+// Produtos removidos com RemoveProduct que ainda ocupam espaço no arquivo,
+// ou seja, o que Compact vai apagar
+func ListDeletedProducts(dataFilename string) ([]Product, error) {
+	return Filter(dataFilename, func(product Product) bool {
+		return !product.Active
+	})
+}
+
+type Alignment uint8
+
+const (
+	ALIGN_LEFT Alignment = iota
+	ALIGN_RIGHT
+)
+
+var ErrUnknownField = errors.New("campo inexistente no registro")
+
+// Um campo da exportação em largura fixa: Name é o nome do campo na struct
+// do registro e Width a largura em caracteres na linha
+type FieldSpec struct {
+	Name  string
+	Width int
+	Align Alignment
+}
+
+// Exporta todos os registros, inclusive os inativos, uma linha por
+// registro, com cada campo completado com espaços até Width. Campos maiores
+// que Width são cortados; nesse caso o arquivo é gravado inteiro e o erro
+// retornado é ErrTruncated
+func ExportFixedWidth[T any](dataFilename string, outPath string, spec []FieldSpec) error {
+	_, err := fixedWidthFields[T](spec)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	err = ExportFixedWidthTo[T](dataFilename, outFile, spec)
+	if errors.Is(err, ErrTruncated) {
+		return firstError(outFile.Sync(), fmt.Errorf("%s: %w", outPath, err))
+	} else if err != nil {
+		return err
+	}
+	return outFile.Sync()
+}
+
+// Como ExportFixedWidth, escrevendo em w. Os registros são lidos e escritos
+// um de cada vez
+func ExportFixedWidthTo[T any](dataFilename string, w io.Writer, spec []FieldSpec) error {
+	fields, err := fixedWidthFields[T](spec)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(w)
+
+	truncated := 0
+	err = ForEach(dataFilename, func(record T) error {
+		value := reflect.ValueOf(record)
+		for i, field := range spec {
+			text := []rune(fixedWidthText(value.Field(fields[i])))
+			if len(text) > field.Width {
+				text = text[:field.Width]
+				truncated++
+			}
+			padding := strings.Repeat(" ", field.Width-len(text))
+			if field.Align == ALIGN_RIGHT {
+				writer.WriteString(padding + string(text))
+			} else {
+				writer.WriteString(string(text) + padding)
+			}
+		}
+		_, err := writer.WriteString("\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	if truncated > 0 {
+		return fmt.Errorf("%w: %d campos cortados", ErrTruncated, truncated)
+	}
+	return nil
+}
+
+// Posição na struct do registro de cada campo de spec
+func fixedWidthFields[T any](spec []FieldSpec) ([]int, error) {
+	recordType := reflect.TypeOf(*new(T))
+	fields := make([]int, len(spec))
+	for i, field := range spec {
+		structField, ok := recordType.FieldByName(field.Name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s.%s", ErrUnknownField, recordType.Name(), field.Name)
+		}
+		fields[i] = structField.Index[0]
+	}
+	return fields, nil
+}
+
+// Registros entre as descargas do csv.Writer em ExportCSV. A descarga
+// também confere o erro de escrita, para que um destino que falhou (um pipe
+// fechado, um disco cheio) interrompa a varredura em vez de ela seguir até
+// o fim do arquivo
+const EXPORT_FLUSH_EVERY = 1000
+
+// Exporta todos os registros, inclusive os inativos, como CSV: um cabeçalho
+// com os nomes dos campos e uma linha por registro, com os valores escritos
+// como em ExportFixedWidth. Nenhum slice com os registros é montado: cada um
+// é lido e escrito antes do próximo, então a memória usada não depende do
+// tamanho do arquivo
+func ExportCSV[T any](dataFilename string, w io.Writer) error {
+	recordType := reflect.TypeOf(*new(T))
+	header := make([]string, recordType.NumField())
+	for i := range header {
+		header[i] = recordType.Field(i).Name
+	}
+
+	writer := csv.NewWriter(w)
+	err := writer.Write(header)
+	if err != nil {
+		return err
+	}
+	row := make([]string, len(header))
+	written := 0
+	err = ForEach(dataFilename, func(record T) error {
+		value := reflect.ValueOf(record)
+		for i := range row {
+			row[i] = fixedWidthText(value.Field(i))
+		}
+		err := writer.Write(row)
+		if err != nil {
+			return err
+		}
+		written++
+		if written%EXPORT_FLUSH_EVERY == 0 {
+			writer.Flush()
+			return writer.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Texto de um campo do registro: arrays de bytes como ByteArrayToString e
+// preços com duas casas, como em printProduct
+func fixedWidthText(field reflect.Value) string {
+	switch field.Kind() {
+	case reflect.Array:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			raw := make([]byte, field.Len())
+			reflect.Copy(reflect.ValueOf(raw), field)
+			return ByteArrayToString(raw)
+		}
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(field.Float(), 'f', 2, 64)
+	}
+	return fmt.Sprint(field.Interface())
+}
+func PrintAllProducts(filename string) error {
+	err := ForEach(filename, func(product Product) error {
+		if product.Active {
+			fmt.Printf(
+				"{ID: %d, CategoryID: %d, Brand: %s, Price: %.2f}\n",
+				product.ID,
+				product.CategoryID,
+				product.Brand,
+				product.Price,
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("não foi possível ler o arquivo: %w", err)
+	}
+	return nil
+}
+func PrintAllCategorys(filename string) error {
+	err := ForEach(filename, func(category Category) error {
+		fmt.Printf("{ID: %d, Name: %s}\n", category.ID, category.Name)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("não foi possível ler o arquivo: %w", err)
+	}
+	return nil
+}
+func PrintAllEvents(filename string) error {
+	err := ForEach(filename, func(event Event) error {
+		fmt.Printf("{ID: %d, UserSession: %s, UserID: %d, ProductID: %d, EventAction: %s, EventTime: %s}\n",
+			event.ID,
+			event.UserSession,
+			event.UserID,
+			event.ProductID,
+			getActionName(event.EventAction),
+			FormatEventTime(event.EventTime),
+		)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("não foi possível ler o arquivo: %w", err)
+	}
+	return nil
+}
+
+// Lê o último registro do arquivo de dados, ou nil se não houver registros
+// ou se o arquivo ainda não existir
+func ReadLastRecord[T any](dataFilename string) (*T, error) {
+	dataFile, err := OpenDataFileReadOnly[T](dataFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("não foi possível abrir o arquivo de dados: %w", err)
+	}
+	defer dataFile.Close()
+
+	fileInfo, err := dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fileInfo.Size() <= dataHeaderSize {
+		return nil, nil
+	}
+
+	lastRecord, err := ReadDataRecordAt[T](dataFile, fileInfo.Size()-dataRecordSize[T]())
+	if err != nil {
+		return nil, fmt.Errorf("não foi possível ler o último registro: %w", err)
+	}
+
+	return &lastRecord, nil
+}
+func ReadLastProduct(dataFilename string) (*Product, error) {
+	return ReadLastRecord[Product](dataFilename)
+}
+func ReadLastCategory(dataFilename string) (*Category, error) {
+	return ReadLastRecord[Category](dataFilename)
+}
+
+// Campos de tamanho fixo de VarProduct, na ordem em que são gravados antes
+// da marca
+type varProductFixed struct {
+	ID         uint32
+	CategoryID uint32
+	Price      float32
+	Active     bool
+}
+
+var ErrVarRecordTooLong = errors.New("registro variável maior que 65535 bytes")
+
+// Formato: campos fixos, {len uint16} e os bytes da marca
+func (p VarProduct) MarshalBinary() ([]byte, error) {
+	if len(p.Brand) > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: marca com %d bytes", ErrVarRecordTooLong, len(p.Brand))
+	}
+
+	var buf bytes.Buffer
+	fixed := varProductFixed{ID: p.ID, CategoryID: p.CategoryID, Price: p.Price, Active: p.Active}
+	err := binary.Write(&buf, Config.ByteOrder, fixed)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(&buf, Config.ByteOrder, uint16(len(p.Brand)))
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(p.Brand)
+	return buf.Bytes(), nil
+}
+
+func (p *VarProduct) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	var fixed varProductFixed
+	err := binary.Read(reader, Config.ByteOrder, &fixed)
+	if err != nil {
+		return err
+	}
+	var brandLength uint16
+	err = binary.Read(reader, Config.ByteOrder, &brandLength)
+	if err != nil {
+		return err
+	}
+	brand := make([]byte, brandLength)
+	_, err = io.ReadFull(reader, brand)
+	if err != nil {
+		return err
+	}
+
+	*p = VarProduct{ID: fixed.ID, CategoryID: fixed.CategoryID, Brand: string(brand), Price: fixed.Price, Active: fixed.Active}
+	return nil
+}
+
+// Grava um registro de tamanho variável no fim do arquivo de dados e o seu
+// offset no índice. Cada registro é emoldurado como {len uint16}{bytes}
+// seguido do CRC32 dos bytes; no cabeçalho do arquivo, RecordSize 0 indica
+// registros variáveis
+func AppendVarRecord(dataFilename string, indexFilename string, id uint32, record encoding.BinaryMarshaler) (int64, error) {
+	payload, err := record.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) > math.MaxUint16 {
+		return 0, fmt.Errorf("%w: %d bytes", ErrVarRecordTooLong, len(payload))
+	}
+
+	dataFile, err := os.OpenFile(dataFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer dataFile.Close()
+	err = InitDataFile(dataFile, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := dataFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, Config.ByteOrder, uint16(len(payload)))
+	buf.Write(payload)
+	binary.Write(&buf, Config.ByteOrder, crc32.ChecksumIEEE(payload))
+	_, err = dataFile.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	err = dataFile.Sync()
+	if err != nil {
+		return 0, err
+	}
+
+	return offset, AppendIndexToFile(indexFilename, id, offset)
+}
+
+// Lê o registro de tamanho variável que começa em offset, conferindo o checksum
+func ReadVarRecord(file *os.File, offset int64, record encoding.BinaryUnmarshaler) error {
+	var lengthBuf [2]byte
+	_, err := file.ReadAt(lengthBuf[:], offset)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, int(Config.ByteOrder.Uint16(lengthBuf[:]))+checksumSize)
+	_, err = file.ReadAt(buf, offset+int64(len(lengthBuf)))
+	if err != nil {
+		return err
+	}
+	payload := buf[:len(buf)-checksumSize]
+	if crc32.ChecksumIEEE(payload) != Config.ByteOrder.Uint32(buf[len(payload):]) {
+		return fmt.Errorf("%w: %s, offset %d", ErrCorruptRecord, file.Name(), offset)
+	}
+	return record.UnmarshalBinary(payload)
+}
+
+func ReadLastEvent(dataFilename string) (*Event, error) {
+	return ReadLastRecord[Event](dataFilename)
+}
+
+// Monta a categoria da linha do CSV, com o ID dado por ids. Um nome que não
+// cabe no campo é truncado e reportado com um erro ErrTruncated, junto com a
+// categoria
+func BuildCategory(column []string, ids IDStrategy) (Category, error) {
+	nextID, err := ids.Next(Categories)
+	if err != nil {
+		return Category{}, err
+	}
+	name, err := StringToByteArrayChecked(column[CATEGORY_CODE])
+	if err != nil {
+		err = fmt.Errorf("categoria %d, nome: %w", nextID, err)
+	}
+	category := Category{
+		ID:   nextID,
+		Name: name,
+	}
+	return category, err
+}
+
+// Aplica Config.Prices ao preço do produto
+func checkPrice(product *Product) error {
+	price := float64(product.Price)
+	if price >= 0 || Config.Prices == AllowNegativePrices {
+		return nil
+	}
+	if Config.Prices == ClampNegativePrices {
+		logger.Warn("preço negativo trocado por 0", "id", product.ID, "preco", product.Price)
+		product.Price = 0
+		return nil
+	}
+	return fmt.Errorf("%w: produto %d, preço %v", ErrNegativePrice, product.ID, price)
+}
+
+// Monta o produto da linha do CSV, com o ID dado por ids. Uma marca que não
+// cabe no campo é truncada e reportada com um erro ErrTruncated, junto com o
+// produto
+func BuildProduct(column []string, productCategory Category, ids IDStrategy) (Product, error) {
+	nextID, err := ids.Next(Products)
+	if err != nil {
+		return Product{}, err
+	}
+	productPrice, err := strconv.ParseFloat(column[PRICE], 32)
+	if err != nil {
+		return Product{}, fmt.Errorf("%w: produto %d, preço %q", ErrInvalidField, nextID, column[PRICE])
+	}
+	brand, err := StringToByteArrayChecked(column[BRAND])
+	if err != nil {
+		err = fmt.Errorf("produto %d, marca: %w", nextID, err)
+	}
+	product := Product{
+		ID:         uint32(nextID),
+		CategoryID: productCategory.ID,
+		Brand:      brand,
+		Price:      float32(productPrice),
+		Active:     true,
+	}
+	priceErr := checkPrice(&product)
+	if priceErr != nil {
+		return Product{}, priceErr
+	}
+	return product, err
+}
+
+// Monta o evento da linha do CSV, com o ID dado por ids. productIDs mapeia
+// o product_id do CSV para o ID interno do produto. Uma sessão que não cabe
+// no campo é truncada e reportada com um erro ErrTruncated, junto com o
+// evento
+func BuildEvent(column []string, productIDs map[uint32]uint32, ids IDStrategy) (Event, error) {
+	nextID, err := ids.Next(Events)
+	if err != nil {
+		return Event{}, err
+	}
+	userId, err := strconv.ParseUint(column[USER_ID], 10, 32)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: evento %d, usuário %q", ErrInvalidField, nextID, column[USER_ID])
+	}
+	csvProductId, err := strconv.ParseUint(column[PRODUCT_ID], 10, 32)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: evento %d, produto %q", ErrInvalidField, nextID, column[PRODUCT_ID])
+	}
+	productID, exists := productIDs[uint32(csvProductId)]
+	if !exists {
+		logger.Warn("evento referencia produto que não foi importado", "evento", nextID, "produto", csvProductId)
+		productID = UNKNOWN_PRODUCT_ID
+	}
+	session, err := StringTo50ByteArrayChecked(column[USER_SESSION])
+	if err != nil {
+		err = fmt.Errorf("evento %d, sessão: %w", nextID, err)
+	}
+	event := Event{
+		ID:          nextID,
+		UserSession: session,
+		UserID:      uint32(userId),
+		ProductID:   productID,
+		EventAction: getActionFromName(column[EVENT_TYPE]),
+		EventTime:   EventTimestamp(column[EVENT_TIME]),
+	}
+	return event, err
+}
+
+// Cria uma categoria com o próximo ID. Os nomes são comparados sem espaços
+// nas pontas e sem diferenciar maiúsculas de minúsculas
+func AddCategory(name string) (Category, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Category{}, errors.New("nome da categoria vazio")
+	}
+	_, err := StringToByteArrayChecked(name)
+	if err != nil {
+		return Category{}, err
+	}
+
+	category, created, err := GetOrCreateCategory(name)
+	if err != nil {
+		return Category{}, err
+	}
+	if !created {
+		return Category{}, fmt.Errorf("%w: %q (ID %d)", ErrDuplicateCategory, name, category.ID)
+	}
+	return category, nil
+}
+
+// Retorna a categoria com o nome dado, criando-a com o próximo ID se ela
+// ainda não existir; created diz qual dos dois aconteceu. Os nomes são
+// comparados como em AddCategory. Um nome que não cabe no campo é truncado
+// e, quando a categoria é criada, reportado com ErrTruncated junto com ela
+func GetOrCreateCategory(name string) (Category, bool, error) {
+	return getOrCreateCategory(Categories, name, SequentialIDs)
+}
+
+func getOrCreateCategory(categories *FileStore[Category], name string, ids IDStrategy) (Category, bool, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Category{}, false, errors.New("nome da categoria vazio")
+	}
+	categoryName, nameErr := StringToByteArrayChecked(name)
+	key := categoryNameKey(ByteArrayToString(categoryName[:]))
+
+	// A trava fica com a consulta e a inclusão, para que duas chamadas com o
+	// mesmo nome não criem duas categorias
+	categoryNamesMu.Lock()
+	defer categoryNamesMu.Unlock()
+
+	names, err := loadCategoryNames(categories, false)
+	if err != nil {
+		return Category{}, false, err
+	}
+	category, found := names.categories[key]
+	if found {
+		// Tombstone não muda o tamanho do arquivo, então a categoria pode ter
+		// sido removida sem que o índice de nomes fosse refeito
+		stillExists, err := categories.Exists(category.ID)
+		if err != nil {
+			return Category{}, false, err
+		}
+		if !stillExists {
+			names, err = loadCategoryNames(categories, true)
+			if err != nil {
+				return Category{}, false, err
+			}
+			category, found = names.categories[key]
+		}
+	}
+	if found {
+		return category, false, nil
+	}
+
+	nextID, err := ids.Next(categories)
+	if err != nil {
+		return Category{}, false, err
+	}
+	category = Category{
+		ID:   nextID,
+		Name: categoryName,
+	}
+	err = categories.Add(category)
+	if err != nil {
+		return Category{}, false, err
+	}
+	names.categories[key] = category
+	names.file, err = os.Stat(categories.dataFilename)
+	if err != nil {
+		return Category{}, false, err
+	}
+
+	if nameErr != nil {
+		nameErr = fmt.Errorf("categoria %d, nome: %w", nextID, nameErr)
+	}
+	return category, true, nameErr
+}
+
+// Nomes das categorias por arquivo de dados, para que GetOrCreateCategory
+// não precise varrer o arquivo a cada chamada. O índice de um arquivo é
+// refeito quando o arquivo muda de tamanho por fora de getOrCreateCategory
+// ou é trocado por outro, como na compactação
+var (
+	categoryNamesMu sync.Mutex
+	categoryNames   = map[string]*categoryNameIndex{}
+)
+
+type categoryNameIndex struct {
+	file       os.FileInfo
+	categories map[string]Category
+}
+
+func (names *categoryNameIndex) current(file os.FileInfo) bool {
+	if names.file == nil || file == nil {
+		return names.file == file
+	}
+	return os.SameFile(names.file, file) && names.file.Size() == file.Size()
+}
+
+func categoryNameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Se houver mais de uma categoria com o mesmo nome, vale a primeira do
+// arquivo. Categorias sem nome e com lápide ficam de fora
+func loadCategoryNames(categories *FileStore[Category], force bool) (*categoryNameIndex, error) {
+	file, err := os.Stat(categories.dataFilename)
+	if os.IsNotExist(err) {
+		file = nil
+	} else if err != nil {
+		return nil, err
+	}
+	names, ok := categoryNames[categories.dataFilename]
+	if ok && !force && names.current(file) {
+		return names, nil
+	}
+
+	tombstones, err := readTombstones(categories.indexFilename)
+	if err != nil {
+		return nil, err
+	}
+	names = &categoryNameIndex{file: file, categories: make(map[string]Category)}
+	err = ForEachWithOffset(categories.dataFilename, func(offset int64, category Category) error {
+		key := categoryNameKey(ByteArrayToString(category.Name[:]))
+		_, seen := names.categories[key]
+		if key == "" || seen || tombstones.covers(category.ID, offset) {
+			return nil
+		}
+		names.categories[key] = category
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	categoryNames[categories.dataFilename] = names
+	return names, nil
+}
+
+// Categoria da linha do CSV. Um category_code vazio não identifica a
+// categoria, então cada category_id sem nome vira uma categoria própria; com
+// nome, a categoria que já tem esse nome é reaproveitada
+func importCategory(categories *FileStore[Category], column []string, ids IDStrategy) (Category, bool, error) {
+	if strings.TrimSpace(column[CATEGORY_CODE]) != "" {
+		return getOrCreateCategory(categories, column[CATEGORY_CODE], ids)
+	}
+
+	category, err := BuildCategory(column, ids)
+	if err != nil {
+		return Category{}, false, err
+	}
+	err = categories.Add(category)
+	if err != nil {
+		return Category{}, false, err
+	}
+	return category, true, nil
+}
+
+// Mantém os arquivos de dados e de índice abertos e acumula as escritas em
+// buffers, em vez de abrir, gravar e sincronizar os dois arquivos a cada
+// registro como Append faz. Nada é garantido em disco antes de Flush ou Close
+type BatchWriter[T any] struct {
+	dataFile   *os.File
+	indexFile  *os.File
+	data       *bufio.Writer
+	index      *bufio.Writer
+	offset     int64
+	recordSize int64
+	secondary  []batchSecondaryIndex[T]
+}
+
+// Índice secundário sem ordenação mantido junto com o primário
+type batchSecondaryIndex[T any] struct {
+	file   *os.File
+	writer *bufio.Writer
+	keyOf  func(T) uint32
+}
+
+func NewBatchWriter[T any](dataFilename string, indexFilename string) (*BatchWriter[T], error) {
+	dataFile, err := OpenDataFile[T](dataFilename)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := dataFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		dataFile.Close()
+		return nil, err
+	}
+
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		dataFile.Close()
+		return nil, err
+	}
+
+	return &BatchWriter[T]{
+		dataFile:   dataFile,
+		indexFile:  indexFile,
+		data:       bufio.NewWriter(dataFile),
+		index:      bufio.NewWriter(indexFile),
+		offset:     offset,
+		recordSize: dataRecordSize[T](),
+	}, nil
+}
+
+// Acrescenta o registro e a entrada de índice, retornando o offset do registro
+func (w *BatchWriter[T]) Append(record T, id uint32) (int64, error) {
+	offset := w.offset
+	err := writeDataRecord(w.data, record)
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(w.index, Config.ByteOrder, IndexEntry{ID: id, Offset: offset})
+	if err != nil {
+		return 0, err
+	}
+	bloomAdd(w.indexFile.Name(), id)
+	for _, secondary := range w.secondary {
+		err = binary.Write(secondary.writer, Config.ByteOrder, IndexEntry{ID: secondary.keyOf(record), Offset: offset})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	w.offset += w.recordSize
+	return offset, nil
+}
+
+// Passa a gravar também um índice secundário, com a chave keyOf de cada
+// registro acrescentado daqui em diante
+func (w *BatchWriter[T]) AddIndex(indexFilename string, keyOf func(T) uint32) error {
+	file, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.secondary = append(w.secondary, batchSecondaryIndex[T]{file: file, writer: bufio.NewWriter(file), keyOf: keyOf})
+	return nil
+}
+
+// Descarrega os buffers e sincroniza todos os arquivos, que continuam
+// abertos para novas escritas. Retorna o primeiro erro encontrado
+func (w *BatchWriter[T]) Flush() error {
+	errs := []error{
+		w.data.Flush(),
+		w.index.Flush(),
+		w.dataFile.Sync(),
+		w.indexFile.Sync(),
+	}
+	for _, secondary := range w.secondary {
+		errs = append(errs, secondary.writer.Flush(), secondary.file.Sync())
+	}
+	return firstError(errs...)
+}
+
+// Descarrega os buffers, sincroniza e fecha todos os arquivos. Retorna o
+// primeiro erro encontrado
+func (w *BatchWriter[T]) Close() error {
+	errs := []error{
+		w.Flush(),
+		w.dataFile.Close(),
+		w.indexFile.Close(),
+	}
+	for _, secondary := range w.secondary {
+		errs = append(errs, secondary.file.Close())
+	}
+	return firstError(errs...)
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var ErrStoreLocked = errors.New("diretório em uso por outro processo")
+
+// Arquivos de produtos, categorias e eventos de um diretório, com os
+// escritores em lote abertos até Close. O arquivo de trava impede que dois
+// processos abram o mesmo diretório; se o processo cair, ele fica para trás
+// e precisa ser apagado à mão
+type Store struct {
+	Dir        string
+	lock       *os.File
+	Products   *BatchWriter[Product]
+	Categories *BatchWriter[Category]
+	Events     *BatchWriter[Event]
+}
+
+func OpenStore(dir string) (*Store, error) {
+	store := &Store{Dir: dir}
+	lock, err := lockStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	store.lock = lock
+
+	store.Products, err = NewBatchWriter[Product](store.Path(PRODUCT_DATA_FILE), store.Path(PRODUCT_INDEX_FILE))
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	store.Categories, err = NewBatchWriter[Category](store.Path(CATEGORY_DATA_FILE), store.Path(CATEGORY_INDEX_FILE))
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	store.Events, err = NewBatchWriter[Event](store.Path(EVENT_DATA_FILE), store.Path(EVENT_INDEX_FILE))
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	err = store.Events.AddIndex(store.Path(EVENT_USER_INDEX_FILE), func(event Event) uint32 { return event.UserID })
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Cria o arquivo de trava do diretório, com o PID de quem o criou
+func lockStore(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, STORE_LOCK_FILE), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrStoreLocked, dir)
+	} else if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(lock, "%d\n", os.Getpid())
+	return lock, nil
+}
+
+func unlockStore(lock *os.File) error {
+	return firstError(lock.Close(), os.Remove(lock.Name()))
+}
+
+// Caminho de um dos arquivos do armazenamento
+func (s *Store) Path(filename string) string {
+	return filepath.Join(s.Dir, filename)
+}
+
+// Descarrega e sincroniza os escritores e os arquivos de métricas, sem
+// fechar nada
+func (s *Store) Flush() error {
+	errs := []error{}
+	for _, writer := range []interface{ Flush() error }{s.Products, s.Categories, s.Events} {
+		errs = append(errs, writer.Flush())
+	}
+	errs = append(errs, syncFiles(s.Path(ACTION_METRICS_FILE), s.Path(PRODUCT_METRICS_FILE)))
+	return firstError(errs...)
+}
+
+// Sincroniza arquivos gravados sem fsync, como os de métricas. Arquivos que
+// ainda não existem são ignorados
+func syncFiles(filenames ...string) error {
+	for _, filename := range filenames {
+		file, err := os.OpenFile(filename, os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = file.Sync()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fecha os escritores (descarregando e sincronizando tudo) e libera a trava.
+// Tenta fechar tudo mesmo depois de um erro e retorna o primeiro
+func (s *Store) Close() error {
+	errs := []error{}
+	if s.Products != nil {
+		errs = append(errs, s.Products.Close())
+	}
+	if s.Categories != nil {
+		errs = append(errs, s.Categories.Close())
+	}
+	if s.Events != nil {
+		errs = append(errs, s.Events.Close())
+	}
+	if s.lock != nil {
+		errs = append(errs, unlockStore(s.lock))
+	}
+	return firstError(errs...)
+}
+
+// Apaga todos os registros de um tipo, deixando os arquivos de dados e de
+// índice vazios. Um arquivo de dados vazio é válido: o cabeçalho é gravado
+// de novo no próximo append
+func DropAll(dataFilename string, indexFilename string) error {
+	return truncateFiles(dataFilename, indexFilename)
+}
+
+// Todos os arquivos gravados num diretório de armazenamento, menos a trava:
+// registros, índices secundários, métricas, índices de mais caro e o WAL
+var storeFiles = []string{
+	PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE,
+	MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, PRODUCT_METRICS_FILE,
+	CATEGORY_DATA_FILE, CATEGORY_INDEX_FILE,
+	EVENT_DATA_FILE, EVENT_INDEX_FILE, EVENT_USER_INDEX_FILE, EVENT_TIME_INDEX_FILE, ACTION_METRICS_FILE,
+	EXTERNAL_ID_MAP_FILE, IMPORT_CHECKPOINT_FILE, WAL_FILE,
+}
+
+// Apaga tudo o que está gravado no diretório. O arquivo de trava não é
+// tocado
+func DropStore(dir string) error {
+	filenames := make([]string, len(storeFiles))
+	for i, filename := range storeFiles {
+		filenames[i] = filepath.Join(dir, filename)
+	}
+	return truncateFiles(filenames...)
+}
+
+var ErrBackupExists = errors.New("destino do backup já tem arquivos")
+
+// Copia os arquivos do diretório para destDir segurando a trava, então
+// nenhum Store consegue gravar no meio da cópia e todos os arquivos saem do
+// mesmo instante. A cópia é feita num diretório temporário ao lado de
+// destDir e renomeada no fim: destDir ou não existe, ou tem o backup inteiro.
+// destDir não pode ter arquivos
+func Backup(dir string, destDir string) error {
+	lock, err := lockStore(dir)
+	if err != nil {
+		return err
+	}
+	return firstError(backupFiles(dir, destDir), unlockStore(lock))
+}
+
+// Como Backup, para um diretório aberto por este processo: os escritores
+// em lote são descarregados antes da cópia
+func (s *Store) Backup(destDir string) error {
+	err := s.Flush()
+	if err != nil {
+		return err
+	}
+	return backupFiles(s.Dir, destDir)
+}
+
+// Saúde de um diretório de armazenamento, de Store.Stats
+type StoreStats struct {
+	// Registros nos arquivos de dados, inclusive os produtos removidos
+	Products   int64
+	Categories int64
+	Events     int64
+
+	ActiveProducts  int64
+	DeletedProducts int64
+	// Bytes ocupados pelos produtos removidos, que Compact libera. Categorias
+	// e eventos são apagados do arquivo na remoção e não deixam buracos
+	FragmentedBytes int64
+
+	// Tamanho de cada arquivo do armazenamento que existe no diretório
+	FileSizes  map[string]int64
+	TotalBytes int64
+
+	// Problemas que VerifyStore acha no índice de produtos, sem as entradas
+	// de produtos removidos, que ficam no índice até Compact
+	ProductIndexProblems []Inconsistency
+	// Os índices primários estão em ordem, sem IDs repetidos, com uma
+	// entrada por registro, e ProductIndexProblems está vazio
+	IndexesConsistent bool
+}
+
+// Levanta contagens, tamanhos, fragmentação e consistência dos índices de
+// todos os arquivos. Os escritores em lote são descarregados antes, para
+// que os números incluam o que ainda estava nos buffers
+func (s *Store) Stats() (StoreStats, error) {
+	stats := StoreStats{FileSizes: map[string]int64{}, IndexesConsistent: true}
+	err := s.Flush()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, filename := range storeFiles {
+		fileInfo, err := os.Stat(s.Path(filename))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return stats, err
+		}
+		stats.FileSizes[filename] = fileInfo.Size()
+		stats.TotalBytes += fileInfo.Size()
+	}
+
+	err = ForEach(s.Path(PRODUCT_DATA_FILE), func(product Product) error {
+		stats.Products++
+		if product.Active {
+			stats.ActiveProducts++
+		} else {
+			stats.DeletedProducts++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+	stats.FragmentedBytes = stats.DeletedProducts * dataRecordSize[Product]()
+	stats.Categories = dataRecordCount[Category](stats.FileSizes[CATEGORY_DATA_FILE])
+	stats.Events = dataRecordCount[Event](stats.FileSizes[EVENT_DATA_FILE])
+
+	if stats.Products > 0 {
+		problems, err := VerifyStore(s.Path(PRODUCT_DATA_FILE), s.Path(PRODUCT_INDEX_FILE))
+		if err != nil {
+			return stats, err
+		}
+		for _, problem := range problems {
+			if problem.Kind != POINTS_TO_INACTIVE {
+				stats.ProductIndexProblems = append(stats.ProductIndexProblems, problem)
+			}
+		}
+	}
+
+	indexes := []struct {
+		filename string
+		records  int64
+	}{
+		{PRODUCT_INDEX_FILE, stats.Products},
+		{CATEGORY_INDEX_FILE, stats.Categories},
+		{EVENT_INDEX_FILE, stats.Events},
+	}
+	for _, index := range indexes {
+		consistent, err := primaryIndexConsistent(s.Path(index.filename), index.records)
+		if err != nil {
+			return stats, err
+		}
+		stats.IndexesConsistent = stats.IndexesConsistent && consistent
+	}
+	stats.IndexesConsistent = stats.IndexesConsistent && len(stats.ProductIndexProblems) == 0
+	return stats, nil
+}
+
+// Quantidade de registros de um arquivo de dados com o tamanho dado
+func dataRecordCount[T any](size int64) int64 {
+	if size <= dataHeaderSize {
+		return 0
+	}
+	return (size - dataHeaderSize) / dataRecordSize[T]()
+}
+
+// Diz se o índice tem IDs estritamente crescentes e records entradas. Um
+// índice que não existe é consistente com um arquivo sem registros
+func primaryIndexConsistent(indexFilename string, records int64) (bool, error) {
+	entries := int64(0)
+	sorted := true
+	var previous uint32
+	err := ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		if entries > 0 && entry.ID <= previous {
+			sorted = false
+		}
+		previous = entry.ID
+		entries++
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return records == 0, nil
+	} else if err != nil {
+		return false, err
+	}
+	return sorted && entries == records, nil
+}
+
+func backupFiles(dir string, destDir string) error {
+	entries, err := os.ReadDir(destDir)
+	if err == nil && len(entries) > 0 {
+		return fmt.Errorf("%w: %s", ErrBackupExists, destDir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	temp, err := os.MkdirTemp(filepath.Dir(destDir), filepath.Base(destDir)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	err = copyStoreFiles(dir, temp)
+	if err == nil {
+		err = os.Chmod(temp, 0755)
+	}
+	if err == nil {
+		err = syncDir(temp)
+	}
+	if err == nil {
+		// Rename não substitui um diretório, nem vazio
+		err = os.Remove(destDir)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(temp, destDir)
+	}
+	if err != nil {
+		os.RemoveAll(temp)
+		return err
+	}
+	return syncDir(filepath.Dir(destDir))
+}
+
+// Copia os arquivos de armazenamento que existem em srcDir, com fsync
+func copyStoreFiles(srcDir string, destDir string) error {
+	for _, filename := range storeFiles {
+		err := copyFileSynced(filepath.Join(srcDir, filename), filepath.Join(destDir, filename))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFileSynced(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	return firstError(err, out.Close())
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Troca os arquivos do diretório pelos de um backup feito com Backup,
+// segurando a trava. Cada arquivo é trocado com atomicReplace; os que não
+// estão no backup são apagados, já que não existiam quando ele foi feito.
+// Se o processo cair no meio, os arquivos ficam misturados e basta rodar
+// Restore de novo
+func Restore(srcDir string, dir string) error {
+	_, err := os.Stat(srcDir)
+	if err != nil {
+		return err
+	}
+	lock, err := lockStore(dir)
+	if err != nil {
+		return err
+	}
+	return firstError(restoreFiles(srcDir, dir), unlockStore(lock))
+}
+
+func restoreFiles(srcDir string, dir string) error {
+	for _, filename := range storeFiles {
+		target := filepath.Join(dir, filename)
+		temp, err := createTempNear(target)
+		if err != nil {
+			return err
+		}
+		temp.Close()
+
+		err = copyFileSynced(filepath.Join(srcDir, filename), temp.Name())
+		if os.IsNotExist(err) {
+			os.Remove(temp.Name())
+			err = os.Remove(target)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		} else if err != nil {
+			os.Remove(temp.Name())
+			return err
+		}
+		err = atomicReplace(temp.Name(), target)
+		if err != nil {
+			return err
+		}
+		// Os filtros de Bloom em memória não conhecem os IDs do backup
+		err = bloomReload(target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Trunca os arquivos para zero bytes, criando os que ainda não existem
+func truncateFiles(filenames ...string) error {
+	for _, filename := range filenames {
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ID da última entrada do índice; found é falso com o índice vazio ou
+// inexistente
+func lastIndexID(indexFilename string) (id uint32, found bool, err error) {
+	file, err := OpenReadOnly(indexFilename)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	entries := fileInfo.Size() / indexEntrySize
+	if entries == 0 {
+		return 0, false, nil
+	}
+	entry, err := ReadRecordAt[IndexEntry](file, (entries-1)*indexEntrySize)
+	if err != nil {
+		return 0, false, err
+	}
+	return entry.ID, true, nil
+}
+
+// Adiciona vários produtos de uma vez. Os arquivos são abertos uma única vez
+// e os índices de produto mais caro (global e por categoria) são calculados
+// em memória e gravados só no final.
+//
+// É tudo ou nada: se alguma escrita falhar, os arquivos de dados e de índice
+// são truncados de volta ao tamanho original e os índices de mais caro não
+// são tocados. Uma queda do processo no meio, porém, pode deixar parte do lote
+// gravada.
+//
+// Como o índice primário é ordenado por acréscimo, os IDs do lote precisam
+// ser crescentes e maiores que o último do índice. Um ID repetido retorna
+// ErrDuplicateID e um fora de ordem ErrIDOutOfOrder, antes de qualquer
+// gravação
+func AddProducts(products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+	products = append([]Product(nil), products...)
+	for i := range products {
+		err := checkPrice(&products[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	lock := dataLock(PRODUCT_DATA_FILE)
+	lock.Lock()
+	defer lock.Unlock()
+
+	lastID, hasLast, err := lastIndexID(PRODUCT_INDEX_FILE)
+	if err != nil {
+		return err
+	}
+	batchIDs := make(map[uint32]bool, len(products))
+	for _, product := range products {
+		if batchIDs[product.ID] {
+			return fmt.Errorf("%w: %d repetido no lote", ErrDuplicateID, product.ID)
+		}
+		if hasLast && product.ID <= lastID {
+			_, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, product.ID)
+			if found {
+				return fmt.Errorf("%w: %d em %s", ErrDuplicateID, product.ID, PRODUCT_INDEX_FILE)
+			}
+			return fmt.Errorf("%w: %d depois de %d", ErrIDOutOfOrder, product.ID, lastID)
+		}
+		batchIDs[product.ID] = true
+		lastID, hasLast = product.ID, true
+	}
+
+	dataSize, err := fileSize(PRODUCT_DATA_FILE)
+	if err != nil {
+		return err
+	}
+	indexSize, err := fileSize(PRODUCT_INDEX_FILE)
+	if err != nil {
+		return err
+	}
+	rollback := func(cause error) error {
+		os.Truncate(PRODUCT_DATA_FILE, dataSize)
+		os.Truncate(PRODUCT_INDEX_FILE, indexSize)
+		return cause
+	}
+
+	writer, err := NewBatchWriter[Product](PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
+	if err != nil {
+		return err
+	}
+
+	var mostExpensiveProduct *Product
+	categoryLeaders := make(map[uint32]Product)
+	for i := range products {
+		product := products[i]
+		_, err = writer.Append(product, product.ID)
+		if err != nil {
+			writer.Close()
+			return rollback(err)
+		}
+
+		if !product.Active {
+			continue
+		}
+		if mostExpensiveProduct == nil || moreExpensive(product, *mostExpensiveProduct) {
+			mostExpensiveProduct = &products[i]
+		}
+		leader, exists := categoryLeaders[product.CategoryID]
+		if !exists || moreExpensive(product, leader) {
+			categoryLeaders[product.CategoryID] = product
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return rollback(err)
+	}
+
+	if mostExpensiveProduct != nil {
+		err = UpdateMostExpensiveProductIndex(MOST_EXPENSIVE_PRODUCT_FILE, *mostExpensiveProduct)
+		if err != nil {
+			return err
+		}
+	}
+	for _, leader := range categoryLeaders {
+		err = UpdateMostExpensivePerCategoryIndex(MOST_EXPENSIVE_PER_CATEGORY_FILE, leader)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tamanho do arquivo, ou 0 se ele ainda não existe
+func fileSize(filename string) (int64, error) {
+	fileInfo, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+// Adiciona o produto e atualiza os índices de mais caro. Retorna
+// ErrDuplicateID se já existir um produto com o mesmo ID
+func AddProduct(product Product) error {
+	return addProduct(Products, product)
+}
+func addProduct(store *FileStore[Product], product Product) error {
+	err := checkPrice(&product)
+	if err != nil {
+		return err
+	}
+	err = store.Add(product)
+	if err != nil {
+		return err
+	}
+	logger.Debug("produto adicionado", "id", product.ID, "categoria", product.CategoryID, "preco", product.Price)
+	err = UpdateMostExpensiveProductIndex(MOST_EXPENSIVE_PRODUCT_FILE, product)
+	if err != nil {
+		return err
+	}
+	return UpdateMostExpensivePerCategoryIndex(MOST_EXPENSIVE_PER_CATEGORY_FILE, product)
+}
+func AddEvent(event Event) error {
+	return addEvent(Events, event)
+}
+func addEvent(store *FileStore[Event], event Event) error {
+	// Grava o evento, o índice primário e o índice secundário por usuário,
+	// com entradas (UserID, offset) na ordem de inserção, sem ordenação. As
+	// métricas ficam fora do WAL: incrementá-las de novo na recuperação
+	// contaria o evento duas vezes
+	err := store.Add(event)
+	if err != nil {
+		return fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", store.dataFilename, err)
+	}
+	err = StoreActionMetrics(ACTION_METRICS_FILE, event.EventAction)
+	if err != nil {
+		return err
+	}
+	if event.EventAction == PURCHASE {
+		return StoreProductMetrics(PRODUCT_METRICS_FILE, PRODUCT_INDEX_FILE, event.ProductID)
+	}
+	return nil
+}
+
+// Remove o evento dos arquivos de dados e de índices e desconta a ação dele
+// das métricas; uma compra também sai do total de compras do produto
+func RemoveEvent(id uint32) error {
+	return removeEvent(Events, id)
+}
+
+func removeEvent(store *FileStore[Event], id uint32) error {
+	event, found, err := store.Get(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("Evento com ID %d não encontrado", id)
+	}
+
+	err = store.Remove(id)
+	if err != nil {
+		return err
+	}
+	// A remoção desloca os eventos seguintes no arquivo de dados
+	err = refreshTimeIndex(context.Background(), store.dataFilename, timeIndexFor(store.dataFilename))
+	if err != nil {
+		return err
+	}
+	err = DecrementActionMetrics(ACTION_METRICS_FILE, event.EventAction)
+	if err != nil {
+		return err
+	}
+	if event.EventAction == PURCHASE {
+		return DecrementProductMetrics(PRODUCT_METRICS_FILE, event.ProductID)
+	}
+	return nil
+}
+
+// Eventos de um usuário na ordem em que foram inseridos, usando o índice
+// por usuário em vez de varrer o arquivo de eventos
+func EventsByUser(userID uint32) ([]Event, error) {
+	events := []Event{}
+	indexFile, err := os.Open(EVENT_USER_INDEX_FILE)
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer indexFile.Close()
+
+	// Sem o arquivo de eventos não há o que ler, como sem o índice
+	dataFile, err := OpenDataFileReadOnly[Event](EVENT_DATA_FILE)
+	if os.IsNotExist(err) {
+		return events, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	reader := bufio.NewReader(indexFile)
+	for {
+		var entry IndexEntry
+		err = binary.Read(reader, Config.ByteOrder, &entry)
+		if err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if entry.ID != userID || entry.Offset == TOMBSTONE_OFFSET {
+			continue
+		}
+		event, err := ReadDataRecordAt[Event](dataFile, entry.Offset)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
+
+// Formatos aceitos para event_time, do formato do dataset para os mais
+// genéricos
+var eventTimeLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+func ParseEventTime(raw string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range eventTimeLayouts {
+		parsed, err := time.Parse(layout, raw)
+		if err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("horário de evento inválido %q", raw)
+}
+
+// Converte o event_time do CSV em segundos Unix. Valores que não puderem ser
+// interpretados viram 0 e são registrados no logger
+func EventTimestamp(raw string) int64 {
+	parsed, err := ParseEventTime(raw)
+	if err != nil {
+		logger.Warn("horário de evento inválido, gravando 0", "erro", err)
+		return 0
+	}
+	return parsed.Unix()
+}
+
+func FormatEventTime(timestamp int64) string {
+	if timestamp == 0 {
+		return "desconhecido"
+	}
+	return time.Unix(timestamp, 0).UTC().Format(eventTimeLayouts[0])
+}
+
+// Entrada do índice por horário: os eventos ordenados por EventTime, e na
+// ordem do arquivo entre eventos do mesmo horário
+type TimeIndexEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+// Índice por horário que fica ao lado do arquivo de eventos
+func timeIndexFor(dataFilename string) string {
+	return filepath.Join(filepath.Dir(dataFilename), EVENT_TIME_INDEX_FILE)
+}
+
+// Grava do zero o índice por horário dos eventos. Manter o índice ordenado
+// a cada evento inserido custaria reescrever o arquivo a cada inserção, então
+// ele é montado em lote: os eventos gravados depois ficam de fora e
+// EventsBetween os confere varrendo só o fim do arquivo de dados.
+// RemoveEvent e CompactAll refazem o índice quando ele existe
+func RebuildTimeIndex(ctx context.Context, dataFilename string, timeIndexFilename string) error {
+	entries := []TimeIndexEntry{}
+	err := ForEachWithOffsetContext(ctx, dataFilename, func(offset int64, event Event) error {
+		entries = append(entries, TimeIndexEntry{Timestamp: event.EventTime, Offset: offset})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp < entries[j].Timestamp })
+
+	indexFile, err := os.Create(timeIndexFilename)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	writer := bufio.NewWriter(indexFile)
+	for _, entry := range entries {
+		err = binary.Write(writer, Config.ByteOrder, entry)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return indexFile.Sync()
+}
+
+// Refaz o índice por horário só se ele já existir
+func refreshTimeIndex(ctx context.Context, dataFilename string, timeIndexFilename string) error {
+	_, err := os.Stat(timeIndexFilename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return RebuildTimeIndex(ctx, dataFilename, timeIndexFilename)
+}
+
+// Eventos com EventTime em [from, to], em segundos Unix, em ordem de
+// horário. Usa o índice por horário ao lado do arquivo de dados, se houver;
+// sem ele, varre o arquivo inteiro
+func EventsBetween(dataFilename string, from, to int64) ([]Event, error) {
+	if from > to {
+		return nil, fmt.Errorf("intervalo inválido: início %d depois do fim %d", from, to)
+	}
+	events, err := eventsBetweenIndexed(dataFilename, timeIndexFor(dataFilename), from, to)
+	if errors.Is(err, errStaleTimeIndex) {
+		logger.Warn("índice por horário desatualizado, varrendo os eventos", "erro", err)
+	} else if !os.IsNotExist(err) {
+		return events, err
+	}
+	return scanEventsBetween(dataFilename, from, to)
+}
+
+// O índice por horário não corresponde mais ao arquivo de dados, por
+// exemplo depois de uma remoção que não passou por RemoveEvent
+var errStaleTimeIndex = errors.New("índice por horário desatualizado")
+
+// Busca binária do primeiro horário >= from no índice, lendo os eventos até
+// passar de to, mais os eventos gravados depois da montagem do índice
+func eventsBetweenIndexed(dataFilename string, timeIndexFilename string, from, to int64) ([]Event, error) {
+	indexFile, err := OpenReadOnly(timeIndexFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer indexFile.Close()
+
+	dataFile, err := OpenDataFileReadOnly[Event](dataFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFile.Close()
+
+	position, count, err := lowerBound(indexFile, func(entry TimeIndexEntry) bool {
+		return entry.Timestamp < from
+	})
+	if err != nil {
+		return nil, err
+	}
+	// O índice cobre os count primeiros registros, já que as remoções
+	// regravam o arquivo sem buracos
+	dataInfo, err := dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	covered := dataHeaderSize + count*dataRecordSize[Event]()
+	if count > 0 && covered > dataInfo.Size() {
+		return nil, fmt.Errorf("%w: %s indexa %d eventos, %s tem %d bytes", errStaleTimeIndex, timeIndexFilename, count, dataFilename, dataInfo.Size())
+	}
+
+	events := []Event{}
+	_, err = indexFile.Seek(position*fixedSize[TimeIndexEntry](), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(indexFile)
+	for ; position < count; position++ {
+		var entry TimeIndexEntry
+		err = binary.Read(reader, Config.ByteOrder, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Timestamp > to {
+			break
+		}
+		event, err := ReadDataRecordAt[Event](dataFile, entry.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if event.EventTime != entry.Timestamp {
+			return nil, fmt.Errorf("%w: offset %d", errStaleTimeIndex, entry.Offset)
+		}
+		events = append(events, event)
+	}
+
+	// Eventos gravados depois do índice, que podem ter qualquer horário
+	tail := []Event{}
+	for offset := covered; offset < dataInfo.Size(); offset += dataRecordSize[Event]() {
+		event, err := ReadDataRecordAt[Event](dataFile, offset)
+		if err != nil {
+			return nil, err
+		}
+		if event.EventTime >= from && event.EventTime <= to {
+			tail = append(tail, event)
+		}
+	}
+	if len(tail) == 0 {
+		return events, nil
+	}
+	events = append(events, tail...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].EventTime < events[j].EventTime })
+	return events, nil
+}
+
+func scanEventsBetween(dataFilename string, from, to int64) ([]Event, error) {
+	events := []Event{}
+	err := ForEach(dataFilename, func(event Event) error {
+		if event.EventTime >= from && event.EventTime <= to {
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].EventTime < events[j].EventTime })
+	return events, nil
+}
+
+// Eventos de uma sessão em ordem cronológica. Se algum evento não tiver
+// horário (EventTime 0), os eventos ficam na ordem de inserção
+func EventsBySession(session string) ([]Event, error) {
+	events := []Event{}
+	err := ForEach(EVENT_DATA_FILE, func(event Event) error {
+		if ByteArrayToString(event.UserSession[:]) == session {
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		if event.EventTime == 0 {
+			return events, nil
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool { return events[i].EventTime < events[j].EventTime })
+	return events, nil
+}
+
+// Ações distintas da sessão, na ordem em que aparecem pela primeira vez
+func ReconstructFunnel(session string) ([]Action, error) {
+	events, err := EventsBySession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[Action]bool)
+	actions := []Action{}
+	for _, event := range events {
+		if !seen[event.EventAction] {
+			seen[event.EventAction] = true
+			actions = append(actions, event.EventAction)
+		}
+	}
+	return actions, nil
+}
+
+type ExternalKind uint8
+
+const (
+	EXTERNAL_CATEGORY ExternalKind = iota + 1
+	EXTERNAL_PRODUCT
+	EXTERNAL_EVENT
+)
+
+// Entrada de external_id_map.bin: o ID do registro no CSV (para eventos, o
+// hash de EventKey) e o ID interno que ele recebeu na importação
+type ExternalIDEntry struct {
+	Kind       ExternalKind
+	ExternalID uint64
+	ID         uint32
+}
+
+// IDs externos já importados, lidos do arquivo no início da importação para
+// que importar de novo o mesmo CSV não duplique nada. Cada registro novo é
+// acrescentado ao arquivo
+type externalIDs struct {
+	categories map[uint64]uint32
+	products   map[uint32]uint32
+	events     map[uint64]bool
+	file       *os.File
+	writer     *bufio.Writer
+}
+
+func openExternalIDs(filename string) (*externalIDs, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	recordSize := externalIDRecordSize
+	if fileInfo.Size()%recordSize != 0 {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s tem %d bytes", ErrTruncatedFile, filename, fileInfo.Size())
+	}
+
+	ids := &externalIDs{
+		categories: make(map[uint64]uint32),
+		products:   make(map[uint32]uint32),
+		events:     make(map[uint64]bool),
+		file:       file,
+		writer:     bufio.NewWriter(file),
+	}
+	reader := bufio.NewReader(file)
+	for {
+		var entry ExternalIDEntry
+		err = binary.Read(reader, Config.ByteOrder, &entry)
+		if err == io.EOF {
+			return ids, nil
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+		ids.remember(entry)
+	}
+}
+
+func (ids *externalIDs) remember(entry ExternalIDEntry) {
+	switch entry.Kind {
+	case EXTERNAL_CATEGORY:
+		ids.categories[entry.ExternalID] = entry.ID
+	case EXTERNAL_PRODUCT:
+		ids.products[uint32(entry.ExternalID)] = entry.ID
+	case EXTERNAL_EVENT:
+		ids.events[entry.ExternalID] = true
+	}
+}
+
+func (ids *externalIDs) add(kind ExternalKind, externalID uint64, id uint32) error {
+	entry := ExternalIDEntry{Kind: kind, ExternalID: externalID, ID: id}
+	ids.remember(entry)
+	return binary.Write(ids.writer, Config.ByteOrder, entry)
+}
+
+func (ids *externalIDs) Sync() error {
+	err := ids.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return ids.file.Sync()
+}
+
+func (ids *externalIDs) Close() error {
+	return firstError(ids.Sync(), ids.file.Close())
+}
+
+// Hash de EventKey, usado como ID externo dos eventos, que não têm ID no CSV
+func eventKeyHash(column []string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(EventKey(column)))
+	return hash.Sum64()
+}
+
+// Chave natural de um evento do CSV: sessão + produto + tipo + horário
+func EventKey(column []string) string {
+	return strings.Join([]string{
+		column[USER_SESSION],
+		column[PRODUCT_ID],
+		column[EVENT_TYPE],
+		column[EVENT_TIME],
+	}, "|")
+}
+
+// Resumo de uma importação. Truncated conta os campos de texto que não
+// couberam no registro e foram gravados cortados
+type ImportStats struct {
+	Categories int `json:"categories"`
+	Products   int `json:"products"`
+	Events     int `json:"events"`
+	Truncated  int `json:"truncated"`
+	// Linhas ignoradas por causa de um campo numérico inválido
+	Rejected int `json:"rejected"`
+}
+
+// Importa o CSV linha a linha. Se ctx for cancelado, para antes da próxima
+// linha e retorna ctx.Err(); as linhas já importadas continuam gravadas. O
+// arquivo pode estar comprimido com gzip
+func ImportarCSV(ctx context.Context, filename string) (ImportStats, error) {
+	return ImportarCSVWithOptions(ctx, filename, CSVOptions{})
+}
+
+// Formato do CSV. O valor zero é o CSV padrão: vírgula, sem comentários e
+// aspas estritas
+type CSVOptions struct {
+	// Separador de campos; zero usa a vírgula
+	Comma rune
+	// Linhas que começam com esse caractere são ignoradas; zero desativa
+	Comment rune
+	// Aceita aspas no meio de campos sem aspas e aspas não escapadas
+	LazyQuotes bool
+	// Chamada para cada linha recusada por ter um campo numérico inválido,
+	// com o número da linha no arquivo. Se for nil, a linha é só impressa
+	OnRowError func(line int, err error)
+}
+
+func (opts CSVOptions) apply(reader *csv.Reader) {
+	if opts.Comma != 0 {
+		reader.Comma = opts.Comma
+	}
+	reader.Comment = opts.Comment
+	reader.LazyQuotes = opts.LazyQuotes
+	// Uma linha com outro número de colunas, como a de um arquivo lido com o
+	// separador errado, vira erro de leitura em vez de índice fora do limite
+	reader.FieldsPerRecord = USER_SESSION + 1
+}
+
+// Como ImportarCSV, para arquivos separados por tab, ponto e vírgula etc.
+func ImportarCSVWithOptions(ctx context.Context, filename string, opts CSVOptions) (ImportStats, error) {
+	// Os IDs vêm de Build*, sempre o último mais um, então a conferência de
+	// ID repetido seria só uma busca a mais por linha
+	return importCSV(ctx, filename, opts, ImportCheckpoint{}, false, Categories.Unchecked(), Products.Unchecked(), Events.Unchecked())
+}
+
+var ErrCheckpointMismatch = errors.New("checkpoint de importação é de outro arquivo")
+
+// Até onde uma importação chegou, gravado em IMPORT_CHECKPOINT_FILE a cada
+// IMPORT_FLUSH_EVERY linhas, junto com a sincronização do mapa de IDs
+// externos. Offset é a posição no CSV já descomprimido logo depois da
+// última linha processada, e FileSize o tamanho do arquivo importado, para
+// recusar a retomada com outro arquivo
+type ImportCheckpoint struct {
+	FileSize int64
+	Offset   int64
+	Row      int64
+}
+
+func writeImportCheckpoint(filename string, checkpoint ImportCheckpoint) error {
+	tempFile, err := createTempNear(filename)
+	if err != nil {
+		return err
+	}
+	tempFilename := tempFile.Name()
+	defer os.Remove(tempFilename)
+	defer tempFile.Close()
+
+	err = binary.Write(tempFile, Config.ByteOrder, checkpoint)
+	if err != nil {
+		return err
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+	return atomicReplace(tempFilename, filename)
+}
+
+// Lê o checkpoint; found é false se não há importação para retomar
+func readImportCheckpoint(filename string) (checkpoint ImportCheckpoint, found bool, err error) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return checkpoint, false, nil
+	} else if err != nil {
+		return checkpoint, false, err
+	}
+	err = binary.Read(bytes.NewReader(data), Config.ByteOrder, &checkpoint)
+	if err != nil {
+		return checkpoint, false, fmt.Errorf("%w: %s tem %d bytes", ErrTruncatedFile, filename, len(data))
+	}
+	return checkpoint, true, nil
+}
+
+// Continua uma importação interrompida a partir de IMPORT_CHECKPOINT_FILE,
+// pulando as linhas já processadas. As linhas entre o checkpoint e a falha
+// são lidas de novo, mas o mapa de IDs externos evita que sejam gravadas
+// duas vezes. Sem checkpoint, importa o arquivo inteiro. Assim como
+// ImportarCSV, o checkpoint é apagado quando a importação termina
+func ResumeImport(ctx context.Context, filename string) (ImportStats, error) {
+	return resumeImport(ctx, filename, CSVOptions{})
+}
+
+func resumeImport(ctx context.Context, filename string, opts CSVOptions) (ImportStats, error) {
+	checkpoint, found, err := readImportCheckpoint(IMPORT_CHECKPOINT_FILE)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	if found {
+		fileInfo, err := os.Stat(filename)
+		if err != nil {
+			return ImportStats{}, err
+		}
+		if fileInfo.Size() != checkpoint.FileSize {
+			return ImportStats{}, fmt.Errorf("%w: %s tem %d bytes, o checkpoint espera %d", ErrCheckpointMismatch, filename, fileInfo.Size(), checkpoint.FileSize)
+		}
+	}
+	return importCSV(ctx, filename, opts, checkpoint, false, Categories.Unchecked(), Products.Unchecked(), Events.Unchecked())
+}
+
+// Importa o CSV como ImportarCSV, mas sem gravar os índices a cada linha:
+// os pares (ID, offset) ficam em memória e cada índice é ordenado e gravado
+// numa única passada no fim, inclusive se ctx for cancelado. Os índices de
+// mais caro continuam sendo atualizados por linha. Os registros não passam
+// pelo WAL; se o processo morrer no meio, os índices ficam para trás dos
+// arquivos de dados e RebuildIndex os recupera
+func ImportSorted(ctx context.Context, filename string) (ImportStats, error) {
+	return importSorted(ctx, filename, CSVOptions{})
+}
+
+func importSorted(ctx context.Context, filename string, opts CSVOptions) (ImportStats, error) {
+	return importDeferred(ctx, filename, opts, false)
+}
+
+// Importa como ImportSorted, com IDs de FromExternal: o mesmo CSV importado
+// em diretórios vazios gera os mesmos IDs internos. Numa base que já tem
+// registros de outra importação os IDs podem colidir e ir para o seguinte
+// livre
+func ImportStable(ctx context.Context, filename string) (ImportStats, error) {
+	return importStable(ctx, filename, CSVOptions{})
+}
+
+func importStable(ctx context.Context, filename string, opts CSVOptions) (ImportStats, error) {
+	return importDeferred(ctx, filename, opts, true)
+}
+
+func importDeferred(ctx context.Context, filename string, opts CSVOptions, stableIDs bool) (ImportStats, error) {
+	categories := Categories.Deferred()
+	products := Products.Deferred()
+	events := Events.Deferred()
+
+	stats, err := importCSV(ctx, filename, opts, ImportCheckpoint{}, stableIDs, categories, products, events)
+	flushErr := firstError(categories.FlushDeferred(), products.FlushDeferred(), events.FlushDeferred())
+	if flushErr != nil {
+		return stats, flushErr
+	}
+
+	// As métricas por produto guardam o offset procurado no índice na hora
+	// da compra, e durante a importação o índice ainda não tinha o produto
+	refreshErr := RefreshProductMetricsLocations(PRODUCT_METRICS_FILE, PRODUCT_INDEX_FILE)
+	return stats, firstError(err, refreshErr)
+}
+
+// Importa a partir de start; o valor zero começa do início do arquivo. Com
+// stableIDs, os IDs saem de FromExternal com os IDs do CSV, e os stores
+// precisam ser de Deferred para que os índices fiquem ordenados
+func importCSV(ctx context.Context, filename string, opts CSVOptions, start ImportCheckpoint, stableIDs bool, categories *FileStore[Category], products *FileStore[Product], events *FileStore[Event]) (ImportStats, error) {
+	var stats ImportStats
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return stats, err
+	}
+
+	buffered := bufio.NewReader(file)
+	input, err := decompressedReader(buffered)
+	if err != nil {
+		return stats, fmt.Errorf("%s: %w", filename, err)
+	}
+	if start.Offset > 0 {
+		// Um arquivo gzip não permite Seek no texto descomprimido, então os
+		// bytes já importados são lidos e descartados
+		if input == io.Reader(buffered) {
+			_, err = file.Seek(start.Offset, io.SeekStart)
+			buffered.Reset(file)
+		} else {
+			_, err = io.CopyN(io.Discard, input, start.Offset)
+		}
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	csvReader := csv.NewReader(input)
+	opts.apply(csvReader)
+
+	if start.Offset == 0 {
+		_, err = csvReader.Read()
+		if err != nil {
+			return stats, fmt.Errorf("erro ao ler o cabeçalho de %s: %w", filename, err)
+		}
+	}
+	// IDs do CSV já importados, nesta ou em importações anteriores
+	imported, err := openExternalIDs(EXTERNAL_ID_MAP_FILE)
+	if err != nil {
+		return stats, err
+	}
+	defer imported.Close()
+	idsFor := func(external uint64) IDStrategy {
+		if stableIDs {
+			return FromExternal(external)
+		}
+		return SequentialIDs
+	}
+
+	for row := 1; ; row++ {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		if row%IMPORT_FLUSH_EVERY == 0 {
+			err = firstError(syncFiles(ACTION_METRICS_FILE, PRODUCT_METRICS_FILE), imported.Sync())
+			if err != nil {
+				return stats, fmt.Errorf("erro ao sincronizar as métricas: %w", err)
+			}
+			// Só depois do mapa de IDs: as linhas antes do checkpoint não
+			// são lidas de novo na retomada
+			err = writeImportCheckpoint(IMPORT_CHECKPOINT_FILE, ImportCheckpoint{
+				FileSize: fileInfo.Size(),
+				Offset:   start.Offset + csvReader.InputOffset(),
+				Row:      start.Row + int64(row) - 1,
+			})
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		column, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return stats, fmt.Errorf("erro ao ler %s: %w", filename, err)
+		}
+		Counters.ImportRows.Add(1)
+		//Verifica se a categoria já foi adicionada para evitar repetições
+		csvCategoryId, _ := strconv.Atoi(column[CATEGORY_ID])
+		categoryID, exists := imported.categories[uint64(csvCategoryId)]
+		if !exists {
+			category, created, err := importCategory(categories, column, idsFor(uint64(csvCategoryId)))
+			if errors.Is(err, ErrTruncated) {
+				stats.warnTruncated(err)
+			} else if err != nil {
+				return stats, fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", CATEGORY_DATA_FILE, err)
+			}
+			// Adiciona a categoria no map de já adicionados
+			err = imported.add(EXTERNAL_CATEGORY, uint64(csvCategoryId), category.ID)
+			if err != nil {
+				return stats, fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", EXTERNAL_ID_MAP_FILE, err)
+			}
+			if created {
+				stats.Categories++
+			}
+			categoryID = category.ID
+		}
+
+		//Verifica se o produto já foi adicionado para evitar repetições
+		csvProductId, _ := strconv.Atoi(column[PRODUCT_ID])
+		_, exists = imported.products[uint32(csvProductId)]
+		if !exists {
+			// BuildProduct só usa o ID da categoria
+			product, err := BuildProduct(column, Category{ID: categoryID}, idsFor(uint64(csvProductId)))
+			if errors.Is(err, ErrInvalidField) {
+				stats.reject(csvReader, opts, err)
+				continue
+			} else if errors.Is(err, ErrTruncated) {
+				stats.warnTruncated(err)
+			} else if err != nil {
+				return stats, err
+			}
+			err = addProduct(products, product)
+			if err != nil {
+				return stats, fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", PRODUCT_DATA_FILE, err)
+			}
+			// Adiciona o produto no map de já adicionados
+			err = imported.add(EXTERNAL_PRODUCT, uint64(csvProductId), product.ID)
+			if err != nil {
+				return stats, fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", EXTERNAL_ID_MAP_FILE, err)
+			}
+			stats.Products++
+		}
+
+		// Verifica se o evento já foi adicionado para evitar repetições. A sessão
+		// sozinha não identifica um evento: uma mesma sessão tem várias ações
+		eventKey := eventKeyHash(column)
+		if !imported.events[eventKey] {
+			event, err := BuildEvent(column, imported.products, idsFor(eventKey))
+			if errors.Is(err, ErrInvalidField) {
+				stats.reject(csvReader, opts, err)
+				continue
+			} else if errors.Is(err, ErrTruncated) {
+				stats.warnTruncated(err)
+			} else if err != nil {
+				return stats, err
+			}
+			err = addEvent(events, event)
+			if err != nil {
+				return stats, err
+			}
+			err = imported.add(EXTERNAL_EVENT, eventKey, event.ID)
+			if err != nil {
+				return stats, fmt.Errorf("não foi possível salvar registro no arquivo %s: %w", EXTERNAL_ID_MAP_FILE, err)
+			}
+			stats.Events++
+		}
+	}
+
+	err = syncFiles(ACTION_METRICS_FILE, PRODUCT_METRICS_FILE)
+	if err != nil {
+		return stats, fmt.Errorf("erro ao sincronizar as métricas: %w", err)
+	}
+	err = os.Remove(IMPORT_CHECKPOINT_FILE)
+	if err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// Os arquivos gzip são reconhecidos pelos dois primeiros bytes, e não pela
+// extensão, para que um .csv comprimido sem .gz também funcione
+func decompressedReader(reader *bufio.Reader) (io.Reader, error) {
+	magic, err := reader.Peek(2)
+	if err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return reader, nil
+	}
+	return gzip.NewReader(reader)
+}
+
+// Uma linha com número inválido não é gravada, em vez de virar um registro
+// com zero no lugar do valor
+func (stats *ImportStats) reject(csvReader *csv.Reader, opts CSVOptions, err error) {
+	stats.Rejected++
+	line, _ := csvReader.FieldPos(0)
+	if opts.OnRowError != nil {
+		opts.OnRowError(line, err)
+		return
+	}
+	logger.Warn("linha ignorada", "linha", line, "erro", err)
+}
+
+// Avisa e conta um campo truncado; err nil não faz nada
+func (stats *ImportStats) warnTruncated(err error) {
+	if err == nil {
+		return
+	}
+	logger.Warn("campo truncado", "erro", err)
+	stats.Truncated++
+}
+
+func CalcPercentage(parte, total float64) float64 {
+	if total == 0 {
+		return 0 // Evita divisão por zero
+	}
+	return (parte / total) * 100
+}
+
+func CalculatePercentageOfOcurrences(part Action, total Action) float64 {
+
+	partMetric, _ := SearchActionMetrics(ACTION_METRICS_FILE, part)
+	totalMetric, _ := SearchActionMetrics(ACTION_METRICS_FILE, total)
+
+	logger.Debug("porcentagem de ocorrências",
+		"parte", getActionName(part),
+		"ocorrencias_parte", partMetric.NumberOfOcurrences,
+		"total", getActionName(total),
+		"ocorrencias_total", totalMetric.NumberOfOcurrences,
+	)
+	return CalcPercentage(float64(partMetric.NumberOfOcurrences), float64(totalMetric.NumberOfOcurrences))
+}
+
+// Soma as ocorrências de todas as ações cujos bits cruzam com mask, por
+// exemplo CART|PURCHASE para "adicionou ao carrinho ou comprou"
+func SearchActionsMatching(mask Action) (uint32, error) {
+	file, err := os.Open(ACTION_METRICS_FILE)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var total uint32
+	reader := bufio.NewReader(file)
+	for {
+		storedMetrics, err := readActionMetrics(reader)
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		if storedMetrics.Action&mask != 0 {
+			total += storedMetrics.NumberOfOcurrences
+		}
+	}
+}
+
+// Lê as quatro métricas do funil em uma única passada pelo arquivo de métricas
+func Funnel() (views, carts, purchases, removes uint32, err error) {
+	counts, err := SnapshotMetrics()
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return counts[VIEW], counts[CART], counts[PURCHASE], counts[REMOVE_FROM_CART], nil
+}
+
+// Contagem atual de cada ação, lida em uma única varredura. Ações que nunca
+// ocorreram ficam fora do map
+func SnapshotMetrics() (map[Action]uint32, error) {
+	return SnapshotMetricsFile(ACTION_METRICS_FILE)
+}
+
+// Como SnapshotMetrics, com o arquivo de métricas de outro diretório
+func SnapshotMetricsFile(filename string) (map[Action]uint32, error) {
+	counts := map[Action]uint32{}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return counts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		storedMetrics, err := readActionMetrics(reader)
+		if err == io.EOF {
+			return counts, nil
+		} else if err != nil {
+			return nil, err
+		}
+		counts[storedMetrics.Action] = storedMetrics.NumberOfOcurrences
+	}
+}
+
+// Quantos eventos de cada ação aconteceram entre from e to (inclusive, em
+// segundos Unix). Diferente de SnapshotMetrics, que é o acumulado de tudo o
+// que já foi importado, conta direto no arquivo de eventos
+func ActionHistogram(from, to int64) (map[Action]uint32, error) {
+	if from > to {
+		return nil, fmt.Errorf("intervalo inválido: início %d depois do fim %d", from, to)
+	}
+
+	counts := map[Action]uint32{}
+	err := ForEach(EVENT_DATA_FILE, func(event Event) error {
+		if event.EventTime >= from && event.EventTime <= to {
+			counts[event.EventAction]++
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return counts, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Zera as métricas de ação, por exemplo para medir um novo período
+func ResetMetrics() error {
+	err := os.Truncate(ACTION_METRICS_FILE, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Percentual de visualizações que viraram adição ao carrinho
+func ViewToCartRate() float64 {
+	views, carts, _, _, err := Funnel()
+	if err != nil {
+		return 0
+	}
+	return CalcPercentage(float64(carts), float64(views))
+}
+
+// Percentual de adições ao carrinho que viraram compra
+func CartToPurchaseRate() float64 {
+	_, carts, purchases, _, err := Funnel()
+	if err != nil {
+		return 0
+	}
+	return CalcPercentage(float64(purchases), float64(carts))
+}
+
+// Percentual de adições ao carrinho que foram removidas
+func AbandonmentRate() float64 {
+	_, carts, _, removes, err := Funnel()
+	if err != nil {
+		return 0
+	}
+	return CalcPercentage(float64(removes), float64(carts))
+}
+
+// Os registros em JSON com os campos de texto sem os zeros do fim
+func (p Product) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID         uint32  `json:"id"`
+		CategoryID uint32  `json:"category_id"`
+		Brand      string  `json:"brand"`
+		Price      float32 `json:"price"`
+		Active     bool    `json:"active"`
+	}{p.ID, p.CategoryID, ByteArrayToString(p.Brand[:]), p.Price, p.Active})
+}
+
+func (c Category) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID   uint32 `json:"id"`
+		Name string `json:"name"`
+	}{c.ID, ByteArrayToString(c.Name[:])})
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID          uint32 `json:"id"`
+		UserSession string `json:"user_session"`
+		UserID      uint32 `json:"user_id"`
+		ProductID   uint32 `json:"product_id"`
+		EventAction string `json:"event_action"`
+		EventTime   int64  `json:"event_time"`
+	}{e.ID, ByteArrayToString(e.UserSession[:]), e.UserID, e.ProductID, getActionName(e.EventAction), e.EventTime})
+}
+
+// Tamanho máximo do CSV enviado para POST /import
+const MAX_IMPORT_UPLOAD = 1 << 30
+
+// API HTTP sobre os arquivos do Store:
+//
+//	GET  /products/{id}         produto ativo pelo ID
+//	GET  /products?min=&max=    produtos ativos com preço no intervalo
+//	GET  /stats                 métricas de eventos e de preços
+//	GET  /metrics               contadores de operações (Counters)
+//	GET  /debug/vars            os mesmos contadores, pelo expvar
+//	POST /import                importa o CSV do campo "file" (multipart)
+//
+// As leituras não enxergam o que ainda está nos buffers dos escritores do
+// Store antes de Flush. A importação usa os arquivos do diretório atual, como
+// ImportarCSV, e só é aceita se o Store for desse diretório; depois dela os
+// escritores do Store não devem ser usados, já que os arquivos cresceram por
+// fora deles
+func NewHandler(store *Store) http.Handler {
+	var importMu sync.Mutex
+	mux := http.NewServeMux()
+
+	// Rotas sem método nem curingas no padrão, que o ServeMux só entende a
+	// partir do Go 1.22; o método é conferido em cada handler
+	mux.HandleFunc("/products/", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		id, err := parseID(strings.TrimPrefix(r.URL.Path, "/products/"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		product, found, err := GetProductByID(store.Path(PRODUCT_DATA_FILE), store.Path(PRODUCT_INDEX_FILE), id)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !found || !product.Active {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("Produto com ID %d não encontrado", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, product)
+	})
+
+	mux.HandleFunc("/products", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		min, err := parsePriceParam(r, "min", 0)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		max, err := parsePriceParam(r, "max", math.MaxFloat32)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		products, err := QueryProductsByPriceRange(store.Path(PRODUCT_DATA_FILE), min, max)
+		if os.IsNotExist(err) {
+			products = []Product{}
+		} else if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, products)
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		stats, err := statsReport(store)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := Counters.WritePrometheus(w)
+		if err != nil {
+			logger.Error("erro ao escrever a resposta", "erro", err)
+		}
+	})
+
+	vars := expvar.Handler()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		vars.ServeHTTP(w, r)
+	})
+
+	mux.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		dir, err := filepath.Abs(store.Dir)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		cwd, err := os.Getwd()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if dir != cwd {
+			writeJSONError(w, http.StatusNotImplemented, fmt.Errorf("a importação só grava no diretório atual, e o Store é de %s", store.Dir))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MAX_IMPORT_UPLOAD)
+		upload, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("campo \"file\" com o CSV: %w", err))
+			return
+		}
+		defer upload.Close()
+
+		importMu.Lock()
+		defer importMu.Unlock()
+		stats, err := importUpload(r.Context(), store, upload)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+	return mux
+}
+
+// Responde 405 se a requisição não for do método esperado
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("método %s não permitido", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		logger.Error("erro ao escrever a resposta", "erro", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"erro": err.Error()})
+}
+
+// Parâmetro de preço da query string, ou def se não vier
+func parsePriceParam(r *http.Request, name string, def float32) (float32, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	price, err := strconv.ParseFloat(raw, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s inválido %q: %v", name, raw, err)
+	}
+	return float32(price), nil
+}
+
+type PriceSummary struct {
+	Min    float32 `json:"min"`
+	Max    float32 `json:"max"`
+	Mean   float32 `json:"mean"`
+	Median float32 `json:"median"`
+}
+
+// O mesmo que o comando stats mostra. Sem produtos ativos, Prices e
+// MostExpensive ficam nil
+type StatsReport struct {
+	Actions       map[string]uint32 `json:"actions"`
+	Prices        *PriceSummary     `json:"prices"`
+	MostExpensive *Product          `json:"most_expensive"`
+}
+
+func statsReport(store *Store) (StatsReport, error) {
+	stats := StatsReport{Actions: map[string]uint32{}}
+	counts, err := SnapshotMetricsFile(store.Path(ACTION_METRICS_FILE))
+	if err != nil {
+		return stats, err
+	}
+	for _, action := range []Action{VIEW, CART, PURCHASE, REMOVE_FROM_CART} {
+		stats.Actions[getActionName(action)] = counts[action]
+	}
+
+	min, max, mean, median, err := PriceStats(store.Path(PRODUCT_DATA_FILE))
+	if err == ErrNoActiveProducts || os.IsNotExist(err) {
+		return stats, nil
+	} else if err != nil {
+		return stats, err
+	}
+	stats.Prices = &PriceSummary{Min: min, Max: max, Mean: mean, Median: median}
+
+	mostExpensive, err := SearchMostExpensiveProduct(store.Path(MOST_EXPENSIVE_PRODUCT_FILE))
+	if err != nil {
+		return stats, err
+	}
+	stats.MostExpensive = &mostExpensive
+	return stats, nil
+}
+
+// Grava o CSV recebido num arquivo temporário, que ImportarCSV precisa para
+// detectar gzip e reportar as linhas, e importa
+func importUpload(ctx context.Context, store *Store, upload io.Reader) (ImportStats, error) {
+	temp, err := createTempNear(store.Path("import.csv"))
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = io.Copy(temp, upload)
+	err = firstError(err, temp.Close())
+	if err != nil {
+		return ImportStats{}, err
+	}
+	return ImportarCSV(ctx, temp.Name())
 }
-func RemoveProductFromDataFile[T any](dataFilename string, tempFilename string, offsetToRemove int64, dataType T) error {
-	dataFile := CreateOrOpenFile(dataFilename)
-	defer dataFile.Close()
 
-	// Arquivo temporário para reorganizar os dados
-	tempDataFile := CreateOrOpenFile(tempFilename)
-	defer tempDataFile.Close()
+func printProduct(product Product) {
+	fmt.Printf(
+		"{ID: %d, CategoryID: %d, Brand: %s, Price: %.2f, Active: %t}\n",
+		product.ID,
+		product.CategoryID,
+		ByteArrayToString(product.Brand[:]),
+		product.Price,
+		product.Active,
+	)
+}
 
-	// Tamanho do registro de produto
-	recordSize, err := SizeOf(dataType)
+func parseID(arg string) (uint32, error) {
+	id, err := strconv.ParseUint(arg, 10, 32)
 	if err != nil {
-		fmt.Print(err)
+		return 0, fmt.Errorf("ID inválido %q: %v", arg, err)
 	}
+	return uint32(id), nil
+}
 
-	// Percorre o arquivo atual
-	currentOffset := int64(0)
-	for {
-		var product T
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Uso: %s [-v] <comando> [argumentos]
 
-		err = binary.Read(dataFile, binary.LittleEndian, &product)
-		if err == io.EOF {
-			break // Fim do arquivo
-		} else if err != nil {
-			return err
-		}
+  -v                       mostra as mensagens de diagnóstico
 
-		// Será removido apenas o registro com offset igual ao procurado, o restante será copiado para o arquivo temporário
-		if currentOffset != offsetToRemove {
-			err = binary.Write(tempDataFile, binary.LittleEndian, product)
-			if err != nil {
-				return err
-			}
-		}
-		currentOffset += int64(recordSize)
+Comandos:
+  import [-sorted] <csv>   importa produtos, categorias e eventos do CSV
+                           (-sorted grava os índices uma vez só, no fim;
+                           -stable faz o mesmo com IDs derivados dos do CSV;
+                           -resume continua a partir do checkpoint;
+                           -delimiter e -lazy-quotes mudam o formato)
+  get product <id>         mostra um produto
+  list products            lista os produtos ativos (-offset, -limit) ou
+                           os removidos (-deleted)
+  remove product <id>      remove (desativa) um produto
+  remove event <id>        remove um evento e o desconta das métricas
+  reactivate product <id>  reativa um produto removido
+  stats                    mostra métricas de eventos e preços
+  compact                  remove fisicamente os produtos inativos
+                           (-all também refaz os índices de todos os arquivos)
+  verify                   confere o índice de produtos contra o arquivo de dados
+  backup <dir>             copia todos os arquivos para dir, que não pode ter arquivos
+  restore <dir>            troca os arquivos pelos de um backup
+  serve [-addr :8080]      expõe get, list, stats e import numa API HTTP
+`, os.Args[0])
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	sorted := flags.Bool("sorted", false, "grava os índices uma vez só, no fim da importação")
+	stable := flags.Bool("stable", false, "como -sorted, com IDs derivados dos IDs do CSV")
+	resume := flags.Bool("resume", false, "continua a importação interrompida a partir do checkpoint")
+	delimiter := flags.String("delimiter", ",", "separador de campos (um caractere, ou \"tab\")")
+	lazyQuotes := flags.Bool("lazy-quotes", false, "aceita aspas mal formadas")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("uso: import [-sorted | -stable | -resume] [-delimiter c] [-lazy-quotes] <csv>")
+	}
+	if (*sorted || *stable) && *resume {
+		return errors.New("-sorted e -stable não podem ser usados com -resume")
 	}
+	opts := CSVOptions{LazyQuotes: *lazyQuotes}
+	if *delimiter == "tab" {
+		*delimiter = "\t"
+	}
+	if utf8.RuneCountInString(*delimiter) != 1 {
+		return fmt.Errorf("separador inválido %q", *delimiter)
+	}
+	opts.Comma, _ = utf8.DecodeRuneInString(*delimiter)
 
-	tempDataFile.Close()
-	dataFile.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	err = os.Remove(dataFilename)
-	if err != nil {
-		log.Fatalf("Falha ao remover arquivo: %v\n", err)
+	importer := ImportarCSVWithOptions
+	if *stable {
+		importer = importStable
+	} else if *sorted {
+		importer = importSorted
+	} else if *resume {
+		importer = resumeImport
 	}
-	err = os.Rename(tempFilename, dataFilename)
+	stats, err := importer(ctx, flags.Arg(0), opts)
 	if err != nil {
-		return err
+		return fmt.Errorf("importação interrompida depois de %d eventos: %w", stats.Events, err)
+	}
+	fmt.Printf("Importados: %d categorias, %d produtos, %d eventos\n", stats.Categories, stats.Products, stats.Events)
+	if stats.Truncated > 0 {
+		fmt.Printf("%d campos de texto foram truncados\n", stats.Truncated)
+	}
+	if stats.Rejected > 0 {
+		fmt.Printf("%d linhas ignoradas por campos numéricos inválidos\n", stats.Rejected)
 	}
 	return nil
 }
 
-func RemoveFromIndexFile(indexFilename string, idToRemove uint32) error {
-	indexFile := CreateOrOpenFile(indexFilename)
-	defer indexFile.Close()
-
-	tempIndexFile := CreateOrOpenFile("temp_index.bin")
-	defer tempIndexFile.Close()
-
-	for {
-		var indexEntry IndexEntry
-
-		err := binary.Read(indexFile, binary.LittleEndian, &indexEntry)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
-		}
-
-		if indexEntry.ID != idToRemove {
-			err = binary.Write(tempIndexFile, binary.LittleEndian, indexEntry)
-			if err != nil {
-				return err
-			}
-		}
+func runGet(args []string) error {
+	if len(args) != 2 || args[0] != "product" {
+		return errors.New("uso: get product <id>")
 	}
-
-	tempIndexFile.Close()
-	indexFile.Close()
-	err := os.Remove(indexFilename)
+	id, err := parseID(args[1])
 	if err != nil {
-		log.Fatalf("Falha ao remover arquivo: %v\n", err)
+		return err
 	}
-	err = os.Rename("temp_index.bin", indexFilename)
+
+	product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, id)
 	if err != nil {
 		return err
 	}
+	if !found || !product.Active {
+		return fmt.Errorf("Produto com ID %d não encontrado", id)
+	}
+	printProduct(product)
 	return nil
 }
 
-func RemoveByID[T any](indexFilename string, dataFilename string, tempFilename string, itemID uint32, dataType T) error {
-	indexFile := CreateOrOpenFile(indexFilename)
-	defer indexFile.Close()
-
-	offset, found := BinarySearchOnDisk(indexFilename, itemID)
-	if !found {
-		return fmt.Errorf("Arquivo não encontrado\n")
+func runList(args []string) error {
+	if len(args) == 0 || args[0] != "products" {
+		return errors.New("uso: list products [-offset n] [-limit n] [-deleted]")
 	}
-	err := RemoveProductFromDataFile(dataFilename, tempFilename, offset, dataType)
+	flags := flag.NewFlagSet("list products", flag.ContinueOnError)
+	offset := flags.Int("offset", 0, "quantidade de produtos ativos a pular")
+	limit := flags.Int("limit", 20, "quantidade máxima de produtos")
+	deleted := flags.Bool("deleted", false, "lista os produtos removidos em vez dos ativos")
+	err := flags.Parse(args[1:])
 	if err != nil {
-		log.Fatalf("Não foi possível remover registro do arquivo de dados: %v\n", err)
+		return err
 	}
 
-	err = RemoveFromIndexFile(indexFilename, itemID)
+	var products []Product
+	if *deleted {
+		products, err = ListDeletedProducts(PRODUCT_DATA_FILE)
+	} else {
+		products, err = ListProducts(PRODUCT_DATA_FILE, *offset, *limit)
+	}
 	if err != nil {
-		log.Fatalf("Não foi possível remover registro do arquivo de índices: %v\n", err)
+		return err
+	}
+	for _, product := range products {
+		printProduct(product)
 	}
-
 	return nil
 }
-func PrintAllProducts(filename string) {
-	file := CreateOrOpenFile(filename)
-	defer file.Close()
-
-	for {
-		var product Product
-		err := binary.Read(file, binary.LittleEndian, &product)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("Não foi possível ler o arquivo: %v", err)
-		}
-
-		if product.Active {
-			fmt.Printf(
-				"{ID: %d, CategoryID: %d, Brand: %s, Price: %.2f}\n",
-				product.ID,
-				product.CategoryID,
-				product.Brand,
-				product.Price,
-			)
-		}
 
+func runRemove(args []string) error {
+	if len(args) != 2 || (args[0] != "product" && args[0] != "event") {
+		return errors.New("uso: remove product|event <id>")
 	}
-}
-func PrintAllCategorys(filename string) {
-	file := CreateOrOpenFile(filename)
-	defer file.Close()
-
-	for {
-		var category Category
-		err := binary.Read(file, binary.LittleEndian, &category)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("Não foi possível ler o arquivo: %v", err)
-		}
-
-		fmt.Printf("{ID: %d, Name: %s}\n", category.ID, category.Name)
+	id, err := parseID(args[1])
+	if err != nil {
+		return err
 	}
-}
-func PrintAllEvents(filename string) {
-	file := CreateOrOpenFile(filename)
-	defer file.Close()
 
-	for {
-		var event Event
-		err := binary.Read(file, binary.LittleEndian, &event)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("Não foi possível ler o arquivo: %v", err)
+	if args[0] == "event" {
+		err = RemoveEvent(id)
+		if err != nil {
+			return err
 		}
-
-		fmt.Printf("{ID: %d, UserSession: %s, UserID: %d, ProductID: %d, EventAction: %s, EventTime: %s}\n",
-			event.ID,
-			event.UserSession,
-			event.UserID,
-			event.ProductID,
-			getActionName(event.EventAction),
-			event.EventTime,
-		)
-
+		fmt.Printf("Evento %d removido\n", id)
+		return nil
+	}
+	err = RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Produto %d removido\n", id)
+	return nil
 }
 
-func ReadLastProduct(dataFilename string) *Product {
-	dataFile := CreateOrOpenFile(dataFilename)
-	defer dataFile.Close()
-
-	fileInfo, _ := dataFile.Stat()
-	if fileInfo.Size() == 0 {
-		return nil
+func runReactivate(args []string) error {
+	if len(args) != 2 || args[0] != "product" {
+		return errors.New("uso: reactivate product <id>")
 	}
-
-	recordSize := binary.Size(Product{})
-
-	_, err := dataFile.Seek(-int64(recordSize), io.SeekEnd)
+	id, err := parseID(args[1])
 	if err != nil {
-		log.Fatalf("Não foi possível olhar o último registro: %v\n", err)
+		return err
 	}
 
-	var lastProduct Product
-	err = binary.Read(dataFile, binary.LittleEndian, &lastProduct)
+	err = ReactivateProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
 	if err != nil {
-		log.Fatalf("Não foi possível ler o último registro: %v\n", err)
+		return err
 	}
-
-	return &lastProduct
+	fmt.Printf("Produto %d reativado\n", id)
+	return nil
 }
-func ReadLastCategory(dataFilename string) *Category {
-	dataFile := CreateOrOpenFile(dataFilename)
-	defer dataFile.Close()
 
-	fileInfo, _ := dataFile.Stat()
-	if fileInfo.Size() == 0 {
-		return nil
+func runStats(args []string) error {
+	views, carts, purchases, removes, err := Funnel()
+	if err != nil {
+		return err
 	}
+	fmt.Printf("Ocorrências para a métrica %s: %d\n", getActionName(VIEW), views)
+	fmt.Printf("Ocorrências para a métrica %s: %d\n", getActionName(CART), carts)
+	fmt.Printf("Ocorrências para a métrica %s: %d\n", getActionName(PURCHASE), purchases)
+	fmt.Printf("Ocorrências para a métrica %s: %d\n", getActionName(REMOVE_FROM_CART), removes)
+	fmt.Printf("Visualização -> carrinho: %.2f\n", ViewToCartRate())
+	fmt.Printf("Carrinho -> compra: %.2f\n", CartToPurchaseRate())
+	fmt.Printf("Abandono de carrinho: %.2f\n", AbandonmentRate())
 
-	recordSize := binary.Size(Category{})
+	min, max, mean, median, err := PriceStats(PRODUCT_DATA_FILE)
+	if err == ErrNoActiveProducts {
+		fmt.Println("Nenhum produto ativo")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("Preços: min %.2f, max %.2f, média %.2f, mediana %.2f\n", min, max, mean, median)
 
-	_, err := dataFile.Seek(-int64(recordSize), io.SeekEnd)
+	mostExpensiveProduct, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
 	if err != nil {
-		log.Fatalf("Não foi possível olhar o último registro: %v\n", err)
+		return err
 	}
+	fmt.Printf("Produto mais caro: ")
+	printProduct(mostExpensiveProduct)
+	return nil
+}
 
-	var lastCategory Category
-	err = binary.Read(dataFile, binary.LittleEndian, &lastCategory)
+func runCompact(args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ContinueOnError)
+	all := flags.Bool("all", false, "compacta todos os arquivos e refaz todos os índices")
+	err := flags.Parse(args)
 	if err != nil {
-		log.Fatalf("Não foi possível ler o último registro: %v\n", err)
+		return err
 	}
 
-	return &lastCategory
-}
-func ReadLastEvent(dataFilename string) *Event {
-	dataFile := CreateOrOpenFile(dataFilename)
-	defer dataFile.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	fileInfo, _ := dataFile.Stat()
-	if fileInfo.Size() == 0 {
+	if *all {
+		err = CompactAll(ctx, ".")
+		if err != nil {
+			return err
+		}
+		fmt.Println("Arquivos compactados e índices refeitos")
 		return nil
 	}
-
-	recordSize := binary.Size(Event{})
-
-	_, err := dataFile.Seek(-int64(recordSize), io.SeekEnd)
+	err = Compact(ctx, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
 	if err != nil {
-		log.Fatalf("Não foi possível olhar o último registro: %v\n", err)
+		return err
 	}
+	fmt.Println("Arquivo de produtos compactado")
+	return nil
+}
 
-	var lastEvent Event
-	err = binary.Read(dataFile, binary.LittleEndian, &lastEvent)
+func runVerify(args []string) error {
+	problems, err := VerifyStore(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
 	if err != nil {
-		log.Fatalf("Não foi possível ler o último registro: %v\n", err)
+		return err
 	}
-
-	return &lastEvent
-}
-
-func BuildCategory(column []string) Category {
-	var nextID uint32
-	lastCategory := ReadLastCategory(CATEGORY_DATA_FILE)
-	if lastCategory == nil {
-		nextID = 0
-	} else {
-		nextID = lastCategory.ID + 1
+	for _, problem := range problems {
+		fmt.Printf("ID %d, offset %d: %s\n", problem.ID, problem.Offset, problem.Kind)
 	}
-	category := Category{
-		ID:   nextID,
-		Name: StringToByteArray(column[CATEGORY_CODE]),
+	if len(problems) > 0 {
+		return fmt.Errorf("%d inconsistências entre %s e %s", len(problems), PRODUCT_INDEX_FILE, PRODUCT_DATA_FILE)
 	}
-	return category
+	fmt.Println("Índice e arquivo de dados consistentes")
+	return nil
 }
-func BuildProduct(column []string, productCategory Category) Product {
-	var nextID uint32
-	lastProduct := ReadLastProduct(PRODUCT_DATA_FILE)
-	if lastProduct == nil {
-		nextID = 0
-	} else {
-		nextID = lastProduct.ID + 1
+
+func runBackup(args []string) error {
+	if len(args) != 1 {
+		return errors.New("uso: backup <dir>")
 	}
-	productPrice, _ := strconv.ParseFloat(column[PRICE], 32)
-	product := Product{
-		ID:         uint32(nextID),
-		CategoryID: productCategory.ID,
-		Brand:      StringToByteArray(column[BRAND]),
-		Price:      float32(productPrice),
-		Active:     true,
+	err := Backup(".", args[0])
+	if err != nil {
+		return err
 	}
-	return product
+	fmt.Printf("Backup gravado em %s\n", args[0])
+	return nil
 }
-func BuildEvent(column []string) Event {
-	var nextID uint32
-	lastEvent := ReadLastEvent(EVENT_DATA_FILE)
-	if lastEvent == nil {
-		nextID = 0
-	} else {
-		nextID = lastEvent.ID + 1
+
+func runRestore(args []string) error {
+	if len(args) != 1 {
+		return errors.New("uso: restore <dir>")
 	}
-	userId, _ := strconv.Atoi(column[USER_ID])
-	event := Event{
-		ID:          nextID,
-		UserSession: StringTo50ByteArray(column[USER_SESSION]),
-		UserID:      uint32(userId),
-		EventAction: getActionFromName(column[EVENT_TYPE]),
-		EventTime:   StringToByteArray(column[EVENT_TIME]),
+	err := Restore(args[0], ".")
+	if err != nil {
+		return err
 	}
-	return event
-}
-func AddProduct(product Product) {
-	Append(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, product, product.ID)
-	fmt.Printf("Adicionado produto de ID %d\n", product.ID)
-	fmt.Printf("{ID: %d, CategoryID: %d, Brand: %s, Price: %.2f, Active: %t}\n", product.ID, product.CategoryID, product.Brand, product.Price, product.Active)
-	UpdateMostExpensiveProductIndex(MOST_EXPENSIVE_PRODUCT_FILE, product)
-}
-func AddEvent(event Event) {
-	Append(EVENT_DATA_FILE, EVENT_INDEX_FILE, event, event.ID)
-	StoreActionMetrics(ACTION_METRICS_FILE, event.EventAction)
+	fmt.Printf("Arquivos restaurados de %s\n", args[0])
+	return nil
 }
-func ImportarCSV(filename string) {
-	file, err := os.Open(filename)
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "endereço em que a API escuta")
+	err := flags.Parse(args)
 	if err != nil {
-		log.Fatalf("Erro ao abrir arquivo")
+		return err
 	}
-	defer file.Close()
-
-	reader := bufio.NewReader(file)
-	csvReader := csv.NewReader(reader)
 
-	_, err = csvReader.Read()
+	store, err := OpenStore(".")
 	if err != nil {
-		log.Fatalf("Erro ao ler header")
+		return err
 	}
-	productId := 0
-	categoryId := 0
-	eventId := 0
-
-	addedProducts := make(map[uint32]int)
-	addedCategorys := make(map[uint64]int)
-	addedEvents := make(map[string]int)
-
-	for {
-		column, err := csvReader.Read()
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			log.Fatalf("Erro ao ler o arquivo: %v", err)
-		}
-		//Verifica se a categoria já foi adicionada para evitar repetições
-		csvCategoryId, _ := strconv.Atoi(column[CATEGORY_ID])
-		_, exists := addedCategorys[uint64(csvCategoryId)]
-		var category Category
-		if !exists {
-			category = BuildCategory(column)
-			Append(CATEGORY_DATA_FILE, CATEGORY_INDEX_FILE, category, category.ID)
-			// Adiciona a categoria no map de já adicionados
-			addedCategorys[uint64(csvCategoryId)] = categoryId
-		}
+	defer store.Close()
 
-		//Verifica se o produto já foi adicionado para evitar repetições
-		csvProductId, _ := strconv.Atoi(column[PRODUCT_ID])
-		_, exists = addedProducts[uint32(csvProductId)]
-		if !exists {
-			product := BuildProduct(column, category)
-			AddProduct(product)
-			// Adiciona o produto no map de já adicionados
-			addedProducts[uint32(csvProductId)] = productId
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-		//Verifica se a sessão já foi adicionada para evitar repetições
-		strUserSession := column[USER_SESSION]
-		_, exists = addedEvents[strUserSession]
-		if !exists {
-			event := BuildEvent(column)
-			AddEvent(event)
-			addedEvents[strUserSession] = eventId
-		}
+	server := &http.Server{Addr: *addr, Handler: NewHandler(store)}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	fmt.Printf("API escutando em %s\n", *addr)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
 	}
+	return err
 }
 
-func CalcPercentage(parte, total float64) float64 {
-	if total == 0 {
-		return 0 // Evita divisão por zero
+func runCommand(args []string) error {
+	switch args[0] {
+	case "import":
+		return runImport(args[1:])
+	case "get":
+		return runGet(args[1:])
+	case "list":
+		return runList(args[1:])
+	case "remove":
+		return runRemove(args[1:])
+	case "reactivate":
+		return runReactivate(args[1:])
+	case "stats":
+		return runStats(args[1:])
+	case "compact":
+		return runCompact(args[1:])
+	case "verify":
+		return runVerify(args[1:])
+	case "backup":
+		return runBackup(args[1:])
+	case "restore":
+		return runRestore(args[1:])
+	case "serve":
+		return runServe(args[1:])
+	default:
+		flag.Usage()
+		return fmt.Errorf("comando desconhecido %q", args[0])
 	}
-	return (parte / total) * 100
 }
 
-func CalculatePercentageOfOcurrences(part Action, total Action) float64 {
-
-	partMetric, _ := SearchActionMetrics(ACTION_METRICS_FILE, part)
-	totalMetric, _ := SearchActionMetrics(ACTION_METRICS_FILE, total)
-
-	fmt.Printf("\n\nParte: %s, Binario: %v, Ocorrencias: %d\n",
-		getActionName(part),
-		part,
-		partMetric.NumberOfOcurrences,
-	)
-	fmt.Printf("Total: %s, Binario: %v, Ocorrencias: %d\n",
-		getActionName(total),
-		total,
-		totalMetric.NumberOfOcurrences,
-	)
-	return CalcPercentage(float64(partMetric.NumberOfOcurrences), float64(totalMetric.NumberOfOcurrences))
-}
 func main() {
-
-	// PopularArquivos()
-	ImportarCSV("test.csv")
-
-	fmt.Printf("\n")
-	offset, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 3)
-	if found {
-		fmt.Printf("Registro encontrado\n")
-		product := ReadFromDataFile[Product](PRODUCT_DATA_FILE, offset)
-		fmt.Printf(
-			"{ID: %d, CategoryID: %d, Brand: %s, Price: %.2f, Active: %t}\n",
-			product.ID,
-			product.CategoryID,
-			product.Brand,
-			product.Price,
-			product.Active,
-		)
-	} else {
-		fmt.Printf("Registro não encontrado\n")
+	flag.Usage = usage
+	verbose := flag.Bool("v", false, "mostra as mensagens de diagnóstico")
+	flag.Parse()
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelDebug
 	}
+	SetLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
 
-	viewMetrics, err := SearchActionMetrics(ACTION_METRICS_FILE, VIEW)
+	err := ValidateSchema()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Esquema inválido: %v", err)
 	}
-	fmt.Printf("Ocorrências para a métrica %s: %d\n",
-		getActionName(VIEW),
-		viewMetrics.NumberOfOcurrences,
-	)
 
-	purchaseMetrics, err := SearchActionMetrics(ACTION_METRICS_FILE, PURCHASE)
+	replayed, err := RecoverWAL()
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Falha ao recuperar o WAL: %v", err)
 	}
-	fmt.Printf("Ocorrências para a métrica %s: %d\n",
-		getActionName(PURCHASE),
-		purchaseMetrics.NumberOfOcurrences,
-	)
-
-	cartMetrics, err := SearchActionMetrics(ACTION_METRICS_FILE, CART)
-	if err != nil {
-		log.Fatal(err)
+	if replayed > 0 {
+		fmt.Printf("%d operações refeitas a partir do WAL\n", replayed)
 	}
-	fmt.Printf("Ocorrências para a métrica %s: %d\n",
-		getActionName(CART),
-		cartMetrics.NumberOfOcurrences,
-	)
 
-	removeFromCartMetrics, err := SearchActionMetrics(ACTION_METRICS_FILE, REMOVE_FROM_CART)
-	if err != nil {
-		log.Fatal(err)
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
 	}
-	fmt.Printf("Ocorrências para a métrica %s: %d\n",
-		getActionName(REMOVE_FROM_CART),
-		removeFromCartMetrics.NumberOfOcurrences,
-	)
-	fmt.Printf("\n\n")
-	mostExpensiveProduct, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+
+	err = runCommand(flag.Args())
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "Erro: %v\n", err)
+		os.Exit(1)
 	}
-	fmt.Printf("Dados produto mais caro:")
-	fmt.Printf(
-		"{ID: %d, CategoryID: %d, Brand: %s, Price: %.2f, Active: %t}\n",
-		mostExpensiveProduct.ID,
-		mostExpensiveProduct.CategoryID,
-		mostExpensiveProduct.Brand,
-		mostExpensiveProduct.Price,
-		mostExpensiveProduct.Active,
-	)
-	fmt.Printf("\n\n\n")
-	fmt.Printf("Listando todos os produtos registrados:\n")
-	PrintAllProducts(PRODUCT_DATA_FILE)
-
-	RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, 1)
-	fmt.Printf("\nRegistro excluído\n")
-	mostExpensiveProduct, _ = SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
-	fmt.Printf(
-		"Produto mais caro: {ID: %d, CategoryID: %d, Brand: %s, Price: %.2f, Active: %t}\n\n",
-		mostExpensiveProduct.ID,
-		mostExpensiveProduct.CategoryID,
-		mostExpensiveProduct.Brand,
-		mostExpensiveProduct.Price,
-		mostExpensiveProduct.Active,
-	)
-
-	PrintAllProducts(PRODUCT_DATA_FILE)
-	PrintAllCategorys(CATEGORY_DATA_FILE)
-	PrintAllEvents(EVENT_DATA_FILE)
-	// var categoryType Category
-	// RemoveByID(CATEGORY_INDEX_FILE, CATEGORY_DATA_FILE, "temp_category.bin", 3, categoryType)
-	// PrintAllCategorys(CATEGORY_DATA_FILE)
-	fmt.Printf("Abandono de carrinho: %.2f", CalculatePercentageOfOcurrences(REMOVE_FROM_CART, CART))
 }
@@ -0,0 +1,5222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Os testes usam os nomes relativos dos arquivos globais (PRODUCT_DATA_FILE,
+// ...), então cada um roda em um diretório temporário próprio. Os IDs já
+// entregues por SequentialIDs são esquecidos, como num processo novo
+func inTempDir(tb testing.TB) {
+	tb.Helper()
+	tb.Chdir(tb.TempDir())
+	SequentialIDs = &Sequential{}
+}
+
+// Copia teste.txt para test.csv em um diretório temporário e o importa
+func importSample(tb testing.TB) ImportStats {
+	tb.Helper()
+	sample, err := os.ReadFile("teste.txt")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	inTempDir(tb)
+	if err := os.WriteFile("test.csv", sample, 0644); err != nil {
+		tb.Fatal(err)
+	}
+
+	stats, err := ImportarCSV(context.Background(), "test.csv")
+	if err != nil {
+		tb.Fatalf("ImportarCSV: %v", err)
+	}
+	return stats
+}
+
+const csvHeader = "event_time,event_type,product_id,category_id,category_code,brand,price,user_id,user_session\n"
+
+// Grava um CSV no formato do dataset com as linhas dadas, depois do cabeçalho
+func writeCSV(t *testing.T, filename string, lines ...string) {
+	t.Helper()
+	content := csvHeader + strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Linhas de dados do test.csv, sem o cabeçalho
+func sampleRows(t *testing.T) [][]string {
+	t.Helper()
+	file, err := os.Open("test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows[1:]
+}
+
+// Todos os registros do arquivo de dados, na ordem do arquivo
+func readAll[T any](t *testing.T, dataFilename string) []T {
+	t.Helper()
+	records := []T{}
+	err := ForEach(dataFilename, func(record T) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// Troca um byte no meio do registro de posição n, sem atualizar o checksum
+func corruptRecord[T any](t *testing.T, dataFilename string, n int64) {
+	t.Helper()
+	file, err := os.OpenFile(dataFilename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	offset := dataHeaderSize + n*dataRecordSize[T]() + 5
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{^b[0]}, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storeActions(t *testing.T, counts map[Action]int) {
+	t.Helper()
+	for action, n := range counts {
+		for i := 0; i < n; i++ {
+			if err := StoreActionMetrics(ACTION_METRICS_FILE, action); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFunnelRates(t *testing.T) {
+	inTempDir(t)
+	if rate := ViewToCartRate(); rate != 0 {
+		t.Errorf("ViewToCartRate sem métricas = %v, quer 0", rate)
+	}
+
+	storeActions(t, map[Action]int{VIEW: 10, CART: 4, PURCHASE: 1, REMOVE_FROM_CART: 2})
+
+	views, carts, purchases, removes, err := Funnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if views != 10 || carts != 4 || purchases != 1 || removes != 2 {
+		t.Fatalf("Funnel = %d, %d, %d, %d, quer 10, 4, 1, 2", views, carts, purchases, removes)
+	}
+	if rate := ViewToCartRate(); rate != 40 {
+		t.Errorf("ViewToCartRate = %v, quer 40", rate)
+	}
+	if rate := CartToPurchaseRate(); rate != 25 {
+		t.Errorf("CartToPurchaseRate = %v, quer 25", rate)
+	}
+	if rate := AbandonmentRate(); rate != 50 {
+		t.Errorf("AbandonmentRate = %v, quer 50", rate)
+	}
+}
+
+func TestTopProductsByPurchase(t *testing.T) {
+	inTempDir(t)
+	for id := uint32(0); id < 3; id++ {
+		if err := AddProduct(Product{ID: id, Price: 10, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventID := uint32(0)
+	for productID, purchases := range map[uint32]int{0: 1, 1: 2, 2: 3} {
+		for i := 0; i < purchases; i++ {
+			if err := AddEvent(Event{ID: eventID, ProductID: productID, EventAction: PURCHASE}); err != nil {
+				t.Fatal(err)
+			}
+			eventID++
+		}
+	}
+	if err := AddEvent(Event{ID: eventID, ProductID: 0, EventAction: VIEW}); err != nil {
+		t.Fatal(err)
+	}
+
+	top, err := TopProductsByPurchase(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIDs := []uint32{2, 1, 0}
+	wantPurchases := []uint64{3, 2, 1}
+	if len(top) != len(wantIDs) {
+		t.Fatalf("TopProductsByPurchase(3) = %v, quer %d produtos", top, len(wantIDs))
+	}
+	for i, metrics := range top {
+		if metrics.ProductID != wantIDs[i] || metrics.TotalPurchase != wantPurchases[i] {
+			t.Errorf("posição %d = produto %d com %d compras, quer produto %d com %d",
+				i, metrics.ProductID, metrics.TotalPurchase, wantIDs[i], wantPurchases[i])
+		}
+		offset, _ := BinarySearchOnDisk(PRODUCT_INDEX_FILE, metrics.ProductID)
+		if metrics.ProductDataLocation != offset {
+			t.Errorf("produto %d: ProductDataLocation = %d, quer %d", metrics.ProductID, metrics.ProductDataLocation, offset)
+		}
+	}
+
+	top, err = TopProductsByPurchase(1)
+	if err != nil || len(top) != 1 || top[0].ProductID != 2 {
+		t.Errorf("TopProductsByPurchase(1) = %v, %v, quer só o produto 2", top, err)
+	}
+}
+
+func TestTopProductsByPurchaseNegativeN(t *testing.T) {
+	inTempDir(t)
+	if top, err := TopProductsByPurchase(-1); err == nil {
+		t.Errorf("TopProductsByPurchase(-1) = %v, quer erro", top)
+	}
+	top, err := TopProductsByPurchase(0)
+	if err != nil || len(top) != 0 {
+		t.Errorf("TopProductsByPurchase(0) = %v, %v, quer lista vazia", top, err)
+	}
+}
+
+func TestImportedEventsReferenceInternalProductIDs(t *testing.T) {
+	importSample(t)
+	rows := sampleRows(t)
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	if len(events) != len(rows) {
+		t.Fatalf("%d eventos importados, quer %d", len(events), len(rows))
+	}
+
+	// O mesmo product_id do CSV sempre vira o mesmo ID interno
+	internalIDs := map[string]uint32{}
+	for i, event := range events {
+		row := rows[i]
+		product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, event.ProductID)
+		if err != nil || !found {
+			t.Fatalf("evento %d: produto %d não encontrado (%v)", event.ID, event.ProductID, err)
+		}
+		price, _ := strconv.ParseFloat(row[PRICE], 32)
+		if product.Price != float32(price) || ByteArrayToString(product.Brand[:]) != row[BRAND] {
+			t.Errorf("evento %d aponta para %+v, quer o produto da linha %v", event.ID, product, row)
+		}
+		if id, seen := internalIDs[row[PRODUCT_ID]]; seen && id != event.ProductID {
+			t.Errorf("product_id %s virou os IDs %d e %d", row[PRODUCT_ID], id, event.ProductID)
+		}
+		internalIDs[row[PRODUCT_ID]] = event.ProductID
+	}
+}
+
+func TestBuildEventUnknownProduct(t *testing.T) {
+	inTempDir(t)
+	row := []string{"2019-10-01 00:02:13 UTC", "view", "3701244", "1", "", "", "1.00", "7", "s"}
+	event, err := BuildEvent(row, map[uint32]uint32{}, SequentialIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ProductID != UNKNOWN_PRODUCT_ID {
+		t.Errorf("ProductID = %d, quer UNKNOWN_PRODUCT_ID", event.ProductID)
+	}
+
+	event, err = BuildEvent(row, map[uint32]uint32{3701244: 5}, SequentialIDs)
+	if err != nil || event.ProductID != 5 {
+		t.Errorf("ProductID = %d, %v, quer 5", event.ProductID, err)
+	}
+}
+
+func TestImportKeepsEventsOfTheSameSession(t *testing.T) {
+	inTempDir(t)
+	writeCSV(t, "session.csv",
+		"2019-10-01 00:02:13 UTC,view,1004237,1,electronics,apple,1081.98,514218020,same-session",
+		"2019-10-01 00:02:20 UTC,cart,1004237,1,electronics,apple,1081.98,514218020,same-session",
+		"2019-10-01 00:02:30 UTC,purchase,1004237,1,electronics,apple,1081.98,514218020,same-session",
+	)
+	if _, err := ImportarCSV(context.Background(), "session.csv"); err != nil {
+		t.Fatal(err)
+	}
+
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	want := []Action{VIEW, CART, PURCHASE}
+	if len(events) != len(want) {
+		t.Fatalf("%d eventos importados, quer %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.EventAction != want[i] {
+			t.Errorf("evento %d: ação %s, quer %s", i, getActionName(event.EventAction), getActionName(want[i]))
+		}
+	}
+}
+
+func TestIndexRange(t *testing.T) {
+	inTempDir(t)
+	for id := uint32(10); id <= 100; id += 10 {
+		if err := AppendIndexToFile("range.bin", id, int64(id)*100); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		lo, hi uint32
+		want   []uint32
+	}{
+		{"dentro", 25, 55, []uint32{30, 40, 50}},
+		{"limites inclusivos", 20, 40, []uint32{20, 30, 40}},
+		{"sobrepõe o início", 0, 15, []uint32{10}},
+		{"sobrepõe o fim", 90, 200, []uint32{90, 100}},
+		{"cobre tudo", 0, 1000, []uint32{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}},
+		{"antes de todos", 0, 9, nil},
+		{"depois de todos", 101, 200, nil},
+		{"entre dois IDs", 41, 49, nil},
+		{"lo maior que hi", 50, 20, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := IndexRange("range.bin", tt.lo, tt.hi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entries == nil || len(entries) != len(tt.want) {
+				t.Fatalf("IndexRange(%d, %d) = %v, quer os IDs %v", tt.lo, tt.hi, entries, tt.want)
+			}
+			for i, entry := range entries {
+				if entry.ID != tt.want[i] || entry.Offset != int64(tt.want[i])*100 {
+					t.Errorf("entrada %d = %+v, quer ID %d", i, entry, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriteRecordAtConcurrent(t *testing.T) {
+	inTempDir(t)
+	file, err := os.Create("records.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// Duas goroutines gravam registros intercalados no mesmo *os.File; com
+	// Seek seguido de Write uma poderia mover a posição da outra
+	const records = 200
+	recordSize := int64(fixedSize[ProductMetrics]())
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for writer := 0; writer < 2; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := writer; i < records; i += 2 {
+				metrics := ProductMetrics{ProductID: uint32(i), ProductDataLocation: int64(i) * 10, TotalPurchase: uint64(writer)}
+				if err := WriteRecordAt(file, int64(i)*recordSize, metrics); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < records; i++ {
+		metrics, err := ReadRecordAt[ProductMetrics](file, int64(i)*recordSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ProductMetrics{ProductID: uint32(i), ProductDataLocation: int64(i) * 10, TotalPurchase: uint64(i % 2)}
+		if metrics != want {
+			t.Fatalf("registro %d = %+v, quer %+v", i, metrics, want)
+		}
+	}
+}
+
+// Tamanho do arquivo, falhando o teste se não existir
+func sizeOf(t *testing.T, filename string) int64 {
+	t.Helper()
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestUpdateMostExpensiveProductIndexOverwrites(t *testing.T) {
+	inTempDir(t)
+	cheap := Product{ID: 1, Price: 5, Active: true}
+	expensive := Product{ID: 2, Price: 50, Active: true}
+	for _, product := range []Product{cheap, expensive} {
+		if err := UpdateMostExpensiveProductIndex(MOST_EXPENSIVE_PRODUCT_FILE, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if size := sizeOf(t, MOST_EXPENSIVE_PRODUCT_FILE); size != productRecordSize {
+		t.Fatalf("arquivo com %d bytes, quer um único registro de %d", size, productRecordSize)
+	}
+	got, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != expensive {
+		t.Errorf("mais caro = %+v, quer %+v", got, expensive)
+	}
+}
+
+func TestRecalculateMostExpensiveProductKeepsOneRecord(t *testing.T) {
+	inTempDir(t)
+	for id, price := range []float32{10, 30, 20} {
+		if err := AddProduct(Product{ID: uint32(id), Price: price, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := CreateOrOpenFile(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for i := 0; i < 3; i++ {
+		if err := RecalculateMostExpensiveProduct(PRODUCT_DATA_FILE, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if size := sizeOf(t, MOST_EXPENSIVE_PRODUCT_FILE); size != int64(binary.Size(Product{})) {
+		t.Fatalf("arquivo com %d bytes, quer %d", size, binary.Size(Product{}))
+	}
+	got, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil || got.ID != 1 {
+		t.Errorf("mais caro = %+v, %v, quer o produto 1", got, err)
+	}
+}
+
+func TestMostExpensiveByCategory(t *testing.T) {
+	inTempDir(t)
+	products := []Product{
+		{ID: 0, CategoryID: 1, Price: 10, Active: true},
+		{ID: 1, CategoryID: 1, Price: 30, Active: true},
+		{ID: 2, CategoryID: 2, Price: 5, Active: true},
+		{ID: 3, CategoryID: 2, Price: 7, Active: true},
+	}
+	for _, product := range products {
+		if err := AddProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertLeaders := func(want map[uint32]uint32) {
+		t.Helper()
+		leaders, err := MostExpensiveByCategory()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(leaders) != len(want) {
+			t.Fatalf("MostExpensiveByCategory = %v, quer líderes %v", leaders, want)
+		}
+		for categoryID, productID := range want {
+			if leaders[categoryID].ID != productID {
+				t.Errorf("categoria %d: líder %d, quer %d", categoryID, leaders[categoryID].ID, productID)
+			}
+		}
+	}
+	assertLeaders(map[uint32]uint32{1: 1, 2: 3})
+
+	for _, id := range []uint32{1, 3} {
+		err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertLeaders(map[uint32]uint32{1: 0, 2: 2})
+}
+
+func TestMostExpensiveByCategoryOtherDirectory(t *testing.T) {
+	inTempDir(t)
+	dir := "other"
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return filepath.Join(dir, name) }
+	data, index := path(PRODUCT_DATA_FILE), path(PRODUCT_INDEX_FILE)
+	mostExpensive, perCategory := path(MOST_EXPENSIVE_PRODUCT_FILE), path(MOST_EXPENSIVE_PER_CATEGORY_FILE)
+
+	for id, price := range []float32{20, 10} {
+		product := Product{ID: uint32(id), CategoryID: 4, Price: price, Active: true}
+		if err := UpsertProduct(data, index, mostExpensive, perCategory, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RemoveProduct(data, index, mostExpensive, perCategory, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReactivateProduct(data, index, mostExpensive, perCategory, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(MOST_EXPENSIVE_PER_CATEGORY_FILE); !os.IsNotExist(err) {
+		t.Errorf("índice por categoria do diretório atual foi tocado: %v", err)
+	}
+	leaders, err := MostExpensiveByCategoryFromFile(perCategory)
+	if err != nil || len(leaders) != 1 || leaders[4].ID != 0 {
+		t.Errorf("líderes em %s = %v, %v, quer só o produto 0 na categoria 4", perCategory, leaders, err)
+	}
+}
+
+func TestRecalculateMostExpensiveOfCategoryWritesInCategoryOrder(t *testing.T) {
+	inTempDir(t)
+	for id := uint32(0); id < 20; id++ {
+		product := Product{ID: id, CategoryID: 19 - id, Price: float32(id), Active: true}
+		if err := AddProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RecalculateMostExpensiveOfCategory(PRODUCT_DATA_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(MOST_EXPENSIVE_PER_CATEGORY_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for categoryID := uint32(0); categoryID < 20; categoryID++ {
+		leader, err := ReadRecordAt[Product](file, int64(categoryID)*productRecordSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leader.CategoryID != categoryID {
+			t.Fatalf("registro %d é da categoria %d, quer em ordem de categoria", categoryID, leader.CategoryID)
+		}
+	}
+}
+
+// Adiciona produtos ativos com os preços dados, com IDs a partir de 0
+func addPricedProducts(t *testing.T, prices ...float32) {
+	t.Helper()
+	for id, price := range prices {
+		if err := AddProduct(Product{ID: uint32(id), Price: price, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPriceStats(t *testing.T) {
+	tests := []struct {
+		name                   string
+		prices                 []float32
+		min, max, mean, median float32
+	}{
+		{"quantidade ímpar", []float32{30, 10, 20}, 10, 30, 20, 20},
+		{"quantidade par", []float32{40, 10, 30, 20}, 10, 40, 25, 25},
+		{"um produto", []float32{7}, 7, 7, 7, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			addPricedProducts(t, tt.prices...)
+			// Um produto removido não entra nas estatísticas
+			if err := AddProduct(Product{ID: 100, Price: 1000}); err != nil {
+				t.Fatal(err)
+			}
+
+			min, max, mean, median, err := PriceStats(PRODUCT_DATA_FILE)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if min != tt.min || max != tt.max || mean != tt.mean || median != tt.median {
+				t.Errorf("PriceStats = %v, %v, %v, %v, quer %v, %v, %v, %v",
+					min, max, mean, median, tt.min, tt.max, tt.mean, tt.median)
+			}
+		})
+	}
+}
+
+func TestPriceStatsWithoutActiveProducts(t *testing.T) {
+	inTempDir(t)
+	if err := AddProduct(Product{ID: 0, Price: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := PriceStats(PRODUCT_DATA_FILE); !errors.Is(err, ErrNoActiveProducts) {
+		t.Errorf("PriceStats sem produtos ativos: erro %v, quer ErrNoActiveProducts", err)
+	}
+}
+
+func TestListProducts(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		offset, limit int
+		want          []uint32
+	}{
+		{"página do meio", 3, 3, []uint32{4, 5, 6}},
+		{"primeira página pula o removido", 0, 3, []uint32{0, 1, 3}},
+		{"limite maior que o disponível", 6, 100, []uint32{7, 8, 9}},
+		{"offset depois do fim", 9, 5, []uint32{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			products, err := ListProducts(PRODUCT_DATA_FILE, tt.offset, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(products) != len(tt.want) {
+				t.Fatalf("ListProducts(%d, %d) = %v, quer os IDs %v", tt.offset, tt.limit, products, tt.want)
+			}
+			for i, product := range products {
+				if product.ID != tt.want[i] {
+					t.Errorf("posição %d: ID %d, quer %d", i, product.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListProductsStopsAtLimit(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 0, 1, 2, 3, 4)
+
+	// Com a página completa nos dois primeiros, o registro corrompido no
+	// fim não chega a ser lido
+	corruptRecord[Product](t, PRODUCT_DATA_FILE, 4)
+	products, err := ListProducts(PRODUCT_DATA_FILE, 0, 2)
+	if err != nil || len(products) != 2 {
+		t.Fatalf("ListProducts(0, 2) = %v, %v", products, err)
+	}
+	if _, err := ListProducts(PRODUCT_DATA_FILE, 0, 10); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ListProducts(0, 10): erro %v, quer ErrCorruptRecord", err)
+	}
+}
+
+func TestCommandsImportThenGet(t *testing.T) {
+	sample, err := os.ReadFile("teste.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inTempDir(t)
+	if err := os.WriteFile("test.csv", sample, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCommand([]string{"import", "test.csv"}); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if err := runCommand([]string{"get", "product", "3"}); err != nil {
+		t.Fatalf("get product 3: %v", err)
+	}
+	if err := runCommand([]string{"get", "product", "999"}); err == nil {
+		t.Error("get product 999 não retornou erro")
+	}
+	if err := runCommand([]string{"get", "product"}); err == nil {
+		t.Error("get product sem ID não retornou erro")
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	if err := ValidateSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []struct {
+		name string
+		got  int64
+		want int64
+	}{
+		{"Product", productRecordSize, 113},
+		{"Category", categoryRecordSize, 104},
+		{"Event", eventRecordSize, 71},
+		{"IndexEntry", indexEntrySize, 12},
+		{"ActionMetrics", actionMetricsRecordSize, 5},
+		{"ProductMetrics", productMetricsRecordSize, 20},
+		{"ExternalIDEntry", externalIDRecordSize, 13},
+	}
+	for _, size := range sizes {
+		if size.got != size.want {
+			t.Errorf("%s: %d bytes, quer %d", size.name, size.got, size.want)
+		}
+	}
+}
+
+func TestMustFixedSizePanicsOnVariableSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("mustFixedSize[VarProduct] não entrou em pânico")
+		}
+	}()
+	mustFixedSize[VarProduct]()
+}
+
+// Cria um arquivo de dados só com o cabeçalho dado
+func writeHeader(t *testing.T, filename string, header FileHeader) {
+	t.Helper()
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := writeAt(file, 0, binary.LittleEndian, header); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readHeader(t *testing.T, filename string) FileHeader {
+	t.Helper()
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, err := readAt[FileHeader](file, 0, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestDataFileHeader(t *testing.T) {
+	inTempDir(t)
+	offset, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: 1, Price: 2, Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != dataHeaderSize {
+		t.Errorf("primeiro registro no offset %d, quer %d (depois do cabeçalho)", offset, dataHeaderSize)
+	}
+	product, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, offset)
+	if err != nil || product.ID != 1 {
+		t.Fatalf("ReadFromDataFile = %+v, %v", product, err)
+	}
+
+	current := FileHeader{
+		Magic:      DATA_FILE_MAGIC,
+		Version:    DATA_FILE_VERSION,
+		RecordSize: uint32(productRecordSize),
+		ByteOrder:  LITTLE_ENDIAN_FILE,
+	}
+	oldVersion := current
+	oldVersion.Version = DATA_FILE_VERSION - 1
+	otherSize := current
+	otherSize.RecordSize = uint32(productRecordSize) - 4
+	notData := current
+	notData.Magic = [4]byte{'x', 'x', 'x', 'x'}
+
+	for name, header := range map[string]FileHeader{"versão antiga": oldVersion, "outro tamanho": otherSize, "sem magic": notData} {
+		t.Run(name, func(t *testing.T) {
+			writeHeader(t, "old.bin", header)
+			if _, err := OpenDataFile[Product]("old.bin"); !errors.Is(err, ErrSchemaMismatch) {
+				t.Errorf("OpenDataFile: erro %v, quer ErrSchemaMismatch", err)
+			}
+			err := ForEach("old.bin", func(Product) error { return nil })
+			if !errors.Is(err, ErrSchemaMismatch) {
+				t.Errorf("ForEach: erro %v, quer ErrSchemaMismatch", err)
+			}
+		})
+	}
+
+	// Um arquivo de categorias lido como produtos
+	if _, err := AppendDataToFile(CATEGORY_DATA_FILE, Category{ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDataFile[Product](CATEGORY_DATA_FILE); !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("OpenDataFile[Product] de categorias: erro %v, quer ErrSchemaMismatch", err)
+	}
+	if _, err := ReadFromDataFile[Product](CATEGORY_DATA_FILE, dataHeaderSize); !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("ReadFromDataFile[Product] de categorias: erro %v, quer ErrSchemaMismatch", err)
+	}
+}
+
+// Troca Config.ByteOrder até o fim do teste
+func setByteOrder(t *testing.T, order binary.ByteOrder) {
+	t.Helper()
+	previous := Config.ByteOrder
+	Config.ByteOrder = order
+	t.Cleanup(func() { Config.ByteOrder = previous })
+}
+
+func TestBigEndianRoundTrip(t *testing.T) {
+	setByteOrder(t, binary.BigEndian)
+	importSample(t)
+
+	product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 4)
+	if err != nil || !found {
+		t.Fatalf("GetProductByID(4) = %v, %v", found, err)
+	}
+	if product.ID != 4 || product.Price != 543.10 || !product.Active {
+		t.Errorf("produto 4 = %+v, quer o sofá de 543.10", product)
+	}
+
+	header := readHeader(t, PRODUCT_DATA_FILE)
+	if header.ByteOrder != BIG_ENDIAN_FILE {
+		t.Errorf("cabeçalho com ByteOrder %d, quer BIG_ENDIAN_FILE", header.ByteOrder)
+	}
+}
+
+func TestByteOrderMismatch(t *testing.T) {
+	setByteOrder(t, binary.BigEndian)
+	importSample(t)
+
+	Config.ByteOrder = binary.LittleEndian
+	if err := ForEach(PRODUCT_DATA_FILE, func(Product) error { return nil }); !errors.Is(err, ErrByteOrderMismatch) {
+		t.Errorf("ForEach: erro %v, quer ErrByteOrderMismatch", err)
+	}
+	if _, err := OpenDataFile[Product](PRODUCT_DATA_FILE); !errors.Is(err, ErrByteOrderMismatch) {
+		t.Errorf("OpenDataFile: erro %v, quer ErrByteOrderMismatch", err)
+	}
+	if _, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, dataHeaderSize); !errors.Is(err, ErrByteOrderMismatch) {
+		t.Errorf("ReadFromDataFile: erro %v, quer ErrByteOrderMismatch", err)
+	}
+	// O índice não tem cabeçalho: lido na ordem errada, o ID simplesmente
+	// não é encontrado, mas o produto nunca volta com os campos trocados
+	product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 4)
+	if found && !errors.Is(err, ErrByteOrderMismatch) {
+		t.Errorf("GetProductByID = %+v, %v, quer ErrByteOrderMismatch ou não encontrado", product, err)
+	}
+}
+
+func TestAddCategory(t *testing.T) {
+	inTempDir(t)
+	for i, name := range []string{"eletrônicos", "  móveis  "} {
+		category, err := AddCategory(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if category.ID != uint32(i) || ByteArrayToString(category.Name[:]) != strings.TrimSpace(name) {
+			t.Errorf("AddCategory(%q) = %d %q, quer ID %d", name, category.ID, ByteArrayToString(category.Name[:]), i)
+		}
+	}
+
+	offset, found := BinarySearchOnDisk(CATEGORY_INDEX_FILE, 1)
+	if !found {
+		t.Fatal("categoria 1 fora do índice")
+	}
+	stored, err := ReadFromDataFile[Category](CATEGORY_DATA_FILE, offset)
+	if err != nil || ByteArrayToString(stored.Name[:]) != "móveis" {
+		t.Errorf("categoria 1 gravada = %+v, %v", stored, err)
+	}
+}
+
+func TestAddCategoryRejectsDuplicateName(t *testing.T) {
+	inTempDir(t)
+	if _, err := AddCategory("Eletrônicos"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Eletrônicos", " eletrônicos ", "ELETRÔNICOS"} {
+		if _, err := AddCategory(name); !errors.Is(err, ErrDuplicateCategory) {
+			t.Errorf("AddCategory(%q): erro %v, quer ErrDuplicateCategory", name, err)
+		}
+	}
+	if _, err := AddCategory("   "); err == nil {
+		t.Error("AddCategory com nome vazio não retornou erro")
+	}
+	if categories := readAll[Category](t, CATEGORY_DATA_FILE); len(categories) != 1 {
+		t.Errorf("%d categorias gravadas, quer 1", len(categories))
+	}
+}
+
+func TestAddProducts(t *testing.T) {
+	inTempDir(t)
+	products := make([]Product, 100)
+	for i := range products {
+		products[i] = Product{ID: uint32(i), CategoryID: uint32(i % 3), Price: float32(i), Active: true}
+	}
+	if err := AddProducts(products); err != nil {
+		t.Fatal(err)
+	}
+
+	product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 57)
+	if err != nil || !found || product.Price != 57 {
+		t.Errorf("GetProductByID(57) = %+v, %v, %v", product, found, err)
+	}
+	mostExpensive, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil || mostExpensive.ID != 99 {
+		t.Errorf("mais caro = %+v, %v, quer o produto 99", mostExpensive, err)
+	}
+	leaders, err := MostExpensiveByCategory()
+	if err != nil || leaders[0].ID != 99 || leaders[1].ID != 97 || leaders[2].ID != 98 {
+		t.Errorf("líderes por categoria = %v, %v", leaders, err)
+	}
+	if problems, err := VerifyStore(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE); err != nil || len(problems) != 0 {
+		t.Errorf("VerifyStore = %v, %v", problems, err)
+	}
+}
+
+func TestAddProductsRejectsBadIDs(t *testing.T) {
+	inTempDir(t)
+	for _, id := range []uint32{10, 20} {
+		if err := AddProduct(Product{ID: id, Price: 1, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataSize := sizeOf(t, PRODUCT_DATA_FILE)
+	indexSize := sizeOf(t, PRODUCT_INDEX_FILE)
+
+	tests := []struct {
+		name string
+		ids  []uint32
+		want error
+	}{
+		{"já no índice", []uint32{21, 20}, ErrDuplicateID},
+		{"repetido no lote", []uint32{30, 31, 31}, ErrDuplicateID},
+		{"menor que o último do índice", []uint32{15}, ErrIDOutOfOrder},
+		{"decrescente no lote", []uint32{40, 35}, ErrIDOutOfOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			products := []Product{}
+			for _, id := range tt.ids {
+				products = append(products, Product{ID: id, Price: 1000, Active: true})
+			}
+			if err := AddProducts(products); !errors.Is(err, tt.want) {
+				t.Fatalf("AddProducts(%v): erro %v, quer %v", tt.ids, err, tt.want)
+			}
+			if sizeOf(t, PRODUCT_DATA_FILE) != dataSize || sizeOf(t, PRODUCT_INDEX_FILE) != indexSize {
+				t.Error("lote rejeitado gravou nos arquivos")
+			}
+		})
+	}
+
+	mostExpensive, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil || mostExpensive.Price != 1 {
+		t.Errorf("mais caro = %+v, %v, quer intocado", mostExpensive, err)
+	}
+}
+
+const benchmarkProducts = 10000
+
+func benchmarkProductBatch() []Product {
+	products := make([]Product, benchmarkProducts)
+	for i := range products {
+		products[i] = Product{ID: uint32(i), CategoryID: uint32(i % 50), Price: float32(i % 997), Active: true}
+	}
+	return products
+}
+
+func BenchmarkAddProductLoop(b *testing.B) {
+	inTempDir(b)
+	products := benchmarkProductBatch()
+	for b.Loop() {
+		b.StopTimer()
+		if err := DropStore("."); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for _, product := range products {
+			if err := AddProduct(product); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkAddProducts(b *testing.B) {
+	inTempDir(b)
+	products := benchmarkProductBatch()
+	for b.Loop() {
+		b.StopTimer()
+		if err := DropStore("."); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if err := AddProducts(products); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Cria as categorias com os nomes dados, com IDs a partir de 0
+func addCategories(t *testing.T, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if _, err := AddCategory(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRemoveCategoryRejectIfReferenced(t *testing.T) {
+	inTempDir(t)
+	addCategories(t, "livre", "usada")
+	if err := AddProduct(Product{ID: 0, CategoryID: 1, Price: 3, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveCategory(1, RejectIfReferenced); !errors.Is(err, ErrCategoryInUse) {
+		t.Fatalf("RemoveCategory(1): erro %v, quer ErrCategoryInUse", err)
+	}
+	if _, found := BinarySearchOnDisk(CATEGORY_INDEX_FILE, 1); !found {
+		t.Error("categoria em uso foi removida")
+	}
+
+	if err := RemoveCategory(0, RejectIfReferenced); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := BinarySearchOnDisk(CATEGORY_INDEX_FILE, 0); found {
+		t.Error("categoria 0 continua no índice")
+	}
+	if err := RemoveCategory(0, RejectIfReferenced); err == nil {
+		t.Error("remover a categoria 0 de novo não retornou erro")
+	}
+}
+
+func TestRemoveCategoryReassignTo(t *testing.T) {
+	inTempDir(t)
+	addCategories(t, "antiga", "nova")
+	for id, price := range []float32{3, 9} {
+		if err := AddProduct(Product{ID: uint32(id), CategoryID: 0, Price: price, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddProduct(Product{ID: 2, CategoryID: 1, Price: 5, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveCategory(0, ReassignTo(0)); err == nil {
+		t.Error("reatribuir para a própria categoria não retornou erro")
+	}
+	if err := RemoveCategory(0, ReassignTo(7)); err == nil {
+		t.Error("reatribuir para uma categoria inexistente não retornou erro")
+	}
+	if err := RemoveCategory(0, ReassignTo(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, product := range readAll[Product](t, PRODUCT_DATA_FILE) {
+		if product.CategoryID != 1 {
+			t.Errorf("produto %d ficou na categoria %d, quer 1", product.ID, product.CategoryID)
+		}
+	}
+	leaders, err := MostExpensiveByCategory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := leaders[0]; exists || leaders[1].ID != 1 {
+		t.Errorf("líderes = %v, quer só a categoria 1, com o produto 1", leaders)
+	}
+}
+
+func TestForEachReverse(t *testing.T) {
+	inTempDir(t)
+	for id := uint32(0); id < 3; id++ {
+		if _, err := AppendDataToFile(EVENT_DATA_FILE, Event{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := []uint32{}
+	err := ForEachReverse(EVENT_DATA_FILE, func(event Event) error {
+		ids = append(ids, event.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] != 2 || ids[1] != 1 || ids[2] != 0 {
+		t.Errorf("ForEachReverse visitou %v, quer [2 1 0]", ids)
+	}
+
+	if err := os.WriteFile("empty.bin", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	err = ForEachReverse("empty.bin", func(Event) error {
+		calls++
+		return nil
+	})
+	if err != nil || calls != 0 {
+		t.Errorf("ForEachReverse em arquivo vazio = %v com %d chamadas", err, calls)
+	}
+
+	if err := os.Truncate(EVENT_DATA_FILE, sizeOf(t, EVENT_DATA_FILE)-3); err != nil {
+		t.Fatal(err)
+	}
+	if err := ForEachReverse(EVENT_DATA_FILE, func(Event) error { return nil }); err == nil {
+		t.Error("ForEachReverse em arquivo truncado não retornou erro")
+	}
+}
+
+func TestEventsByUser(t *testing.T) {
+	inTempDir(t)
+	users := []uint32{7, 9, 7, 9, 7}
+	for id, userID := range users {
+		if err := AddEvent(Event{ID: uint32(id), UserID: userID, EventAction: VIEW}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for userID, want := range map[uint32][]uint32{7: {0, 2, 4}, 9: {1, 3}, 8: {}} {
+		events, err := EventsByUser(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != len(want) {
+			t.Fatalf("EventsByUser(%d) = %v, quer os eventos %v", userID, events, want)
+		}
+		for i, event := range events {
+			if event.ID != want[i] || event.UserID != userID {
+				t.Errorf("EventsByUser(%d)[%d] = evento %d do usuário %d, quer o evento %d", userID, i, event.ID, event.UserID, want[i])
+			}
+		}
+	}
+}
+
+func TestEventsBySessionChronological(t *testing.T) {
+	inTempDir(t)
+	// Inseridos fora de ordem: compra, visualização, carrinho
+	events := []Event{
+		{ID: 0, EventAction: PURCHASE, EventTime: EventTimestamp("2019-10-01 00:02:15 UTC")},
+		{ID: 1, EventAction: VIEW, EventTime: EventTimestamp("2019-10-01 00:02:13 UTC")},
+		{ID: 2, EventAction: CART, EventTime: EventTimestamp("2019-10-01T00:02:14Z")},
+		{ID: 3, EventAction: VIEW, EventTime: EventTimestamp("2019-10-01 00:02:16 UTC")},
+	}
+	for _, event := range events {
+		event.UserSession = StringTo50ByteArray("sessão")
+		if err := AddEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := Event{ID: 4, UserSession: StringTo50ByteArray("outra"), EventAction: VIEW}
+	if err := AddEvent(other); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := EventsBySession("sessão")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantIDs := []uint32{1, 2, 0, 3}
+	if len(session) != len(wantIDs) {
+		t.Fatalf("EventsBySession = %v, quer os eventos %v", session, wantIDs)
+	}
+	for i, event := range session {
+		if event.ID != wantIDs[i] {
+			t.Errorf("posição %d: evento %d, quer %d", i, event.ID, wantIDs[i])
+		}
+	}
+
+	funnel, err := ReconstructFunnel("sessão")
+	if err != nil || len(funnel) != 3 || funnel[0] != VIEW || funnel[1] != CART || funnel[2] != PURCHASE {
+		t.Errorf("ReconstructFunnel = %v, %v, quer [VIEW CART PURCHASE]", funnel, err)
+	}
+}
+
+func TestReconstructFunnelReturnsReadErrors(t *testing.T) {
+	inTempDir(t)
+	// Um arquivo de eventos que não é um arquivo de dados
+	if err := os.WriteFile(EVENT_DATA_FILE, []byte("não é um arquivo de dados"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if funnel, err := ReconstructFunnel("sessão"); !errors.Is(err, ErrSchemaMismatch) {
+		t.Errorf("ReconstructFunnel = %v, %v, quer ErrSchemaMismatch", funnel, err)
+	}
+}
+
+func TestEventsBySessionWithoutTimeKeepsInsertionOrder(t *testing.T) {
+	inTempDir(t)
+	for id, raw := range []string{"2019-10-01 00:02:15 UTC", "sem horário", "2019-10-01 00:02:13 UTC"} {
+		event := Event{ID: uint32(id), UserSession: StringTo50ByteArray("s"), EventAction: VIEW, EventTime: EventTimestamp(raw)}
+		if err := AddEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := EventsBySession("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, event := range session {
+		if event.ID != uint32(i) {
+			t.Fatalf("EventsBySession = %v, quer a ordem de inserção", session)
+		}
+	}
+}
+
+func TestParseEventTime(t *testing.T) {
+	want := time.Date(2019, 10, 1, 0, 2, 13, 0, time.UTC)
+	for _, raw := range []string{
+		"2019-10-01 00:02:13 UTC",
+		"2019-10-01T00:02:13Z",
+		"2019-10-01 00:02:13",
+		"2019-10-01T00:02:13",
+		"  2019-10-01 00:02:13 UTC  ",
+	} {
+		parsed, err := ParseEventTime(raw)
+		if err != nil || !parsed.Equal(want) {
+			t.Errorf("ParseEventTime(%q) = %v, %v, quer %v", raw, parsed, err, want)
+		}
+		if timestamp := EventTimestamp(raw); timestamp != want.Unix() {
+			t.Errorf("EventTimestamp(%q) = %d, quer %d", raw, timestamp, want.Unix())
+		}
+	}
+
+	for _, raw := range []string{"", "ontem", "2019-13-01 00:00:00 UTC"} {
+		if _, err := ParseEventTime(raw); err == nil {
+			t.Errorf("ParseEventTime(%q) não retornou erro", raw)
+		}
+		if timestamp := EventTimestamp(raw); timestamp != 0 {
+			t.Errorf("EventTimestamp(%q) = %d, quer 0", raw, timestamp)
+		}
+	}
+}
+
+func TestImportedEventTimesAreQueryable(t *testing.T) {
+	importSample(t)
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	first := time.Date(2019, 10, 1, 0, 2, 13, 0, time.UTC)
+	if events[0].EventTime != first.Unix() {
+		t.Errorf("primeiro evento às %d, quer %d", events[0].EventTime, first.Unix())
+	}
+
+	// As linhas das 00:02 do teste.txt
+	from := first
+	to := time.Date(2019, 10, 1, 0, 2, 59, 0, time.UTC)
+	inWindow, err := EventsBetween(EVENT_DATA_FILE, from.Unix(), to.Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inWindow) != 7 {
+		t.Errorf("EventsBetween(00:02:13, 00:02:59) retornou %d eventos, quer 7", len(inWindow))
+	}
+}
+
+func TestEventsBetween(t *testing.T) {
+	inTempDir(t)
+	for id, timestamp := range []int64{500, 100, 300, 200, 400} {
+		if _, err := AppendDataToFile("events.bin", Event{ID: uint32(id), EventTime: timestamp}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		from, to int64
+		want     []uint32
+	}{
+		{200, 400, []uint32{2, 3, 4}},
+		{150, 250, []uint32{3}},
+		{0, 1000, []uint32{0, 1, 2, 3, 4}},
+		{600, 700, []uint32{}},
+		{300, 300, []uint32{2}},
+	}
+	for _, tt := range tests {
+		events, err := EventsBetween("events.bin", tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := map[uint32]bool{}
+		for _, event := range events {
+			ids[event.ID] = true
+		}
+		if len(events) != len(tt.want) {
+			t.Errorf("EventsBetween(%d, %d) = %v, quer os eventos %v", tt.from, tt.to, events, tt.want)
+			continue
+		}
+		for _, id := range tt.want {
+			if !ids[id] {
+				t.Errorf("EventsBetween(%d, %d) sem o evento %d", tt.from, tt.to, id)
+			}
+		}
+	}
+
+	if _, err := EventsBetween("events.bin", 400, 200); err == nil {
+		t.Error("EventsBetween com início depois do fim não retornou erro")
+	}
+}
+
+// Registro com chave composta, ordenado por (Time, Seq)
+type timeKey struct {
+	Time int64
+	Seq  uint32
+}
+
+func TestSearchSorted(t *testing.T) {
+	inTempDir(t)
+	keys := []timeKey{{10, 0}, {10, 1}, {20, 0}, {30, 5}, {30, 6}}
+	file, err := os.Create("keys.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := binary.Write(file, Config.ByteOrder, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := func(target timeKey) func(timeKey) bool {
+		return func(key timeKey) bool {
+			return key.Time < target.Time || (key.Time == target.Time && key.Seq < target.Seq)
+		}
+	}
+	tests := []struct {
+		target    timeKey
+		want      timeKey
+		wantFound bool
+	}{
+		{timeKey{10, 1}, timeKey{10, 1}, true},
+		{timeKey{0, 0}, timeKey{10, 0}, true},
+		{timeKey{15, 0}, timeKey{20, 0}, true},
+		{timeKey{30, 6}, timeKey{30, 6}, true},
+		{timeKey{30, 7}, timeKey{}, false},
+	}
+	for _, tt := range tests {
+		got, found, err := SearchSorted("keys.bin", before(tt.target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tt.wantFound || got != tt.want {
+			t.Errorf("SearchSorted(%v) = %v, %v, quer %v, %v", tt.target, got, found, tt.want, tt.wantFound)
+		}
+	}
+
+	if _, found, err := SearchSorted("missing.bin", before(timeKey{})); found || err != nil {
+		t.Errorf("SearchSorted em arquivo inexistente = %v, %v", found, err)
+	}
+}
+
+func TestCorruptRecordDetected(t *testing.T) {
+	inTempDir(t)
+	for id := uint32(0); id < 3; id++ {
+		if err := AddProduct(Product{ID: id, Brand: StringToByteArray("marca"), Price: 9.5, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptRecord[Product](t, PRODUCT_DATA_FILE, 1)
+
+	offset, _ := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 1)
+	if _, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, offset); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ReadFromDataFile: erro %v, quer ErrCorruptRecord", err)
+	}
+	if _, _, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 1); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("GetProductByID: erro %v, quer ErrCorruptRecord", err)
+	}
+	if err := ForEach(PRODUCT_DATA_FILE, func(Product) error { return nil }); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("ForEach: erro %v, quer ErrCorruptRecord", err)
+	}
+
+	// Os registros intactos continuam legíveis
+	if product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 2); err != nil || !found || product.Price != 9.5 {
+		t.Errorf("GetProductByID(2) = %+v, %v, %v", product, found, err)
+	}
+}
+
+func TestPlanRemovalIsDryRun(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2, 3)
+	dataBefore, err := os.ReadFile(PRODUCT_DATA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexBefore, err := os.ReadFile(PRODUCT_INDEX_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanRemoval[Product](PRODUCT_INDEX_FILE, PRODUCT_DATA_FILE, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RemovalPlan{
+		Found:        true,
+		Offset:       dataHeaderSize + dataRecordSize[Product](),
+		DataSize:     int64(len(dataBefore)),
+		NewDataSize:  int64(len(dataBefore)) - dataRecordSize[Product](),
+		IndexSize:    int64(len(indexBefore)),
+		NewIndexSize: int64(len(indexBefore)) - indexEntrySize,
+	}
+	if plan != want {
+		t.Errorf("PlanRemoval(1) = %+v, quer %+v", plan, want)
+	}
+
+	missing, err := PlanRemoval[Product](PRODUCT_INDEX_FILE, PRODUCT_DATA_FILE, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing.Found || missing.NewDataSize != missing.DataSize || missing.NewIndexSize != missing.IndexSize {
+		t.Errorf("PlanRemoval(9) = %+v, quer plano vazio", missing)
+	}
+
+	dataAfter, _ := os.ReadFile(PRODUCT_DATA_FILE)
+	indexAfter, _ := os.ReadFile(PRODUCT_INDEX_FILE)
+	if string(dataAfter) != string(dataBefore) || string(indexAfter) != string(indexBefore) {
+		t.Error("PlanRemoval modificou os arquivos")
+	}
+
+	// A remoção de verdade chega aos tamanhos previstos
+	if err := RemoveByID(PRODUCT_INDEX_FILE, PRODUCT_DATA_FILE, 1, Product{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := sizeOf(t, PRODUCT_DATA_FILE); got != plan.NewDataSize {
+		t.Errorf("tamanho dos dados = %d, quer %d", got, plan.NewDataSize)
+	}
+	if got := sizeOf(t, PRODUCT_INDEX_FILE); got != plan.NewIndexSize {
+		t.Errorf("tamanho do índice = %d, quer %d", got, plan.NewIndexSize)
+	}
+}
+
+func TestConcurrentRemovalsUseDistinctTempFiles(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2, 3)
+	addCategories(t, "a", "b", "c")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = RemoveByID(PRODUCT_INDEX_FILE, PRODUCT_DATA_FILE, 1, Product{})
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = RemoveByID(CATEGORY_INDEX_FILE, CATEGORY_DATA_FILE, 2, Category{})
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	if len(products) != 2 || products[0].ID != 0 || products[1].ID != 2 {
+		t.Errorf("produtos = %+v, quer IDs 0 e 2", products)
+	}
+	categories := readAll[Category](t, CATEGORY_DATA_FILE)
+	if len(categories) != 2 || categories[0].ID != 0 || categories[1].ID != 1 {
+		t.Errorf("categorias = %+v, quer IDs 0 e 1", categories)
+	}
+
+	leftovers, err := filepath.Glob("*.tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("arquivos temporários restantes: %v", leftovers)
+	}
+}
+
+func TestRemoveByIDNotFound(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1)
+	err := RemoveByID(PRODUCT_INDEX_FILE, PRODUCT_DATA_FILE, 7, Product{})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("RemoveByID(7): erro %v, quer os.ErrNotExist", err)
+	}
+}
+
+func TestAtomicReplaceTargetAlwaysExists(t *testing.T) {
+	inTempDir(t)
+	const target = "alvo.bin"
+	if err := os.WriteFile(target, []byte("versão 0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Um leitor observa o alvo enquanto ele é substituído várias vezes
+	stop := make(chan struct{})
+	missing := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(missing)
+				return
+			default:
+			}
+			if _, err := os.Stat(target); err != nil {
+				missing <- err
+				close(missing)
+				return
+			}
+		}
+	}()
+
+	for i := 1; i <= 200; i++ {
+		temp, err := createTempNear(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := temp.WriteString("versão " + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		temp.Close()
+		if err := atomicReplace(temp.Name(), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if err := <-missing; err != nil {
+		t.Fatalf("alvo ausente durante a substituição: %v", err)
+	}
+
+	content, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "versão 200" {
+		t.Errorf("conteúdo = %q, quer %q", content, "versão 200")
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("permissão = %v, quer 0644", info.Mode().Perm())
+	}
+}
+
+func TestRebuildIndexNeverTruncatesLiveIndex(t *testing.T) {
+	inTempDir(t)
+	products := make([]Product, 500)
+	for i := range products {
+		products[i] = Product{ID: uint32(i), Price: 1, Active: true}
+	}
+	if err := AddProducts(products); err != nil {
+		t.Fatal(err)
+	}
+	full := sizeOf(t, PRODUCT_INDEX_FILE)
+
+	// Um leitor observa o índice enquanto ele é reconstruído várias vezes;
+	// o índice antigo só é trocado pelo novo já completo
+	stop := make(chan struct{})
+	partial := make(chan int64, 1)
+	go func() {
+		defer close(partial)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			info, err := os.Stat(PRODUCT_INDEX_FILE)
+			if err != nil || info.Size() != full {
+				size := int64(-1)
+				if err == nil {
+					size = info.Size()
+				}
+				partial <- size
+				return
+			}
+		}
+	}()
+
+	idOf := func(product Product) uint32 { return product.ID }
+	for i := 0; i < 20; i++ {
+		if err := RebuildIndex(context.Background(), PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, idOf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	if size, seen := <-partial; seen {
+		t.Fatalf("índice com %d bytes durante a reconstrução, quer sempre %d", size, full)
+	}
+
+	leftovers, err := filepath.Glob(PRODUCT_INDEX_FILE + ".tmp-*")
+	if err != nil || len(leftovers) != 0 {
+		t.Errorf("temporários do índice = %v, %v", leftovers, err)
+	}
+}
+
+func TestRecoverWALReappliesUncommittedEntry(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1)
+	if err := LoggedAppend(WAL_APPEND_PRODUCT, 1, Product{ID: 1, Price: 2, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A intenção do produto 2 chega ao disco, mas o processo cai depois de
+	// gravar só o registro de dados, antes do índice e do commit
+	lost := Product{ID: 2, Price: 3, Active: true}
+	var payload bytes.Buffer
+	if err := binary.Write(&payload, Config.ByteOrder, lost); err != nil {
+		t.Fatal(err)
+	}
+	header := walEntryHeader{
+		Op:        WAL_APPEND_PRODUCT,
+		ID:        lost.ID,
+		DataSize:  sizeOf(t, PRODUCT_DATA_FILE),
+		IndexSize: sizeOf(t, PRODUCT_INDEX_FILE),
+	}
+	if _, err := walAppend(header, payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AppendDataToFile(PRODUCT_DATA_FILE, lost); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := RecoverWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Errorf("RecoverWAL refez %d operações, quer 1", replayed)
+	}
+	if _, err := os.Stat(WAL_FILE); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("WAL não foi removido: %v", err)
+	}
+
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	if len(products) != 3 {
+		t.Fatalf("%d produtos no arquivo, quer 3", len(products))
+	}
+	product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 2)
+	if err != nil || !found || product.Price != 3 {
+		t.Errorf("GetProductByID(2) = %+v, %v, %v", product, found, err)
+	}
+
+	// Sem nada pendente, uma nova recuperação não faz nada
+	if replayed, err := RecoverWAL(); err != nil || replayed != 0 {
+		t.Errorf("segunda RecoverWAL = %d, %v, quer 0, nil", replayed, err)
+	}
+}
+
+// Inclui os registros, busca cada um, remove o primeiro e confere que só ele
+// sumiu. Os registros devem estar em ordem crescente de ID
+func exerciseStore[T comparable](t *testing.T, store Appender[T], idOf func(T) uint32, records []T) {
+	t.Helper()
+	for _, record := range records {
+		if err := store.Add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Add(records[0]); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Add repetido: erro %v, quer ErrDuplicateID", err)
+	}
+	for _, record := range records {
+		got, found, err := store.Get(idOf(record))
+		if err != nil || !found || got != record {
+			t.Errorf("Get(%d) = %+v, %v, %v, quer %+v", idOf(record), got, found, err, record)
+		}
+	}
+
+	if err := store.Remove(idOf(records[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := store.Get(idOf(records[0])); err != nil || found {
+		t.Errorf("Get(%d) depois de Remove = %v, %v", idOf(records[0]), found, err)
+	}
+	for _, record := range records[1:] {
+		got, found, err := store.Get(idOf(record))
+		if err != nil || !found || got != record {
+			t.Errorf("Get(%d) depois de Remove = %+v, %v, %v, quer %+v", idOf(record), got, found, err, record)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	t.Run("Product", func(t *testing.T) {
+		inTempDir(t)
+		store := NewFileStore("p.bin", "pi.bin", productID)
+		exerciseStore(t, store, productID, []Product{
+			{ID: 3, Brand: StringToByteArray("acme"), Price: 10, Active: true},
+			{ID: 5, Brand: StringToByteArray("zeta"), Price: 20, Active: true},
+			{ID: 8, Price: 30},
+		})
+		if _, err := os.Stat(PRODUCT_DATA_FILE); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("o store gravou no arquivo global: %v", err)
+		}
+	})
+	t.Run("Category", func(t *testing.T) {
+		inTempDir(t)
+		store := NewFileStore("c.bin", "ci.bin", categoryID)
+		exerciseStore(t, store, categoryID, []Category{
+			{ID: 0, Name: StringToByteArray("livros")},
+			{ID: 1, Name: StringToByteArray("jogos")},
+		})
+	})
+}
+
+func TestBloomIndex(t *testing.T) {
+	inTempDir(t)
+	const inserted = 10000
+	entries := make([]IndexEntry, inserted)
+	for i := range entries {
+		entries[i] = IndexEntry{ID: uint32(2 * i), Offset: int64(i)}
+	}
+	if err := appendIndexEntries("idx.bin", entries); err != nil {
+		t.Fatal(err)
+	}
+
+	const rate = 0.01
+	bloom, err := NewBloomIndex("idx.bin", rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !bloom.MayContain(entry.ID) {
+			t.Fatalf("falso negativo para o ID %d", entry.ID)
+		}
+	}
+
+	// Os IDs ímpares nunca foram incluídos
+	falsePositives := 0
+	for i := 0; i < inserted; i++ {
+		if bloom.MayContain(uint32(2*i + 1)) {
+			falsePositives++
+		}
+	}
+	if got := float64(falsePositives) / inserted; got > 3*rate {
+		t.Errorf("taxa de falsos positivos = %.4f, quer no máximo %.4f", got, 3*rate)
+	}
+
+	if _, err := NewBloomIndex("idx.bin", 0); err == nil {
+		t.Error("NewBloomIndex aceitou taxa zero")
+	}
+}
+
+func TestUseBloomIndexSeesNewProducts(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2)
+	if err := UseBloomIndex(PRODUCT_INDEX_FILE, 0.01); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bloomMu.Lock()
+		delete(bloomIndexes, PRODUCT_INDEX_FILE)
+		bloomMu.Unlock()
+	})
+
+	if err := AddProduct(Product{ID: 2, Price: 3, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	for id := uint32(0); id < 3; id++ {
+		if _, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, id); err != nil || !found {
+			t.Errorf("GetProductByID(%d) = %v, %v", id, found, err)
+		}
+	}
+	if _, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 99); err != nil || found {
+		t.Errorf("GetProductByID(99) = %v, %v, quer não encontrado", found, err)
+	}
+}
+
+func TestVarRecordRoundTrip(t *testing.T) {
+	inTempDir(t)
+	products := []VarProduct{
+		{ID: 1, CategoryID: 2, Brand: "", Price: 1.5, Active: true},
+		{ID: 2, CategoryID: 2, Brand: strings.Repeat("b", 10), Price: 2.5},
+		// Não cabe nos 100 bytes do Product, que truncaria a marca
+		{ID: 3, CategoryID: 7, Brand: strings.Repeat("c", 150), Price: 3.5, Active: true},
+	}
+	for _, product := range products {
+		if _, err := AppendVarRecord("v.bin", "vi.bin", product.ID, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open("v.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for _, want := range products {
+		offset, found := BinarySearchOnDisk("vi.bin", want.ID)
+		if !found {
+			t.Fatalf("ID %d não está no índice", want.ID)
+		}
+		var got VarProduct
+		if err := ReadVarRecord(file, offset, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("ReadVarRecord(%d) = %+v, quer %+v", want.ID, got, want)
+		}
+	}
+
+	long := VarProduct{ID: 4, Brand: strings.Repeat("x", 70000)}
+	if _, err := AppendVarRecord("v.bin", "vi.bin", long.ID, long); !errors.Is(err, ErrVarRecordTooLong) {
+		t.Errorf("AppendVarRecord com marca longa: erro %v, quer ErrVarRecordTooLong", err)
+	}
+}
+
+func TestStringToByteArrayChecked(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		truncated bool
+	}{
+		{"menor", "samsung", false},
+		{"exato", strings.Repeat("a", 100), false},
+		{"maior", strings.Repeat("a", 101), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arr, err := StringToByteArrayChecked(tt.input)
+			if errors.Is(err, ErrTruncated) != tt.truncated {
+				t.Fatalf("erro %v, quer truncado = %v", err, tt.truncated)
+			}
+			want := tt.input
+			if len(want) > len(arr) {
+				want = want[:len(arr)]
+			}
+			if got := ByteArrayToString(arr[:]); got != want {
+				t.Errorf("conteúdo = %q, quer %q", got, want)
+			}
+		})
+	}
+
+	if _, err := StringTo50ByteArrayChecked(strings.Repeat("s", 50)); err != nil {
+		t.Errorf("50 bytes exatos: erro %v", err)
+	}
+	if _, err := StringTo50ByteArrayChecked(strings.Repeat("s", 51)); !errors.Is(err, ErrTruncated) {
+		t.Errorf("51 bytes: erro %v, quer ErrTruncated", err)
+	}
+}
+
+func TestImportCountsTruncatedFields(t *testing.T) {
+	inTempDir(t)
+	longBrand := strings.Repeat("m", 120)
+	longSession := strings.Repeat("s", 60)
+	writeCSV(t, "long.csv",
+		"2019-10-01 00:00:00 UTC,view,1,1,electronics,"+longBrand+",10.00,7,ok-session",
+		"2019-10-01 00:00:01 UTC,view,2,1,electronics,apple,20.00,7,"+longSession,
+	)
+	stats, err := ImportarCSV(context.Background(), "long.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Truncated != 2 {
+		t.Errorf("Truncated = %d, quer 2", stats.Truncated)
+	}
+
+	// O prefixo que coube continua gravado
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	if len(products) != 2 || ByteArrayToString(products[0].Brand[:]) != longBrand[:100] {
+		t.Errorf("produtos = %+v", products)
+	}
+}
+
+func TestStoreCloseAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenStore(dir); !errors.Is(err, ErrStoreLocked) {
+		t.Errorf("segundo OpenStore: erro %v, quer ErrStoreLocked", err)
+	}
+	for id := uint32(0); id < 3; id++ {
+		if _, err := store.Products.Append(Product{ID: id, Price: float32(id) + 1, Active: true}, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.Events.Append(Event{ID: 0, ProductID: 1, UserID: 42}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.Path(STORE_LOCK_FILE)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("trava continua depois de Close: %v", err)
+	}
+
+	store, err = OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for id := uint32(0); id < 3; id++ {
+		product, found, err := GetProductByID(store.Path(PRODUCT_DATA_FILE), store.Path(PRODUCT_INDEX_FILE), id)
+		if err != nil || !found || product.Price != float32(id)+1 {
+			t.Errorf("GetProductByID(%d) = %+v, %v, %v", id, product, found, err)
+		}
+	}
+	offset, found := BinarySearchOnDisk(store.Path(EVENT_USER_INDEX_FILE), 42)
+	if !found {
+		t.Fatal("evento não está no índice por usuário")
+	}
+	event, err := ReadFromDataFile[Event](store.Path(EVENT_DATA_FILE), offset)
+	if err != nil || event.ProductID != 1 {
+		t.Errorf("evento = %+v, %v", event, err)
+	}
+}
+
+func TestBatchWriterFlushKeepsWriterOpen(t *testing.T) {
+	inTempDir(t)
+	writer, err := NewBatchWriter[Product](PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	for id := uint32(0); id < 2; id++ {
+		if _, err := writer.Append(Product{ID: id, Price: 5, Active: true}, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outro handle já enxerga os registros descarregados
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != 2 {
+		t.Fatalf("%d produtos no disco depois de Flush, quer 2", len(products))
+	}
+	if _, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 1); err != nil || !found {
+		t.Errorf("GetProductByID(1) = %v, %v", found, err)
+	}
+
+	// O escritor continua aceitando registros
+	if _, err := writer.Append(Product{ID: 2, Price: 6, Active: true}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 2); err != nil || !found || product.Price != 6 {
+		t.Errorf("GetProductByID(2) = %+v, %v, %v", product, found, err)
+	}
+}
+
+func TestSearchActionsMatching(t *testing.T) {
+	inTempDir(t)
+	if total, err := SearchActionsMatching(VIEW | CART); err != nil || total != 0 {
+		t.Errorf("sem métricas = %d, %v, quer 0", total, err)
+	}
+	storeActions(t, map[Action]int{VIEW: 8, CART: 4, REMOVE_FROM_CART: 1, PURCHASE: 2})
+
+	tests := []struct {
+		name string
+		mask Action
+		want uint32
+	}{
+		{"view", VIEW, 8},
+		{"cart ou purchase", CART | PURCHASE, 6},
+		{"cart ou remove", CART | REMOVE_FROM_CART, 5},
+		{"todas", VIEW | CART | REMOVE_FROM_CART | PURCHASE, 15},
+		{"nenhuma", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total, err := SearchActionsMatching(tt.mask)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.want {
+				t.Errorf("SearchActionsMatching(%d) = %d, quer %d", tt.mask, total, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsFileTruncatedMidRecord(t *testing.T) {
+	t.Run("ações", func(t *testing.T) {
+		inTempDir(t)
+		storeActions(t, map[Action]int{VIEW: 2, CART: 1})
+		if err := os.Truncate(ACTION_METRICS_FILE, sizeOf(t, ACTION_METRICS_FILE)-2); err != nil {
+			t.Fatal(err)
+		}
+		size := sizeOf(t, ACTION_METRICS_FILE)
+		if err := StoreActionMetrics(ACTION_METRICS_FILE, CART); !errors.Is(err, ErrTruncatedFile) {
+			t.Errorf("StoreActionMetrics: erro %v, quer ErrTruncatedFile", err)
+		}
+		if _, err := SearchActionMetrics(ACTION_METRICS_FILE, PURCHASE); !errors.Is(err, ErrTruncatedFile) {
+			t.Errorf("SearchActionMetrics: erro %v, quer ErrTruncatedFile", err)
+		}
+		if got := sizeOf(t, ACTION_METRICS_FILE); got != size {
+			t.Errorf("tamanho = %d depois do erro, quer %d", got, size)
+		}
+	})
+	t.Run("produtos", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 1, 2)
+		for _, id := range []uint32{0, 1} {
+			if err := StoreProductMetrics(PRODUCT_METRICS_FILE, PRODUCT_INDEX_FILE, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Truncate(PRODUCT_METRICS_FILE, sizeOf(t, PRODUCT_METRICS_FILE)-3); err != nil {
+			t.Fatal(err)
+		}
+		size := sizeOf(t, PRODUCT_METRICS_FILE)
+		if err := StoreProductMetrics(PRODUCT_METRICS_FILE, PRODUCT_INDEX_FILE, 1); !errors.Is(err, ErrTruncatedFile) {
+			t.Errorf("StoreProductMetrics: erro %v, quer ErrTruncatedFile", err)
+		}
+		if got := sizeOf(t, PRODUCT_METRICS_FILE); got != size {
+			t.Errorf("tamanho = %d depois do erro, quer %d", got, size)
+		}
+	})
+	t.Run("mais caro por categoria", func(t *testing.T) {
+		inTempDir(t)
+		for id, categoryID := range []uint32{1, 2} {
+			product := Product{ID: uint32(id), CategoryID: categoryID, Price: 10, Active: true}
+			if err := UpdateMostExpensivePerCategoryIndex(MOST_EXPENSIVE_PER_CATEGORY_FILE, product); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Truncate(MOST_EXPENSIVE_PER_CATEGORY_FILE, sizeOf(t, MOST_EXPENSIVE_PER_CATEGORY_FILE)-3); err != nil {
+			t.Fatal(err)
+		}
+		size := sizeOf(t, MOST_EXPENSIVE_PER_CATEGORY_FILE)
+		product := Product{ID: 2, CategoryID: 3, Price: 10, Active: true}
+		if err := UpdateMostExpensivePerCategoryIndex(MOST_EXPENSIVE_PER_CATEGORY_FILE, product); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("UpdateMostExpensivePerCategoryIndex: erro %v, quer io.ErrUnexpectedEOF", err)
+		}
+		if got := sizeOf(t, MOST_EXPENSIVE_PER_CATEGORY_FILE); got != size {
+			t.Errorf("tamanho = %d depois do erro, quer %d", got, size)
+		}
+	})
+}
+
+func TestSnapshotMetrics(t *testing.T) {
+	inTempDir(t)
+	seeded := map[Action]int{VIEW: 5, CART: 3, REMOVE_FROM_CART: 1, PURCHASE: 2}
+	storeActions(t, seeded)
+
+	counts, err := SnapshotMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != len(seeded) {
+		t.Errorf("SnapshotMetrics tem %d ações, quer %d", len(counts), len(seeded))
+	}
+	for action, n := range seeded {
+		if counts[action] != uint32(n) {
+			t.Errorf("%s = %d, quer %d", getActionName(action), counts[action], n)
+		}
+	}
+}
+
+func TestResetMetrics(t *testing.T) {
+	inTempDir(t)
+	if err := ResetMetrics(); err != nil {
+		t.Errorf("ResetMetrics sem arquivo: %v", err)
+	}
+	storeActions(t, map[Action]int{VIEW: 4, PURCHASE: 1})
+	if err := ResetMetrics(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := SnapshotMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("SnapshotMetrics depois de ResetMetrics = %v, quer vazio", counts)
+	}
+
+	// A contagem recomeça do zero
+	storeActions(t, map[Action]int{VIEW: 1})
+	if views, _, _, _, err := Funnel(); err != nil || views != 1 {
+		t.Errorf("views = %d, %v, quer 1", views, err)
+	}
+}
+
+func TestGetManySameOnMemAndFileStore(t *testing.T) {
+	stores := map[string]func() Appender[Product]{
+		"MemStore":  func() Appender[Product] { return NewMemStore(productID) },
+		"FileStore": func() Appender[Product] { return NewFileStore("p.bin", "pi.bin", productID) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			inTempDir(t)
+			store := newStore()
+			for id := uint32(1); id <= 5; id++ {
+				if err := store.Add(Product{ID: id, Price: float32(10 * id), Active: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Remove(3); err != nil {
+				t.Fatal(err)
+			}
+
+			products, err := GetMany(store, []uint32{5, 3, 1, 9})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(products) != 2 || products[0].ID != 5 || products[1].ID != 1 || products[1].Price != 10 {
+				t.Errorf("GetMany = %+v, quer os produtos 5 e 1", products)
+			}
+			if entries, _ := os.ReadDir("."); name == "MemStore" && len(entries) != 0 {
+				t.Errorf("MemStore criou arquivos: %v", entries)
+			}
+		})
+	}
+}
+
+func TestProductMemStoreRemoveDeactivates(t *testing.T) {
+	store := NewProductMemStore()
+	if err := store.Add(Product{ID: 1, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	product, found, err := store.Get(1)
+	if err != nil || !found || product.Active {
+		t.Errorf("Get(1) = %+v, %v, %v, quer produto inativo", product, found, err)
+	}
+	if err := store.Remove(2); err == nil {
+		t.Error("Remove(2) não retornou erro")
+	}
+	if next, err := store.NextID(); err != nil || next != 2 {
+		t.Errorf("NextID = %d, %v, quer 2", next, err)
+	}
+}
+
+// Contexto que passa a ser cancelado depois de remaining consultas a Err,
+// para cancelar uma importação num ponto determinado do arquivo
+type cancelAfter struct {
+	context.Context
+	remaining int
+}
+
+func (c *cancelAfter) Err() error {
+	c.remaining--
+	if c.remaining < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestImportarCSVCancelledMidFile(t *testing.T) {
+	inTempDir(t)
+	const rows = 500
+	lines := make([]string, rows)
+	for i := range lines {
+		lines[i] = "2019-10-01 00:00:00 UTC,view," + strconv.Itoa(1000+i) + ",1,electronics,apple,10.00," + strconv.Itoa(i) + ",s" + strconv.Itoa(i)
+	}
+	writeCSV(t, "big.csv", lines...)
+
+	_, err := ImportarCSV(&cancelAfter{Context: context.Background(), remaining: 50}, "big.csv")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ImportarCSV: erro %v, quer context.Canceled", err)
+	}
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	if len(events) == 0 || len(events) > 50 {
+		t.Errorf("%d eventos importados antes do cancelamento, quer entre 1 e 50", len(events))
+	}
+}
+
+func TestCancelledContextStopsScans(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2, 3)
+	index, err := os.ReadFile(PRODUCT_INDEX_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := Compact(ctx, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE); !errors.Is(err, context.Canceled) {
+		t.Errorf("Compact: erro %v, quer context.Canceled", err)
+	}
+	if err := RebuildIndex(ctx, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, productID); !errors.Is(err, context.Canceled) {
+		t.Errorf("RebuildIndex: erro %v, quer context.Canceled", err)
+	}
+	if after, _ := os.ReadFile(PRODUCT_INDEX_FILE); string(after) != string(index) {
+		t.Error("o índice mudou depois de uma operação cancelada")
+	}
+}
+
+func TestRebuildIndexCancelledMidScanKeepsIndex(t *testing.T) {
+	inTempDir(t)
+	products := make([]Product, 3*CANCEL_CHECK_EVERY)
+	for i := range products {
+		products[i] = Product{ID: uint32(i), Price: 1, Active: true}
+	}
+	if err := AddProducts(products); err != nil {
+		t.Fatal(err)
+	}
+	index, err := os.ReadFile(PRODUCT_INDEX_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancela depois de já ter lido parte do arquivo de dados
+	ctx := &cancelAfter{Context: context.Background(), remaining: 2}
+	if err := RebuildIndex(ctx, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, productID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("RebuildIndex: erro %v, quer context.Canceled", err)
+	}
+	if after, _ := os.ReadFile(PRODUCT_INDEX_FILE); string(after) != string(index) {
+		t.Error("o índice mudou depois de um RebuildIndex cancelado")
+	}
+	if leftovers, _ := filepath.Glob(PRODUCT_INDEX_FILE + ".tmp-*"); len(leftovers) > 0 {
+		t.Errorf("temporários sobraram: %v", leftovers)
+	}
+}
+
+func TestRecordScanner(t *testing.T) {
+	scanAll := func(t *testing.T, stopAt uint32) ([]uint32, []int64, error) {
+		t.Helper()
+		scanner, err := NewRecordScanner[Product](PRODUCT_DATA_FILE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer scanner.Close()
+		ids, offsets := []uint32{}, []int64{}
+		for scanner.Scan() {
+			ids = append(ids, scanner.Record().ID)
+			offsets = append(offsets, scanner.Offset())
+			if scanner.Record().ID == stopAt {
+				break
+			}
+		}
+		return ids, offsets, scanner.Err()
+	}
+
+	t.Run("completo", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 1, 2, 3)
+		ids, offsets, err := scanAll(t, math.MaxUint32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 3 || ids[0] != 0 || ids[2] != 2 {
+			t.Errorf("IDs = %v, quer [0 1 2]", ids)
+		}
+		for i, offset := range offsets {
+			if want, _ := BinarySearchOnDisk(PRODUCT_INDEX_FILE, ids[i]); offset != want {
+				t.Errorf("Offset do ID %d = %d, quer %d", ids[i], offset, want)
+			}
+		}
+	})
+	t.Run("interrompido", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 1, 2, 3)
+		ids, _, err := scanAll(t, 1)
+		if err != nil || len(ids) != 2 {
+			t.Errorf("IDs = %v, erro %v, quer [0 1] sem erro", ids, err)
+		}
+	})
+	t.Run("vazio", func(t *testing.T) {
+		inTempDir(t)
+		if err := os.WriteFile(PRODUCT_DATA_FILE, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		ids, _, err := scanAll(t, math.MaxUint32)
+		if err != nil || len(ids) != 0 {
+			t.Errorf("IDs = %v, erro %v, quer nenhum registro", ids, err)
+		}
+	})
+	t.Run("corrompido", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 1, 2, 3)
+		corruptRecord[Product](t, PRODUCT_DATA_FILE, 1)
+		ids, _, err := scanAll(t, math.MaxUint32)
+		if !errors.Is(err, ErrCorruptRecord) {
+			t.Errorf("Err() = %v, quer ErrCorruptRecord", err)
+		}
+		if len(ids) != 1 {
+			t.Errorf("IDs = %v, quer só o registro antes do corrompido", ids)
+		}
+	})
+	t.Run("cortado", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 1, 2)
+		if err := os.Truncate(PRODUCT_DATA_FILE, sizeOf(t, PRODUCT_DATA_FILE)-10); err != nil {
+			t.Fatal(err)
+		}
+		ids, _, err := scanAll(t, math.MaxUint32)
+		if err == nil || len(ids) != 1 {
+			t.Errorf("IDs = %v, erro %v, quer um registro e erro", ids, err)
+		}
+	})
+}
+
+func TestAddProductRejectsDuplicateID(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2)
+	err := AddProduct(Product{ID: 1, Price: 99, Active: true})
+	if !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("AddProduct repetido: erro %v, quer ErrDuplicateID", err)
+	}
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != 2 {
+		t.Errorf("%d produtos gravados, quer 2", len(products))
+	}
+	if product, _, _ := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 1); product.Price != 2 {
+		t.Errorf("preço do produto 1 = %v, quer 2", product.Price)
+	}
+
+	// A carga em lote pula a conferência
+	if err := Products.Unchecked().Add(Product{ID: 1, Price: 99, Active: true}); err != nil {
+		t.Errorf("Unchecked().Add: %v", err)
+	}
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != 3 {
+		t.Errorf("%d produtos gravados, quer 3", len(products))
+	}
+}
+
+func TestVerifyStore(t *testing.T) {
+	t.Run("consistente", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 1, 2, 3)
+		problems, err := VerifyStore(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
+		if err != nil || len(problems) != 0 {
+			t.Errorf("VerifyStore = %v, %v, quer nenhum problema", problems, err)
+		}
+	})
+
+	t.Run("cada inconsistência", func(t *testing.T) {
+		inTempDir(t)
+		offsets := make([]int64, 5)
+		for i := range offsets {
+			product := Product{ID: uint32(i), Price: 1, Active: i != 1}
+			offset, err := AppendDataToFile(PRODUCT_DATA_FILE, product)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offsets[i] = offset
+		}
+		corruptRecord[Product](t, PRODUCT_DATA_FILE, 3)
+
+		// O produto 2 fica fora do índice
+		err := appendIndexEntries(PRODUCT_INDEX_FILE, []IndexEntry{
+			{ID: 0, Offset: offsets[0]},
+			{ID: 1, Offset: offsets[1]},
+			{ID: 3, Offset: offsets[3]},
+			{ID: 4, Offset: offsets[4]},
+			{ID: 4, Offset: offsets[4]},
+			{ID: 5, Offset: offsets[0]},
+			{ID: 6, Offset: offsets[4] + 10*dataRecordSize[Product]()},
+			{ID: 7, Offset: offsets[0] + 1},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		problems, err := VerifyStore(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Inconsistency{
+			{Kind: POINTS_TO_INACTIVE, ID: 1, Offset: offsets[1]},
+			{Kind: CORRUPT_RECORD, ID: 3, Offset: offsets[3]},
+			{Kind: DUPLICATE_ID, ID: 4, Offset: offsets[4]},
+			{Kind: ID_MISMATCH, ID: 5, Offset: offsets[0]},
+			{Kind: OFFSET_PAST_EOF, ID: 6, Offset: offsets[4] + 10*dataRecordSize[Product]()},
+			{Kind: OFFSET_PAST_EOF, ID: 7, Offset: offsets[0] + 1},
+			{Kind: MISSING_FROM_INDEX, ID: 2, Offset: offsets[2]},
+		}
+		if len(problems) != len(want) {
+			t.Fatalf("VerifyStore = %v, quer %v", problems, want)
+		}
+		for i := range want {
+			if problems[i] != want[i] {
+				t.Errorf("problema %d = %+v (%s), quer %+v (%s)", i, problems[i], problems[i].Kind, want[i], want[i].Kind)
+			}
+		}
+	})
+}
+
+func TestReadFromDataFileOffsetOutOfRange(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2)
+	size := sizeOf(t, PRODUCT_DATA_FILE)
+	recordSize := dataRecordSize[Product]()
+
+	tests := []struct {
+		name   string
+		offset int64
+	}{
+		{"negativo", -1},
+		{"no cabeçalho", 0},
+		{"depois do fim", size + recordSize},
+		{"último registro cortado", size - recordSize + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, tt.offset); !errors.Is(err, ErrOffsetOutOfRange) {
+				t.Errorf("ReadFromDataFile(%d): erro %v, quer ErrOffsetOutOfRange", tt.offset, err)
+			}
+		})
+	}
+
+	product, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, size-recordSize)
+	if err != nil || product.ID != 1 {
+		t.Errorf("último registro = %+v, %v", product, err)
+	}
+}
+
+func TestGetProductsByIDs(t *testing.T) {
+	inTempDir(t)
+	if products, err := GetProductsByIDs([]uint32{1, 2}); err != nil || len(products) != 0 {
+		t.Errorf("sem arquivos = %v, %v, quer map vazio", products, err)
+	}
+
+	addPricedProducts(t, 10, 20, 30, 40, 50)
+	if err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	products, err := GetProductsByIDs([]uint32{4, 99, 0, 3, 4, 7, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]float32{0: 10, 2: 30, 3: 40, 4: 50}
+	if len(products) != len(want) {
+		t.Errorf("GetProductsByIDs retornou os IDs %v, quer %v", products, want)
+	}
+	for id, price := range want {
+		product, ok := products[id]
+		if !ok || product.ID != id || product.Price != price {
+			t.Errorf("produto %d = %+v, %v, quer preço %v", id, product, ok, price)
+		}
+	}
+	if products[3].Active {
+		t.Error("produto 3 deveria voltar inativo")
+	}
+}
+
+// Grava um CSV no formato do dataset com rows eventos sobre 500 produtos de
+// 20 categorias, com os IDs de produto fora de ordem
+func writeEventsCSV(tb testing.TB, filename string, rows int) {
+	tb.Helper()
+	var content strings.Builder
+	content.WriteString(csvHeader)
+	actions := []string{"view", "view", "view", "cart", "purchase"}
+	for i := 0; i < rows; i++ {
+		product := 1000000 + (i*7919)%500
+		fmt.Fprintf(&content, "2019-10-01 00:%02d:%02d UTC,%s,%d,%d,categoria.%d,marca%d,%d.99,%d,sessao%d\n",
+			(i/60)%60, i%60, actions[i%len(actions)], product, 2000+product%20, product%20, product%7, product%1000, 500000+i%300, i%300)
+	}
+	if err := os.WriteFile(filename, []byte(content.String()), 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Confere que o índice está em ordem crescente e que a busca binária acha
+// cada ID no registro certo. Retorna quantas entradas o índice tem
+func checkSortedIndex[T any](t *testing.T, dataFilename, indexFilename string, idOf func(T) uint32) int {
+	t.Helper()
+	entries := 0
+	var last uint32
+	err := ForEachIndexEntry(indexFilename, func(entry IndexEntry) error {
+		if entries > 0 && entry.ID < last {
+			t.Errorf("%s fora de ordem: %d depois de %d", indexFilename, entry.ID, last)
+		}
+		last = entry.ID
+		entries++
+
+		offset, found := BinarySearchOnDisk(indexFilename, entry.ID)
+		if !found {
+			t.Errorf("ID %d não encontrado em %s", entry.ID, indexFilename)
+			return nil
+		}
+		record, err := ReadFromDataFile[T](dataFilename, offset)
+		if err != nil {
+			return err
+		}
+		if idOf(record) != entry.ID {
+			t.Errorf("ID %d de %s aponta para o registro %d", entry.ID, indexFilename, idOf(record))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestImportSortedIndexIsSearchable(t *testing.T) {
+	inTempDir(t)
+	writeEventsCSV(t, "import.csv", 1200)
+	stats, err := ImportSorted(context.Background(), "import.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := checkSortedIndex(t, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, productID); n != stats.Products || n != 500 {
+		t.Errorf("%d produtos no índice, ImportStats tem %d, quer 500", n, stats.Products)
+	}
+	if n := checkSortedIndex(t, CATEGORY_DATA_FILE, CATEGORY_INDEX_FILE, categoryID); n != stats.Categories || n != 20 {
+		t.Errorf("%d categorias no índice, ImportStats tem %d, quer 20", n, stats.Categories)
+	}
+	if n := checkSortedIndex(t, EVENT_DATA_FILE, EVENT_INDEX_FILE, eventID); n != 1200 {
+		t.Errorf("%d eventos no índice, quer 1200", n)
+	}
+
+	var want Product
+	for _, product := range readAll[Product](t, PRODUCT_DATA_FILE) {
+		if product.Price > want.Price {
+			want = product
+		}
+	}
+	got, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Price != want.Price {
+		t.Errorf("mais caro = %+v, quer preço %v", got, want.Price)
+	}
+}
+
+func benchmarkImport(b *testing.B, importFile func(context.Context, string) (ImportStats, error)) {
+	inTempDir(b)
+	writeEventsCSV(b, "bench.csv", 5000)
+	for b.Loop() {
+		b.StopTimer()
+		if err := DropStore("."); err != nil {
+			b.Fatal(err)
+		}
+		SequentialIDs = &Sequential{}
+		b.StartTimer()
+		if _, err := importFile(context.Background(), "bench.csv"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkImportarCSV(b *testing.B) { benchmarkImport(b, ImportarCSV) }
+
+func BenchmarkImportSorted(b *testing.B) { benchmarkImport(b, ImportSorted) }
+
+func TestExistsReadsOnlyTheIndex(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2, 3)
+	if err := os.Remove(PRODUCT_DATA_FILE); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, want := range map[uint32]bool{0: true, 2: true, 3: false, 100: false} {
+		found, err := Exists(PRODUCT_INDEX_FILE, id)
+		if err != nil || found != want {
+			t.Errorf("Exists(%d) = %v, %v, quer %v", id, found, err, want)
+		}
+	}
+	if _, err := os.Stat(PRODUCT_DATA_FILE); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Exists recriou o arquivo de dados: %v", err)
+	}
+
+	if found, err := Exists("inexistente.bin", 1); err != nil || found {
+		t.Errorf("Exists sem índice = %v, %v, quer false", found, err)
+	}
+}
+
+func TestReactivateProduct(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 10, 50, 20)
+	remove := func(id uint32) {
+		t.Helper()
+		if err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reactivate := func(id uint32) error {
+		return ReactivateProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
+	}
+	listed := func() []uint32 {
+		t.Helper()
+		products, err := ListProducts(PRODUCT_DATA_FILE, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []uint32{}
+		for _, product := range products {
+			ids = append(ids, product.ID)
+		}
+		return ids
+	}
+
+	remove(1)
+	if ids := listed(); len(ids) != 2 {
+		t.Fatalf("ListProducts depois de remover = %v, quer [0 2]", ids)
+	}
+	if mostExpensive, _ := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE); mostExpensive.ID != 2 {
+		t.Fatalf("mais caro depois de remover = %d, quer 2", mostExpensive.ID)
+	}
+
+	if err := reactivate(1); err != nil {
+		t.Fatal(err)
+	}
+	if ids := listed(); len(ids) != 3 || ids[1] != 1 {
+		t.Errorf("ListProducts depois de reativar = %v, quer [0 1 2]", ids)
+	}
+	if mostExpensive, _ := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE); mostExpensive.ID != 1 {
+		t.Errorf("mais caro depois de reativar = %d, quer 1", mostExpensive.ID)
+	}
+	leaders, err := MostExpensiveByCategoryFromFile(MOST_EXPENSIVE_PER_CATEGORY_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaders[0].ID != 1 {
+		t.Errorf("mais caro da categoria 0 = %d, quer 1", leaders[0].ID)
+	}
+
+	if err := reactivate(1); !errors.Is(err, ErrAlreadyActive) {
+		t.Errorf("reativar de novo: erro %v, quer ErrAlreadyActive", err)
+	}
+	if err := reactivate(9); err == nil {
+		t.Error("reativar ID inexistente não retornou erro")
+	}
+}
+
+func TestDropAll(t *testing.T) {
+	importSample(t)
+	categories := len(readAll[Category](t, CATEGORY_DATA_FILE))
+	if err := DropAll(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE); err != nil {
+		t.Fatal(err)
+	}
+
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != 0 {
+		t.Errorf("%d produtos depois de DropAll, quer 0", len(products))
+	}
+	if size := sizeOf(t, PRODUCT_INDEX_FILE); size != 0 {
+		t.Errorf("índice com %d bytes depois de DropAll", size)
+	}
+	if got := len(readAll[Category](t, CATEGORY_DATA_FILE)); got != categories {
+		t.Errorf("%d categorias depois de DropAll dos produtos, quer %d", got, categories)
+	}
+
+	// Os arquivos vazios continuam utilizáveis
+	if err := AddProduct(Product{ID: 0, Price: 1, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 0); err != nil || !found {
+		t.Errorf("GetProductByID(0) depois de DropAll = %v, %v", found, err)
+	}
+}
+
+func TestDropStore(t *testing.T) {
+	importSample(t)
+	if err := DropStore("."); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range storeFiles {
+		if size := sizeOf(t, filename); size != 0 {
+			t.Errorf("%s com %d bytes depois de DropStore", filename, size)
+		}
+	}
+	counts, err := SnapshotMetrics()
+	if err != nil || len(counts) != 0 {
+		t.Errorf("SnapshotMetrics depois de DropStore = %v, %v, quer vazio", counts, err)
+	}
+
+	SequentialIDs = &Sequential{}
+	stats, err := ImportarCSV(context.Background(), "test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != stats.Products {
+		t.Errorf("%d produtos depois de importar de novo, quer %d", len(products), stats.Products)
+	}
+}
+
+func TestActionHistogram(t *testing.T) {
+	inTempDir(t)
+	if counts, err := ActionHistogram(0, 100); err != nil || len(counts) != 0 {
+		t.Errorf("sem eventos = %v, %v, quer vazio", counts, err)
+	}
+
+	events := []Event{
+		// Primeira janela, de 1000 a 1999
+		{EventTime: 1000, EventAction: VIEW},
+		{EventTime: 1500, EventAction: VIEW},
+		{EventTime: 1999, EventAction: CART},
+		// Segunda janela, de 2000 a 2999
+		{EventTime: 2000, EventAction: VIEW},
+		{EventTime: 2100, EventAction: CART},
+		{EventTime: 2200, EventAction: PURCHASE},
+		{EventTime: 2300, EventAction: PURCHASE},
+	}
+	for id, event := range events {
+		event.ID = uint32(id)
+		if _, err := AppendDataToFile(EVENT_DATA_FILE, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		from, to int64
+		want     map[Action]uint32
+	}{
+		{"primeira janela", 1000, 1999, map[Action]uint32{VIEW: 2, CART: 1}},
+		{"segunda janela", 2000, 2999, map[Action]uint32{VIEW: 1, CART: 1, PURCHASE: 2}},
+		{"tudo", 0, 3000, map[Action]uint32{VIEW: 3, CART: 2, PURCHASE: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counts, err := ActionHistogram(tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(counts) != len(tt.want) {
+				t.Errorf("ActionHistogram(%d, %d) = %v, quer %v", tt.from, tt.to, counts, tt.want)
+			}
+			for action, n := range tt.want {
+				if counts[action] != n {
+					t.Errorf("%s = %d, quer %d", getActionName(action), counts[action], n)
+				}
+			}
+		})
+	}
+
+	if _, err := ActionHistogram(10, 5); err == nil {
+		t.Error("ActionHistogram aceitou início depois do fim")
+	}
+}
+
+func TestTopBrands(t *testing.T) {
+	inTempDir(t)
+	brands := []string{"samsung", "apple", " samsung ", "xiaomi", "apple", "samsung", "", "lg", "xiaomi", "sony"}
+	for id, brand := range brands {
+		product := Product{ID: uint32(id), Brand: StringToByteArray(brand), Price: 1, Active: true}
+		if err := AddProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Produtos inativos não entram na contagem
+	if err := AddProduct(Product{ID: 10, Brand: StringToByteArray("lg"), Price: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		n    int
+		want []BrandCount
+	}{
+		{3, []BrandCount{{"samsung", 3}, {"apple", 2}, {"xiaomi", 2}}},
+		{1, []BrandCount{{"samsung", 3}}},
+		{10, []BrandCount{{"samsung", 3}, {"apple", 2}, {"xiaomi", 2}, {"lg", 1}, {"sony", 1}}},
+		{0, []BrandCount{}},
+	}
+	for _, tt := range tests {
+		got, err := TopBrands(PRODUCT_DATA_FILE, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("TopBrands(%d) = %v, quer %v", tt.n, got, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("TopBrands(%d)[%d] = %v, quer %v", tt.n, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestTopBrandsNegativeN(t *testing.T) {
+	inTempDir(t)
+	if err := AddProduct(Product{ID: 0, Brand: StringToByteArray("apple"), Price: 1, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if top, err := TopBrands(PRODUCT_DATA_FILE, -1); err == nil {
+		t.Errorf("TopBrands(-1) = %v, quer erro", top)
+	}
+}
+
+func TestAveragePriceByCategory(t *testing.T) {
+	inTempDir(t)
+	products := []Product{
+		{ID: 0, CategoryID: 1, Price: 10, Active: true},
+		{ID: 1, CategoryID: 1, Price: 20, Active: true},
+		{ID: 2, CategoryID: 1, Price: 1000},
+		{ID: 3, CategoryID: 2, Price: 5, Active: true},
+		{ID: 4, CategoryID: 2, Price: 6, Active: true},
+		{ID: 5, CategoryID: 2, Price: 7, Active: true},
+		// Categoria só com produto inativo
+		{ID: 6, CategoryID: 3, Price: 50},
+	}
+	for _, product := range products {
+		if err := AddProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	averages, err := AveragePriceByCategory(PRODUCT_DATA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]float32{1: 15, 2: 6}
+	if len(averages) != len(want) {
+		t.Errorf("AveragePriceByCategory = %v, quer %v", averages, want)
+	}
+	for categoryID, average := range want {
+		if averages[categoryID] != average {
+			t.Errorf("média da categoria %d = %v, quer %v", categoryID, averages[categoryID], average)
+		}
+	}
+	if _, ok := averages[3]; ok {
+		t.Error("categoria sem produtos ativos está no map")
+	}
+}
+
+func TestListDeletedProducts(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2, 3, 4)
+	for _, id := range []uint32{3, 1} {
+		if err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := ListDeletedProducts(PRODUCT_DATA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0].ID != 1 || deleted[1].ID != 3 {
+		t.Errorf("ListDeletedProducts = %+v, quer os produtos 1 e 3", deleted)
+	}
+	for _, product := range deleted {
+		if product.Active {
+			t.Errorf("produto %d removido continua ativo", product.ID)
+		}
+	}
+}
+
+func TestCachedRecordSizes(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached int64
+		live   int
+	}{
+		{"Product", productRecordSize, binary.Size(Product{})},
+		{"Category", categoryRecordSize, binary.Size(Category{})},
+		{"Event", eventRecordSize, binary.Size(Event{})},
+		{"IndexEntry", indexEntrySize, binary.Size(IndexEntry{})},
+		{"ActionMetrics", actionMetricsRecordSize, binary.Size(ActionMetrics{})},
+		{"ProductMetrics", productMetricsRecordSize, binary.Size(ProductMetrics{})},
+		{"ExternalIDEntry", externalIDRecordSize, binary.Size(ExternalIDEntry{})},
+	}
+	for _, tt := range tests {
+		if tt.cached != int64(tt.live) {
+			t.Errorf("tamanho de %s = %d, binary.Size = %d", tt.name, tt.cached, tt.live)
+		}
+	}
+	if got, want := dataRecordSize[Product](), productRecordSize+checksumSize; got != want {
+		t.Errorf("dataRecordSize[Product] = %d, quer %d", got, want)
+	}
+}
+
+func setSyncPolicy(tb testing.TB, policy SyncPolicy) {
+	tb.Helper()
+	previous := Config.Sync
+	Config.Sync = policy
+	tb.Cleanup(func() { Config.Sync = previous })
+}
+
+func BenchmarkAppendDataToFile(b *testing.B) {
+	policies := []struct {
+		name   string
+		policy SyncPolicy
+	}{
+		{"SyncAlways", SyncAlways},
+		{"SyncInterval100", SyncInterval(100)},
+		{"SyncNever", SyncNever},
+	}
+	for _, p := range policies {
+		b.Run(p.name, func(b *testing.B) {
+			inTempDir(b)
+			setSyncPolicy(b, p.policy)
+			id := uint32(0)
+			for b.Loop() {
+				if _, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: id, Active: true}); err != nil {
+					b.Fatal(err)
+				}
+				id++
+			}
+		})
+	}
+}
+
+func BenchmarkBinarySearchOnDisk(b *testing.B) {
+	const entries = 100000
+	inTempDir(b)
+	index := make([]IndexEntry, entries)
+	for id := range index {
+		index[id] = IndexEntry{ID: uint32(id), Offset: int64(id)}
+	}
+	if err := appendIndexEntries(PRODUCT_INDEX_FILE, index); err != nil {
+		b.Fatal(err)
+	}
+
+	i := 0
+	for b.Loop() {
+		id := uint32(i*7919) % entries
+		if _, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, id); !found {
+			b.Fatalf("ID %d não encontrado", id)
+		}
+		i++
+	}
+}
+
+func BenchmarkReadFromDataFile(b *testing.B) {
+	const records = 1000
+	inTempDir(b)
+	writer, err := NewBatchWriter[Product](PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for id := uint32(0); id < records; id++ {
+		if _, err := writer.Append(Product{ID: id, Active: true}, id); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	i := 0
+	for b.Loop() {
+		offset := dataHeaderSize + int64(i%records)*dataRecordSize[Product]()
+		if _, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, offset); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
+
+func TestImportarCSVGzip(t *testing.T) {
+	plain := importSample(t)
+	sample, err := os.ReadFile("test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(sample); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pela extensão e, sem ela, pelo número mágico do gzip
+	for _, name := range []string{"events.csv.gz", "events.csv"} {
+		t.Run(name, func(t *testing.T) {
+			inTempDir(t)
+			if err := os.WriteFile(name, compressed.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := ImportarCSV(context.Background(), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats != plain {
+				t.Errorf("ImportStats = %+v, quer %+v como na importação sem gzip", stats, plain)
+			}
+			if events := readAll[Event](t, EVENT_DATA_FILE); len(events) != plain.Events {
+				t.Errorf("%d eventos gravados, quer %d", len(events), plain.Events)
+			}
+		})
+	}
+}
+
+func TestImportarCSVWithOptions(t *testing.T) {
+	rows := [][]string{
+		strings.Split(strings.TrimSpace(csvHeader), ","),
+		{"2019-10-01 00:00:00 UTC", "view", "1004237", "1", "electronics", "apple", "1081.98", "514218020", "s1"},
+		{"2019-10-01 00:00:05 UTC", "cart", "1004237", "1", "electronics", "apple", "1081.98", "514218020", "s1"},
+		{"2019-10-01 00:00:09 UTC", "view", "1005105", "2", "appliances", "samsung", "12.50", "514218021", "s2"},
+	}
+	join := func(comma string) string {
+		lines := make([]string, len(rows))
+		for i, row := range rows {
+			lines[i] = strings.Join(row, comma)
+		}
+		return strings.Join(lines, "\n") + "\n"
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		opts    CSVOptions
+	}{
+		{"tab", join("\t"), CSVOptions{Comma: '\t'}},
+		{"ponto e vírgula", join(";"), CSVOptions{Comma: ';'}},
+		{"comentários", "# exportado em 2019-10-02\n" + join(";"), CSVOptions{Comma: ';', Comment: '#'}},
+		{"aspas soltas", strings.Replace(join(","), "samsung", `sam"sung`, 1), CSVOptions{LazyQuotes: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t)
+			if err := os.WriteFile("events.csv", []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := ImportarCSVWithOptions(context.Background(), "events.csv", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Events != 3 || stats.Products != 2 || stats.Categories != 2 {
+				t.Errorf("ImportStats = %+v, quer 3 eventos, 2 produtos e 2 categorias", stats)
+			}
+			product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 1)
+			if err != nil || !found || product.Price != 12.5 {
+				t.Errorf("segundo produto = %+v, %v, %v", product, found, err)
+			}
+		})
+	}
+
+	t.Run("separador errado", func(t *testing.T) {
+		inTempDir(t)
+		if err := os.WriteFile("events.csv", []byte(join(";")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := ImportarCSV(context.Background(), "events.csv")
+		if !errors.Is(err, csv.ErrFieldCount) {
+			t.Errorf("arquivo com ; importado com vírgula: erro %v, quer csv.ErrFieldCount", err)
+		}
+		if stats.Events != 0 {
+			t.Errorf("%d eventos importados, quer 0", stats.Events)
+		}
+	})
+}
+
+func TestImportRejectsMalformedNumbers(t *testing.T) {
+	inTempDir(t)
+	writeCSV(t, "events.csv",
+		"2019-10-01 00:00:00 UTC,view,1,1,electronics,apple,10.00,7,s1",
+		"2019-10-01 00:00:01 UTC,view,2,1,electronics,apple,abc,7,s1",
+		"2019-10-01 00:00:02 UTC,view,3,1,electronics,apple,30.00,usuário,s1",
+		"2019-10-01 00:00:03 UTC,cart,1,1,electronics,apple,10.00,7,s1",
+	)
+	type rejection struct {
+		line int
+		err  error
+	}
+	rejected := []rejection{}
+	opts := CSVOptions{OnRowError: func(line int, err error) {
+		rejected = append(rejected, rejection{line, err})
+	}}
+	stats, err := ImportarCSVWithOptions(context.Background(), "events.csv", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Rejected != 2 || len(rejected) != 2 {
+		t.Fatalf("Rejected = %d, OnRowError chamado com %v, quer 2 linhas", stats.Rejected, rejected)
+	}
+	for i, line := range []int{3, 4} {
+		if rejected[i].line != line || !errors.Is(rejected[i].err, ErrInvalidField) {
+			t.Errorf("rejeição %d = linha %d, %v, quer linha %d com ErrInvalidField", i, rejected[i].line, rejected[i].err, line)
+		}
+	}
+
+	for _, product := range readAll[Product](t, PRODUCT_DATA_FILE) {
+		if product.Price == 0 {
+			t.Errorf("produto %d gravado com preço zero", product.ID)
+		}
+	}
+	if stats.Events != 2 || stats.Products != 2 {
+		t.Errorf("ImportStats = %+v, quer 2 eventos e 2 produtos", stats)
+	}
+}
+
+func TestImportTwiceDoesNotDuplicate(t *testing.T) {
+	first := importSample(t)
+	// Um processo novo: só o mapa de IDs externos em disco lembra a
+	// primeira importação
+	SequentialIDs = &Sequential{}
+
+	second, err := ImportarCSV(context.Background(), "test.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Products != 0 || second.Categories != 0 || second.Events != 0 {
+		t.Errorf("segunda importação = %+v, quer nada novo", second)
+	}
+	if got := len(readAll[Product](t, PRODUCT_DATA_FILE)); got != first.Products {
+		t.Errorf("%d produtos depois de importar duas vezes, quer %d", got, first.Products)
+	}
+	if got := len(readAll[Category](t, CATEGORY_DATA_FILE)); got != first.Categories {
+		t.Errorf("%d categorias depois de importar duas vezes, quer %d", got, first.Categories)
+	}
+	if got := len(readAll[Event](t, EVENT_DATA_FILE)); got != first.Events {
+		t.Errorf("%d eventos depois de importar duas vezes, quer %d", got, first.Events)
+	}
+
+	// Só as linhas novas de um CSV que se sobrepõe ao primeiro entram
+	rows := sampleRows(t)
+	overlap := append([]string{}, strings.Join(rows[0], ","))
+	overlap = append(overlap, "2019-10-02 00:00:00 UTC,view,99999999,1,electronics,nova,5.00,1,nova-sessao")
+	writeCSV(t, "overlap.csv", overlap...)
+	third, err := ImportarCSV(context.Background(), "overlap.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Products != 1 || third.Events != 1 {
+		t.Errorf("importação sobreposta = %+v, quer 1 produto e 1 evento", third)
+	}
+}
+
+func TestUpsertProduct(t *testing.T) {
+	inTempDir(t)
+	upsert := func(product Product) {
+		t.Helper()
+		err := UpsertProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, product)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mostExpensive := func() uint32 {
+		t.Helper()
+		product, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return product.ID
+	}
+
+	// Inclusão
+	upsert(Product{ID: 0, CategoryID: 1, Price: 10, Active: true})
+	upsert(Product{ID: 1, CategoryID: 1, Price: 40, Active: true})
+	upsert(Product{ID: 2, CategoryID: 2, Price: 30, Active: true})
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != 3 {
+		t.Fatalf("%d produtos depois das inclusões, quer 3", len(products))
+	}
+	if id := mostExpensive(); id != 1 {
+		t.Fatalf("mais caro = %d, quer 1", id)
+	}
+
+	// Atualização no lugar que derruba o mais caro
+	upsert(Product{ID: 1, CategoryID: 1, Price: 5, Active: true})
+	if products := readAll[Product](t, PRODUCT_DATA_FILE); len(products) != 3 {
+		t.Errorf("%d produtos depois da atualização, quer 3", len(products))
+	}
+	if product, _, _ := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 1); product.Price != 5 {
+		t.Errorf("preço do produto 1 = %v, quer 5", product.Price)
+	}
+	if id := mostExpensive(); id != 2 {
+		t.Errorf("mais caro depois de baratear o 1 = %d, quer 2", id)
+	}
+	leaders, err := MostExpensiveByCategoryFromFile(MOST_EXPENSIVE_PER_CATEGORY_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaders[1].ID != 0 {
+		t.Errorf("mais caro da categoria 1 = %d, quer 0", leaders[1].ID)
+	}
+
+	// Atualização que passa a ser o mais caro
+	upsert(Product{ID: 0, CategoryID: 1, Price: 100, Active: true})
+	if id := mostExpensive(); id != 0 {
+		t.Errorf("mais caro depois de encarecer o 0 = %d, quer 0", id)
+	}
+}
+
+func TestMergeStores(t *testing.T) {
+	writeProducts := func(t *testing.T, filename string, ids ...uint32) {
+		t.Helper()
+		for _, id := range ids {
+			if _, err := AppendDataToFile(filename, Product{ID: id, Price: float32(id), Active: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	renumber := func(product *Product, id uint32) { product.ID = id }
+
+	t.Run("IDs disjuntos", func(t *testing.T) {
+		inTempDir(t)
+		writeProducts(t, "a.bin", 1, 3, 5)
+		writeProducts(t, "b.bin", 2, 4)
+		if err := MergeStores("dst.bin", "dst_idx.bin", "a.bin", "b.bin", productID, nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := checkSortedIndex(t, "dst.bin", "dst_idx.bin", productID); n != 5 {
+			t.Errorf("%d entradas no índice, quer 5", n)
+		}
+		products := readAll[Product](t, "dst.bin")
+		want := []uint32{1, 3, 5, 2, 4}
+		for i, product := range products {
+			if product.ID != want[i] {
+				t.Errorf("registro %d com ID %d, quer %d", i, product.ID, want[i])
+			}
+		}
+	})
+
+	t.Run("IDs repetidos recusados", func(t *testing.T) {
+		inTempDir(t)
+		writeProducts(t, "a.bin", 1, 2)
+		writeProducts(t, "b.bin", 2, 3)
+		err := MergeStores("dst.bin", "dst_idx.bin", "a.bin", "b.bin", productID, nil)
+		if !errors.Is(err, ErrDuplicateID) {
+			t.Errorf("MergeStores: erro %v, quer ErrDuplicateID", err)
+		}
+		if _, err := os.Stat("dst.bin"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("destino criado apesar do erro: %v", err)
+		}
+	})
+
+	t.Run("IDs repetidos renumerados", func(t *testing.T) {
+		inTempDir(t)
+		writeProducts(t, "a.bin", 1, 2)
+		writeProducts(t, "b.bin", 2, 3)
+		if err := MergeStores("a.bin", "a_idx.bin", "a.bin", "b.bin", productID, renumber); err != nil {
+			t.Fatal(err)
+		}
+		if n := checkSortedIndex(t, "a.bin", "a_idx.bin", productID); n != 4 {
+			t.Errorf("%d entradas no índice, quer 4", n)
+		}
+		// O segundo 2 vira 4, o maior ID das origens mais um
+		product, err := ReadFromDataFile[Product]("a.bin", dataHeaderSize+2*dataRecordSize[Product]())
+		if err != nil || product.ID != 4 || product.Price != 2 {
+			t.Errorf("produto renumerado = %+v, %v, quer ID 4 com preço 2", product, err)
+		}
+	})
+}
+
+func TestQueryProductHitsWriteBack(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 5, 15, 25, 35)
+
+	hits, err := QueryProductHitsByPriceRange(PRODUCT_DATA_FILE, 10, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Product.ID != 1 || hits[1].Product.ID != 2 {
+		t.Fatalf("hits = %+v, quer os produtos 1 e 2", hits)
+	}
+
+	file, err := OpenDataFile[Product](PRODUCT_DATA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	hit := hits[1]
+	hit.Product.Price = 99
+	if err := WriteDataRecordAt(file, hit.Offset, hit.Product); err != nil {
+		t.Fatal(err)
+	}
+
+	product, err := ReadDataRecordAt[Product](file, hit.Offset)
+	if err != nil || product.ID != 2 || product.Price != 99 {
+		t.Errorf("produto relido = %+v, %v, quer ID 2 com preço 99", product, err)
+	}
+	if got, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 2); err != nil || !found || got.Price != 99 {
+		t.Errorf("GetProductByID(2) = %+v, %v, %v, quer preço 99", got, found, err)
+	}
+	if hits, _ := QueryProductHitsByPriceRange(PRODUCT_DATA_FILE, 10, 30); len(hits) != 1 {
+		t.Errorf("%d hits depois da escrita, quer 1", len(hits))
+	}
+}
+
+// Grava o registro em um arquivo de dados novo e lê de volta pelo offset
+// devolvido
+func roundTripFile[T any](t *testing.T, filename string, record T) T {
+	t.Helper()
+	offset, err := AppendDataToFile(filename, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFromDataFile[T](filename, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// bool, float32 e bytes NUL no meio dos textos são onde binary costuma
+// surpreender
+func FuzzProductRoundTrip(f *testing.F) {
+	f.Add(uint32(0), uint32(0), "", float32(0), false, int64(0), uint8(VIEW))
+	f.Add(uint32(math.MaxUint32), uint32(math.MaxUint32), "samsung", float32(math.MaxFloat32), true, int64(math.MaxInt64), uint8(PURCHASE))
+	f.Add(uint32(1), uint32(2), "a\x00b", float32(-math.SmallestNonzeroFloat32), true, int64(math.MinInt64), uint8(REMOVE_FROM_CART|PURCHASE))
+	f.Add(uint32(3), uint32(4), "\x00\x00", float32(math.Inf(-1)), false, int64(-1), uint8(0xff))
+	f.Add(uint32(5), uint32(6), strings.Repeat("x", 120), float32(19.99), true, int64(1570000000), uint8(CART))
+
+	f.Fuzz(func(t *testing.T, id, categoryID uint32, text string, price float32, active bool, eventTime int64, action uint8) {
+		dir := t.TempDir()
+
+		product := Product{ID: id, CategoryID: categoryID, Brand: StringToByteArray(text), Price: price, Active: active}
+		got := roundTripFile(t, filepath.Join(dir, "products.bin"), product)
+		// NaN != NaN, então o preço é comparado pelos bits
+		if math.Float32bits(got.Price) != math.Float32bits(product.Price) {
+			t.Errorf("preço %v virou %v", product.Price, got.Price)
+		}
+		got.Price, product.Price = 0, 0
+		if got != product {
+			t.Errorf("produto %+v virou %+v", product, got)
+		}
+
+		category := Category{ID: id, Name: StringToByteArray(text)}
+		if got := roundTripFile(t, filepath.Join(dir, "categories.bin"), category); got != category {
+			t.Errorf("categoria %+v virou %+v", category, got)
+		}
+
+		event := Event{ID: id, UserSession: StringTo50ByteArray(text), UserID: categoryID, ProductID: id, EventAction: Action(action), EventTime: eventTime}
+		if got := roundTripFile(t, filepath.Join(dir, "events.bin"), event); got != event {
+			t.Errorf("evento %+v virou %+v", event, got)
+		}
+	})
+}
+
+func TestNextIDOverflow(t *testing.T) {
+	inTempDir(t)
+	row := strings.Split("2019-10-01 00:00:00 UTC,view,1,2,eletronicos,samsung,10.5,3,sessao", ",")
+
+	if err := AddProduct(Product{ID: math.MaxUint32, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildProduct(row, Category{}, SequentialIDs); !errors.Is(err, ErrIDOverflow) {
+		t.Errorf("BuildProduct depois do ID %d: erro %v, quer ErrIDOverflow", uint32(math.MaxUint32), err)
+	}
+
+	if err := AddEvent(Event{ID: math.MaxUint32}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildEvent(row, map[uint32]uint32{1: 0}, SequentialIDs); !errors.Is(err, ErrIDOverflow) {
+		t.Errorf("BuildEvent depois do ID %d: erro %v, quer ErrIDOverflow", uint32(math.MaxUint32), err)
+	}
+
+	if err := Categories.Add(Category{ID: math.MaxUint32, Name: StringToByteArray("ultima")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildCategory(row, SequentialIDs); !errors.Is(err, ErrIDOverflow) {
+		t.Errorf("BuildCategory depois do ID %d: erro %v, quer ErrIDOverflow", uint32(math.MaxUint32), err)
+	}
+	if _, err := AddCategory("nova"); !errors.Is(err, ErrIDOverflow) {
+		t.Errorf("AddCategory depois do ID %d: erro %v, quer ErrIDOverflow", uint32(math.MaxUint32), err)
+	}
+
+	// Nenhum registro com ID 0 foi gravado por engano
+	for _, filename := range []string{PRODUCT_INDEX_FILE, CATEGORY_INDEX_FILE, EVENT_INDEX_FILE} {
+		if found, err := Exists(filename, 0); err != nil || found {
+			t.Errorf("Exists(%s, 0) = %v, %v, quer false", filename, found, err)
+		}
+	}
+}
+
+func TestGetProductWithCategory(t *testing.T) {
+	inTempDir(t)
+	addCategories(t, "livros", "moveis")
+	if err := AddProduct(Product{ID: 0, CategoryID: 1, Brand: StringToByteArray("tok"), Price: 200, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	product, category, err := GetProductWithCategory(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if product.Price != 200 || category.ID != 1 || ByteArrayToString(category.Name[:]) != "moveis" {
+		t.Errorf("GetProductWithCategory(0) = %+v, %+v, quer o produto com a categoria moveis", product, category)
+	}
+
+	// A categoria some por baixo do produto
+	if err := Categories.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	product, category, err = GetProductWithCategory(0)
+	if !errors.Is(err, ErrDanglingCategory) {
+		t.Fatalf("categoria removida: erro %v, quer ErrDanglingCategory", err)
+	}
+	if product.ID != 0 || product.Price != 200 || category != (Category{}) {
+		t.Errorf("categoria removida: %+v, %+v, quer o produto com uma categoria zerada", product, category)
+	}
+
+	if _, _, err := GetProductWithCategory(5); err == nil || errors.Is(err, ErrDanglingCategory) {
+		t.Errorf("produto inexistente: erro %v", err)
+	}
+}
+
+func TestExportFixedWidth(t *testing.T) {
+	inTempDir(t)
+	products := []Product{
+		{ID: 0, CategoryID: 3, Brand: StringToByteArray("apple"), Price: 1299.9, Active: true},
+		{ID: 1, CategoryID: 12, Brand: StringToByteArray("lg"), Price: 5, Active: false},
+	}
+	for _, product := range products {
+		if _, err := AppendDataToFile(PRODUCT_DATA_FILE, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spec := []FieldSpec{
+		{Name: "ID", Width: 4, Align: ALIGN_RIGHT},
+		{Name: "Brand", Width: 8, Align: ALIGN_LEFT},
+		{Name: "Price", Width: 10, Align: ALIGN_RIGHT},
+		{Name: "Active", Width: 6},
+	}
+
+	if err := ExportFixedWidth[Product](PRODUCT_DATA_FILE, "produtos.txt", spec); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile("produtos.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"   0apple      1299.90true  ",
+		"   1lg            5.00false ",
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("%d linhas, quer %d:\n%s", len(lines), len(want), content)
+	}
+	for i, line := range lines {
+		if len(line) != 28 {
+			t.Errorf("linha %d com %d caracteres, quer 28", i, len(line))
+		}
+		if line != want[i] {
+			t.Errorf("linha %d = %q, quer %q", i, line, want[i])
+		}
+		// A marca ocupa as colunas 4 a 11
+		if brand := strings.TrimSpace(line[4:12]); brand != ByteArrayToString(products[i].Brand[:]) {
+			t.Errorf("linha %d: marca %q nas colunas 4-12", i, brand)
+		}
+	}
+
+	// Campo maior que a largura: o arquivo sai completo, com o campo cortado
+	spec[1].Width = 3
+	if err := ExportFixedWidth[Product](PRODUCT_DATA_FILE, "produtos.txt", spec); !errors.Is(err, ErrTruncated) {
+		t.Errorf("marca maior que a largura: erro %v, quer ErrTruncated", err)
+	}
+	if content, _ := os.ReadFile("produtos.txt"); !strings.HasPrefix(string(content), "   0app   1299.90") {
+		t.Errorf("exportação cortada começa com %q", content)
+	}
+
+	if err := ExportFixedWidth[Product](PRODUCT_DATA_FILE, "produtos.txt", []FieldSpec{{Name: "Nome", Width: 5}}); !errors.Is(err, ErrUnknownField) {
+		t.Errorf("campo inexistente: erro %v, quer ErrUnknownField", err)
+	}
+}
+
+func TestResumeImport(t *testing.T) {
+	const rows = 2500
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "eventos.csv")
+	writeEventsCSV(t, csvPath, rows)
+
+	// Importação sem falha, para comparar
+	inTempDir(t)
+	want, err := ImportarCSV(context.Background(), csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantViews, wantCarts, wantPurchases, _, err := Funnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A importação cai na linha 1500, depois do checkpoint da linha 1000
+	inTempDir(t)
+	_, err = ImportarCSV(&cancelAfter{Context: context.Background(), remaining: 1500}, csvPath)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ImportarCSV: erro %v, quer context.Canceled", err)
+	}
+	checkpoint, found, err := readImportCheckpoint(IMPORT_CHECKPOINT_FILE)
+	if err != nil || !found {
+		t.Fatalf("checkpoint depois da falha: %+v, %v, %v", checkpoint, found, err)
+	}
+	if checkpoint.Row != IMPORT_FLUSH_EVERY-1 || checkpoint.Offset <= 0 {
+		t.Errorf("checkpoint = %+v, quer a linha %d", checkpoint, IMPORT_FLUSH_EVERY-1)
+	}
+	if leftovers, _ := filepath.Glob(IMPORT_CHECKPOINT_FILE + ".tmp*"); len(leftovers) > 0 {
+		t.Errorf("temporários do checkpoint sobraram: %v", leftovers)
+	}
+
+	if _, err := ResumeImport(context.Background(), csvPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(IMPORT_CHECKPOINT_FILE); !os.IsNotExist(err) {
+		t.Errorf("checkpoint ainda existe depois da retomada: %v", err)
+	}
+	if got := len(readAll[Category](t, CATEGORY_DATA_FILE)); got != want.Categories {
+		t.Errorf("%d categorias, quer %d", got, want.Categories)
+	}
+	if got := len(readAll[Product](t, PRODUCT_DATA_FILE)); got != want.Products {
+		t.Errorf("%d produtos, quer %d", got, want.Products)
+	}
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	if len(events) != want.Events || len(events) != rows {
+		t.Errorf("%d eventos, quer %d", len(events), want.Events)
+	}
+	views, carts, purchases, _, err := Funnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if views != wantViews || carts != wantCarts || purchases != wantPurchases {
+		t.Errorf("funil = %d/%d/%d, quer %d/%d/%d", views, carts, purchases, wantViews, wantCarts, wantPurchases)
+	}
+	if n := checkSortedIndex(t, EVENT_DATA_FILE, EVENT_INDEX_FILE, eventID); n != rows {
+		t.Errorf("%d entradas no índice de eventos, quer %d", n, rows)
+	}
+
+	// Outro arquivo com o mesmo nome não é retomado
+	if err := writeImportCheckpoint(IMPORT_CHECKPOINT_FILE, ImportCheckpoint{FileSize: 1, Offset: 10, Row: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResumeImport(context.Background(), csvPath); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Errorf("checkpoint de outro arquivo: erro %v, quer ErrCheckpointMismatch", err)
+	}
+}
+
+type logEntry struct {
+	level string
+	msg   string
+	args  []any
+}
+
+// Logger que guarda as mensagens em vez de escrevê-las
+type capturingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *capturingLogger) log(level, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, args})
+}
+
+func (l *capturingLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *capturingLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *capturingLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *capturingLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+func TestLookupLogsAtDebugLevel(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 10, 20)
+	t.Cleanup(func() { SetLogger(nil) })
+
+	captured := &capturingLogger{}
+	SetLogger(captured)
+	if _, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 1); !found {
+		t.Fatal("produto 1 não encontrado")
+	}
+	if _, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 7); found {
+		t.Fatal("produto 7 encontrado")
+	}
+	want := []string{"ID encontrado no índice", "ID não encontrado no índice"}
+	if len(captured.entries) != len(want) {
+		t.Fatalf("mensagens = %+v, quer %q", captured.entries, want)
+	}
+	for i, entry := range captured.entries {
+		if entry.level != "DEBUG" || entry.msg != want[i] {
+			t.Errorf("mensagem %d = %s %q, quer DEBUG %q", i, entry.level, entry.msg, want[i])
+		}
+	}
+
+	// Acima de debug, a busca não escreve nada
+	var out bytes.Buffer
+	SetLogger(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	BinarySearchOnDisk(PRODUCT_INDEX_FILE, 1)
+	BinarySearchOnDisk(PRODUCT_INDEX_FILE, 7)
+	if out.Len() != 0 {
+		t.Errorf("nível info registrou %q", out.String())
+	}
+	SetLogger(slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	BinarySearchOnDisk(PRODUCT_INDEX_FILE, 1)
+	if !strings.Contains(out.String(), "level=DEBUG") || !strings.Contains(out.String(), "id=1") {
+		t.Errorf("nível debug registrou %q", out.String())
+	}
+
+	// O padrão é não registrar nada
+	SetLogger(nil)
+	if _, ok := logger.(nopLogger); !ok {
+		t.Errorf("SetLogger(nil) deixou %T", logger)
+	}
+}
+
+// Conteúdo de cada arquivo do store que existe no diretório
+func storeSnapshot(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	for _, filename := range storeFiles {
+		content, err := os.ReadFile(filepath.Join(dir, filename))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		files[filename] = content
+	}
+	return files
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	importSample(t)
+	before := storeSnapshot(t, ".")
+	destDir := filepath.Join(t.TempDir(), "backup")
+
+	if err := Backup(".", destDir); err != nil {
+		t.Fatal(err)
+	}
+	backup := storeSnapshot(t, destDir)
+	if len(backup) != len(before) {
+		t.Errorf("backup com %d arquivos, o diretório tem %d", len(backup), len(before))
+	}
+	if _, err := os.Stat(STORE_LOCK_FILE); !os.IsNotExist(err) {
+		t.Errorf("trava não foi liberada depois do backup: %v", err)
+	}
+	if err := Backup(".", destDir); err == nil {
+		t.Error("Backup sobre um backup existente não falhou")
+	}
+
+	// Muda o original depois do backup
+	err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddProduct(Product{ID: 9999, Price: 1, Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(IMPORT_CHECKPOINT_FILE, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Restore(destDir, "."); err != nil {
+		t.Fatal(err)
+	}
+	after := storeSnapshot(t, ".")
+	if len(after) != len(before) {
+		t.Errorf("%d arquivos depois da restauração, quer %d", len(after), len(before))
+	}
+	for filename, content := range before {
+		if !bytes.Equal(after[filename], content) {
+			t.Errorf("%s diferente depois da restauração", filename)
+		}
+	}
+	if product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 0); err != nil || !found || !product.Active {
+		t.Errorf("produto 0 depois da restauração = %+v, %v, %v", product, found, err)
+	}
+	if _, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 9999); found {
+		t.Error("produto 9999, gravado depois do backup, continua lá")
+	}
+
+	// Com a trava de outro processo, nenhum dos dois roda
+	lock, err := lockStore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlockStore(lock)
+	if err := Restore(destDir, "."); !errors.Is(err, ErrStoreLocked) {
+		t.Errorf("Restore com o diretório travado: erro %v, quer ErrStoreLocked", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 5, 50, 500, 5000)
+	err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []Event{
+		{ID: 0, UserID: 7, ProductID: 1, EventAction: VIEW},
+		{ID: 1, UserID: 8, ProductID: 1, EventAction: CART},
+		{ID: 2, UserID: 7, ProductID: 3, EventAction: PURCHASE},
+	}
+	for _, event := range events {
+		if err := AddEvent(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := func(products []Product) []uint32 {
+		ids := []uint32{}
+		for _, product := range products {
+			ids = append(ids, product.ID)
+		}
+		return ids
+	}
+	productTests := []struct {
+		name string
+		pred func(Product) bool
+		want []uint32
+	}{
+		{"ativos acima de 10", func(p Product) bool { return p.Active && p.Price > 10 }, []uint32{1, 3}},
+		{"inativos", func(p Product) bool { return !p.Active }, []uint32{2}},
+		{"nenhum", func(p Product) bool { return p.Price < 0 }, []uint32{}},
+	}
+	for _, test := range productTests {
+		got, err := Filter(PRODUCT_DATA_FILE, test.pred)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(test.want) {
+			t.Errorf("%s: IDs %v, quer %v", test.name, ids(got), test.want)
+		}
+	}
+
+	byUser, err := Filter(EVENT_DATA_FILE, func(e Event) bool { return e.UserID == 7 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byUser) != 2 || byUser[0].ID != 0 || byUser[1].ID != 2 {
+		t.Errorf("eventos do usuário 7 = %+v, quer os eventos 0 e 2", byUser)
+	}
+	purchases, err := Filter(EVENT_DATA_FILE, func(e Event) bool { return e.EventAction&(CART|PURCHASE) != 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purchases) != 2 || purchases[0].EventAction != CART || purchases[1].EventAction != PURCHASE {
+		t.Errorf("eventos de carrinho ou compra = %+v", purchases)
+	}
+
+	if _, err := Filter(CATEGORY_DATA_FILE, func(Category) bool { return true }); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("arquivo inexistente: erro %v, quer os.ErrNotExist", err)
+	}
+}
+
+func TestReduce(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 10, 250.5, 40, 1000)
+	err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := InventoryValue(PRODUCT_DATA_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 300.5 {
+		t.Errorf("InventoryValue = %v, quer 300.5", total)
+	}
+
+	// Produtos inativos também chegam em fn
+	maxPrice, err := Reduce(PRODUCT_DATA_FILE, float32(0), func(max float32, product Product) float32 {
+		return float32(math.Max(float64(max), float64(product.Price)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxPrice != 1000 {
+		t.Errorf("maior preço = %v, quer 1000", maxPrice)
+	}
+
+	count, err := Reduce(PRODUCT_DATA_FILE, map[bool]int{}, func(counts map[bool]int, product Product) map[bool]int {
+		counts[product.Active]++
+		return counts
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count[true] != 3 || count[false] != 1 {
+		t.Errorf("contagem por Active = %v, quer 3 ativos e 1 inativo", count)
+	}
+
+	init := -1.0
+	got, err := Reduce(EVENT_DATA_FILE, init, func(acc float64, event Event) float64 { return acc + 1 })
+	if !errors.Is(err, os.ErrNotExist) || got != init {
+		t.Errorf("arquivo inexistente: %v, %v, quer init e os.ErrNotExist", got, err)
+	}
+}
+
+func TestCompactAllKeepsReferences(t *testing.T) {
+	inTempDir(t)
+	addCategories(t, "livros", "moveis", "sem uso")
+	prices := []float32{10, 900, 30, 40, 800, 60}
+	for id, price := range prices {
+		if err := AddProduct(Product{ID: uint32(id), CategoryID: uint32(id % 2), Price: price, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := range uint32(12) {
+		if err := AddEvent(Event{ID: id, UserID: id % 3, ProductID: id % 6, EventAction: VIEW}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []uint32{1, 4} {
+		err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Categories.Tombstone(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{3, 7} {
+		if err := Events.Tombstone(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CompactAll(context.Background(), "."); err != nil {
+		t.Fatal(err)
+	}
+
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	if got := fmt.Sprint(len(products), checkSortedIndex(t, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, productID)); got != "4 4" {
+		t.Errorf("produtos e entradas no índice = %s, quer 4 4", got)
+	}
+	for i, id := range []uint32{0, 2, 3, 5} {
+		if products[i].ID != id || products[i].Price != prices[id] {
+			t.Errorf("produto %d = %+v, quer o ID %d com o mesmo preço", i, products[i], id)
+		}
+		if _, category, err := GetProductWithCategory(id); err != nil || category.ID != id%2 {
+			t.Errorf("categoria do produto %d = %+v, %v", id, category, err)
+		}
+	}
+	if n := checkSortedIndex(t, CATEGORY_DATA_FILE, CATEGORY_INDEX_FILE, categoryID); n != 2 {
+		t.Errorf("%d categorias no índice, quer 2", n)
+	}
+
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	if n := checkSortedIndex(t, EVENT_DATA_FILE, EVENT_INDEX_FILE, eventID); len(events) != 10 || n != 10 {
+		t.Errorf("%d eventos e %d entradas no índice, quer 10", len(events), n)
+	}
+	for _, event := range events {
+		if event.ID == 3 || event.ID == 7 {
+			t.Errorf("evento %d com lápide continua no arquivo", event.ID)
+		}
+		product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, event.ProductID)
+		removed := event.ProductID == 1 || event.ProductID == 4
+		if err != nil || found == removed || (found && product.ID != event.ProductID) {
+			t.Errorf("produto do evento %d = %+v, %v, %v", event.ID, product, found, err)
+		}
+	}
+	byUser, err := EventsByUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byUser) != 3 {
+		t.Errorf("%d eventos do usuário 1 depois da compactação, quer 3: %+v", len(byUser), byUser)
+	}
+
+	mostExpensive, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil || mostExpensive.ID != 5 {
+		t.Errorf("mais caro depois da compactação = %+v, %v, quer o produto 5", mostExpensive, err)
+	}
+	if _, err := os.Stat(STORE_LOCK_FILE); !os.IsNotExist(err) {
+		t.Errorf("trava não foi liberada: %v", err)
+	}
+}
+
+func TestRecomputeActionMetrics(t *testing.T) {
+	importSample(t)
+	scanned, err := Reduce(EVENT_DATA_FILE, map[Action]uint32{}, func(counts map[Action]uint32, event Event) map[Action]uint32 {
+		counts[event.EventAction]++
+		return counts
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Uma contagem errada seguida de um registro pela metade
+	var corrupt bytes.Buffer
+	binary.Write(&corrupt, Config.ByteOrder, ActionMetrics{Action: VIEW, NumberOfOcurrences: 12345})
+	corrupt.Write([]byte{byte(CART), 1})
+	if err := os.WriteFile(ACTION_METRICS_FILE, corrupt.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SnapshotMetrics(); !errors.Is(err, ErrTruncatedFile) {
+		t.Fatalf("métricas corrompidas: erro %v, quer ErrTruncatedFile", err)
+	}
+
+	if err := RecomputeActionMetrics(EVENT_DATA_FILE); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := SnapshotMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(counts) != fmt.Sprint(scanned) {
+		t.Errorf("métricas recalculadas = %v, a varredura dos eventos dá %v", counts, scanned)
+	}
+	if size := sizeOf(t, ACTION_METRICS_FILE); size != int64(len(scanned)*binary.Size(ActionMetrics{})) {
+		t.Errorf("arquivo de métricas com %d bytes, quer %d registros", size, len(scanned))
+	}
+}
+
+func TestRemoveEventDecrementsMetrics(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 10)
+	for id := range uint32(3) {
+		if err := AddEvent(Event{ID: id, UserID: 1, ProductID: 0, EventAction: PURCHASE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := AddEvent(Event{ID: 3, UserID: 1, ProductID: 0, EventAction: VIEW}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveEvent(1); err != nil {
+		t.Fatal(err)
+	}
+	views, _, purchases, _, err := Funnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purchases != 2 || views != 1 {
+		t.Errorf("compras = %d e visualizações = %d depois da remoção, quer 2 e 1", purchases, views)
+	}
+	top, err := TopProductsByPurchase(1)
+	if err != nil || len(top) != 1 || top[0].TotalPurchase != 2 {
+		t.Errorf("compras do produto 0 = %+v, %v, quer 2", top, err)
+	}
+	if _, found, _ := Events.Get(1); found {
+		t.Error("evento 1 continua no store")
+	}
+	if err := RemoveEvent(1); err == nil {
+		t.Error("remover o evento 1 de novo não falhou")
+	}
+
+	// A contagem não passa de zero para o maior uint32
+	var zeroed bytes.Buffer
+	binary.Write(&zeroed, Config.ByteOrder, ActionMetrics{Action: PURCHASE})
+	if err := os.WriteFile(ACTION_METRICS_FILE, zeroed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveEvent(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, purchases, _, err := Funnel(); err != nil || purchases != 0 {
+		t.Errorf("compras depois de descontar de zero = %d, %v, quer 0", purchases, err)
+	}
+}
+
+func TestForEachWithOffset(t *testing.T) {
+	importSample(t)
+	recordSize := dataRecordSize[Event]()
+
+	var offsets []int64
+	err := ForEachWithOffset(EVENT_DATA_FILE, func(offset int64, event Event) error {
+		if (offset-dataHeaderSize)%recordSize != 0 {
+			t.Errorf("evento %d no offset %d, fora do tamanho do registro %d", event.ID, offset, recordSize)
+		}
+		if indexed, found := BinarySearchOnDisk(EVENT_INDEX_FILE, event.ID); !found || indexed != offset {
+			t.Errorf("evento %d no offset %d, o índice diz %d", event.ID, offset, indexed)
+		}
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) == 0 || offsets[0] != dataHeaderSize {
+		t.Fatalf("offsets = %v, quer começar em %d", offsets, dataHeaderSize)
+	}
+	if last, want := offsets[len(offsets)-1], sizeOf(t, EVENT_DATA_FILE)-recordSize; last != want {
+		t.Errorf("último offset = %d, quer o tamanho do arquivo menos um registro, %d", last, want)
+	}
+
+	// Um erro de fn encerra a varredura e é retornado
+	stop := errors.New("parar")
+	visited := 0
+	err = ForEachWithOffset(EVENT_DATA_FILE, func(int64, Event) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("fn com erro: %d registros visitados, erro %v", visited, err)
+	}
+}
+
+func TestSequentialIDsUniqueUnderConcurrency(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 1, 2, 3)
+
+	const goroutines = 64
+	ids := make(chan uint32, goroutines)
+	var wg sync.WaitGroup
+	for range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := SequentialIDs.Next(Products)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[uint32]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("ID %d entregue duas vezes", id)
+		}
+		if id < 3 || id >= 3+goroutines {
+			t.Errorf("ID %d fora de 3..%d", id, 3+goroutines-1)
+		}
+		seen[id] = true
+	}
+	if len(seen) != goroutines {
+		t.Errorf("%d IDs distintos, quer %d", len(seen), goroutines)
+	}
+
+	// Depois de esvaziado, o store volta a começar do 0
+	if err := DropStore("."); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := SequentialIDs.Next(Products); err != nil || id != 0 {
+		t.Errorf("Next depois de esvaziar = %d, %v, quer 0", id, err)
+	}
+}
+
+func TestFromExternalStableAcrossImports(t *testing.T) {
+	sample, err := os.ReadFile("teste.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvPath := filepath.Join(t.TempDir(), "test.csv")
+	if err := os.WriteFile(csvPath, sample, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	type imported struct {
+		categories []Category
+		products   []Product
+		events     []Event
+	}
+	importInNewDir := func() imported {
+		inTempDir(t)
+		if _, err := ImportStable(context.Background(), csvPath); err != nil {
+			t.Fatal(err)
+		}
+		checkSortedIndex(t, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, productID)
+		return imported{
+			readAll[Category](t, CATEGORY_DATA_FILE),
+			readAll[Product](t, PRODUCT_DATA_FILE),
+			readAll[Event](t, EVENT_DATA_FILE),
+		}
+	}
+	first, second := importInNewDir(), importInNewDir()
+
+	if len(first.products) == 0 || len(first.events) == 0 {
+		t.Fatalf("importação vazia: %d produtos, %d eventos", len(first.products), len(first.events))
+	}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Error("duas importações do mesmo CSV geraram registros diferentes")
+	}
+	// Os IDs vêm do hash dos IDs do CSV, e não da ordem de chegada
+	sequential := true
+	for i, product := range first.products {
+		sequential = sequential && product.ID == uint32(i)
+	}
+	if sequential {
+		t.Error("ImportStable gerou os IDs sequenciais 0, 1, 2...")
+	}
+
+	// Um hash já usado passa para o ID seguinte
+	store := NewMemStore(productID)
+	hash, err := FromExternal(12345).Next(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(Product{ID: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if next, err := FromExternal(12345).Next(store); err != nil || next != hash+1 {
+		t.Errorf("FromExternal(12345) com o ID %d em uso = %d, %v, quer %d", hash, next, err, hash+1)
+	}
+}
+
+func TestReadPathsDoNotCreateFiles(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 10, 20)
+	if err := AddEvent(Event{ID: 0, UserID: 7, ProductID: 1, EventAction: VIEW}); err != nil {
+		t.Fatal(err)
+	}
+	// Os índices continuam apontando para arquivos de dados que sumiram
+	for _, filename := range []string{PRODUCT_DATA_FILE, EVENT_DATA_FILE} {
+		if err := os.Remove(filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := Products.Get(1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Products.Get sem o arquivo de dados: erro %v, quer os.ErrNotExist", err)
+	}
+	if _, err := GetProductsByIDs([]uint32{0, 1}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("GetProductsByIDs sem o arquivo de dados: erro %v, quer os.ErrNotExist", err)
+	}
+	if events, err := EventsByUser(7); err != nil || len(events) != 0 {
+		t.Errorf("EventsByUser sem o arquivo de eventos = %+v, %v, quer nenhum evento", events, err)
+	}
+	if _, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, dataHeaderSize); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadFromDataFile sem o arquivo: erro %v, quer os.ErrNotExist", err)
+	}
+	if _, found := BinarySearchOnDisk("inexistente_index.bin", 1); found {
+		t.Error("BinarySearchOnDisk achou um ID num índice que não existe")
+	}
+
+	for _, filename := range []string{PRODUCT_DATA_FILE, EVENT_DATA_FILE, "inexistente_index.bin"} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s foi criado por uma leitura: %v", filename, err)
+		}
+	}
+}
+
+func TestDumpRecordHex(t *testing.T) {
+	inTempDir(t)
+	offset, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: 0x04030201, Brand: StringToByteArray("acme"), Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dump, err := DumpRecordHex(PRODUCT_DATA_FILE, offset, int(dataRecordSize[Product]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// O ID em little-endian abre o registro, e a marca vem depois dos dois IDs
+	if !strings.HasPrefix(dump, "00000000  01 02 03 04 ") {
+		t.Errorf("dump começa com %q, quer o ID 01 02 03 04", dump[:min(len(dump), 40)])
+	}
+	if !strings.Contains(dump, "|........acme") {
+		t.Errorf("dump sem a marca:\n%s", dump)
+	}
+	if lines := strings.Count(dump, "\n"); lines != int(dataRecordSize[Product]()+15)/16 {
+		t.Errorf("dump com %d linhas para %d bytes", lines, dataRecordSize[Product]())
+	}
+
+	index := []IndexEntry{{ID: 0x0a0b0c0d, Offset: offset}}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, index)
+	if err := os.WriteFile("index.bin", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	all, err := DumpAllHex("index.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(all, "00000000  0d 0c 0b 0a ") {
+		t.Errorf("DumpAllHex do índice = %q, quer o ID 0d 0c 0b 0a", all)
+	}
+
+	size := sizeOf(t, PRODUCT_DATA_FILE)
+	if _, err := DumpRecordHex(PRODUCT_DATA_FILE, size-4, 8); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("dump além do fim: erro %v, quer ErrOffsetOutOfRange", err)
+	}
+	if _, err := DumpRecordHex("inexistente.bin", 0, 1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("arquivo inexistente: erro %v, quer os.ErrNotExist", err)
+	}
+}
+
+func TestEventsBetweenIndexMatchesScan(t *testing.T) {
+	inTempDir(t)
+	addEvents := func(from, to uint32) {
+		for id := from; id < to; id++ {
+			// Horários fora de ordem e repetidos
+			event := Event{ID: id, UserID: id % 5, EventAction: VIEW, EventTime: 1000 + int64((id*37)%50)*10}
+			if err := AddEvent(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ids := func(events []Event) string {
+		sorted := make([]int, len(events))
+		for i, event := range events {
+			if i > 0 && event.EventTime < events[i-1].EventTime {
+				t.Errorf("evento %d fora da ordem de horário", event.ID)
+			}
+			sorted[i] = int(event.ID)
+		}
+		slices.Sort(sorted)
+		return fmt.Sprint(sorted)
+	}
+	ranges := [][2]int64{{0, 5000}, {1000, 1000}, {1105, 1295}, {1490, 1490}, {1200, 1200}, {2000, 3000}, {0, 999}}
+	check := func(stage string) {
+		t.Helper()
+		for _, r := range ranges {
+			indexed, err := EventsBetween(EVENT_DATA_FILE, r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			scanned, err := scanEventsBetween(EVENT_DATA_FILE, r[0], r[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := ids(indexed), ids(scanned); got != want {
+				t.Errorf("%s: EventsBetween(%d, %d) = %s, a varredura dá %s", stage, r[0], r[1], got, want)
+			}
+		}
+	}
+
+	// A varredura de reserva avisa quando o índice não serve
+	captured := &capturingLogger{}
+	SetLogger(captured)
+	t.Cleanup(func() { SetLogger(nil) })
+
+	addEvents(0, 200)
+	if err := RebuildTimeIndex(context.Background(), EVENT_DATA_FILE, EVENT_TIME_INDEX_FILE); err != nil {
+		t.Fatal(err)
+	}
+	if got := sizeOf(t, EVENT_TIME_INDEX_FILE); got != 200*int64(binary.Size(TimeIndexEntry{})) {
+		t.Errorf("índice por horário com %d bytes, quer 200 entradas", got)
+	}
+	check("índice completo")
+
+	// Eventos gravados depois da montagem ficam fora do índice
+	addEvents(200, 230)
+	check("eventos depois do índice")
+
+	if err := RemoveEvent(17); err != nil {
+		t.Fatal(err)
+	}
+	check("depois de RemoveEvent")
+	for _, entry := range captured.entries {
+		if entry.level == "WARN" {
+			t.Errorf("a busca não usou o índice: %s %v", entry.msg, entry.args)
+		}
+	}
+}
+
+// Processo filho de TestSyncAlwaysSurvivesAbruptExit: grava os produtos e
+// sai sem fechar nada nem rodar os defers
+const syncChildDirEnv = "SYNC_POLICY_CHILD_DIR"
+
+func TestSyncAlwaysSurvivesAbruptExit(t *testing.T) {
+	const records = 50
+	if dir := os.Getenv(syncChildDirEnv); dir != "" {
+		os.Chdir(dir)
+		Config.Sync = SyncAlways
+		for id := range uint32(records) {
+			if _, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: id, Price: float32(id), Active: true}); err != nil {
+				os.Exit(1)
+			}
+		}
+		os.Exit(3)
+	}
+
+	inTempDir(t)
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := exec.Command(os.Args[0], "-test.run=^TestSyncAlwaysSurvivesAbruptExit$")
+	child.Env = append(os.Environ(), syncChildDirEnv+"="+dir)
+	var exitErr *exec.ExitError
+	if err := child.Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("processo filho terminou com %v, quer o código 3", err)
+	}
+
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	if len(products) != records {
+		t.Fatalf("%d produtos depois da saída abrupta, quer %d", len(products), records)
+	}
+	for i, product := range products {
+		if product.ID != uint32(i) || product.Price != float32(i) {
+			t.Errorf("produto %d = %+v", i, product)
+		}
+	}
+}
+
+func TestSyncIntervalCountsWritesPerFile(t *testing.T) {
+	inTempDir(t)
+	setSyncPolicy(t, SyncInterval(4))
+	t.Cleanup(func() {
+		unsyncedMu.Lock()
+		clear(unsyncedWrites)
+		unsyncedMu.Unlock()
+	})
+	if SyncInterval(1) != SyncAlways || SyncInterval(0) != SyncAlways {
+		t.Error("SyncInterval(n <= 1) diferente de SyncAlways")
+	}
+
+	unsynced := func(filename string) int {
+		unsyncedMu.Lock()
+		defer unsyncedMu.Unlock()
+		return unsyncedWrites[filename]
+	}
+	for i, want := range []int{1, 2, 3, 0, 1} {
+		if _, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: uint32(i), Active: true}); err != nil {
+			t.Fatal(err)
+		}
+		if got := unsynced(PRODUCT_DATA_FILE); got != want {
+			t.Errorf("depois da gravação %d: %d gravações sem Sync, quer %d", i+1, got, want)
+		}
+	}
+	// Cada arquivo tem a sua contagem
+	if _, err := AppendDataToFile(CATEGORY_DATA_FILE, Category{ID: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(unsynced(CATEGORY_DATA_FILE), unsynced(PRODUCT_DATA_FILE)); got != "1 1" {
+		t.Errorf("gravações sem Sync por arquivo = %s, quer 1 1", got)
+	}
+}
+
+func TestShardedStoreAcrossShardBoundary(t *testing.T) {
+	inTempDir(t)
+	store := NewShardedStore("events_data", "events_sharded_index.bin", 3, eventID)
+	for id := range uint32(7) {
+		if err := store.Add(Event{ID: id, UserID: 100 + id, EventAction: VIEW}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shards, err := store.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ShardInfo{{0, 2, 3}, {3, 5, 3}, {6, 6, 1}}
+	if fmt.Sprint(shards) != fmt.Sprint(want) {
+		t.Errorf("manifesto = %v, quer %v", shards, want)
+	}
+	for shard := range want {
+		if got := sizeOf(t, store.ShardFilename(shard)); got != dataHeaderSize+int64(want[shard].Records)*dataRecordSize[Event]() {
+			t.Errorf("%s com %d bytes", store.ShardFilename(shard), got)
+		}
+	}
+	if store.ShardFilename(1) != "events_data.001.bin" {
+		t.Errorf("ShardFilename(1) = %q", store.ShardFilename(1))
+	}
+
+	// Os dois lados de cada fronteira
+	for _, id := range []uint32{0, 2, 3, 5, 6} {
+		event, found, err := store.Get(id)
+		if err != nil || !found || event.ID != id || event.UserID != 100+id {
+			t.Errorf("Get(%d) = %+v, %v, %v", id, event, found, err)
+		}
+	}
+	if _, found, err := store.Get(7); found || err != nil {
+		t.Errorf("Get(7) = %v, %v, quer não encontrado", found, err)
+	}
+	if err := store.Add(Event{ID: 4}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("ID repetido: erro %v, quer ErrDuplicateID", err)
+	}
+
+	// A remoção no shard 1 só desloca os registros seguintes do mesmo shard
+	if err := store.Remove(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{2, 4, 5, 6} {
+		if event, found, err := store.Get(id); err != nil || !found || event.ID != id {
+			t.Errorf("Get(%d) depois de remover o 3 = %+v, %v, %v", id, event, found, err)
+		}
+	}
+	if shards, _ := store.Manifest(); shards[1].Records != 2 {
+		t.Errorf("shard 1 com %d registros depois da remoção, quer 2", shards[1].Records)
+	}
+
+	ids := []uint32{}
+	err = store.ForEach(func(event Event) error {
+		ids = append(ids, event.ID)
+		return nil
+	})
+	if err != nil || fmt.Sprint(ids) != "[0 1 2 4 5 6]" {
+		t.Errorf("ForEach = %v, %v, quer [0 1 2 4 5 6]", ids, err)
+	}
+}
+
+type productJSON struct {
+	ID         uint32  `json:"id"`
+	CategoryID uint32  `json:"category_id"`
+	Brand      string  `json:"brand"`
+	Price      float32 `json:"price"`
+	Active     bool    `json:"active"`
+}
+
+func serveJSON(t *testing.T, handler http.Handler, target string, out any) int {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	if out != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), out); err != nil {
+			t.Fatalf("GET %s: %v em %q", target, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestHandlerProducts(t *testing.T) {
+	inTempDir(t)
+	brands := []string{"apple", "samsung", "lg", "xiaomi"}
+	for id, price := range []float32{100, 250, 40, 999.5} {
+		product := Product{ID: uint32(id), CategoryID: 1, Brand: StringToByteArray(brands[id]), Price: price, Active: true}
+		if err := AddProduct(product); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenStore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	handler := NewHandler(store)
+
+	var product productJSON
+	if code := serveJSON(t, handler, "/products/3", &product); code != http.StatusOK {
+		t.Fatalf("GET /products/3: status %d", code)
+	}
+	if product != (productJSON{ID: 3, CategoryID: 1, Brand: "xiaomi", Price: 999.5, Active: true}) {
+		t.Errorf("GET /products/3 = %+v", product)
+	}
+
+	var body map[string]string
+	for target, want := range map[string]int{
+		"/products/1":   http.StatusNotFound,
+		"/products/42":  http.StatusNotFound,
+		"/products/abc": http.StatusBadRequest,
+	} {
+		if code := serveJSON(t, handler, target, &body); code != want || body["erro"] == "" {
+			t.Errorf("GET %s: status %d, corpo %v, quer %d com erro", target, code, body, want)
+		}
+	}
+
+	tests := []struct {
+		target string
+		want   []uint32
+	}{
+		{"/products?min=50&max=300", []uint32{0}},
+		{"/products?min=40", []uint32{0, 2, 3}},
+		{"/products?max=40", []uint32{2}},
+		{"/products", []uint32{0, 2, 3}},
+		{"/products?min=1000", []uint32{}},
+	}
+	for _, tt := range tests {
+		var products []productJSON
+		if code := serveJSON(t, handler, tt.target, &products); code != http.StatusOK {
+			t.Errorf("GET %s: status %d", tt.target, code)
+			continue
+		}
+		ids := []uint32{}
+		for _, product := range products {
+			ids = append(ids, product.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+			t.Errorf("GET %s = %v, quer %v", tt.target, ids, tt.want)
+		}
+	}
+	if code := serveJSON(t, handler, "/products?min=barato", nil); code != http.StatusBadRequest {
+		t.Errorf("GET /products?min=barato: status %d, quer 400", code)
+	}
+}
+
+func TestHandlerRejectsOtherMethods(t *testing.T) {
+	inTempDir(t)
+	store, err := OpenStore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	handler := NewHandler(store)
+
+	tests := []struct {
+		method, target, allow string
+	}{
+		{http.MethodPost, "/products/1", http.MethodGet},
+		{http.MethodDelete, "/products", http.MethodGet},
+		{http.MethodPut, "/stats", http.MethodGet},
+		{http.MethodPost, "/metrics", http.MethodGet},
+		{http.MethodPost, "/debug/vars", http.MethodGet},
+		{http.MethodGet, "/import", http.MethodPost},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s: status %d, Allow %q, quer 405 com Allow %q", tt.method, tt.target, recorder.Code, recorder.Header().Get("Allow"), tt.allow)
+		}
+	}
+}
+
+func TestOperationCounters(t *testing.T) {
+	inTempDir(t)
+	before := Counters.Snapshot()
+	delta := func(name string) int64 { return Counters.Snapshot()[name] - before[name] }
+
+	for id := range uint32(5) {
+		if err := Products.Add(Product{ID: id, Price: 1, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const gets = 17
+	hits := 0
+	for i := range uint32(gets) {
+		_, found, err := Products.Get(i % 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			hits++
+		}
+	}
+	if err := Products.Remove(4); err != nil {
+		t.Fatal(err)
+	}
+
+	if delta("gets") != gets || delta("get_hits")+delta("get_misses") != gets {
+		t.Errorf("%d Get: gets = %d, hits + misses = %d", gets, delta("gets"), delta("get_hits")+delta("get_misses"))
+	}
+	if delta("get_hits") != int64(hits) {
+		t.Errorf("get_hits = %d, quer %d", delta("get_hits"), hits)
+	}
+	if delta("adds") != 5 || delta("removes") != 1 {
+		t.Errorf("adds = %d e removes = %d, quer 5 e 1", delta("adds"), delta("removes"))
+	}
+
+	writeCSV(t, "linhas.csv",
+		"2019-10-01 00:00:00 UTC,view,1,2,eletronicos,apple,10.00,3,s1",
+		"2019-10-01 00:00:01 UTC,cart,1,2,eletronicos,apple,10.00,3,s1",
+	)
+	if _, err := ImportarCSV(context.Background(), "linhas.csv"); err != nil {
+		t.Fatal(err)
+	}
+	if delta("import_rows") != 2 {
+		t.Errorf("import_rows = %d, quer 2", delta("import_rows"))
+	}
+
+	var out strings.Builder
+	if err := Counters.WritePrometheus(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("# TYPE store_gets_total counter\nstore_gets_total %d\n", Counters.Gets.Load())
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("WritePrometheus sem %q:\n%s", want, out.String())
+	}
+}
+
+type taggedProduct struct {
+	ID     uint32
+	Brand  string `fixed:"100"`
+	Price  float32
+	Active bool
+	Code   string `fixed:"8"`
+}
+
+func TestEncodeRecordFixedStrings(t *testing.T) {
+	size, err := RecordSize(taggedProduct{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// O mesmo layout de um Product com [100]byte, mais os 8 bytes de Code
+	if want := 4 + 100 + 4 + 1 + 8; size != want {
+		t.Fatalf("RecordSize = %d, quer %d", size, want)
+	}
+
+	tests := map[string]taggedProduct{
+		"vazio":         {},
+		"curto":         {ID: 1, Brand: "lg", Price: 9.99, Active: true, Code: "a"},
+		"largura exata": {ID: math.MaxUint32, Brand: strings.Repeat("m", 100), Price: -1, Code: "12345678"},
+		"acentos":       {ID: 7, Brand: "café ç", Code: "ã"},
+	}
+	for name, record := range tests {
+		data, err := EncodeRecord(record)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(data) != size {
+			t.Errorf("%s: %d bytes, quer %d", name, len(data), size)
+		}
+		var decoded taggedProduct
+		if err := DecodeRecord(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if decoded != record {
+			t.Errorf("%s: %+v virou %+v", name, record, decoded)
+		}
+	}
+
+	// Um texto maior que a largura é cortado, e o registro sai mesmo assim
+	long := taggedProduct{ID: 2, Brand: strings.Repeat("x", 150), Code: "codigo-longo"}
+	data, err := EncodeRecord(long)
+	if !errors.Is(err, ErrTruncated) || len(data) != size {
+		t.Fatalf("texto longo: %d bytes, erro %v, quer %d bytes e ErrTruncated", len(data), err, size)
+	}
+	var decoded taggedProduct
+	if err := DecodeRecord(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Brand != strings.Repeat("x", 100) || decoded.Code != "codigo-l" || decoded.ID != 2 {
+		t.Errorf("texto longo decodificado = %+v", decoded)
+	}
+
+	// A mesma ordem de bytes de binary.Write
+	setByteOrder(t, binary.BigEndian)
+	data, _ = EncodeRecord(taggedProduct{ID: 0x01020304})
+	if !bytes.HasPrefix(data, []byte{1, 2, 3, 4}) {
+		t.Errorf("ID em big-endian gravado como % x", data[:4])
+	}
+
+	type untagged struct{ Name string }
+	if _, err := EncodeRecord(untagged{"a"}); !errors.Is(err, ErrUnsupportedField) {
+		t.Errorf("string sem tag: erro %v, quer ErrUnsupportedField", err)
+	}
+	if err := DecodeRecord(data, taggedProduct{}); !errors.Is(err, ErrUnsupportedField) {
+		t.Errorf("DecodeRecord sem ponteiro: erro %v, quer ErrUnsupportedField", err)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	importSample(t)
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	for _, id := range []uint32{products[0].ID, products[2].ID} {
+		err := RemoveProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := OpenStore(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Products != int64(len(products)) || stats.ActiveProducts != int64(len(products))-2 || stats.DeletedProducts != 2 {
+		t.Errorf("produtos = %d, ativos = %d, removidos = %d, quer %d, %d e 2",
+			stats.Products, stats.ActiveProducts, stats.DeletedProducts, len(products), len(products)-2)
+	}
+	if stats.FragmentedBytes == 0 || stats.FragmentedBytes != 2*dataRecordSize[Product]() {
+		t.Errorf("FragmentedBytes = %d, quer dois registros de produto", stats.FragmentedBytes)
+	}
+	if stats.Events != int64(len(readAll[Event](t, EVENT_DATA_FILE))) || stats.Categories == 0 {
+		t.Errorf("categorias = %d, eventos = %d", stats.Categories, stats.Events)
+	}
+	if !stats.IndexesConsistent || len(stats.ProductIndexProblems) != 0 {
+		t.Errorf("índices inconsistentes logo depois da importação: %+v", stats.ProductIndexProblems)
+	}
+	total := int64(0)
+	for filename, size := range stats.FileSizes {
+		if size != sizeOf(t, filename) {
+			t.Errorf("FileSizes[%s] = %d, quer %d", filename, size, sizeOf(t, filename))
+		}
+		total += size
+	}
+	if stats.TotalBytes != total || stats.FileSizes[PRODUCT_DATA_FILE] == 0 {
+		t.Errorf("TotalBytes = %d, a soma de FileSizes é %d", stats.TotalBytes, total)
+	}
+
+	// Uma entrada a mais no índice de eventos o deixa inconsistente
+	if err := appendIndexEntries(EVENT_INDEX_FILE, []IndexEntry{{ID: 0, Offset: dataHeaderSize}}); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err := store.Stats(); err != nil || stats.IndexesConsistent {
+		t.Errorf("índice com ID repetido: IndexesConsistent = %v, %v", stats.IndexesConsistent, err)
+	}
+}
+
+// Produto em que todos os campos vêm de version: uma leitura que mistura
+// duas versões aparece como campos que não batem
+func versionedProduct(version uint32) Product {
+	return Product{
+		ID:         0,
+		CategoryID: version,
+		Brand:      StringToByteArray(strings.Repeat(string(rune('a'+version%26)), 100)),
+		Price:      float32(version),
+		Active:     true,
+	}
+}
+
+func checkVersionedProduct(product Product) error {
+	version := product.CategoryID
+	if product != versionedProduct(version) {
+		return fmt.Errorf("registro pela metade: versão %d com preço %v e marca %q...", version, product.Price, product.Brand[:4])
+	}
+	return nil
+}
+
+func TestConcurrentReadsDuringUpsert(t *testing.T) {
+	inTempDir(t)
+	if err := AddProduct(versionedProduct(0)); err != nil {
+		t.Fatal(err)
+	}
+	offset, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 0)
+	if !found {
+		t.Fatal("produto 0 não encontrado")
+	}
+
+	const versions = 200
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				product, found, err := Products.Get(0)
+				if err == nil && !found {
+					err = errors.New("produto 0 sumiu durante a atualização")
+				}
+				if err == nil {
+					err = checkVersionedProduct(product)
+				}
+				if err == nil {
+					product, err = ReadFromDataFile[Product](PRODUCT_DATA_FILE, offset)
+				}
+				if err == nil {
+					err = checkVersionedProduct(product)
+				}
+				if err != nil {
+					report(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for version := uint32(1); version <= versions; version++ {
+		err := UpsertProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, versionedProduct(version))
+		if err != nil {
+			report(err)
+			break
+		}
+	}
+	close(done)
+	readers.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// A atualização foi feita no lugar
+	product, err := ReadFromDataFile[Product](PRODUCT_DATA_FILE, offset)
+	if err != nil || product != versionedProduct(versions) {
+		t.Errorf("produto no offset %d = %+v, %v, quer a versão %d", offset, product.CategoryID, err, versions)
+	}
+}
+
+func TestRecordTypesAreFixedSize(t *testing.T) {
+	tests := []struct {
+		name string
+		size func() int64
+		want int64
+	}{
+		{"Product", mustFixedSize[Product], 4 + 4 + 100 + 4 + 1},
+		{"Category", mustFixedSize[Category], 4 + 100},
+		{"Event", mustFixedSize[Event], 4 + 50 + 4 + 4 + 1 + 8},
+		{"IndexEntry", mustFixedSize[IndexEntry], 4 + 8},
+		{"ActionMetrics", mustFixedSize[ActionMetrics], int64(binary.Size(ActionMetrics{}))},
+		{"ProductMetrics", mustFixedSize[ProductMetrics], 4 + 8 + 8},
+		{"ExternalIDEntry", mustFixedSize[ExternalIDEntry], int64(binary.Size(ExternalIDEntry{}))},
+		{"TimeIndexEntry", mustFixedSize[TimeIndexEntry], 8 + 8},
+		{"ShardInfo", mustFixedSize[ShardInfo], 4 + 4 + 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.size(); got != tt.want || got <= 0 {
+				t.Errorf("mustFixedSize = %d, quer %d", got, tt.want)
+			}
+		})
+	}
+	if err := ValidateSchema(); err != nil {
+		t.Errorf("ValidateSchema: %v", err)
+	}
+
+	// Um campo string, como alguém poderia acrescentar a Event
+	type eventWithString struct {
+		ID          uint32
+		UserSession string
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("mustFixedSize de um registro com string não entrou em pânico")
+		}
+	}()
+	mustFixedSize[eventWithString]()
+}
+
+func TestTombstoneKeepsNeighborOffsets(t *testing.T) {
+	inTempDir(t)
+	for id := range uint32(5) {
+		if err := AddEvent(Event{ID: id, UserID: 9, EventAction: VIEW}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offsets := map[uint32]int64{}
+	for id := range uint32(5) {
+		offsets[id], _ = BinarySearchOnDisk(EVENT_INDEX_FILE, id)
+	}
+	dataSize, indexSize := sizeOf(t, EVENT_DATA_FILE), sizeOf(t, EVENT_INDEX_FILE)
+
+	if err := Events.Tombstone(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := Events.Get(2); found || err != nil {
+		t.Errorf("Get(2) depois da lápide = %v, %v, quer não encontrado", found, err)
+	}
+	if found, err := Exists(EVENT_INDEX_FILE, 2); found || err != nil {
+		t.Errorf("Exists(2) depois da lápide = %v, %v", found, err)
+	}
+	for _, id := range []uint32{0, 1, 3, 4} {
+		offset, found := BinarySearchOnDisk(EVENT_INDEX_FILE, id)
+		if !found || offset != offsets[id] {
+			t.Errorf("ID %d no offset %d (%v), antes estava em %d", id, offset, found, offsets[id])
+		}
+	}
+	if sizeOf(t, EVENT_DATA_FILE) != dataSize || sizeOf(t, EVENT_INDEX_FILE) != indexSize {
+		t.Error("a lápide reescreveu um dos arquivos")
+	}
+	if events, err := EventsByUser(9); err != nil || len(events) != 4 {
+		t.Errorf("EventsByUser depois da lápide = %d eventos, %v, quer 4", len(events), err)
+	}
+	if err := Events.Tombstone(2); err == nil {
+		t.Error("lápide repetida no ID 2 não falhou")
+	}
+
+	// A compactação descarta o registro e as lápides
+	if err := Events.CompactTombstones(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := checkSortedIndex(t, EVENT_DATA_FILE, EVENT_INDEX_FILE, eventID); n != 4 {
+		t.Errorf("%d entradas depois da compactação, quer 4", n)
+	}
+	if got := sizeOf(t, EVENT_DATA_FILE); got != dataSize-dataRecordSize[Event]() {
+		t.Errorf("arquivo de eventos com %d bytes depois da compactação, quer %d", got, dataSize-dataRecordSize[Event]())
+	}
+	if _, found := BinarySearchOnDisk(EVENT_INDEX_FILE, 2); found {
+		t.Error("ID 2 voltou depois da compactação")
+	}
+}
+
+func TestGetOrCreateCategory(t *testing.T) {
+	inTempDir(t)
+
+	created, isNew, err := GetOrCreateCategory("Eletrônicos")
+	if err != nil || !isNew || created.ID != 0 {
+		t.Fatalf("primeira chamada = %+v, %v, %v, quer a categoria 0 criada", created, isNew, err)
+	}
+	existing, isNew, err := GetOrCreateCategory("  eletrônicos ")
+	if err != nil || isNew || existing != created {
+		t.Errorf("segunda chamada = %+v, %v, %v, quer a categoria 0 já existente", existing, isNew, err)
+	}
+	if n := len(readAll[Category](t, CATEGORY_DATA_FILE)); n != 1 {
+		t.Errorf("%d categorias gravadas, quer 1", n)
+	}
+
+	// Várias chamadas ao mesmo tempo com um nome novo criam uma só
+	var wg sync.WaitGroup
+	createdCount := make(chan bool, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, isNew, err := GetOrCreateCategory("moveis")
+			if err != nil {
+				t.Error(err)
+			}
+			createdCount <- isNew
+		}()
+	}
+	wg.Wait()
+	close(createdCount)
+	news := 0
+	for isNew := range createdCount {
+		if isNew {
+			news++
+		}
+	}
+	if categories := readAll[Category](t, CATEGORY_DATA_FILE); news != 1 || len(categories) != 2 {
+		t.Errorf("%d chamadas criaram a categoria, %d categorias gravadas, quer 1 e 2", news, len(categories))
+	}
+
+	// Uma categoria removida não é devolvida
+	if err := Categories.Tombstone(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	recreated, isNew, err := GetOrCreateCategory("Eletrônicos")
+	if err != nil || !isNew || recreated.ID == created.ID {
+		t.Errorf("depois da remoção = %+v, %v, %v, quer uma categoria nova", recreated, isNew, err)
+	}
+
+	if _, _, err := GetOrCreateCategory("   "); err == nil {
+		t.Error("nome vazio não falhou")
+	}
+
+	// Na importação, dois IDs do CSV com o mesmo nome viram uma categoria
+	writeCSV(t, "categorias.csv",
+		"2019-10-01 00:00:00 UTC,view,1,10,audio,sony,10.00,3,s1",
+		"2019-10-01 00:00:01 UTC,view,2,11,Audio,sony,20.00,3,s1",
+		"2019-10-01 00:00:02 UTC,view,3,12,moveis,tok,30.00,3,s1",
+	)
+	stats, err := ImportarCSV(context.Background(), "categorias.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Categories != 1 {
+		t.Errorf("importação criou %d categorias, quer 1 (audio)", stats.Categories)
+	}
+	products := readAll[Product](t, PRODUCT_DATA_FILE)
+	if len(products) != 3 || products[0].CategoryID != products[1].CategoryID {
+		t.Errorf("produtos importados = %+v, quer 1 e 2 na mesma categoria", products)
+	}
+}
+
+func TestRenumberProduct(t *testing.T) {
+	inTempDir(t)
+	addPricedProducts(t, 10, 20, 30, 40)
+	for id, productID := range []uint32{1, 1, 2} {
+		if err := AddEvent(Event{ID: uint32(id), UserID: 5, ProductID: productID, EventAction: PURCHASE}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offset, _ := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 1)
+
+	if err := RenumberProduct(1, 100, CascadeToEvents); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 1); found {
+		t.Error("ID antigo 1 continua no índice")
+	}
+	product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 100)
+	if err != nil || !found || product.ID != 100 || product.Price != 20 {
+		t.Errorf("GetProductByID(100) = %+v, %v, %v, quer o antigo produto 1", product, found, err)
+	}
+	if newOffset, _ := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 100); newOffset != offset {
+		t.Errorf("produto renumerado no offset %d, estava em %d", newOffset, offset)
+	}
+	if n := checkSortedIndex(t, PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, productID); n != 4 {
+		t.Errorf("%d entradas no índice, quer 4", n)
+	}
+	top, err := TopProductsByPurchase(1)
+	if err != nil || len(top) != 1 || top[0].ProductID != 100 || top[0].TotalPurchase != 2 {
+		t.Errorf("métricas depois da troca = %+v, %v, quer 2 compras do produto 100", top, err)
+	}
+	events := readAll[Event](t, EVENT_DATA_FILE)
+	if events[0].ProductID != 100 || events[1].ProductID != 100 || events[2].ProductID != 2 {
+		t.Errorf("eventos depois da troca com CascadeToEvents = %+v", events)
+	}
+
+	// Sem cascata, os eventos ficam com o ID antigo
+	if err := RenumberProduct(2, 200, KeepEvents); err != nil {
+		t.Fatal(err)
+	}
+	if events := readAll[Event](t, EVENT_DATA_FILE); events[2].ProductID != 2 {
+		t.Errorf("evento 2 com o produto %d depois da troca sem cascata, quer 2", events[2].ProductID)
+	}
+
+	if err := RenumberProduct(0, 3, KeepEvents); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("troca para um ID existente: erro %v, quer ErrDuplicateID", err)
+	}
+	if _, found := BinarySearchOnDisk(PRODUCT_INDEX_FILE, 0); !found {
+		t.Error("produto 0 sumiu depois da troca recusada")
+	}
+	if err := RenumberProduct(7, 8, KeepEvents); err == nil {
+		t.Error("troca de um ID inexistente não falhou")
+	}
+}
+
+// Chamadas read e write do processo até agora, de /proc/self/io. Zero e
+// false fora do Linux
+func readWriteSyscalls() (int64, bool) {
+	content, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	total := int64(0)
+	for _, line := range strings.Split(string(content), "\n") {
+		name, value, _ := strings.Cut(line, ": ")
+		if name == "syscr" || name == "syscw" {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			total += n
+		}
+	}
+	return total, true
+}
+
+// Inclusão de 10 mil produtos com dados e índice: abrindo os arquivos a cada
+// registro, como AppendDataToFile e AppendIndexToFile, uma vez por registro
+// com Append, ou uma vez só para o laço inteiro
+func BenchmarkAppendLoop(b *testing.B) {
+	const records = 10000
+	loops := []struct {
+		name   string
+		insert func(b *testing.B, first uint32)
+	}{
+		{"AppendDataToFile", func(b *testing.B, first uint32) {
+			for id := first; id < first+records; id++ {
+				offset, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: id, Active: true})
+				if err == nil {
+					err = AppendIndexToFile(PRODUCT_INDEX_FILE, id, offset)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"Append", func(b *testing.B, first uint32) {
+			for id := first; id < first+records; id++ {
+				if err := Append(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, Product{ID: id, Active: true}, id); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+		{"OpenOnce", func(b *testing.B, first uint32) {
+			dataFile, err := OpenDataFile[Product](PRODUCT_DATA_FILE)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer dataFile.Close()
+			indexFile, err := CreateOrOpenFile(PRODUCT_INDEX_FILE)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer indexFile.Close()
+			for id := first; id < first+records; id++ {
+				offset, err := appendDataRecord(dataFile, Product{ID: id, Active: true})
+				if err == nil {
+					err = appendIndexEntry(indexFile, id, offset)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}},
+	}
+
+	for _, loop := range loops {
+		b.Run(loop.name, func(b *testing.B) {
+			inTempDir(b)
+			setSyncPolicy(b, SyncNever)
+			before, counted := readWriteSyscalls()
+			first := uint32(0)
+			for b.Loop() {
+				loop.insert(b, first)
+				first += records
+			}
+			if after, _ := readWriteSyscalls(); counted {
+				b.ReportMetric(float64(after-before)/float64(first), "rw-syscalls/record")
+			}
+		})
+	}
+}
+
+// Writer que guarda o tamanho da maior escrita e falha depois de limit bytes
+type chunkWriter struct {
+	total, largest, limit int
+}
+
+var errWriterFull = errors.New("destino cheio")
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.total+len(p) > w.limit {
+		return 0, errWriterFull
+	}
+	w.total += len(p)
+	w.largest = max(w.largest, len(p))
+	return len(p), nil
+}
+
+func TestExportCSV(t *testing.T) {
+	inTempDir(t)
+	setSyncPolicy(t, SyncNever)
+	products := []Product{
+		{ID: 0, CategoryID: 2, Brand: StringToByteArray("apple"), Price: 10.5, Active: true},
+		{ID: 1, CategoryID: 3, Brand: StringToByteArray(`marca "com" aspas, e vírgula`), Price: 0, Active: false},
+	}
+	for _, product := range products {
+		if _, err := AppendDataToFile(PRODUCT_DATA_FILE, product); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ExportCSV[Product](PRODUCT_DATA_FILE, &buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"ID", "CategoryID", "Brand", "Price", "Active"},
+		{"0", "2", "apple", "10.50", "true"},
+		{"1", "3", `marca "com" aspas, e vírgula`, "0.00", "false"},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Errorf("CSV lido de volta = %q, quer %q", rows, want)
+	}
+
+	// Muitos registros: o destino recebe pedaços pequenos enquanto o arquivo
+	// é lido, em vez de um texto montado com todos os registros
+	const events = 20000
+	for id := range uint32(events) {
+		if _, err := AppendDataToFile(EVENT_DATA_FILE, Event{ID: id, UserSession: StringTo50ByteArray(strings.Repeat("s", 40))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream := &chunkWriter{}
+	if err := ExportCSV[Event](EVENT_DATA_FILE, stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.total < events*40 || stream.largest > 64<<10 {
+		t.Errorf("exportação de %d bytes com escrita máxima de %d bytes", stream.total, stream.largest)
+	}
+
+	// Um destino que falha interrompe a varredura
+	full := &chunkWriter{limit: 100 << 10}
+	if err := ExportCSV[Event](EVENT_DATA_FILE, full); !errors.Is(err, errWriterFull) {
+		t.Errorf("destino cheio: erro %v, quer errWriterFull", err)
+	}
+}
+
+func recalculateMostExpensive(t *testing.T) Product {
+	t.Helper()
+	file, err := CreateOrOpenFile(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := RecalculateMostExpensiveProduct(PRODUCT_DATA_FILE, file); err != nil {
+		t.Fatal(err)
+	}
+	product, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return product
+}
+
+func TestMostExpensiveTieBreak(t *testing.T) {
+	t.Run("empate no maior preço", func(t *testing.T) {
+		inTempDir(t)
+		// O ID maior vem antes no arquivo
+		for _, product := range []Product{{ID: 5, Price: 100, Active: true}, {ID: 1, Price: 50, Active: true}, {ID: 2, Price: 100, Active: true}} {
+			if _, err := AppendDataToFile(PRODUCT_DATA_FILE, product); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if product := recalculateMostExpensive(t); product.ID != 2 {
+			t.Errorf("mais caro = %+v, quer o produto 2, o menor ID entre os de preço 100", product)
+		}
+	})
+
+	t.Run("atualização incremental", func(t *testing.T) {
+		inTempDir(t)
+		addPricedProducts(t, 100, 100, 30)
+		incremental, err := SearchMostExpensiveProduct(MOST_EXPENSIVE_PRODUCT_FILE)
+		if err != nil || incremental.ID != 0 {
+			t.Errorf("mais caro mantido por AddProduct = %+v, %v, quer o produto 0", incremental, err)
+		}
+		if product := recalculateMostExpensive(t); product != incremental {
+			t.Errorf("recálculo = %+v, a atualização incremental deu %+v", product, incremental)
+		}
+	})
+
+	t.Run("todos com preço zero", func(t *testing.T) {
+		inTempDir(t)
+		for _, product := range []Product{{ID: 0, Price: 0, Active: false}, {ID: 3, Price: 0, Active: true}, {ID: 1, Price: 0, Active: true}} {
+			if _, err := AppendDataToFile(PRODUCT_DATA_FILE, product); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if product := recalculateMostExpensive(t); product.ID != 1 || !product.Active {
+			t.Errorf("mais caro = %+v, quer o produto ativo 1", product)
+		}
+	})
+
+	t.Run("nenhum ativo", func(t *testing.T) {
+		inTempDir(t)
+		if _, err := AppendDataToFile(PRODUCT_DATA_FILE, Product{ID: 4, Price: 10}); err != nil {
+			t.Fatal(err)
+		}
+		if product := recalculateMostExpensive(t); product != (Product{}) {
+			t.Errorf("mais caro sem produtos ativos = %+v, quer o valor zero", product)
+		}
+	})
+}
+
+func setPricePolicy(t *testing.T, policy PricePolicy) {
+	t.Helper()
+	previous := Config.Prices
+	Config.Prices = policy
+	t.Cleanup(func() { Config.Prices = previous })
+}
+
+func TestPriceValidation(t *testing.T) {
+	t.Run("negativo recusado", func(t *testing.T) {
+		inTempDir(t)
+		setPricePolicy(t, RejectNegativePrices)
+		if err := AddProduct(Product{ID: 0, Price: -5, Active: true}); !errors.Is(err, ErrNegativePrice) {
+			t.Errorf("AddProduct com preço -5: erro %v, quer ErrNegativePrice", err)
+		}
+		if err := AddProducts([]Product{{ID: 0, Price: 1, Active: true}, {ID: 1, Price: -1, Active: true}}); !errors.Is(err, ErrNegativePrice) {
+			t.Errorf("AddProducts com um preço negativo: erro %v, quer ErrNegativePrice", err)
+		}
+		if err := AddProduct(Product{ID: 0, Price: float32(math.NaN()), Active: true}); !errors.Is(err, ErrNegativePrice) {
+			t.Errorf("AddProduct com preço NaN: erro %v, quer ErrNegativePrice", err)
+		}
+		if _, err := os.Stat(PRODUCT_DATA_FILE); err == nil && len(readAll[Product](t, PRODUCT_DATA_FILE)) != 0 {
+			t.Error("produto com preço inválido foi gravado")
+		}
+
+		addPricedProducts(t, 10)
+		err := UpsertProduct(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, MOST_EXPENSIVE_PRODUCT_FILE, MOST_EXPENSIVE_PER_CATEGORY_FILE, Product{ID: 0, Price: -10, Active: true})
+		if !errors.Is(err, ErrNegativePrice) {
+			t.Errorf("UpsertProduct com preço negativo: erro %v, quer ErrNegativePrice", err)
+		}
+		if product, _, _ := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 0); product.Price != 10 {
+			t.Errorf("preço depois da atualização recusada = %v, quer 10", product.Price)
+		}
+	})
+
+	t.Run("zero aceito", func(t *testing.T) {
+		inTempDir(t)
+		setPricePolicy(t, RejectNegativePrices)
+		if err := AddProduct(Product{ID: 0, Price: 0, Active: true}); err != nil {
+			t.Errorf("AddProduct com preço 0: %v", err)
+		}
+		if product, found, err := GetProductByID(PRODUCT_DATA_FILE, PRODUCT_INDEX_FILE, 0); err != nil || !found || product.Price != 0 {
+			t.Errorf("produto de preço 0 = %+v, %v, %v", product, found, err)
+		}
+	})
+
+	t.Run("importação", func(t *testing.T) {
+		inTempDir(t)
+		setPricePolicy(t, RejectNegativePrices)
+		writeCSV(t, "precos.csv",
+			"2019-10-01 00:00:00 UTC,view,1,1,electronics,apple,-3.50,7,s1",
+			"2019-10-01 00:00:01 UTC,view,2,1,electronics,apple,0,7,s1",
+			"2019-10-01 00:00:02 UTC,view,3,1,electronics,apple,12.00,7,s1",
+		)
+		lines := []int{}
+		opts := CSVOptions{OnRowError: func(line int, err error) {
+			if !errors.Is(err, ErrNegativePrice) {
+				t.Errorf("linha %d recusada com %v, quer ErrNegativePrice", line, err)
+			}
+			lines = append(lines, line)
+		}}
+		stats, err := ImportarCSVWithOptions(context.Background(), "precos.csv", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Rejected != 1 || fmt.Sprint(lines) != "[2]" || stats.Products != 2 {
+			t.Errorf("ImportStats = %+v, linhas recusadas %v, quer só a linha 2", stats, lines)
+		}
+	})
+
+	t.Run("políticas", func(t *testing.T) {
+		inTempDir(t)
+		setPricePolicy(t, ClampNegativePrices)
+		if err := AddProduct(Product{ID: 0, Price: -7, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+		setPricePolicy(t, AllowNegativePrices)
+		if err := AddProduct(Product{ID: 1, Price: -7, Active: true}); err != nil {
+			t.Fatal(err)
+		}
+		products := readAll[Product](t, PRODUCT_DATA_FILE)
+		if products[0].Price != 0 || products[1].Price != -7 {
+			t.Errorf("preços gravados = %v e %v, quer 0 (ClampNegativePrices) e -7 (AllowNegativePrices)", products[0].Price, products[1].Price)
+		}
+	})
+}
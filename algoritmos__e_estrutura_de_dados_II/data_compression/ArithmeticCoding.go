@@ -1,17 +1,65 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// EncodedData stores integer counts instead of the odds themselves: they
+// are smaller once serialized and the odds are recomputed exactly as the
+// encoder computed them, Counts[char] / Total.
 type EncodedData struct {
+	Code   float64
+	Counts map[rune]uint32
+	Total  uint32
+}
+
+func (d EncodedData) Odds() map[rune]float64 {
+	odds := make(map[rune]float64)
+	for char, count := range d.Counts {
+		odds[char] = float64(count) / float64(d.Total)
+	}
+	return odds
+}
+
+// legacyEncodedData is the format written before Counts existed.
+type legacyEncodedData struct {
 	Code float64
 	Odds map[rune]float64
 }
 
+var ErrLegacyEncodedData = errors.New("encoded file uses the old odds format, run MigrateEncodedDataFile")
+
+// AdaptiveEncodedData does not need the Counts map: the decoder rebuilds the
+// same frequencies from the alphabet while it decodes.
+type AdaptiveEncodedData struct {
+	Code     []byte
+	Alphabet []rune
+}
+
+// CalcCharsCounts returns how many times each rune occurs and the number of
+// runes in the text.
+func CalcCharsCounts(text string) (map[rune]uint32, uint32) {
+	counts := make(map[rune]uint32)
+	total := uint32(0)
+	for _, char := range text {
+		counts[char]++
+		total++
+	}
+	return counts, total
+}
+
 func CalcCharsOdds(text string) map[rune]float64 {
 	frequencies := make(map[rune]int)
 	total := len(text)
@@ -28,13 +76,62 @@ func CalcCharsOdds(text string) map[rune]float64 {
 	return odds
 }
 
+// Entropy returns the Shannon entropy of the distribution in bits per symbol.
+func Entropy(odds map[rune]float64) float64 {
+	entropy := 0.0
+	for _, odd := range odds {
+		if odd > 0 {
+			entropy -= odd * math.Log2(odd)
+		}
+	}
+	return entropy
+}
+
+type CompressionStats struct {
+	OriginalSize   int
+	EntropyMinSize float64
+	EncodedSize    int64
+}
+
+// Ratio is EncodedSize / OriginalSize. Values above 1 mean the encoded file
+// is bigger than the input, which is expected for short texts since the
+// whole Counts map is serialized along with the code.
+func (s CompressionStats) Ratio() float64 {
+	if s.OriginalSize == 0 {
+		return 0
+	}
+	return float64(s.EncodedSize) / float64(s.OriginalSize)
+}
+
+func EncodeStats(text string, odds map[rune]float64, encodedPath string) (CompressionStats, error) {
+	info, err := os.Stat(encodedPath)
+	if err != nil {
+		return CompressionStats{}, err
+	}
+
+	return CompressionStats{
+		OriginalSize:   len(text),
+		EntropyMinSize: Entropy(odds) * float64(utf8.RuneCountInString(text)) / 8,
+		EncodedSize:    info.Size(),
+	}, nil
+}
+
+// CalcInterval walks the symbols in rune order: ranging over the map
+// directly gives a different order on every call, and the encoder and the
+// decoder would disagree on the intervals.
 func CalcInterval(odds map[rune]float64, targetChar rune) (float64, float64) {
+	chars := make([]rune, 0, len(odds))
+	for char := range odds {
+		chars = append(chars, char)
+	}
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+
 	low := 0.0
-	for char, odd := range odds {
+	for _, char := range chars {
 		if char == targetChar {
-			return low, low + odd
+			return low, low + odds[char]
 		}
-		low += odd
+		low += odds[char]
 	}
 	return 0, 0
 }
@@ -55,7 +152,7 @@ func Encode(text string, odds map[rune]float64) (float64, float64) {
 func Decode(data EncodedData, size int) string {
 	result := ""
 	code := data.Code
-	odds := data.Odds
+	odds := data.Odds()
 
 	for i := 0; i < size; i++ {
 		for char := range odds {
@@ -71,7 +168,530 @@ func Decode(data EncodedData, size int) string {
 	return result
 }
 
-func SaveEncodedData(path string, data EncodedData) error {
+func textAlphabet(text string) []rune {
+	seen := make(map[rune]bool)
+	alphabet := []rune{}
+	for _, char := range text {
+		if !seen[char] {
+			seen[char] = true
+			alphabet = append(alphabet, char)
+		}
+	}
+	sort.Slice(alphabet, func(i, j int) bool { return alphabet[i] < alphabet[j] })
+	return alphabet
+}
+
+// adaptiveMaxTotal bounds the counts of the adaptive model: once the total
+// goes over it every count is halved, which keeps the integer intervals wide
+// enough and lets the model follow changes along the text.
+const adaptiveMaxTotal = freqScale
+
+type adaptiveModel struct {
+	counts []uint64
+	total  uint64
+}
+
+func newAdaptiveModel(size int) *adaptiveModel {
+	counts := make([]uint64, size)
+	for i := range counts {
+		counts[i] = 1
+	}
+	return &adaptiveModel{counts: counts, total: uint64(size)}
+}
+
+func (m *adaptiveModel) interval(index int) (uint64, uint64) {
+	cumulative := uint64(0)
+	for i := 0; i < index; i++ {
+		cumulative += m.counts[i]
+	}
+	return cumulative, cumulative + m.counts[index]
+}
+
+// find returns the symbol whose interval contains target.
+func (m *adaptiveModel) find(target uint64) int {
+	cumulative := uint64(0)
+	for index, count := range m.counts {
+		cumulative += count
+		if target < cumulative {
+			return index
+		}
+	}
+	return len(m.counts) - 1
+}
+
+func (m *adaptiveModel) update(index int) {
+	m.counts[index]++
+	m.total++
+	if m.total <= adaptiveMaxTotal {
+		return
+	}
+	m.total = 0
+	for i, count := range m.counts {
+		m.counts[i] = (count + 1) / 2
+		m.total += m.counts[i]
+	}
+}
+
+// EncodeAdaptive starts every symbol of the alphabet with count 1 and
+// increments the count of each symbol after coding it, so the odds adapt
+// to the text without being stored. It uses the same integer ranges as
+// EncodeBytes, so the length of the text is not limited.
+func EncodeAdaptive(text string) AdaptiveEncodedData {
+	alphabet := textAlphabet(text)
+	position := make(map[rune]int)
+	for i, char := range alphabet {
+		position[char] = i
+	}
+
+	model := newAdaptiveModel(len(alphabet))
+	encoder := newRangeEncoder()
+	for _, char := range text {
+		index := position[char]
+		low, high := model.interval(index)
+		encoder.encode(low, high, model.total)
+		model.update(index)
+	}
+
+	var code []byte
+	if len(text) > 0 {
+		code = encoder.finish()
+	}
+	return AdaptiveEncodedData{
+		Code:     code,
+		Alphabet: alphabet,
+	}
+}
+
+func DecodeAdaptive(code []byte, alphabet []rune, length int) string {
+	var result strings.Builder
+	if length == 0 || len(alphabet) == 0 {
+		return ""
+	}
+
+	model := newAdaptiveModel(len(alphabet))
+	decoder := newRangeDecoder(code)
+	for i := 0; i < length; i++ {
+		index := model.find(decoder.target(model.total))
+		result.WriteRune(alphabet[index])
+		low, high := model.interval(index)
+		decoder.decode(low, high, model.total)
+		model.update(index)
+	}
+
+	return result.String()
+}
+
+const (
+	codeBits    = 32
+	codeWhole   = uint64(1) << codeBits
+	codeHalf    = codeWhole / 2
+	codeQuarter = codeWhole / 4
+	freqScale   = 1 << 16
+)
+
+type bitWriter struct {
+	buf []byte
+	cur byte
+	n   uint
+}
+
+func (w *bitWriter) write(bit uint64) {
+	w.cur = w.cur<<1 | byte(bit)
+	w.n++
+	if w.n == 8 {
+		w.buf = append(w.buf, w.cur)
+		w.cur, w.n = 0, 0
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.n > 0 {
+		return append(w.buf, w.cur<<(8-w.n))
+	}
+	return w.buf
+}
+
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+// Bits past the end of the stream are read as zeros.
+func (r *bitReader) read() uint64 {
+	if r.pos >= len(r.buf)*8 {
+		r.pos++
+		return 0
+	}
+	bit := (r.buf[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint64(bit)
+}
+
+// rangeEncoder keeps the current interval as 32-bit integers and shifts
+// out the leading bits as soon as they are settled (renormalization).
+type rangeEncoder struct {
+	out     bitWriter
+	low     uint64
+	high    uint64
+	pending int
+}
+
+func newRangeEncoder() *rangeEncoder {
+	return &rangeEncoder{high: codeWhole - 1}
+}
+
+func (e *rangeEncoder) emit(bit uint64) {
+	e.out.write(bit)
+	for ; e.pending > 0; e.pending-- {
+		e.out.write(bit ^ 1)
+	}
+}
+
+// encode narrows the interval to [cumLow, cumHigh) out of total. total must
+// not exceed codeQuarter, otherwise a symbol may get an empty interval.
+func (e *rangeEncoder) encode(cumLow, cumHigh, total uint64) {
+	rangeWidth := e.high - e.low + 1
+	e.high = e.low + rangeWidth*cumHigh/total - 1
+	e.low = e.low + rangeWidth*cumLow/total
+
+	for e.high < codeHalf || e.low >= codeHalf || (e.low >= codeQuarter && e.high < 3*codeQuarter) {
+		switch {
+		case e.high < codeHalf:
+			e.emit(0)
+		case e.low >= codeHalf:
+			e.emit(1)
+			e.low -= codeHalf
+			e.high -= codeHalf
+		default:
+			e.pending++
+			e.low -= codeQuarter
+			e.high -= codeQuarter
+		}
+		e.low = e.low << 1
+		e.high = e.high<<1 | 1
+	}
+}
+
+func (e *rangeEncoder) finish() []byte {
+	e.pending++
+	if e.low < codeQuarter {
+		e.emit(0)
+	} else {
+		e.emit(1)
+	}
+	return e.out.bytes()
+}
+
+type rangeDecoder struct {
+	in    bitReader
+	low   uint64
+	high  uint64
+	value uint64
+}
+
+func newRangeDecoder(code []byte) *rangeDecoder {
+	d := &rangeDecoder{in: bitReader{buf: code}, high: codeWhole - 1}
+	for i := 0; i < codeBits; i++ {
+		d.value = d.value<<1 | d.in.read()
+	}
+	return d
+}
+
+// target returns the cumulative frequency, out of total, that falls inside
+// the interval of the next symbol.
+func (d *rangeDecoder) target(total uint64) uint64 {
+	rangeWidth := d.high - d.low + 1
+	return ((d.value-d.low+1)*total - 1) / rangeWidth
+}
+
+// decode consumes the symbol found with target, mirroring encode.
+func (d *rangeDecoder) decode(cumLow, cumHigh, total uint64) {
+	rangeWidth := d.high - d.low + 1
+	d.high = d.low + rangeWidth*cumHigh/total - 1
+	d.low = d.low + rangeWidth*cumLow/total
+
+	for d.high < codeHalf || d.low >= codeHalf || (d.low >= codeQuarter && d.high < 3*codeQuarter) {
+		switch {
+		case d.high < codeHalf:
+		case d.low >= codeHalf:
+			d.value -= codeHalf
+			d.low -= codeHalf
+			d.high -= codeHalf
+		default:
+			d.value -= codeQuarter
+			d.low -= codeQuarter
+			d.high -= codeQuarter
+		}
+		d.low = d.low << 1
+		d.high = d.high<<1 | 1
+		d.value = d.value<<1 | d.in.read()
+	}
+}
+
+func CalcByteOdds(data []byte) map[byte]float64 {
+	frequencies := make(map[byte]int)
+	for _, b := range data {
+		frequencies[b]++
+	}
+
+	odds := make(map[byte]float64)
+	for b, freq := range frequencies {
+		odds[b] = float64(freq) / float64(len(data))
+	}
+
+	return odds
+}
+
+// byteCumFreqs turns the odds into integer cumulative frequencies so the
+// encoder and decoder share exactly the same intervals. Every byte with a
+// non-zero odd gets at least frequency 1.
+func byteCumFreqs(odds map[byte]float64) [257]uint64 {
+	var cum [257]uint64
+	for b := 0; b < 256; b++ {
+		freq := uint64(0)
+		if odd := odds[byte(b)]; odd > 0 {
+			freq = uint64(odd*(freqScale-256)) + 1
+		}
+		cum[b+1] = cum[b] + freq
+	}
+	return cum
+}
+
+// EncodeBytes works on raw bytes instead of runes and uses integer ranges
+// with renormalization, so it is not limited by float64 precision and can
+// encode inputs of any length. Every byte of data must have a non-zero odd.
+func EncodeBytes(data []byte, odds map[byte]float64) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	cum := byteCumFreqs(odds)
+	total := cum[256]
+
+	encoder := newRangeEncoder()
+	for _, b := range data {
+		encoder.encode(cum[b], cum[int(b)+1], total)
+	}
+	return encoder.finish()
+}
+
+func DecodeBytes(code []byte, odds map[byte]float64, size int) []byte {
+	if size == 0 {
+		return []byte{}
+	}
+	cum := byteCumFreqs(odds)
+	total := cum[256]
+
+	decoder := newRangeDecoder(code)
+	result := make([]byte, 0, size)
+	for i := 0; i < size; i++ {
+		scaled := decoder.target(total)
+		b := 0
+		for cum[b+1] <= scaled {
+			b++
+		}
+		result = append(result, byte(b))
+		decoder.decode(cum[b], cum[b+1], total)
+	}
+
+	return result
+}
+
+// Codec compresses a whole buffer. The output starts with a format tag, so
+// decoding data written by another codec fails instead of returning garbage.
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+var ErrWrongCodec = errors.New("data was not encoded by this codec")
+
+type arithmeticCodec struct{}
+
+var CodecArithmetic Codec = arithmeticCodec{}
+
+var arithmeticTag = [4]byte{'A', 'C', 'B', '1'}
+
+// The header has the original size and the count of every byte that
+// occurs, so the decoder can rebuild exactly the same odds.
+func (arithmeticCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	counts := byteCounts(data)
+	writeCountsHeader(&buf, arithmeticTag, len(data), counts)
+	buf.Write(EncodeBytes(data, countOdds(counts, len(data))))
+	return buf.Bytes(), nil
+}
+
+func (arithmeticCodec) Decode(data []byte) ([]byte, error) {
+	reader := bytes.NewReader(data)
+	size, counts, err := readCountsHeader(reader, arithmeticTag)
+	if err != nil {
+		return nil, err
+	}
+	code := data[len(data)-reader.Len():]
+	return DecodeBytes(code, countOdds(counts, size), size), nil
+}
+
+func byteCounts(data []byte) map[byte]uint32 {
+	counts := make(map[byte]uint32)
+	for _, b := range data {
+		counts[b]++
+	}
+	return counts
+}
+
+// writeCountsHeader writes the tag, the size and the (byte, count) pairs in
+// byte order.
+func writeCountsHeader(buf *bytes.Buffer, tag [4]byte, size int, counts map[byte]uint32) {
+	symbols := make([]byte, 0, len(counts))
+	for b := range counts {
+		symbols = append(symbols, b)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i] < symbols[j] })
+
+	buf.Write(tag[:])
+	binary.Write(buf, binary.LittleEndian, uint64(size))
+	binary.Write(buf, binary.LittleEndian, uint16(len(symbols)))
+	for _, b := range symbols {
+		buf.WriteByte(b)
+		binary.Write(buf, binary.LittleEndian, counts[b])
+	}
+}
+
+func readCountsHeader(reader *bytes.Reader, tag [4]byte) (int, map[byte]uint32, error) {
+	var stored [4]byte
+	_, err := io.ReadFull(reader, stored[:])
+	if err != nil || stored != tag {
+		return 0, nil, fmt.Errorf("%w: expected tag %q", ErrWrongCodec, tag[:])
+	}
+	var size uint64
+	var symbols uint16
+	err = binary.Read(reader, binary.LittleEndian, &size)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = binary.Read(reader, binary.LittleEndian, &symbols)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	counts := make(map[byte]uint32)
+	for i := 0; i < int(symbols); i++ {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		var count uint32
+		err = binary.Read(reader, binary.LittleEndian, &count)
+		if err != nil {
+			return 0, nil, err
+		}
+		counts[b] = count
+	}
+	return int(size), counts, nil
+}
+
+// CompressFile writes the CodecArithmetic output of in to out.
+func CompressFile(in, out string) error {
+	return CompressFileWith(CodecArithmetic, in, out)
+}
+
+func DecompressFile(in, out string) error {
+	return DecompressFileWith(CodecArithmetic, in, out)
+}
+
+func CompressFileWith(codec Codec, in, out string) error {
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	encoded, err := codec.Encode(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, encoded, 0644)
+}
+
+func DecompressFileWith(codec Codec, in, out string) error {
+	encoded, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	data, err := codec.Decode(encoded)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+	return os.WriteFile(out, data, 0644)
+}
+
+// countOdds turns byte counts into the odds EncodeBytes expects. It runs the
+// same float division on both sides, so encoder and decoder agree.
+func countOdds(counts map[byte]uint32, total int) map[byte]float64 {
+	odds := make(map[byte]float64)
+	for b, count := range counts {
+		odds[b] = float64(count) / float64(total)
+	}
+	return odds
+}
+
+type CodecComparison struct {
+	OriginalSize   int
+	ArithmeticSize int
+	HuffmanSize    int
+	GzipSize       int
+	ArithmeticTime time.Duration
+	HuffmanTime    time.Duration
+	GzipTime       time.Duration
+}
+
+// CompareWithGzip compresses the same file with CompressFile, CodecHuffman
+// and compress/gzip at the default level, measuring size and time of each.
+func CompareWithGzip(path string) (CodecComparison, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return CodecComparison{}, err
+	}
+	result := CodecComparison{OriginalSize: len(data)}
+
+	tmp, err := os.CreateTemp("", "arith-*")
+	if err != nil {
+		return result, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	start := time.Now()
+	err = CompressFile(path, tmp.Name())
+	result.ArithmeticTime = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return result, err
+	}
+	result.ArithmeticSize = int(info.Size())
+
+	start = time.Now()
+	huffman, err := CodecHuffman.Encode(data)
+	result.HuffmanTime = time.Since(start)
+	if err != nil {
+		return result, err
+	}
+	result.HuffmanSize = len(huffman)
+
+	var gz bytes.Buffer
+	start = time.Now()
+	writer := gzip.NewWriter(&gz)
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	result.GzipTime = time.Since(start)
+	result.GzipSize = gz.Len()
+	return result, err
+}
+
+func SaveEncodedData[T any](path string, data T) error {
 	file, err := os.Create(path)
 	if err != nil {
 		return err
@@ -94,8 +714,18 @@ func readTextFile(path string) (string, error) {
 	}
 	return string(data), nil
 }
-func readEncodedDataFile(path string) (EncodedData, error) {
-	var data EncodedData
+
+// storedEncodedData has the fields of both formats, so gob fills whichever
+// the file has.
+type storedEncodedData struct {
+	Code   float64
+	Counts map[rune]uint32
+	Total  uint32
+	Odds   map[rune]float64
+}
+
+func readStoredEncodedData(path string) (storedEncodedData, error) {
+	var data storedEncodedData
 	file, err := os.Open(path)
 	if err != nil {
 		return data, err
@@ -104,11 +734,43 @@ func readEncodedDataFile(path string) (EncodedData, error) {
 
 	decoder := gob.NewDecoder(file)
 	err = decoder.Decode(&data)
+	return data, err
+}
+
+func readEncodedDataFile(path string) (EncodedData, error) {
+	data, err := readStoredEncodedData(path)
 	if err != nil {
-		return data, err
+		return EncodedData{}, err
 	}
+	if data.Odds != nil {
+		return EncodedData{}, fmt.Errorf("%w: %s", ErrLegacyEncodedData, path)
+	}
+	return EncodedData{Code: data.Code, Counts: data.Counts, Total: data.Total}, nil
+}
 
-	return data, nil
+// MigrateEncodedDataFile rewrites a file in the old odds format with
+// counts. The old odds were count / len(text) in bytes, so textLength must
+// be the byte length of the original text; it becomes Total, which makes
+// the recomputed odds identical to the stored ones.
+func MigrateEncodedDataFile(path string, textLength int) error {
+	data, err := readStoredEncodedData(path)
+	if err != nil {
+		return err
+	}
+	if data.Odds == nil {
+		return nil
+	}
+
+	legacy := legacyEncodedData{Code: data.Code, Odds: data.Odds}
+	migrated := EncodedData{
+		Code:   legacy.Code,
+		Counts: make(map[rune]uint32),
+		Total:  uint32(textLength),
+	}
+	for char, odd := range legacy.Odds {
+		migrated.Counts[char] = uint32(math.Round(odd * float64(textLength)))
+	}
+	return SaveEncodedData(path, migrated)
 }
 
 func main() {
@@ -119,16 +781,16 @@ func main() {
 	}
 	text = strings.TrimSpace(text)
 
-	odds := CalcCharsOdds(text)
+	counts, total := CalcCharsCounts(text)
+	data := EncodedData{
+		Counts: counts,
+		Total:  total,
+	}
+	odds := data.Odds()
 
 	low, high := Encode(text, odds)
 	fmt.Printf("Encoded interval: [%.10f, %.10f]\n", low, high)
-
-	code := (low + high) / 2
-	data := EncodedData{
-		Code: code,
-		Odds: odds,
-	}
+	data.Code = (low + high) / 2
 
 	err = SaveEncodedData("encoded.gob", data)
 	if err != nil {
@@ -136,6 +798,15 @@ func main() {
 		return
 	}
 
+	stats, err := EncodeStats(text, odds, "encoded.gob")
+	if err != nil {
+		fmt.Printf("Error reading encoded file stats: %v\n", err)
+		return
+	}
+	fmt.Printf("Original size: %d bytes\n", stats.OriginalSize)
+	fmt.Printf("Entropy minimum: %.2f bytes\n", stats.EntropyMinSize)
+	fmt.Printf("Encoded size: %d bytes (ratio %.2f)\n", stats.EncodedSize, stats.Ratio())
+
 	readedData, err := readEncodedDataFile("encoded.gob")
 	if err != nil {
 		fmt.Printf("Error reading encoded file: %v\n", err)
@@ -144,4 +815,30 @@ func main() {
 
 	decodedText := Decode(readedData, len(text))
 	fmt.Printf("Decoded text: %s\n", decodedText)
+
+	adaptiveData := EncodeAdaptive(text)
+	err = SaveEncodedData("encoded_adaptive.gob", adaptiveData)
+	if err != nil {
+		fmt.Printf("Error writing adaptive encoded file: %v\n", err)
+		return
+	}
+	adaptiveStats, err := EncodeStats(text, odds, "encoded_adaptive.gob")
+	if err != nil {
+		fmt.Printf("Error reading adaptive encoded file stats: %v\n", err)
+		return
+	}
+	fmt.Printf("Adaptive encoded size: %d bytes (ratio %.2f)\n", adaptiveStats.EncodedSize, adaptiveStats.Ratio())
+	fmt.Printf("Adaptive decoded text: %s\n", DecodeAdaptive(adaptiveData.Code, adaptiveData.Alphabet, utf8.RuneCountInString(text)))
+
+	// A text and a binary file (the gob written above) against gzip
+	for _, path := range []string{"loremIpsum.txt", "encoded.gob"} {
+		comparison, err := CompareWithGzip(path)
+		if err != nil {
+			fmt.Printf("Error comparing with gzip: %v\n", err)
+			return
+		}
+		fmt.Printf("%s: %d bytes, arithmetic %d bytes in %v, huffman %d bytes in %v, gzip %d bytes in %v\n", path,
+			comparison.OriginalSize, comparison.ArithmeticSize, comparison.ArithmeticTime,
+			comparison.HuffmanSize, comparison.HuffmanTime, comparison.GzipSize, comparison.GzipTime)
+	}
 }
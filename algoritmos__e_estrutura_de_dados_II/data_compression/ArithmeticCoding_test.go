@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEncodeBytesRoundTripAllByteValues(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	odds := CalcByteOdds(data)
+	code := EncodeBytes(data, odds)
+	decoded := DecodeBytes(code, odds, len(data))
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("DecodeBytes(EncodeBytes(data)) = %v, want %v", decoded, data)
+	}
+}
+
+func TestEntropyUniformTwoSymbols(t *testing.T) {
+	if got := Entropy(map[rune]float64{'a': 0.5, 'b': 0.5}); got != 1.0 {
+		t.Fatalf("Entropy = %v, want 1.0", got)
+	}
+}
+
+func TestAdaptiveRoundTrip(t *testing.T) {
+	highEntropy, err := readTextFile("highEntropy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	symbols := []rune("abcdefghij ÁÉçã€😀")
+	randomText := make([]rune, 5000)
+	for i := range randomText {
+		randomText[i] = symbols[random.Intn(len(symbols))]
+	}
+
+	texts := map[string]string{
+		"empty":        "",
+		"single":       "a",
+		"repeated":     strings.Repeat("a", 1000),
+		"abracadabra":  "abracadabra",
+		"long":         strings.Repeat("the quick brown fox jumps over the lazy dog ", 200),
+		"random":       string(randomText),
+		"high entropy": highEntropy,
+	}
+	for name, text := range texts {
+		data := EncodeAdaptive(text)
+		decoded := DecodeAdaptive(data.Code, data.Alphabet, utf8.RuneCountInString(text))
+		if decoded != text {
+			t.Errorf("%s: DecodeAdaptive returned %q, want %q", name, decoded, text)
+		}
+	}
+}
+
+func TestAdaptiveSmallerThanStatic(t *testing.T) {
+	highEntropy, err := readTextFile("highEntropy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	for _, text := range []string{"abracadabra", "mississippi", strings.TrimSpace(highEntropy)} {
+		counts, total := CalcCharsCounts(text)
+		static := EncodedData{Counts: counts, Total: total}
+		low, high := Encode(text, static.Odds())
+		static.Code = (low + high) / 2
+		staticPath := filepath.Join(dir, "static.gob")
+		if err := SaveEncodedData(staticPath, static); err != nil {
+			t.Fatal(err)
+		}
+
+		adaptivePath := filepath.Join(dir, "adaptive.gob")
+		if err := SaveEncodedData(adaptivePath, EncodeAdaptive(text)); err != nil {
+			t.Fatal(err)
+		}
+
+		staticInfo, err := os.Stat(staticPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adaptiveInfo, err := os.Stat(adaptivePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if adaptiveInfo.Size() >= staticInfo.Size() {
+			t.Errorf("%.20q: adaptive output is %d bytes, static is %d bytes", text, adaptiveInfo.Size(), staticInfo.Size())
+		}
+	}
+}
+
+// binaryInput is a deterministic non-text input with a skewed byte
+// distribution, so it still compresses.
+func binaryInput(size int) []byte {
+	random := rand.New(rand.NewSource(2))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(min(random.ExpFloat64()*16, 255))
+	}
+	return data
+}
+
+func writeInput(t testing.TB, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCompressFileRoundTrip(t *testing.T) {
+	lorem, err := os.ReadFile("loremIpsum.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	inputs := map[string][]byte{
+		"text":   lorem,
+		"binary": binaryInput(64 << 10),
+		"empty":  nil,
+	}
+	for name, data := range inputs {
+		t.Run(name, func(t *testing.T) {
+			in := writeInput(t, dir, name+".in", data)
+			compressed := filepath.Join(dir, name+".ac")
+			out := filepath.Join(dir, name+".out")
+			if err := CompressFile(in, compressed); err != nil {
+				t.Fatal(err)
+			}
+			if err := DecompressFile(compressed, out); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("round trip returned %d bytes, want %d identical bytes", len(got), len(data))
+			}
+			if info, _ := os.Stat(compressed); len(data) > 1024 && info.Size() >= int64(len(data)) {
+				t.Errorf("compressed file is %d bytes, input is %d", info.Size(), len(data))
+			}
+		})
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	lorem, err := os.ReadFile("loremIpsum.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	inputs := []struct {
+		name string
+		data []byte
+	}{
+		{"text", lorem},
+		{"binary", binaryInput(64 << 10)},
+	}
+	compressors := []struct {
+		name     string
+		compress func([]byte) ([]byte, error)
+	}{
+		{"arithmetic", CodecArithmetic.Encode},
+		{"gzip", func(data []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			writer := gzip.NewWriter(&buf)
+			if _, err := writer.Write(data); err != nil {
+				return nil, err
+			}
+			err := writer.Close()
+			return buf.Bytes(), err
+		}},
+	}
+
+	for _, input := range inputs {
+		for _, compressor := range compressors {
+			b.Run(input.name+"/"+compressor.name, func(b *testing.B) {
+				b.SetBytes(int64(len(input.data)))
+				var size int
+				for b.Loop() {
+					out, err := compressor.compress(input.data)
+					if err != nil {
+						b.Fatal(err)
+					}
+					size = len(out)
+				}
+				b.ReportMetric(float64(size)/float64(len(input.data)), "ratio")
+			})
+		}
+	}
+}
+
+func TestEncodedDataCountsRoundTrip(t *testing.T) {
+	const text = "abracadabra"
+	path := filepath.Join(t.TempDir(), "encoded.gob")
+
+	counts, total := CalcCharsCounts(text)
+	data := EncodedData{Counts: counts, Total: total}
+	low, high := Encode(text, data.Odds())
+	data.Code = (low + high) / 2
+	if err := SaveEncodedData(path, data); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := readEncodedDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Decode(stored, utf8.RuneCountInString(text)); got != text {
+		t.Errorf("Decode = %q, want %q", got, text)
+	}
+}
+
+func TestMigrateEncodedDataFile(t *testing.T) {
+	const text = "abracadabra"
+	dir := t.TempDir()
+	legacyPath := filepath.Join(dir, "legacy.gob")
+
+	odds := CalcCharsOdds(text)
+	low, high := Encode(text, odds)
+	legacy := legacyEncodedData{Code: (low + high) / 2, Odds: odds}
+	if err := SaveEncodedData(legacyPath, legacy); err != nil {
+		t.Fatal(err)
+	}
+	legacyInfo, err := os.Stat(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readEncodedDataFile(legacyPath); !errors.Is(err, ErrLegacyEncodedData) {
+		t.Fatalf("reading the old format: error %v, want ErrLegacyEncodedData", err)
+	}
+	if err := MigrateEncodedDataFile(legacyPath, len(text)); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := readEncodedDataFile(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for char, odd := range migrated.Odds() {
+		if odd != odds[char] {
+			t.Errorf("odds[%q] = %v after migration, want %v", char, odd, odds[char])
+		}
+	}
+	if got := Decode(migrated, utf8.RuneCountInString(text)); got != text {
+		t.Errorf("Decode after migration = %q, want %q", got, text)
+	}
+
+	migratedInfo, err := os.Stat(legacyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migratedInfo.Size() >= legacyInfo.Size() {
+		t.Errorf("migrated file is %d bytes, old format was %d", migratedInfo.Size(), legacyInfo.Size())
+	}
+
+	// Already migrated files are left alone.
+	if err := MigrateEncodedDataFile(legacyPath, len(text)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+)
+
+type huffmanCodec struct{}
+
+var CodecHuffman Codec = huffmanCodec{}
+
+var huffmanTag = [4]byte{'H', 'U', 'F', '1'}
+
+var ErrCorruptHuffman = errors.New("huffman stream ends before all symbols were decoded")
+
+type huffmanNode struct {
+	weight      uint64
+	symbol      byte
+	order       int
+	left, right *huffmanNode
+}
+
+func (n *huffmanNode) leaf() bool {
+	return n.left == nil
+}
+
+// buildHuffmanTree merges the two lightest nodes until one is left. Ties are
+// broken by creation order, with the leaves created in byte order, so the
+// encoder and the decoder build the same tree from the same counts.
+func buildHuffmanTree(counts map[byte]uint32) *huffmanNode {
+	symbols := make([]byte, 0, len(counts))
+	for b := range counts {
+		symbols = append(symbols, b)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i] < symbols[j] })
+
+	nodes := make([]*huffmanNode, 0, len(symbols))
+	for i, b := range symbols {
+		nodes = append(nodes, &huffmanNode{weight: uint64(counts[b]), symbol: b, order: i})
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	next := len(nodes)
+	for len(nodes) > 1 {
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].weight != nodes[j].weight {
+				return nodes[i].weight < nodes[j].weight
+			}
+			return nodes[i].order < nodes[j].order
+		})
+		parent := &huffmanNode{weight: nodes[0].weight + nodes[1].weight, order: next, left: nodes[0], right: nodes[1]}
+		next++
+		nodes = append([]*huffmanNode{parent}, nodes[2:]...)
+	}
+	return nodes[0]
+}
+
+// huffmanCodes returns the path to every leaf, 0 for left and 1 for right.
+// A tree with a single symbol still gets a one bit code.
+func huffmanCodes(root *huffmanNode) map[byte][]uint64 {
+	codes := make(map[byte][]uint64)
+	if root == nil {
+		return codes
+	}
+	if root.leaf() {
+		codes[root.symbol] = []uint64{0}
+		return codes
+	}
+
+	var walk func(node *huffmanNode, path []uint64)
+	walk = func(node *huffmanNode, path []uint64) {
+		if node.leaf() {
+			codes[node.symbol] = append([]uint64(nil), path...)
+			return
+		}
+		walk(node.left, append(path, 0))
+		walk(node.right, append(path, 1))
+	}
+	walk(root, nil)
+	return codes
+}
+
+// Uses the same header as CodecArithmetic, with its own tag.
+func (huffmanCodec) Encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	counts := byteCounts(data)
+	writeCountsHeader(&buf, huffmanTag, len(data), counts)
+
+	codes := huffmanCodes(buildHuffmanTree(counts))
+	var out bitWriter
+	for _, b := range data {
+		for _, bit := range codes[b] {
+			out.write(bit)
+		}
+	}
+	buf.Write(out.bytes())
+	return buf.Bytes(), nil
+}
+
+func (huffmanCodec) Decode(data []byte) ([]byte, error) {
+	reader := bytes.NewReader(data)
+	size, counts, err := readCountsHeader(reader, huffmanTag)
+	if err != nil {
+		return nil, err
+	}
+	root := buildHuffmanTree(counts)
+	if size == 0 {
+		return []byte{}, nil
+	}
+	if root == nil {
+		return nil, ErrCorruptHuffman
+	}
+
+	code := data[len(data)-reader.Len():]
+	in := bitReader{buf: code}
+	result := make([]byte, 0, size)
+	for len(result) < size {
+		node := root
+		if node.leaf() {
+			in.read()
+		}
+		for !node.leaf() {
+			if in.pos >= len(code)*8 {
+				return nil, ErrCorruptHuffman
+			}
+			if in.read() == 0 {
+				node = node.left
+			} else {
+				node = node.right
+			}
+		}
+		result = append(result, node.symbol)
+	}
+	return result, nil
+}
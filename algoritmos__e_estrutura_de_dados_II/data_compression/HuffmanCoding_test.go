@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func codecCorpus(t *testing.T) map[string][]byte {
+	corpus := map[string][]byte{
+		"empty":  {},
+		"single": []byte("a"),
+		"same":   bytes.Repeat([]byte{'z'}, 1000),
+		"binary": binaryInput(16 << 10),
+	}
+	for _, name := range []string{"loremIpsum.txt", "lowEntropy.txt", "highEntropy.txt"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus[name] = data
+	}
+	return corpus
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	codecs := map[string]Codec{"arithmetic": CodecArithmetic, "huffman": CodecHuffman}
+	for codecName, codec := range codecs {
+		for name, data := range codecCorpus(t) {
+			t.Run(codecName+"/"+name, func(t *testing.T) {
+				encoded, err := codec.Encode(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decoded, err := codec.Decode(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decoded, data) {
+					t.Fatalf("round trip returned %d bytes, want %d identical bytes", len(decoded), len(data))
+				}
+			})
+		}
+	}
+}
+
+func TestCodecRejectsOtherCodecOutput(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	fromHuffman, err := CodecHuffman.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CodecArithmetic.Decode(fromHuffman); !errors.Is(err, ErrWrongCodec) {
+		t.Errorf("CodecArithmetic.Decode(huffman output): error %v, want ErrWrongCodec", err)
+	}
+
+	fromArithmetic, err := CodecArithmetic.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CodecHuffman.Decode(fromArithmetic); !errors.Is(err, ErrWrongCodec) {
+		t.Errorf("CodecHuffman.Decode(arithmetic output): error %v, want ErrWrongCodec", err)
+	}
+}
+
+func TestHuffmanTruncatedStream(t *testing.T) {
+	encoded, err := CodecHuffman.Encode([]byte("abracadabra abracadabra"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CodecHuffman.Decode(encoded[:len(encoded)-2]); !errors.Is(err, ErrCorruptHuffman) {
+		t.Errorf("Decode of a truncated stream: error %v, want ErrCorruptHuffman", err)
+	}
+}